@@ -0,0 +1,70 @@
+// Package creditnote issues the numbered credit notes a sales return earns
+// the customer. Returns taken in sales-service and in api-golang both issue
+// them here, into one series, and sales-service settles them.
+package creditnote
+
+import (
+	"time"
+
+	"github.com/yeelo/homeopathy-platform/shared-go/docno"
+	"gorm.io/gorm"
+)
+
+// Credit note statuses
+const (
+	StatusOpen    = "OPEN"
+	StatusPartial = "PARTIAL"
+	StatusClosed  = "CLOSED"
+)
+
+// CreditNote is what the shop owes the customer for a return. Its balance can
+// be refunded, adjusted against the customer's dues, or left as store credit.
+type CreditNote struct {
+	ID           string        `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	CreditNoteNo string        `json:"credit_note_no" gorm:"uniqueIndex;not null"`
+	ReturnID     string        `json:"return_id" gorm:"type:uuid;uniqueIndex"`
+	InvoiceID    string        `json:"invoice_id" gorm:"type:uuid;not null;index"`
+	CustomerID   string        `json:"customer_id" gorm:"type:uuid;index"`
+	ShopID       string        `json:"shop_id" gorm:"type:uuid;not null;index"`
+	IssueDate    time.Time     `json:"issue_date" gorm:"not null"`
+	Amount       float64       `json:"amount" gorm:"not null"`
+	Balance      float64       `json:"balance" gorm:"not null"`
+	Status       string        `json:"status" gorm:"not null;default:'OPEN';index"` // OPEN, PARTIAL, CLOSED
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+	Applications []Application `json:"applications,omitempty" gorm:"foreignKey:CreditNoteID"`
+}
+
+// Application is one use of a credit note's balance
+type Application struct {
+	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	CreditNoteID string    `json:"credit_note_id" gorm:"type:uuid;not null;index"`
+	Type         string    `json:"type" gorm:"not null"` // REFUND, ADJUST
+	InvoiceID    *string   `json:"invoice_id" gorm:"type:uuid"`
+	PaymentMode  string    `json:"payment_mode"` // CASH, CARD, UPI for refunds
+	Reference    string    `json:"reference"`
+	Amount       float64   `json:"amount" gorm:"not null"`
+	CreatedBy    string    `json:"created_by" gorm:"type:uuid"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// TableName keeps the table sales-service first created for applications
+func (Application) TableName() string {
+	return "credit_note_applications"
+}
+
+// Issue numbers the note and records its whole amount as open balance
+func Issue(tx *gorm.DB, note *CreditNote) error {
+	if note.IssueDate.IsZero() {
+		note.IssueDate = time.Now()
+	}
+
+	no, err := docno.Next(tx, "credit-note", "CN", note.IssueDate)
+	if err != nil {
+		return err
+	}
+	note.CreditNoteNo = no
+	note.Balance = note.Amount
+	note.Status = StatusOpen
+	return tx.Create(note).Error
+}
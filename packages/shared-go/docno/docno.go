@@ -0,0 +1,95 @@
+// Package docno numbers documents in gap-free series that reset every Indian
+// financial year. sales-service numbers its invoices, receipts and credit
+// notes with it, and api-golang its credit notes, so both services draw from
+// the same counters.
+package docno
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultPattern is used when a series has no pattern of its own
+const DefaultPattern = "{PREFIX}/{YY}/{SEQ:5}{SUFFIX}"
+
+var seqToken = regexp.MustCompile(`\{SEQ(?::(\d+))?\}`)
+
+// Sequence is the last number issued by a series in a financial year. It is
+// only ever advanced inside the document's own transaction, so a rolled back
+// document gives its number back and the series stays gap-free.
+type Sequence struct {
+	SeriesKey     string    `json:"series_key" gorm:"primaryKey"`
+	FinancialYear string    `json:"financial_year" gorm:"primaryKey;size:7"`
+	LastNumber    int       `json:"last_number" gorm:"not null"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// TableName keeps the table sales-service first created for invoice numbers
+func (Sequence) TableName() string {
+	return "invoice_sequences"
+}
+
+// FinancialYear returns the Indian financial year (April to March) containing
+// t, as "2026-27"
+func FinancialYear(t time.Time) string {
+	start := t.Year()
+	if t.Month() < time.April {
+		start--
+	}
+	return fmt.Sprintf("%d-%02d", start, (start+1)%100)
+}
+
+// Format expands a series pattern. Supported tokens are {PREFIX}, {SUFFIX},
+// {FY} (2026-27), {YY} (2627) and {SEQ} or {SEQ:n} for a number zero-padded
+// to n digits.
+func Format(pattern, prefix, suffix, fy string, seq int) string {
+	if pattern == "" {
+		pattern = DefaultPattern
+	}
+
+	out := strings.NewReplacer(
+		"{PREFIX}", prefix,
+		"{SUFFIX}", suffix,
+		"{FY}", fy,
+		"{YY}", fy[2:4]+fy[5:7],
+	).Replace(pattern)
+
+	return seqToken.ReplaceAllStringFunc(out, func(token string) string {
+		width := 0
+		if m := seqToken.FindStringSubmatch(token); m[1] != "" {
+			width, _ = strconv.Atoi(m[1])
+		}
+		return fmt.Sprintf("%0*d", width, seq)
+	})
+}
+
+// Next draws the next number for a kind of document such as a credit note or
+// receipt. Each kind shares one series across shops.
+func Next(tx *gorm.DB, key, prefix string, at time.Time) (string, error) {
+	fy := FinancialYear(at)
+	seq, err := NextSequence(tx, key, fy, 1)
+	if err != nil {
+		return "", err
+	}
+	return Format(DefaultPattern, prefix, "", fy, seq), nil
+}
+
+// NextSequence advances the counter for key in a financial year, starting at
+// start, and returns the new value. The row stays locked until tx ends, which
+// serialises documents within a series.
+func NextSequence(tx *gorm.DB, key, fy string, start int) (int, error) {
+	var seq int
+	err := tx.Raw(`
+		INSERT INTO invoice_sequences (series_key, financial_year, last_number, updated_at)
+		VALUES (?, ?, ?, NOW())
+		ON CONFLICT (series_key, financial_year)
+		DO UPDATE SET last_number = invoice_sequences.last_number + 1, updated_at = NOW()
+		RETURNING last_number
+	`, key, fy, start).Scan(&seq).Error
+	return seq, err
+}
@@ -0,0 +1,164 @@
+// Package gst prices invoice lines for GST. sales-service bills and
+// api-golang invoices, quotations and purchase returns all use it, so a line
+// is taxed and rounded the same way whichever service raises it.
+package gst
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Supply types decide how GST is split
+const (
+	SupplyIntraState = "INTRA_STATE" // CGST + SGST
+	SupplyInterState = "INTER_STATE" // IGST
+)
+
+// ErrNoRate is returned when a product has no GST rate in force
+var ErrNoRate = errors.New("no GST rate configured")
+
+// Rate is the GST classification of one product on a given date
+type Rate struct {
+	ProductID string
+	HSNCode   string
+	Rate      float64
+}
+
+// Line is the tax breakup of one invoice line
+type Line struct {
+	TaxableValue float64
+	CGSTRate     float64
+	CGSTAmount   float64
+	SGSTRate     float64
+	SGSTAmount   float64
+	IGSTRate     float64
+	IGSTAmount   float64
+	TaxAmount    float64
+	Total        float64
+}
+
+// Rates looks up the GST rate in force on at for each product. The rate
+// comes from the product's tax slab, falling back to the slab on its HSN
+// code. Products without a rate are left out of the map.
+func Rates(db *gorm.DB, productIDs []string, at time.Time) (map[string]Rate, error) {
+	var rows []Rate
+	if err := db.Raw(`
+		SELECT p.id AS product_id, COALESCE(p.hsn_code, '') AS hsn_code,
+			COALESCE(ts.percentage, hts.percentage) AS rate
+		FROM products p
+		LEFT JOIN tax_slabs ts ON ts.id = p.tax_slab_id AND ts.is_active = true
+			AND (ts.effective_from IS NULL OR ts.effective_from <= @at)
+			AND (ts.effective_to IS NULL OR ts.effective_to >= @at)
+		LEFT JOIN hsn_codes h ON h.code = p.hsn_code AND h.is_active = true
+		LEFT JOIN tax_slabs hts ON hts.id = h.tax_slab_id AND hts.is_active = true
+			AND (hts.effective_from IS NULL OR hts.effective_from <= @at)
+			AND (hts.effective_to IS NULL OR hts.effective_to >= @at)
+		WHERE p.id IN @ids AND COALESCE(ts.percentage, hts.percentage) IS NOT NULL
+	`, map[string]interface{}{
+		"at":  at,
+		"ids": productIDs,
+	}).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	rates := make(map[string]Rate, len(rows))
+	for _, row := range rows {
+		rates[row.ProductID] = row
+	}
+	return rates, nil
+}
+
+// ResolveSupply works out a sale's place of supply and supply type. The
+// place of supply given wins; otherwise it is the customer's state, and
+// walk-in customers are supplied where the branch is.
+func ResolveSupply(db *gorm.DB, branchID, customerID, placeOfSupply string) (string, string, error) {
+	branchState, err := State(db, "branches", branchID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if placeOfSupply == "" {
+		if placeOfSupply, err = State(db, "customers", customerID); err != nil {
+			return "", "", err
+		}
+	}
+	if placeOfSupply == "" {
+		placeOfSupply = branchState
+	}
+	return placeOfSupply, SupplyType(branchState, placeOfSupply), nil
+}
+
+// SupplyType is inter-state when both states are known and differ
+func SupplyType(from, to string) string {
+	if from != "" && to != "" && !strings.EqualFold(strings.TrimSpace(from), strings.TrimSpace(to)) {
+		return SupplyInterState
+	}
+	return SupplyIntraState
+}
+
+// State returns the state column of one row of a master table
+func State(db *gorm.DB, table, id string) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+	var states []string
+	if err := db.Table(table).Where("id = ?", id).Limit(1).Pluck("COALESCE(state, '')", &states).Error; err != nil {
+		return "", err
+	}
+	if len(states) == 0 {
+		return "", nil
+	}
+	return states[0], nil
+}
+
+// ComputeLine prices a line from its gross after discount. For
+// tax-inclusive (MRP) lines the taxable value is backed out of the gross so
+// the line total stays exactly what the customer pays. Each tax component is
+// rounded to the paisa on its own.
+func ComputeLine(gross, rate float64, inclusive bool, supplyType string) Line {
+	gross = RoundPaise(gross)
+
+	var line Line
+	if inclusive {
+		line.TaxableValue = RoundPaise(gross * 100 / (100 + rate))
+	} else {
+		line.TaxableValue = gross
+	}
+
+	if supplyType == SupplyInterState {
+		line.IGSTRate = rate
+		line.IGSTAmount = RoundPaise(line.TaxableValue * rate / 100)
+	} else {
+		line.CGSTRate = rate / 2
+		line.SGSTRate = rate / 2
+		line.CGSTAmount = RoundPaise(line.TaxableValue * line.CGSTRate / 100)
+		line.SGSTAmount = RoundPaise(line.TaxableValue * line.SGSTRate / 100)
+	}
+	line.TaxAmount = RoundPaise(line.CGSTAmount + line.SGSTAmount + line.IGSTAmount)
+
+	if inclusive {
+		// Absorb rounding in the taxable value, never in what is collected
+		line.TaxableValue = RoundPaise(gross - line.TaxAmount)
+		line.Total = gross
+	} else {
+		line.Total = RoundPaise(line.TaxableValue + line.TaxAmount)
+	}
+	return line
+}
+
+// RoundOff rounds an invoice total to whole rupees, as GST invoices are
+// settled, and returns the payable amount and the round-off kept
+func RoundOff(total float64) (float64, float64) {
+	total = RoundPaise(total)
+	payable := math.Round(total)
+	return payable, RoundPaise(payable - total)
+}
+
+// RoundPaise rounds an amount to the paisa
+func RoundPaise(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,128 @@
+package ledger
+
+import (
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ShopBatch is a batch of a product and how much of it one shop holds.
+// Batches are not owned by a shop; a shop holds what its batch-tagged
+// movements of the batch add up to, plus its share of the batch's stock that
+// no movement accounts for (see ShopBatches).
+type ShopBatch struct {
+	ID         string
+	BatchNo    string
+	ExpiryDate time.Time
+	Status     string  // ACTIVE, QUARANTINED, RECALLED
+	Quantity   float64 // across every shop
+	Held       float64 // at this shop
+}
+
+// shopBatchRow is a batch with the batch-tagged movements behind it
+type shopBatchRow struct {
+	ID         string
+	BatchNo    string
+	ExpiryDate time.Time
+	Status     string
+	Quantity   float64
+	Tagged     float64 // tagged movements at this shop
+	TaggedAll  float64 // tagged movements at every shop
+}
+
+// ShopBatches locks the product's batches that the shop holds any of and
+// returns them earliest expiry first.
+//
+// Stock from before the ledger tagged movements with a batch, batches created
+// directly, and untagged adjustments leave a shop holding more than its
+// tagged movements say. That untagged stock is placed in the batches whose
+// quantity no movement accounts for, active ones first.
+func ShopBatches(tx *gorm.DB, productID, shopID string) ([]ShopBatch, error) {
+	var rows []shopBatchRow
+	if err := tx.Raw(`
+		SELECT b.id, b.batch_no, b.expiry_date, b.status, b.quantity,
+			COALESCE(here.held, 0) AS tagged, COALESCE(everywhere.held, 0) AS tagged_all
+		FROM batches b
+		LEFT JOIN (
+			SELECT batch_id, SUM(quantity) AS held
+			FROM stock_movements
+			WHERE product_id = @product_id AND shop_id = @shop_id AND batch_id IS NOT NULL
+			GROUP BY batch_id
+		) here ON here.batch_id = b.id
+		LEFT JOIN (
+			SELECT batch_id, SUM(quantity) AS held
+			FROM stock_movements
+			WHERE product_id = @product_id AND batch_id IS NOT NULL
+			GROUP BY batch_id
+		) everywhere ON everywhere.batch_id = b.id
+		WHERE b.product_id = @product_id
+		ORDER BY b.expiry_date ASC, b.created_at ASC
+		FOR UPDATE OF b
+	`, map[string]interface{}{
+		"product_id": productID,
+		"shop_id":    shopID,
+	}).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var onHand []float64
+	if err := tx.Model(&Stock{}).
+		Where("product_id = ? AND shop_id = ?", productID, shopID).
+		Pluck("quantity", &onHand).Error; err != nil {
+		return nil, err
+	}
+	var qty float64
+	if len(onHand) > 0 {
+		qty = onHand[0]
+	}
+	return apportionHeld(rows, qty), nil
+}
+
+// apportionHeld works out what a shop holding onHand units holds of each
+// batch. The units its tagged movements do not account for are spread over
+// the batches' untracked quantity, active batches first and earliest expiry
+// first within them. Two shops may both be given a batch's untracked
+// quantity; the batch's own quantity still caps what can be drawn from it.
+func apportionHeld(rows []shopBatchRow, onHand float64) []ShopBatch {
+	untagged := onHand
+	for _, row := range rows {
+		untagged -= row.Tagged
+	}
+
+	held := make([]float64, len(rows))
+	for i, row := range rows {
+		held[i] = row.Tagged
+	}
+	for _, active := range []bool{true, false} {
+		for i, row := range rows {
+			if untagged <= 0 {
+				break
+			}
+			if (row.Status == "ACTIVE") != active {
+				continue
+			}
+			if untracked := row.Quantity - row.TaggedAll; untracked > 0 {
+				extra := math.Min(untracked, untagged)
+				held[i] += extra
+				untagged -= extra
+			}
+		}
+	}
+
+	var batches []ShopBatch
+	for i, row := range rows {
+		if held[i] <= 0 {
+			continue
+		}
+		batches = append(batches, ShopBatch{
+			ID:         row.ID,
+			BatchNo:    row.BatchNo,
+			ExpiryDate: row.ExpiryDate,
+			Status:     row.Status,
+			Quantity:   row.Quantity,
+			Held:       held[i],
+		})
+	}
+	return batches
+}
@@ -0,0 +1,75 @@
+package ledger
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Table-driven tests for what a shop holds of each batch
+func TestApportionHeld(t *testing.T) {
+	row := func(id, status string, qty, tagged, taggedAll float64) shopBatchRow {
+		return shopBatchRow{ID: id, Status: status, Quantity: qty, Tagged: tagged, TaggedAll: taggedAll}
+	}
+
+	tests := []struct {
+		name   string
+		rows   []shopBatchRow
+		onHand float64
+		want   map[string]float64
+	}{
+		{
+			name:   "tagged movements only",
+			rows:   []shopBatchRow{row("a", "ACTIVE", 10, 6, 10), row("b", "ACTIVE", 5, 0, 5)},
+			onHand: 6,
+			want:   map[string]float64{"a": 6},
+		},
+		{
+			name:   "opening stock with no movements",
+			rows:   []shopBatchRow{row("a", "ACTIVE", 4, 0, 0), row("b", "ACTIVE", 10, 0, 0)},
+			onHand: 9,
+			want:   map[string]float64{"a": 4, "b": 5},
+		},
+		{
+			name:   "batch created directly next to tracked stock",
+			rows:   []shopBatchRow{row("a", "ACTIVE", 10, 10, 10), row("b", "ACTIVE", 8, 0, 0)},
+			onHand: 15,
+			want:   map[string]float64{"a": 10, "b": 5},
+		},
+		{
+			name:   "selling an untracked batch keeps the rest held",
+			rows:   []shopBatchRow{row("a", "ACTIVE", 6, -4, -4)},
+			onHand: 6,
+			want:   map[string]float64{"a": 6},
+		},
+		{
+			name:   "untagged stock goes to active batches before blocked ones",
+			rows:   []shopBatchRow{row("old", "QUARANTINED", 10, 0, 0), row("new", "ACTIVE", 10, 0, 0)},
+			onHand: 12,
+			want:   map[string]float64{"old": 2, "new": 10},
+		},
+		{
+			name:   "untagged stock beyond every batch stays unplaced",
+			rows:   []shopBatchRow{row("a", "ACTIVE", 3, 0, 0)},
+			onHand: 10,
+			want:   map[string]float64{"a": 3},
+		},
+		{
+			name:   "nothing on hand",
+			rows:   []shopBatchRow{row("a", "ACTIVE", 3, 0, 0)},
+			onHand: 0,
+			want:   map[string]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]float64{}
+			for _, batch := range apportionHeld(tt.rows, tt.onHand) {
+				got[batch.ID] = batch.Held
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apportionHeld() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
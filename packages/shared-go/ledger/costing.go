@@ -0,0 +1,310 @@
+package ledger
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Costing methods
+const (
+	CostingFIFO            = "FIFO"
+	CostingWeightedAverage = "WEIGHTED_AVERAGE"
+)
+
+// CostingSetting is the stock costing method a company values inventory with
+type CostingSetting struct {
+	CompanyID string    `json:"company_id" gorm:"primaryKey;type:uuid"`
+	Method    string    `json:"method" gorm:"not null;default:'FIFO'"` // FIFO, WEIGHTED_AVERAGE
+	UpdatedBy string    `json:"updated_by" gorm:"type:uuid"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CostingShop ties a shop to the company whose costing method it follows
+type CostingShop struct {
+	ShopID    string    `json:"shop_id" gorm:"primaryKey;type:uuid"`
+	CompanyID string    `json:"company_id" gorm:"type:uuid;not null;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CostLayer is a quantity of a product received into a shop at one unit cost
+type CostLayer struct {
+	ID         string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ProductID  string    `json:"product_id" gorm:"type:uuid;not null;index:idx_cost_layer_product_shop"`
+	ShopID     string    `json:"shop_id" gorm:"type:uuid;not null;index:idx_cost_layer_product_shop"`
+	BatchID    *string   `json:"batch_id" gorm:"type:uuid"`
+	MovementID string    `json:"movement_id" gorm:"type:uuid;not null"`
+	SourceType string    `json:"source_type"` // GRN, ADJUSTMENT, TRANSFER, RECONCILIATION
+	SourceID   string    `json:"source_id" gorm:"type:uuid;default:null"`
+	Quantity   float64   `json:"quantity" gorm:"not null"`
+	Remaining  float64   `json:"remaining" gorm:"not null"`
+	UnitCost   float64   `json:"unit_cost" gorm:"not null;default:0"`
+	ReceivedAt time.Time `json:"received_at" gorm:"not null;index"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CostConsumption is the cost drawn from one layer by an outbound movement
+type CostConsumption struct {
+	ID            string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	LayerID       *string   `json:"layer_id" gorm:"type:uuid;index"`
+	MovementID    string    `json:"movement_id" gorm:"type:uuid;not null;index"`
+	ProductID     string    `json:"product_id" gorm:"type:uuid;not null;index"`
+	ShopID        string    `json:"shop_id" gorm:"type:uuid;not null;index"`
+	ReferenceType string    `json:"reference_type"`
+	Quantity      float64   `json:"quantity" gorm:"not null"`
+	UnitCost      float64   `json:"unit_cost" gorm:"not null"`
+	Amount        float64   `json:"amount" gorm:"not null"`
+	ConsumedAt    time.Time `json:"consumed_at" gorm:"not null;index"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// AfterCreate keeps cost layers in step with the stock ledger. Inbound
+// movements open a layer and outbound movements consume layers, inside the
+// same transaction as the movement itself.
+func (m *StockMovement) AfterCreate(tx *gorm.DB) error {
+	switch {
+	case m.Quantity > 0:
+		return openCostLayer(tx, m)
+	case m.Quantity < 0:
+		return consumeCostLayers(tx, m)
+	}
+	return nil
+}
+
+// CostingMethod returns the method configured for the shop's company, FIFO by default
+func CostingMethod(tx *gorm.DB, shopID string) (string, error) {
+	var methods []string
+	if err := tx.Model(&CostingSetting{}).
+		Joins("JOIN costing_shops ON costing_shops.company_id = costing_settings.company_id").
+		Where("costing_shops.shop_id = ?", shopID).
+		Limit(1).
+		Pluck("costing_settings.method", &methods).Error; err != nil {
+		return "", err
+	}
+	if len(methods) == 0 {
+		return CostingFIFO, nil
+	}
+	return methods[0], nil
+}
+
+// openCostLayer records an inbound movement as a new layer. Movements that
+// carry no cost of their own come in at the shop's current average cost.
+func openCostLayer(tx *gorm.DB, m *StockMovement) error {
+	unitCost := m.UnitCost
+	if unitCost <= 0 {
+		var err error
+		if unitCost, err = currentUnitCost(tx, m.ProductID, m.ShopID); err != nil {
+			return err
+		}
+	}
+
+	receivedAt := m.CreatedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+
+	m.CostAmount = unitCost * m.Quantity
+	return tx.Create(&CostLayer{
+		ProductID:  m.ProductID,
+		ShopID:     m.ShopID,
+		BatchID:    m.BatchID,
+		MovementID: m.ID,
+		SourceType: m.ReferenceType,
+		SourceID:   m.ReferenceID,
+		Quantity:   m.Quantity,
+		Remaining:  m.Quantity,
+		UnitCost:   unitCost,
+		ReceivedAt: receivedAt,
+	}).Error
+}
+
+// consumeCostLayers draws an outbound movement's quantity from open layers,
+// oldest first, by the shop's costing method (see drawLayers). A movement
+// tied to a cost source draws from that source's layers oldest first
+// whatever the method.
+func consumeCostLayers(tx *gorm.DB, m *StockMovement) error {
+	method := CostingFIFO
+	query := tx.Clauses(forUpdate).
+		Where("product_id = ? AND shop_id = ? AND remaining > 0", m.ProductID, m.ShopID)
+	if m.CostSourceType != "" {
+		query = query.Where("source_type = ? AND source_id = ? AND batch_id IS NOT DISTINCT FROM ?",
+			m.CostSourceType, m.CostSourceID, m.BatchID)
+	} else {
+		var err error
+		if method, err = CostingMethod(tx, m.ShopID); err != nil {
+			return err
+		}
+	}
+
+	var layers []CostLayer
+	if err := query.Order("received_at ASC, created_at ASC").Find(&layers).Error; err != nil {
+		return err
+	}
+
+	qty := -m.Quantity
+	consumedAt := m.CreatedAt
+	if consumedAt.IsZero() {
+		consumedAt = time.Now()
+	}
+
+	takes, short := drawLayers(layers, qty, method)
+	m.CostAmount = 0
+	for i, take := range takes {
+		if take <= 0 {
+			continue
+		}
+		layer := &layers[i]
+		layer.Remaining -= take
+		if err := tx.Model(layer).Update("remaining", layer.Remaining).Error; err != nil {
+			return err
+		}
+		if err := recordConsumption(tx, m, &layer.ID, take, layer.UnitCost, consumedAt); err != nil {
+			return err
+		}
+	}
+
+	// Stock that predates costing has no layer. Open one for the shortfall at
+	// what the stock was bought at and draw it straight down, so valuation
+	// never sees more consumed than received.
+	if short > 1e-9 {
+		layer, err := openingLayer(tx, m, short, consumedAt)
+		if err != nil {
+			return err
+		}
+		if err := recordConsumption(tx, m, &layer.ID, short, layer.UnitCost, consumedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drawLayers works out how much of qty each layer gives up and how much no
+// layer covers. FIFO empties layers in the order given; weighted average
+// takes the same share of every layer, which leaves the average cost of what
+// remains unchanged.
+func drawLayers(layers []CostLayer, qty float64, method string) ([]float64, float64) {
+	var open float64
+	for _, layer := range layers {
+		open += layer.Remaining
+	}
+
+	takes := make([]float64, len(layers))
+	remaining := qty
+	for i, layer := range layers {
+		if remaining <= 0 {
+			break
+		}
+		take := layer.Remaining
+		if method == CostingWeightedAverage && qty < open {
+			take = layer.Remaining * qty / open
+		}
+		if take > remaining {
+			take = remaining
+		}
+		takes[i] = take
+		remaining -= take
+	}
+	return takes, math.Max(remaining, 0)
+}
+
+// openingLayer opens an already drawn layer for qty of stock that came in
+// before costing did. It is costed at the movement's own cost if it carries
+// one, else at the purchase price of its batch, else at the product's
+// average purchase price, else at the last known cost.
+func openingLayer(tx *gorm.DB, m *StockMovement, qty float64, at time.Time) (*CostLayer, error) {
+	unitCost := m.UnitCost
+	if unitCost <= 0 {
+		var err error
+		if unitCost, err = purchaseCost(tx, m.ProductID, m.BatchID); err != nil {
+			return nil, err
+		}
+	}
+	if unitCost <= 0 {
+		var err error
+		if unitCost, err = lastUnitCost(tx, m.ProductID, m.ShopID); err != nil {
+			return nil, err
+		}
+	}
+
+	layer := &CostLayer{
+		ProductID:  m.ProductID,
+		ShopID:     m.ShopID,
+		BatchID:    m.BatchID,
+		MovementID: m.ID,
+		SourceType: "OPENING",
+		Quantity:   qty,
+		Remaining:  0,
+		UnitCost:   unitCost,
+		ReceivedAt: at,
+	}
+	return layer, tx.Create(layer).Error
+}
+
+// purchaseCost is the purchase price of the batch, or without one the
+// product's purchase price averaged over its batches by quantity
+func purchaseCost(tx *gorm.DB, productID string, batchID *string) (float64, error) {
+	var cost struct{ Price float64 }
+	query := tx.Table("batches")
+	if batchID != nil {
+		query = query.Select("COALESCE(MAX(purchase_price), 0) AS price").Where("id = ?", *batchID)
+	} else {
+		query = query.Select("COALESCE(SUM(quantity * purchase_price) / NULLIF(SUM(quantity), 0), AVG(purchase_price), 0) AS price").
+			Where("product_id = ? AND quantity > 0", productID)
+	}
+	if err := query.Scan(&cost).Error; err != nil {
+		return 0, err
+	}
+	if cost.Price <= 0 && batchID != nil {
+		return purchaseCost(tx, productID, nil)
+	}
+	return cost.Price, nil
+}
+
+func recordConsumption(tx *gorm.DB, m *StockMovement, layerID *string, qty, unitCost float64, at time.Time) error {
+	amount := qty * unitCost
+	m.CostAmount += amount
+	return tx.Create(&CostConsumption{
+		LayerID:       layerID,
+		MovementID:    m.ID,
+		ProductID:     m.ProductID,
+		ShopID:        m.ShopID,
+		ReferenceType: m.ReferenceType,
+		Quantity:      qty,
+		UnitCost:      unitCost,
+		Amount:        amount,
+		ConsumedAt:    at,
+	}).Error
+}
+
+// currentUnitCost is the average cost of the product's open layers at a shop
+func currentUnitCost(tx *gorm.DB, productID, shopID string) (float64, error) {
+	var totals struct {
+		Qty   float64
+		Value float64
+	}
+	if err := tx.Model(&CostLayer{}).
+		Select("COALESCE(SUM(remaining), 0) AS qty, COALESCE(SUM(remaining * unit_cost), 0) AS value").
+		Where("product_id = ? AND shop_id = ? AND remaining > 0", productID, shopID).
+		Scan(&totals).Error; err != nil {
+		return 0, err
+	}
+	if totals.Qty > 0 {
+		return totals.Value / totals.Qty, nil
+	}
+	return lastUnitCost(tx, productID, shopID)
+}
+
+// lastUnitCost is the cost of the most recent layer for the product at a shop
+func lastUnitCost(tx *gorm.DB, productID, shopID string) (float64, error) {
+	var layer CostLayer
+	err := tx.Where("product_id = ? AND shop_id = ?", productID, shopID).
+		Order("received_at DESC, created_at DESC").
+		First(&layer).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return layer.UnitCost, err
+}
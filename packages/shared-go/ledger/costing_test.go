@@ -0,0 +1,80 @@
+package ledger
+
+import (
+	"math"
+	"testing"
+)
+
+// Table-driven tests for how an outbound quantity is drawn from cost layers
+func TestDrawLayers(t *testing.T) {
+	layers := func(remaining ...float64) []CostLayer {
+		var out []CostLayer
+		for _, r := range remaining {
+			out = append(out, CostLayer{Remaining: r})
+		}
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		layers    []CostLayer
+		qty       float64
+		method    string
+		wantTakes []float64
+		wantShort float64
+	}{
+		{
+			name:      "fifo empties the oldest layer first",
+			layers:    layers(4, 10),
+			qty:       6,
+			method:    CostingFIFO,
+			wantTakes: []float64{4, 2},
+		},
+		{
+			name:      "weighted average takes the same share of every layer",
+			layers:    layers(4, 12),
+			qty:       8,
+			method:    CostingWeightedAverage,
+			wantTakes: []float64{2, 6},
+		},
+		{
+			name:      "weighted average empties every layer when it takes them all",
+			layers:    layers(4, 12),
+			qty:       16,
+			method:    CostingWeightedAverage,
+			wantTakes: []float64{4, 12},
+		},
+		{
+			name:      "stock from before costing is left short",
+			layers:    layers(3),
+			qty:       5,
+			method:    CostingFIFO,
+			wantTakes: []float64{3},
+			wantShort: 2,
+		},
+		{
+			name:      "no layers at all",
+			qty:       5,
+			method:    CostingWeightedAverage,
+			wantTakes: []float64{},
+			wantShort: 5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			takes, short := drawLayers(tt.layers, tt.qty, tt.method)
+			if len(takes) != len(tt.wantTakes) {
+				t.Fatalf("drawLayers() took from %d layers, want %d", len(takes), len(tt.wantTakes))
+			}
+			for i := range takes {
+				if math.Abs(takes[i]-tt.wantTakes[i]) > 1e-9 {
+					t.Errorf("layer %d take = %.4f, want %.4f", i, takes[i], tt.wantTakes[i])
+				}
+			}
+			if math.Abs(short-tt.wantShort) > 1e-9 {
+				t.Errorf("short = %.4f, want %.4f", short, tt.wantShort)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package ledger
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StockMovement is one line of the stock ledger. Outbound movements carry a
+// negative quantity.
+type StockMovement struct {
+	ID            string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ProductID     string    `json:"product_id" gorm:"type:uuid;not null;index"`
+	ShopID        string    `json:"shop_id" gorm:"type:uuid;not null;index"`
+	MovementType  string    `json:"movement_type" gorm:"not null"` // IN, OUT, ADJUST, TRANSFER
+	Quantity      float64   `json:"quantity" gorm:"not null"`
+	Reason        string    `json:"reason"`
+	ReferenceType string    `json:"reference_type"` // SALE, PURCHASE, ADJUSTMENT, TRANSFER
+	ReferenceID   string    `json:"reference_id" gorm:"type:uuid;default:null"`
+	BatchID       *string   `json:"batch_id" gorm:"type:uuid;index"`
+	CreatedBy     string    `json:"created_by" gorm:"type:uuid;default:null"`
+	CreatedAt     time.Time `json:"created_at" gorm:"index"`
+
+	// Costing inputs and outputs, not persisted
+	UnitCost   float64 `json:"-" gorm:"-"`
+	CostAmount float64 `json:"-" gorm:"-"`
+
+	// CostSourceType and CostSourceID, when set, draw an outbound movement
+	// from the layers one document opened instead of the shop's queue, so a
+	// purchase return goes back at what its GRN came in at
+	CostSourceType string `json:"-" gorm:"-"`
+	CostSourceID   string `json:"-" gorm:"-"`
+}
+
+// Post moves the shop's stock, writes the movement and queues its
+// inventory.adjusted event, all in tx. Writing the movement opens or draws
+// its cost layers. An outbound movement may not take more than the shop has
+// available.
+func Post(tx *gorm.DB, m *StockMovement) (*Stock, error) {
+	var stock *Stock
+	var err error
+	if m.Quantity < 0 {
+		stock, err = Debit(tx, m.ProductID, m.ShopID, -m.Quantity)
+	} else {
+		stock, err = ApplyDelta(tx, m.ProductID, m.ShopID, m.Quantity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Create(m).Error; err != nil {
+		return nil, err
+	}
+	return stock, EnqueueStockAdjusted(tx, stock, m)
+}
@@ -0,0 +1,66 @@
+package ledger
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TopicInventoryAdjusted is the event queued for every posted movement
+const TopicInventoryAdjusted = "inventory.adjusted"
+
+// OutboxEvent is an event waiting to be shipped to Kafka. Rows are written in
+// the same transaction as the stock change they describe, so a crash can
+// never leave a change without its event. inventory-service relays them.
+type OutboxEvent struct {
+	ID          string     `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Topic       string     `json:"topic" gorm:"not null"`
+	EventKey    string     `json:"event_key"`
+	Payload     string     `json:"payload" gorm:"type:jsonb;not null"`
+	Attempts    int        `json:"attempts" gorm:"not null;default:0"`
+	LastError   string     `json:"last_error"`
+	PublishedAt *time.Time `json:"published_at" gorm:"index"`
+	CreatedAt   time.Time  `json:"created_at" gorm:"index"`
+}
+
+// StockAdjustedData is the payload of inventory.adjusted
+type StockAdjustedData struct {
+	ProductID     string  `json:"productId"`
+	ShopID        string  `json:"shopId"`
+	Quantity      float64 `json:"quantity"`
+	OnHand        float64 `json:"onHand"`
+	Available     float64 `json:"available"`
+	Reason        string  `json:"reason"`
+	ReferenceType string  `json:"referenceType"`
+	ReferenceID   string  `json:"referenceId,omitempty"`
+}
+
+// Enqueue writes an event to the outbox as part of tx
+func Enqueue(tx *gorm.DB, topic, key string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&OutboxEvent{
+		Topic:    topic,
+		EventKey: key,
+		Payload:  string(payload),
+	}).Error
+}
+
+// EnqueueStockAdjusted queues inventory.adjusted for a movement and the stock
+// row it left behind
+func EnqueueStockAdjusted(tx *gorm.DB, stock *Stock, movement *StockMovement) error {
+	return Enqueue(tx, TopicInventoryAdjusted, stock.ProductID, StockAdjustedData{
+		ProductID:     stock.ProductID,
+		ShopID:        stock.ShopID,
+		Quantity:      movement.Quantity,
+		OnHand:        stock.Quantity,
+		Available:     stock.Available,
+		Reason:        movement.Reason,
+		ReferenceType: movement.ReferenceType,
+		ReferenceID:   movement.ReferenceID,
+	})
+}
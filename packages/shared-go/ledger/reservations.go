@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrReservationNotFound is returned when no reservation has the given id
+	ErrReservationNotFound = errors.New("reservation not found")
+	// ErrReservationClosed is returned when a reservation was already
+	// released, expired or converted
+	ErrReservationClosed = errors.New("reservation is no longer active")
+)
+
+// Reservation is a hold on a shop's stock for a sales order or held bill.
+// The held units stay in the shop's stock but out of its available stock
+// until the reservation is released or converted.
+type Reservation struct {
+	ID            string
+	ReservationNo string
+	ShopID        string
+	Status        string // ACTIVE, RELEASED, EXPIRED, CONVERTED
+	ExpiresAt     time.Time
+	InvoiceID     *string
+	ConvertedAt   *time.Time
+	Items         []ReservationItem `gorm:"foreignKey:ReservationID"`
+}
+
+func (Reservation) TableName() string { return "stock_reservations" }
+
+// ReservationItem is the quantity of one product a reservation holds
+type ReservationItem struct {
+	ID            string
+	ReservationID string
+	ProductID     string
+	Quantity      float64
+	QuantitySold  float64
+}
+
+func (ReservationItem) TableName() string { return "stock_reservation_items" }
+
+// LockReservation loads a reservation with its items and locks the header
+func LockReservation(tx *gorm.DB, id string) (*Reservation, error) {
+	var r Reservation
+	if err := tx.Clauses(forUpdate).Preload("Items").First(&r, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrReservationNotFound
+		}
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Held returns what the reservation holds of each product
+func (r *Reservation) Held() map[string]float64 {
+	held := make(map[string]float64, len(r.Items))
+	for _, item := range r.Items {
+		held[item.ProductID] += item.Quantity
+	}
+	return held
+}
+
+// settle closes an active reservation as converted, recording what was sold
+// of each line; a line is never sold past what it held
+func (r *Reservation) settle(sold map[string]float64, at time.Time) error {
+	if r.Status != "ACTIVE" || !r.ExpiresAt.After(at) {
+		return ErrReservationClosed
+	}
+	for i := range r.Items {
+		item := &r.Items[i]
+		item.QuantitySold = math.Max(math.Min(sold[item.ProductID], item.Quantity), 0)
+		sold[item.ProductID] -= item.QuantitySold
+	}
+	r.Status = "CONVERTED"
+	return nil
+}
+
+// ConvertReservation closes a reservation against the invoice that billed
+// it. Every held unit goes back to available stock for the invoice's own
+// movements to take; the reservation never moves stock itself, so reserved
+// goods are billed once, by the invoice. sold is what the invoice billed of
+// each product.
+func ConvertReservation(tx *gorm.DB, r *Reservation, invoiceID string, sold map[string]float64) error {
+	now := time.Now()
+	remaining := make(map[string]float64, len(sold))
+	for productID, qty := range sold {
+		remaining[productID] = qty
+	}
+	if err := r.settle(remaining, now); err != nil {
+		return err
+	}
+
+	for _, item := range r.Items {
+		if _, err := Unreserve(tx, item.ProductID, r.ShopID, item.Quantity); err != nil {
+			return err
+		}
+		if err := tx.Model(&ReservationItem{}).Where("id = ?", item.ID).
+			Update("quantity_sold", item.QuantitySold).Error; err != nil {
+			return err
+		}
+	}
+
+	r.InvoiceID = &invoiceID
+	r.ConvertedAt = &now
+	return tx.Model(&Reservation{}).Where("id = ?", r.ID).Updates(map[string]interface{}{
+		"status":       r.Status,
+		"invoice_id":   invoiceID,
+		"converted_at": now,
+		"updated_at":   now,
+	}).Error
+}
+
+// Unreserve returns qty of a shop's reserved stock to available
+func Unreserve(tx *gorm.DB, productID, shopID string, qty float64) (*Stock, error) {
+	stock, err := LockStock(tx, productID, shopID)
+	if err != nil {
+		return nil, err
+	}
+
+	stock.Reserved -= qty
+	if stock.Reserved < 0 {
+		stock.Reserved = 0
+	}
+	stock.UpdateAvailable()
+	if err := tx.Save(stock).Error; err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
@@ -0,0 +1,102 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Table-driven tests for what converting a reservation records as sold
+func TestSettle(t *testing.T) {
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	reservation := func(status string, expires time.Time) *Reservation {
+		return &Reservation{
+			Status:    status,
+			ExpiresAt: expires,
+			Items: []ReservationItem{
+				{ProductID: "a", Quantity: 5},
+				{ProductID: "b", Quantity: 3},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		r       *Reservation
+		sold    map[string]float64
+		want    map[string]float64
+		wantErr error
+	}{
+		{
+			name: "invoice bills the reserved quantity",
+			r:    reservation("ACTIVE", now.Add(time.Hour)),
+			sold: map[string]float64{"a": 5, "b": 3},
+			want: map[string]float64{"a": 5, "b": 3},
+		},
+		{
+			name: "invoice bills more than was reserved",
+			r:    reservation("ACTIVE", now.Add(time.Hour)),
+			sold: map[string]float64{"a": 8, "b": 3},
+			want: map[string]float64{"a": 5, "b": 3},
+		},
+		{
+			name: "invoice sells a line short",
+			r:    reservation("ACTIVE", now.Add(time.Hour)),
+			sold: map[string]float64{"a": 2},
+			want: map[string]float64{"a": 2, "b": 0},
+		},
+		{
+			name:    "converted reservation cannot be billed again",
+			r:       reservation("CONVERTED", now.Add(time.Hour)),
+			sold:    map[string]float64{"a": 5, "b": 3},
+			wantErr: ErrReservationClosed,
+		},
+		{
+			name:    "expired reservation",
+			r:       reservation("ACTIVE", now),
+			sold:    map[string]float64{"a": 5, "b": 3},
+			wantErr: ErrReservationClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.r.settle(tt.sold, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("settle() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if tt.r.Status != "CONVERTED" {
+				t.Errorf("status = %s, want CONVERTED", tt.r.Status)
+			}
+			for _, item := range tt.r.Items {
+				if item.QuantitySold != tt.want[item.ProductID] {
+					t.Errorf("%s sold = %.2f, want %.2f", item.ProductID, item.QuantitySold, tt.want[item.ProductID])
+				}
+			}
+		})
+	}
+}
+
+// A reservation's units are billed by one invoice only: once settled, a
+// second invoice naming it is refused
+func TestSettleBillsOnce(t *testing.T) {
+	now := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	r := &Reservation{
+		Status:    "ACTIVE",
+		ExpiresAt: now.Add(time.Hour),
+		Items:     []ReservationItem{{ProductID: "a", Quantity: 4}},
+	}
+
+	if err := r.settle(map[string]float64{"a": 4}, now); err != nil {
+		t.Fatalf("first settle() error = %v", err)
+	}
+	if err := r.settle(map[string]float64{"a": 4}, now); !errors.Is(err, ErrReservationClosed) {
+		t.Fatalf("second settle() error = %v, want %v", err, ErrReservationClosed)
+	}
+	if got := r.Items[0].QuantitySold; got != 4 {
+		t.Errorf("sold = %.2f, want 4.00", got)
+	}
+}
@@ -0,0 +1,152 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Return dispositions decide where returned stock goes
+const (
+	ReturnSellable = "SELLABLE" // back into the batch it was sold from
+	ReturnDamaged  = "DAMAGED"  // into the damaged bin
+)
+
+// damagedBinReason is the status reason a damaged bin is created with. Bins
+// are told apart by batches.damaged_bin, which recalls and quarantines leave
+// alone.
+const damagedBinReason = "Damaged return"
+
+// ErrBatchNotFound is returned when a return names a batch that was never received
+var ErrBatchNotFound = errors.New("batch not found")
+
+// Return is goods a customer brings back into a shop
+type Return struct {
+	ProductID     string
+	ShopID        string
+	BatchID       *string // the batch row sold from; BatchNo is used without it
+	BatchNo       string
+	Quantity      float64
+	Disposition   string // SELLABLE, DAMAGED
+	Reason        string
+	ReferenceType string
+	ReferenceID   string
+	CreatedBy     string
+	At            time.Time
+}
+
+// returnBatch is the part of a batch row a return needs
+type returnBatch struct {
+	ID         string
+	BatchNo    string
+	Status     string
+	ExpiryDate time.Time
+}
+
+// Restock puts returned units back into stock. Sellable units go back into
+// the batch they were sold from, the exact row when the return names it.
+// Damaged units, and units of a batch that can no longer be sold, go to the
+// damaged bin: one quarantined row per batch that the allocator never picks
+// and that inventory-service can write off.
+// The units are posted to the shop's ledger against the batch they went
+// into, and damaged units are kept out of available stock. It returns that
+// batch and the disposition actually applied.
+func Restock(tx *gorm.DB, r Return) (string, string, error) {
+	if r.At.IsZero() {
+		r.At = time.Now()
+	}
+
+	query := tx.Table("batches").Clauses(forUpdate).
+		Select("id, batch_no, status, expiry_date").
+		Where("product_id = ? AND NOT damaged_bin", r.ProductID)
+	if r.BatchID != nil {
+		query = query.Where("id = ?", *r.BatchID)
+	} else {
+		query = query.Where("batch_no = ?", r.BatchNo)
+	}
+
+	var batches []returnBatch
+	if err := query.Order("created_at ASC").Find(&batches).Error; err != nil {
+		return "", "", err
+	}
+	if len(batches) == 0 {
+		return "", "", fmt.Errorf("%w: batch %q of product %s", ErrBatchNotFound, r.BatchNo, r.ProductID)
+	}
+
+	batchID, disposition := "", ReturnDamaged
+	if r.Disposition == ReturnSellable {
+		for _, batch := range batches {
+			if batch.Status == "ACTIVE" && batch.ExpiryDate.After(r.At) {
+				batchID, disposition = batch.ID, ReturnSellable
+				break
+			}
+		}
+	}
+
+	if batchID == "" {
+		var err error
+		if batchID, err = damagedBin(tx, r.ProductID, batches[0].BatchNo, batches[0].ID); err != nil {
+			return "", "", err
+		}
+	}
+
+	if err := tx.Table("batches").Where("id = ?", batchID).
+		Update("quantity", gorm.Expr("quantity + ?", r.Quantity)).Error; err != nil {
+		return "", "", err
+	}
+
+	_, err := Post(tx, &StockMovement{
+		ProductID:     r.ProductID,
+		ShopID:        r.ShopID,
+		MovementType:  "IN",
+		Quantity:      r.Quantity,
+		Reason:        r.Reason,
+		ReferenceType: r.ReferenceType,
+		ReferenceID:   r.ReferenceID,
+		BatchID:       &batchID,
+		CreatedBy:     r.CreatedBy,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	// The damaged bin is on hand but not for sale
+	if disposition == ReturnDamaged {
+		if _, err := Quarantine(tx, r.ProductID, r.ShopID, r.Quantity); err != nil {
+			return "", "", err
+		}
+	}
+	return batchID, disposition, nil
+}
+
+// damagedBin returns the batch's damaged bin, creating it from the original
+// batch row the first time. An advisory lock on the batch keeps concurrent
+// returns from each creating a bin of their own.
+func damagedBin(tx *gorm.DB, productID, batchNo, originalID string) (string, error) {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "damaged-bin:"+productID+":"+batchNo).Error; err != nil {
+		return "", err
+	}
+
+	var bins []string
+	if err := tx.Table("batches").
+		Where("product_id = ? AND batch_no = ? AND damaged_bin", productID, batchNo).
+		Order("created_at ASC").
+		Limit(1).
+		Pluck("id", &bins).Error; err != nil {
+		return "", err
+	}
+	if len(bins) > 0 {
+		return bins[0], nil
+	}
+
+	var binID string
+	err := tx.Raw(`
+		INSERT INTO batches (product_id, batch_no, mfg_date, expiry_date, quantity, mrp, purchase_price, status, status_reason, damaged_bin, created_at, updated_at)
+		SELECT product_id, batch_no, mfg_date, expiry_date, 0, mrp, purchase_price, 'QUARANTINED', ?, true, NOW(), NOW()
+		FROM batches WHERE id = ?
+		RETURNING id
+	`, damagedBinReason, originalID).Scan(&binID).Error
+	return binID, err
+}
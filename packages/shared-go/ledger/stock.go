@@ -0,0 +1,148 @@
+// Package ledger posts stock movements. The tables are owned and migrated by
+// inventory-service; services that move stock as part of their own documents
+// (invoices, GRNs, purchase returns) post through this package so the stock
+// row, the movement, its cost layers and its event commit with the document.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrInsufficientStock is returned when an outbound movement would take more
+// than a shop has available
+var ErrInsufficientStock = errors.New("insufficient stock")
+
+// forUpdate locks the selected rows until the surrounding transaction ends
+var forUpdate = clause.Locking{Strength: "UPDATE"}
+
+// Stock is the on-hand quantity of a product at a shop. Units held for a
+// sale and units of quarantined or recalled batches are on hand but not
+// available.
+type Stock struct {
+	ID          string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ProductID   string    `json:"product_id" gorm:"type:uuid;not null;index"`
+	ShopID      string    `json:"shop_id" gorm:"type:uuid;not null;index"`
+	Quantity    float64   `json:"quantity" gorm:"not null;default:0"`
+	Reserved    float64   `json:"reserved" gorm:"not null;default:0"`
+	Quarantined float64   `json:"quarantined" gorm:"not null;default:0"`
+	Available   float64   `json:"available" gorm:"not null;default:0"`
+	RackID      *string   `json:"rack_id" gorm:"type:uuid"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// UpdateAvailable recomputes what is available from what is on hand,
+// reserved and quarantined
+func (s *Stock) UpdateAvailable() {
+	s.Available = s.Quantity - s.Reserved - s.Quarantined
+}
+
+// LockStock loads the stock row for a product at a shop and locks it
+func LockStock(tx *gorm.DB, productID, shopID string) (*Stock, error) {
+	var stock Stock
+	if err := tx.Clauses(forUpdate).
+		Where("product_id = ? AND shop_id = ?", productID, shopID).
+		First(&stock).Error; err != nil {
+		return nil, err
+	}
+	return &stock, nil
+}
+
+// Debit removes qty from a shop, refusing to go below what is available
+func Debit(tx *gorm.DB, productID, shopID string, qty float64) (*Stock, error) {
+	stock, err := LockStock(tx, productID, shopID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w for product %s at shop %s: available 0.00, requested %.2f", ErrInsufficientStock, productID, shopID, qty)
+		}
+		return nil, err
+	}
+
+	if stock.Available < qty {
+		return nil, fmt.Errorf("%w for product %s at shop %s: available %.2f, requested %.2f", ErrInsufficientStock, productID, shopID, stock.Available, qty)
+	}
+
+	stock.Quantity -= qty
+	stock.UpdateAvailable()
+	if err := tx.Save(stock).Error; err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// ApplyDelta moves the on-hand quantity by delta without an availability
+// check, creating the stock row on first receipt
+func ApplyDelta(tx *gorm.DB, productID, shopID string, delta float64) (*Stock, error) {
+	stock, err := LockStock(tx, productID, shopID)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		stock = &Stock{
+			ProductID: productID,
+			ShopID:    shopID,
+		}
+	}
+
+	stock.Quantity += delta
+	stock.UpdateAvailable()
+	if err := tx.Save(stock).Error; err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// Quarantine takes qty of a shop's stock out of available without taking it
+// off hand, for units of a batch that can no longer be sold
+func Quarantine(tx *gorm.DB, productID, shopID string, qty float64) (*Stock, error) {
+	stock, err := LockStock(tx, productID, shopID)
+	if err != nil {
+		return nil, err
+	}
+
+	stock.Quarantined += qty
+	stock.UpdateAvailable()
+	if err := tx.Save(stock).Error; err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// DebitQuarantined removes qty of quarantined units from a shop, such as a
+// write-off of an expired batch. Whatever the shop has not quarantined is
+// taken from available stock and may not exceed it.
+func DebitQuarantined(tx *gorm.DB, productID, shopID string, qty float64) (*Stock, error) {
+	stock, err := LockStock(tx, productID, shopID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w for product %s at shop %s: available 0.00, requested %.2f", ErrInsufficientStock, productID, shopID, qty)
+		}
+		return nil, err
+	}
+
+	quarantined, available := splitQuarantined(stock, qty)
+	if stock.Available < available {
+		return nil, fmt.Errorf("%w for product %s at shop %s: quarantined %.2f, available %.2f, requested %.2f", ErrInsufficientStock, productID, shopID, stock.Quarantined, stock.Available, qty)
+	}
+
+	stock.Quarantined -= quarantined
+	stock.Quantity -= qty
+	stock.UpdateAvailable()
+	if err := tx.Save(stock).Error; err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// splitQuarantined splits qty leaving a shop into the part its quarantined
+// units cover and the part that must come from available stock
+func splitQuarantined(stock *Stock, qty float64) (float64, float64) {
+	quarantined := math.Min(math.Max(stock.Quarantined, 0), qty)
+	return quarantined, qty - quarantined
+}
@@ -0,0 +1,51 @@
+package ledger
+
+import "testing"
+
+// Table-driven tests for what a shop has available
+func TestUpdateAvailable(t *testing.T) {
+	tests := []struct {
+		name  string
+		stock Stock
+		want  float64
+	}{
+		{name: "nothing held back", stock: Stock{Quantity: 10}, want: 10},
+		{name: "reserved", stock: Stock{Quantity: 10, Reserved: 3}, want: 7},
+		{name: "quarantined", stock: Stock{Quantity: 10, Quarantined: 4}, want: 6},
+		{name: "reserved and quarantined", stock: Stock{Quantity: 10, Reserved: 3, Quarantined: 4}, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.stock.UpdateAvailable()
+			if tt.stock.Available != tt.want {
+				t.Errorf("Available = %.2f, want %.2f", tt.stock.Available, tt.want)
+			}
+		})
+	}
+}
+
+// Table-driven tests for writing off quarantined units
+func TestSplitQuarantined(t *testing.T) {
+	tests := []struct {
+		name            string
+		quarantined     float64
+		qty             float64
+		wantQuarantined float64
+		wantAvailable   float64
+	}{
+		{name: "covered by quarantined units", quarantined: 6, qty: 4, wantQuarantined: 4},
+		{name: "every quarantined unit", quarantined: 6, qty: 6, wantQuarantined: 6},
+		{name: "more than was quarantined", quarantined: 6, qty: 8, wantQuarantined: 6, wantAvailable: 2},
+		{name: "nothing quarantined", quarantined: 0, qty: 3, wantAvailable: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quarantined, available := splitQuarantined(&Stock{Quantity: 20, Quarantined: tt.quarantined}, tt.qty)
+			if quarantined != tt.wantQuarantined || available != tt.wantAvailable {
+				t.Errorf("splitQuarantined() = %.2f, %.2f, want %.2f, %.2f", quarantined, available, tt.wantQuarantined, tt.wantAvailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// Package loyalty redeems loyalty points and gift cards. api-golang's loyalty
+// handlers and sales-service's split tenders both redeem here, under the same
+// locks, so a point or a rupee of card balance can only be spent once.
+package loyalty
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInsufficientPoints is returned when a customer has fewer live points than asked
+	ErrInsufficientPoints = errors.New("insufficient points balance")
+	// ErrGiftCardNotFound is returned for a code with no active card
+	ErrGiftCardNotFound = errors.New("gift card not found or expired")
+	// ErrGiftCardExpired is returned for a card past its expiry date
+	ErrGiftCardExpired = errors.New("gift card has expired")
+	// ErrInsufficientBalance is returned when a card holds less than asked
+	ErrInsufficientBalance = errors.New("insufficient gift card balance")
+)
+
+// pointsRow is one loyalty transaction as the balance sees it
+type pointsRow struct {
+	PointsEarned   float64
+	PointsRedeemed float64
+	ExpiryDate     *time.Time
+	CreatedAt      time.Time
+}
+
+// lot is what is left of one earning
+type lot struct {
+	remaining float64
+	expiry    *time.Time
+}
+
+// PointsBalance is the customer's points still live at at. Each redemption
+// is drawn from the earnings that were live when it was made, soonest to
+// expire first, so points spent before they lapsed are not counted again and
+// points that lapsed unspent are not counted at all.
+func PointsBalance(tx *gorm.DB, customerID string, at time.Time) (float64, error) {
+	var rows []pointsRow
+	if err := tx.Table("loyalty_transactions").
+		Select("COALESCE(points_earned, 0) AS points_earned, COALESCE(points_redeemed, 0) AS points_redeemed, expiry_date, created_at").
+		Where("customer_id = ?", customerID).
+		Order("created_at ASC").
+		Scan(&rows).Error; err != nil {
+		return 0, err
+	}
+	return balanceOf(rows, at), nil
+}
+
+func balanceOf(rows []pointsRow, at time.Time) float64 {
+	live := func(l lot, t time.Time) bool {
+		return l.remaining > 0 && (l.expiry == nil || l.expiry.After(t))
+	}
+
+	var lots []lot
+	for _, row := range rows {
+		if row.PointsEarned > 0 {
+			lots = append(lots, lot{remaining: row.PointsEarned, expiry: row.ExpiryDate})
+		}
+		if row.PointsRedeemed <= 0 {
+			continue
+		}
+
+		// Soonest to expire first; points that never expire go last
+		sort.SliceStable(lots, func(i, j int) bool {
+			if lots[i].expiry == nil || lots[j].expiry == nil {
+				return lots[j].expiry == nil && lots[i].expiry != nil
+			}
+			return lots[i].expiry.Before(*lots[j].expiry)
+		})
+		owed := row.PointsRedeemed
+		for i := range lots {
+			if owed <= 0 {
+				break
+			}
+			if !live(lots[i], row.CreatedAt) {
+				continue
+			}
+			take := lots[i].remaining
+			if take > owed {
+				take = owed
+			}
+			lots[i].remaining -= take
+			owed -= take
+		}
+	}
+
+	var balance float64
+	for _, l := range lots {
+		if live(l, at) {
+			balance += l.remaining
+		}
+	}
+	return balance
+}
+
+// PointsRedemption is a request to spend a customer's points
+type PointsRedemption struct {
+	CustomerID  string
+	Points      float64
+	RewardID    string
+	Description string
+}
+
+// RedeemPoints spends points if the customer has that many live, and returns
+// the redeem transaction's id and the balance left. Redemptions are
+// serialised per customer. The redeem row carries no expiry: it is a debit,
+// and stays one for good.
+func RedeemPoints(tx *gorm.DB, r PointsRedemption) (string, float64, error) {
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "loyalty:"+r.CustomerID).Error; err != nil {
+		return "", 0, err
+	}
+
+	now := time.Now()
+	balance, err := PointsBalance(tx, r.CustomerID, now)
+	if err != nil {
+		return "", 0, err
+	}
+	if balance < r.Points {
+		return "", balance, fmt.Errorf("%w: %.0f left", ErrInsufficientPoints, balance)
+	}
+
+	var rewardID interface{}
+	if r.RewardID != "" {
+		rewardID = r.RewardID
+	}
+	var id string
+	if err := tx.Raw(`
+		INSERT INTO loyalty_transactions (customer_id, reward_id, transaction_type, points_earned, points_redeemed, description, expiry_date, created_at)
+		VALUES (?, ?, 'redeem', 0, ?, ?, NULL, ?)
+		RETURNING id
+	`, r.CustomerID, rewardID, r.Points, r.Description, now).Scan(&id).Error; err != nil {
+		return "", 0, err
+	}
+	return id, balance - r.Points, nil
+}
+
+// GiftCardRedemption is what a gift card redemption left behind
+type GiftCardRedemption struct {
+	GiftCardID string
+	Code       string
+	Amount     float64
+	Balance    float64
+	Status     string // active, redeemed
+}
+
+// giftCard is the part of a gift card row a redemption needs
+type giftCard struct {
+	ID         string
+	Code       string
+	Balance    float64
+	ExpiryDate time.Time
+}
+
+// RedeemGiftCard takes amount off an active card under a row lock and logs
+// the redemption. at is when the card is spent, for the expiry check.
+func RedeemGiftCard(tx *gorm.DB, code string, amount float64, description string, at time.Time) (*GiftCardRedemption, error) {
+	var card giftCard
+	err := tx.Table("gift_cards").Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id, code, balance, expiry_date").
+		Where("code = ? AND status = ?", code, "active").
+		Take(&card).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrGiftCardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if at.After(card.ExpiryDate) {
+		return nil, ErrGiftCardExpired
+	}
+	if card.Balance < amount {
+		return nil, fmt.Errorf("%w: %.2f left", ErrInsufficientBalance, card.Balance)
+	}
+
+	redemption := &GiftCardRedemption{
+		GiftCardID: card.ID,
+		Code:       card.Code,
+		Amount:     amount,
+		Balance:    math.Round((card.Balance-amount)*100) / 100,
+		Status:     "active",
+	}
+	if redemption.Balance <= 0 {
+		redemption.Status = "redeemed"
+	}
+
+	now := time.Now()
+	if err := tx.Table("gift_cards").Where("id = ?", card.ID).Updates(map[string]interface{}{
+		"balance":     redemption.Balance,
+		"status":      redemption.Status,
+		"redeemed_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Table("gift_card_redemptions").Create(map[string]interface{}{
+		"gift_card_id": card.ID,
+		"amount":       amount,
+		"balance":      redemption.Balance,
+		"description":  description,
+		"redeemed_at":  now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	return redemption, nil
+}
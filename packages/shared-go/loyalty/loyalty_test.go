@@ -0,0 +1,76 @@
+package loyalty
+
+import (
+	"testing"
+	"time"
+)
+
+// Table-driven tests for the live points balance
+func TestBalanceOf(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2025, 1, d, 12, 0, 0, 0, time.UTC) }
+	expires := func(d int) *time.Time { at := day(d); return &at }
+	earn := func(points float64, on int, expiry *time.Time) pointsRow {
+		return pointsRow{PointsEarned: points, ExpiryDate: expiry, CreatedAt: day(on)}
+	}
+	redeem := func(points float64, on int) pointsRow {
+		return pointsRow{PointsRedeemed: points, CreatedAt: day(on)}
+	}
+
+	tests := []struct {
+		name string
+		rows []pointsRow
+		at   time.Time
+		want float64
+	}{
+		{
+			name: "earned and unspent",
+			rows: []pointsRow{earn(100, 1, expires(20))},
+			at:   day(10),
+			want: 100,
+		},
+		{
+			name: "redeemed points stay spent",
+			rows: []pointsRow{earn(100, 1, expires(20)), redeem(60, 2)},
+			at:   day(10),
+			want: 40,
+		},
+		{
+			name: "redeemed points are not spent again once the redeem row is old",
+			rows: []pointsRow{earn(100, 1, expires(20)), redeem(100, 2), earn(50, 5, expires(25))},
+			at:   day(10),
+			want: 50,
+		},
+		{
+			name: "unspent points lapse at their expiry",
+			rows: []pointsRow{earn(100, 1, expires(5)), earn(30, 2, expires(20))},
+			at:   day(10),
+			want: 30,
+		},
+		{
+			name: "a redemption draws on the points expiring soonest",
+			rows: []pointsRow{earn(100, 1, expires(20)), earn(50, 2, expires(8)), redeem(50, 3)},
+			at:   day(10),
+			want: 100,
+		},
+		{
+			name: "a redemption cannot draw on points already lapsed",
+			rows: []pointsRow{earn(100, 1, expires(3)), earn(50, 2, nil), redeem(50, 5)},
+			at:   day(10),
+			want: 0,
+		},
+		{
+			name: "points without an expiry never lapse",
+			rows: []pointsRow{earn(80, 1, nil)},
+			at:   day(31),
+			want: 80,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := balanceOf(tt.rows, tt.at); got != tt.want {
+				t.Errorf("balanceOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"time"
 	"github.com/gin-gonic/gin"
@@ -44,6 +46,40 @@ func (h *InventoryHandler) GetInventory(c *gin.Context) {
 	})
 }
 
+// GetInventoryValuation returns closing stock valued from the cost layers.
+// inventory-service keeps the layers, so this forwards to its valuation.
+func (h *InventoryHandler) GetInventoryValuation(c *gin.Context) {
+	query := url.Values{}
+	shopID := c.Query("shop_id")
+	if shopID == "" {
+		shopID = c.Query("warehouse_id")
+	}
+	if shopID != "" {
+		query.Set("shop_id", shopID)
+	}
+	if productID := c.Query("product_id"); productID != "" {
+		query.Set("product_id", productID)
+	}
+	if asOf := c.Query("as_of"); asOf != "" {
+		query.Set("as_of", asOf)
+	}
+
+	baseURL := os.Getenv("INVENTORY_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8002"
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(baseURL + "/api/v1/inventory/valuation?" + query.Encode())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to calculate inventory valuation"})
+		return
+	}
+	defer resp.Body.Close()
+
+	c.DataFromReader(resp.StatusCode, resp.ContentLength, "application/json", resp.Body, nil)
+}
+
 // GetInventoryHistory returns inventory transaction history
 func (h *InventoryHandler) GetInventoryHistory(c *gin.Context) {
 	productID := c.Query("product_id")
@@ -218,22 +254,6 @@ func (h *InventoryHandler) GetStockAlerts(c *gin.Context) {
 	})
 }
 
-// GetInventoryValuation returns current inventory value
-func (h *InventoryHandler) GetInventoryValuation(c *gin.Context) {
-	warehouseID := c.Query("warehouse_id")
-
-	valuation, err := h.inventoryService.GetInventoryValuation(warehouseID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate inventory valuation"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"valuation": valuation,
-		"calculated_at": time.Now(),
-	})
-}
-
 // GetInventoryHistory returns inventory transaction history
 func (h *InventoryHandler) GetInventoryHistory(c *gin.Context) {
 	productID := c.Query("product_id")
@@ -339,18 +359,3 @@ func (h *InventoryHandler) GetStockAlerts(c *gin.Context) {
 	})
 }
 
-// GetInventoryValuation returns current inventory value
-func (h *InventoryHandler) GetInventoryValuation(c *gin.Context) {
-	warehouseID := c.Query("warehouse_id")
-
-	valuation, err := h.inventoryService.GetInventoryValuation(warehouseID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate inventory valuation"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"valuation": valuation,
-		"calculated_at": time.Now(),
-	})
-}
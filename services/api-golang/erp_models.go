@@ -352,24 +352,28 @@ type Invoice struct {
 
 type PurchaseOrder struct {
 	BaseEntity
-	PONumber      string    `gorm:"uniqueIndex;not null;size:50" json:"po_number" validate:"required"`
-	VendorID      string    `gorm:"not null;index" json:"vendor_id" validate:"required"`
-	OrderDate     time.Time `gorm:"not null" json:"order_date"`
-	ExpectedDate  *time.Time `json:"expected_date"`
-	Status        string    `gorm:"not null;default:draft;size:20" json:"status" validate:"oneof=draft sent partial_received received cancelled"`
-	SubTotal      float64   `gorm:"type:decimal(12,2);default:0.00" json:"sub_total"`
-	TaxAmount     float64   `gorm:"type:decimal(12,2);default:0.00" json:"tax_amount"`
-	DiscountAmount float64  `gorm:"type:decimal(12,2);default:0.00" json:"discount_amount"`
-	TotalAmount   float64   `gorm:"type:decimal(12,2);default:0.00" json:"total_amount"`
-	ReceivedQty   int       `gorm:"default:0" json:"received_qty"`
-	ShippingAddress string  `gorm:"type:text" json:"shipping_address"`
-	BillingAddress  string  `gorm:"type:text" json:"billing_address"`
-	Notes         string    `gorm:"type:text" json:"notes"`
-	PaymentTerms  string    `gorm:"size:100" json:"payment_terms"`
-	ApprovedBy    *string   `gorm:"index" json:"approved_by"`
-	ApprovedAt    *time.Time `json:"approved_at"`
-	Vendor        Vendor    `gorm:"foreignKey:VendorID" json:"vendor"`
-	Items         []PurchaseOrderItem `gorm:"foreignKey:PurchaseOrderID" json:"items"`
+	PONumber        string              `gorm:"uniqueIndex;not null;size:50" json:"po_number" validate:"required"`
+	VendorID        string              `gorm:"not null;index" json:"vendor_id" validate:"required"`
+	OrderDate       time.Time           `gorm:"not null" json:"order_date"`
+	ExpectedDate    *time.Time          `json:"expected_date"`
+	BranchID        *string             `gorm:"index" json:"branch_id"` // branch whose approval rules apply
+	Status          string              `gorm:"not null;default:draft;size:20" json:"status" validate:"oneof=draft pending_approval approved rejected sent partially_received closed cancelled"`
+	SubTotal        float64             `gorm:"type:decimal(12,2);default:0.00" json:"sub_total"`
+	TaxAmount       float64             `gorm:"type:decimal(12,2);default:0.00" json:"tax_amount"`
+	DiscountAmount  float64             `gorm:"type:decimal(12,2);default:0.00" json:"discount_amount"`
+	TotalAmount     float64             `gorm:"type:decimal(12,2);default:0.00" json:"total_amount"`
+	ReceivedQty     int                 `gorm:"default:0" json:"received_qty"`
+	ShippingAddress string              `gorm:"type:text" json:"shipping_address"`
+	BillingAddress  string              `gorm:"type:text" json:"billing_address"`
+	Notes           string              `gorm:"type:text" json:"notes"`
+	PaymentTerms    string              `gorm:"size:100" json:"payment_terms"`
+	ApprovedBy      *string             `gorm:"index" json:"approved_by"`
+	ApprovedAt      *time.Time          `json:"approved_at"`
+	ApprovalSteps   []POApprovalStep    `gorm:"serializer:json;type:jsonb" json:"approval_steps"`
+	ApprovalLevel   int                 `gorm:"default:0" json:"approval_level"` // steps approved so far
+	Vendor          Vendor              `gorm:"foreignKey:VendorID" json:"vendor"`
+	Items           []PurchaseOrderItem `gorm:"foreignKey:PurchaseOrderID" json:"items"`
+	Approvals       []POApproval        `gorm:"foreignKey:PurchaseOrderID" json:"approvals,omitempty"`
 }
 
 type PurchaseOrderItem struct {
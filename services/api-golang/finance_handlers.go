@@ -566,23 +566,39 @@ func (h *FinanceHandler) GetGSTReturns(c *gin.Context) {
 	if startDate == "" || endDate == "" {
 		// Default to current month
 		now := time.Now()
-		startDate = now.Format("2006-01-01")
-		endDate = now.AddDate(0, 1, 0).AddDate(0, 0, -1).Format("2006-01-02")
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		startDate = monthStart.Format("2006-01-02")
+		endDate = monthStart.AddDate(0, 1, -1).Format("2006-01-02")
 	}
 
 	var gstData map[string]interface{}
 
-	// Calculate GST data based on invoices and vendor invoices
+	// Output GST from sales invoices, input credit from approved vendor
+	// invoices, less the credit reversed by debit notes for purchase returns
 	query := `
+		WITH sales AS (
+			SELECT COALESCE(SUM(tax_amount), 0) AS gst, COUNT(*) AS invoices
+			FROM invoices
+			WHERE is_active = true AND invoice_date >= ?::date AND invoice_date < ?::date + 1
+		), purchases AS (
+			SELECT COALESCE(SUM(tax_amount), 0) AS gst, COUNT(*) AS invoices
+			FROM vendor_invoices
+			WHERE is_active = true AND status = 'confirmed' AND invoice_date >= ?::date AND invoice_date < ?::date + 1
+		), reversed AS (
+			SELECT COALESCE(SUM(tax_amount), 0) AS gst, COUNT(*) AS notes
+			FROM debit_notes
+			WHERE is_active = true AND issue_date >= ?::date AND issue_date < ?::date + 1
+		)
 		SELECT
-			SUM(CASE WHEN i.total_amount > 0 THEN i.tax_amount ELSE 0 END) as sales_gst,
-			SUM(CASE WHEN vi.total_amount > 0 THEN vi.tax_amount ELSE 0 END) as purchase_gst,
-			COUNT(DISTINCT i.id) as sales_invoices,
-			COUNT(DISTINCT vi.id) as purchase_invoices
-		FROM invoices i
-		FULL OUTER JOIN vendor_invoices vi ON i.invoice_date BETWEEN ? AND ?
-		WHERE (i.invoice_date BETWEEN ? AND ? OR vi.invoice_date BETWEEN ? AND ?)
-		AND (i.is_active = true OR vi.is_active = true)
+			sales.gst AS sales_gst,
+			purchases.gst AS purchase_gst,
+			reversed.gst AS itc_reversed,
+			purchases.gst - reversed.gst AS net_itc,
+			sales.gst - (purchases.gst - reversed.gst) AS net_gst_payable,
+			sales.invoices AS sales_invoices,
+			purchases.invoices AS purchase_invoices,
+			reversed.notes AS debit_notes
+		FROM sales, purchases, reversed
 	`
 
 	if err := h.db.DB.WithContext(ctx).Raw(query, startDate, endDate, startDate, endDate, startDate, endDate).Scan(&gstData).Error; err != nil {
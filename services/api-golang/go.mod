@@ -36,6 +36,9 @@ require (
 	// GORM
 	gorm.io/driver/postgres v1.5.4
 	gorm.io/gorm v1.25.5
+
+	// Ledger and GST code shared with the Go services
+	github.com/yeelo/homeopathy-platform/shared-go v0.0.0
 )
 
 require (
@@ -88,3 +91,5 @@ require (
 	google.golang.org/protobuf v1.34.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/yeelo/homeopathy-platform/shared-go => ../../packages/shared-go
@@ -0,0 +1,151 @@
+// Idempotency - Lets clients retry writes under an Idempotency-Key without repeating them
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyKeyHeader lets a client retry a request without repeating it
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyClaimTTL is how long a claim may stay in progress. A claim left
+// behind by a process that died mid-request is taken over after this.
+const idempotencyClaimTTL = 2 * time.Minute
+
+// errClaimLost is returned by complete when the claim was taken over
+var errClaimLost = errors.New("idempotency claim was taken over by a retry")
+
+// IdempotencyKey remembers a request made under a client's key and the
+// response it got. The table is shared with sales-service, which scopes its
+// keys separately.
+type IdempotencyKey struct {
+	Scope       string          `json:"scope" gorm:"primaryKey;size:100"`
+	Key         string          `json:"key" gorm:"primaryKey;size:255"`
+	RequestHash string          `json:"request_hash" gorm:"size:64;not null"`
+	StatusCode  int             `json:"status_code" gorm:"not null;default:0"` // 0 while in progress
+	Response    json.RawMessage `json:"response" gorm:"type:jsonb"`
+	CreatedAt   time.Time       `json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at"`
+}
+
+// beginIdempotent claims the request's Idempotency-Key before it is handled.
+// Without a key it returns nil and the request is handled as usual. A repeat
+// of a completed request is answered with the original response, the same key
+// with a different body is rejected, and a repeat while the first attempt is
+// still running is told to retry; in those cases done is true and the handler
+// must return.
+//
+// The response should be stored with complete in the same transaction as the
+// work it reports. A claim that was not completed is released so the client
+// can retry, and one older than idempotencyClaimTTL is taken over by the next
+// request with its key.
+func beginIdempotent(ctx context.Context, db *gorm.DB, c *gin.Context, scope string) (claim *IdempotencyKey, done bool) {
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		return nil, false
+	}
+	if len(key) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": IdempotencyKeyHeader + " is too long"})
+		return nil, true
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, true
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+
+	claim = &IdempotencyKey{Scope: scope, Key: key, RequestHash: hex.EncodeToString(sum[:])}
+	// The claim is told apart from a later takeover by when it was made
+	claim.CreatedAt = time.Now().Truncate(time.Microsecond)
+	res := db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(claim)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to claim idempotency key"})
+		return nil, true
+	}
+	if res.RowsAffected == 1 {
+		return claim, false
+	}
+
+	// Take over a claim of the same request that never finished. A different
+	// request under the key is never let in; it gets a 422 below.
+	res = db.WithContext(ctx).Model(&IdempotencyKey{}).
+		Where("scope = ? AND key = ? AND request_hash = ? AND status_code = 0 AND created_at < ?", scope, key, claim.RequestHash, claim.CreatedAt.Add(-idempotencyClaimTTL)).
+		Update("created_at", claim.CreatedAt)
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to claim idempotency key"})
+		return nil, true
+	}
+	if res.RowsAffected == 1 {
+		return claim, false
+	}
+
+	var existing IdempotencyKey
+	if err := db.WithContext(ctx).First(&existing, "scope = ? AND key = ?", scope, key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A request with this " + IdempotencyKeyHeader + " is being retried, try again"})
+			return nil, true
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read idempotency key"})
+		return nil, true
+	}
+
+	switch {
+	case existing.RequestHash != claim.RequestHash:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": IdempotencyKeyHeader + " was already used with a different request"})
+	case existing.StatusCode == 0:
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this " + IdempotencyKeyHeader + " is still in progress"})
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(existing.StatusCode, "application/json; charset=utf-8", existing.Response)
+	}
+	return nil, true
+}
+
+// complete stores the response to a claimed request so repeats get it back.
+// It fails with errClaimLost if the claim was taken over, so the work it
+// would report rolls back.
+func (k *IdempotencyKey) complete(tx *gorm.DB, status int, response interface{}) error {
+	if k == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	res := tx.Model(&IdempotencyKey{}).
+		Where("scope = ? AND key = ? AND status_code = 0 AND created_at = ?", k.Scope, k.Key, k.CreatedAt).
+		Updates(map[string]interface{}{"status_code": status, "response": string(body), "completed_at": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errClaimLost
+	}
+	return nil
+}
+
+// release frees a claim whose request was not completed; a completed claim,
+// or one taken over by a retry, is left alone
+func (k *IdempotencyKey) release(db *gorm.DB) {
+	if k == nil {
+		return
+	}
+	db.Where("scope = ? AND key = ? AND status_code = 0 AND created_at = ?", k.Scope, k.Key, k.CreatedAt).Delete(&IdempotencyKey{})
+}
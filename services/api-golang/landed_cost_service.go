@@ -0,0 +1,379 @@
+// Landed Cost Service - Freight and other inbound charges spread into the cost of received stock
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ways a landed cost voucher spreads its charges over GRN lines
+const (
+	AllocateByValue    = "value"
+	AllocateByQuantity = "quantity"
+	AllocateByWeight   = "weight"
+)
+
+// LandedCostPosted is the status of a voucher once its charges are in stock cost
+const LandedCostPosted = "posted"
+
+// ErrInvalidLandedCost is returned when a landed cost voucher cannot be allocated as sent
+var ErrInvalidLandedCost = errors.New("invalid landed cost voucher")
+
+// LandedCostVoucher carries freight, octroi, courier and similar charges for
+// inbound shipments. Posting it spreads the charges over the accepted lines
+// of its GRNs and raises the unit cost of the stock they brought in.
+type LandedCostVoucher struct {
+	BaseEntity
+	VoucherNumber    string                 `gorm:"uniqueIndex;not null;size:50" json:"voucher_number"`
+	VoucherDate      time.Time              `gorm:"not null" json:"voucher_date"`
+	VendorID         *string                `gorm:"index" json:"vendor_id"` // carrier or agent billing the charges
+	ReferenceNo      string                 `gorm:"size:100" json:"reference_no"`
+	AllocationMethod string                 `gorm:"not null;size:20" json:"allocation_method" validate:"oneof=value quantity weight"`
+	GRNIDs           []string               `gorm:"serializer:json;type:jsonb" json:"grn_ids" validate:"required,min=1"`
+	LineWeights      map[string]float64     `gorm:"-" json:"line_weights,omitempty"` // GRN item id to weight, for allocation by weight
+	TotalAmount      float64                `gorm:"type:decimal(12,2);default:0" json:"total_amount"`
+	Status           string                 `gorm:"not null;default:posted;size:20" json:"status"`
+	Notes            string                 `gorm:"type:text" json:"notes"`
+	CreatedBy        string                 `gorm:"size:255" json:"created_by"`
+	Charges          []LandedCostCharge     `gorm:"foreignKey:VoucherID" json:"charges"`
+	Allocations      []LandedCostAllocation `gorm:"foreignKey:VoucherID" json:"allocations,omitempty"`
+}
+
+// LandedCostCharge is one charge on a voucher. A charge naming a FreightCharge
+// master without an amount takes the master's fixed value, or its percentage
+// of the value received on the voucher's GRNs.
+type LandedCostCharge struct {
+	BaseEntity
+	VoucherID       string  `gorm:"not null;index" json:"voucher_id"`
+	FreightChargeID *string `gorm:"index" json:"freight_charge_id"`
+	ChargeType      string  `gorm:"not null;size:20" json:"charge_type"` // FREIGHT, OCTROI, COURIER, OTHER
+	Description     string  `gorm:"size:255" json:"description"`
+	Amount          float64 `gorm:"type:decimal(12,2);not null" json:"amount"`
+}
+
+// LandedCostAllocation is the share of a voucher taken by one GRN line
+type LandedCostAllocation struct {
+	BaseEntity
+	VoucherID      string  `gorm:"not null;index" json:"voucher_id"`
+	GRNID          string  `gorm:"not null;index" json:"grn_id"`
+	GRNItemID      string  `gorm:"not null;index" json:"grn_item_id"`
+	ProductID      string  `gorm:"not null;index" json:"product_id"`
+	BatchID        *string `gorm:"index" json:"batch_id"`
+	Quantity       int     `gorm:"not null" json:"quantity"`
+	Basis          float64 `gorm:"type:decimal(14,4);not null" json:"basis"` // the line's value, quantity or weight
+	Amount         float64 `gorm:"type:decimal(12,2);not null" json:"amount"`
+	UnitCostBefore float64 `gorm:"type:decimal(12,4)" json:"unit_cost_before"`
+	UnitCostAfter  float64 `gorm:"type:decimal(12,4)" json:"unit_cost_after"`
+}
+
+// ==================== LANDED COST OPERATIONS ====================
+
+// CreateLandedCostVoucher posts a voucher against its GRNs. In one
+// transaction it allocates the charges over their accepted lines and raises
+// the cost of the batches and cost layers those lines received into; stock
+// already consumed from a layer has the extra cost charged to what consumed it.
+func (s *PurchaseService) CreateLandedCostVoucher(ctx context.Context, voucher *LandedCostVoucher) (*LandedCostVoucher, error) {
+	voucher.AllocationMethod = strings.ToLower(strings.TrimSpace(voucher.AllocationMethod))
+	if voucher.AllocationMethod == "" {
+		voucher.AllocationMethod = AllocateByValue
+	}
+	switch voucher.AllocationMethod {
+	case AllocateByValue, AllocateByQuantity, AllocateByWeight:
+	default:
+		return nil, fmt.Errorf("%w: allocation method must be value, quantity or weight", ErrInvalidLandedCost)
+	}
+	if len(voucher.GRNIDs) == 0 {
+		return nil, fmt.Errorf("%w: at least one GRN is required", ErrInvalidLandedCost)
+	}
+	if len(voucher.Charges) == 0 {
+		return nil, fmt.Errorf("%w: at least one charge is required", ErrInvalidLandedCost)
+	}
+	if voucher.VoucherDate.IsZero() {
+		voucher.VoucherDate = time.Now()
+	}
+
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		grnIDs := uniqueStrings(voucher.GRNIDs)
+		var grns []GRN
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id IN ? AND is_active = ?", grnIDs, true).
+			Order("id").
+			Find(&grns).Error; err != nil {
+			return err
+		}
+		if len(grns) != len(grnIDs) {
+			return fmt.Errorf("%w: GRN not found", ErrInvalidLandedCost)
+		}
+		shops := make(map[string]string, len(grns))
+		for _, grn := range grns {
+			if grn.Status != GRNPosted {
+				return fmt.Errorf("%w: GRN %s is %s, only posted GRNs carry landed cost", ErrInvalidLandedCost, grn.GRNNumber, grn.Status)
+			}
+			shops[grn.ID] = grn.ShopID
+		}
+
+		var lines []GRNItem
+		if err := tx.Where("grn_id IN ? AND accepted_quantity > 0 AND is_active = ?", grnIDs, true).
+			Order("grn_id, created_at").
+			Find(&lines).Error; err != nil {
+			return err
+		}
+		if len(lines) == 0 {
+			return fmt.Errorf("%w: the GRNs have no accepted stock", ErrInvalidLandedCost)
+		}
+
+		if err := priceLandedCharges(tx, voucher, lines); err != nil {
+			return err
+		}
+		allocations, err := allocateLandedCost(voucher, lines)
+		if err != nil {
+			return err
+		}
+
+		voucher.ID = ""
+		voucher.Status = LandedCostPosted
+		voucher.GRNIDs = grnIDs
+		voucher.Allocations = nil
+		if voucher.VoucherNumber, err = nextDailyNumber(tx, &LandedCostVoucher{}, "voucher_number", "LC", voucher.VoucherDate); err != nil {
+			return err
+		}
+		if err := tx.Create(voucher).Error; err != nil {
+			return err
+		}
+
+		for i := range allocations {
+			allocation := &allocations[i]
+			allocation.VoucherID = voucher.ID
+			if err := applyLandedCost(tx, allocation, &lines[i], shops[allocation.GRNID]); err != nil {
+				return err
+			}
+			if err := tx.Create(allocation).Error; err != nil {
+				return err
+			}
+		}
+		voucher.Allocations = allocations
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to post landed cost voucher: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "landed_costs:*")
+	s.cache.DeletePattern(ctx, "grn:*")
+	return voucher, nil
+}
+
+// priceLandedCharges fills in charges taken from the FreightCharge master and
+// totals the voucher
+func priceLandedCharges(tx *gorm.DB, voucher *LandedCostVoucher, lines []GRNItem) error {
+	var received float64
+	for _, line := range lines {
+		received += float64(line.AcceptedQuantity) * line.UnitPrice
+	}
+
+	voucher.TotalAmount = 0
+	for i := range voucher.Charges {
+		charge := &voucher.Charges[i]
+		charge.ID = ""
+		charge.ChargeType = strings.ToUpper(strings.TrimSpace(charge.ChargeType))
+		if charge.Amount == 0 && charge.FreightChargeID != nil {
+			var master FreightCharge
+			if err := tx.Where("id = ? AND is_active = ?", *charge.FreightChargeID, true).First(&master).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return fmt.Errorf("%w: freight charge %s not found", ErrInvalidLandedCost, *charge.FreightChargeID)
+				}
+				return err
+			}
+			if strings.EqualFold(master.Type, "Percentage") {
+				charge.Amount = received * master.Value / 100
+			} else {
+				charge.Amount = master.Value
+			}
+			if charge.Description == "" {
+				charge.Description = master.Name
+			}
+		}
+		if charge.ChargeType == "" {
+			charge.ChargeType = "OTHER"
+		}
+		charge.Amount = roundPaise(charge.Amount)
+		if charge.Amount <= 0 {
+			return fmt.Errorf("%w: charge amounts must be positive", ErrInvalidLandedCost)
+		}
+		voucher.TotalAmount += charge.Amount
+	}
+	voucher.TotalAmount = roundPaise(voucher.TotalAmount)
+	return nil
+}
+
+// allocateLandedCost spreads the voucher total over the lines in proportion to
+// their basis. Shares are rounded to the paisa and the rounding difference
+// goes to the line with the largest basis, so the shares add up exactly.
+func allocateLandedCost(voucher *LandedCostVoucher, lines []GRNItem) ([]LandedCostAllocation, error) {
+	allocations := make([]LandedCostAllocation, len(lines))
+	var totalBasis float64
+	for i, line := range lines {
+		var basis float64
+		switch voucher.AllocationMethod {
+		case AllocateByValue:
+			basis = float64(line.AcceptedQuantity) * line.UnitPrice
+		case AllocateByQuantity:
+			basis = float64(line.AcceptedQuantity)
+		case AllocateByWeight:
+			weight, ok := voucher.LineWeights[line.ID]
+			if !ok || weight < 0 {
+				return nil, fmt.Errorf("%w: a weight is required for every line, batch %s has none", ErrInvalidLandedCost, line.BatchNumber)
+			}
+			basis = weight
+		}
+		allocations[i] = LandedCostAllocation{
+			GRNID:     line.GRNID,
+			GRNItemID: line.ID,
+			ProductID: line.ProductID,
+			BatchID:   line.BatchID,
+			Quantity:  line.AcceptedQuantity,
+			Basis:     basis,
+		}
+		totalBasis += basis
+	}
+	if totalBasis <= 0 {
+		return nil, fmt.Errorf("%w: the GRN lines have nothing to allocate %s by", ErrInvalidLandedCost, voucher.AllocationMethod)
+	}
+
+	var allocated float64
+	largest := 0
+	for i := range allocations {
+		allocations[i].Amount = roundPaise(voucher.TotalAmount * allocations[i].Basis / totalBasis)
+		allocated += allocations[i].Amount
+		if allocations[i].Basis > allocations[largest].Basis {
+			largest = i
+		}
+	}
+	allocations[largest].Amount = roundPaise(allocations[largest].Amount + voucher.TotalAmount - allocated)
+	return allocations, nil
+}
+
+// applyLandedCost adds a line's share to its GRN line, batch and cost layer.
+// The layer's unit cost goes up by the share per unit, and so do the layers
+// its stock was transferred into; see raiseLayerCost.
+func applyLandedCost(tx *gorm.DB, allocation *LandedCostAllocation, line *GRNItem, shopID string) error {
+	qty := float64(line.AcceptedQuantity)
+	perUnit := allocation.Amount / qty
+
+	allocation.UnitCostBefore = line.UnitPrice + line.LandedCost/qty
+	line.LandedCost = roundPaise(line.LandedCost + allocation.Amount)
+	allocation.UnitCostAfter = line.UnitPrice + line.LandedCost/qty
+
+	if err := tx.Model(line).Update("landed_cost", line.LandedCost).Error; err != nil {
+		return err
+	}
+	if line.BatchID != nil {
+		if err := tx.Table("batches").Where("id = ?", *line.BatchID).Updates(map[string]interface{}{
+			"purchase_price": roundPaise(allocation.UnitCostAfter),
+			"updated_at":     time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	if !tx.Migrator().HasTable("cost_layers") {
+		return nil
+	}
+	var layerIDs []string
+	if err := tx.Table("cost_layers").Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("source_type = 'GRN' AND source_id = ? AND product_id = ? AND shop_id = ? AND batch_id IS NOT DISTINCT FROM ?",
+			line.GRNID, line.ProductID, shopID, line.BatchID).
+		Pluck("id", &layerIDs).Error; err != nil {
+		return err
+	}
+	for _, layerID := range layerIDs {
+		if err := raiseLayerCost(tx, layerID, perUnit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layerTransfer is stock a cost layer sent to another shop
+type layerTransfer struct {
+	ReferenceID string
+	ProductID   string
+	ShopID      string
+	BatchID     *string
+	Sent        float64 // the whole transfer movement
+	Consumed    float64 // the part drawn from the layer
+}
+
+// raiseLayerCost puts perUnit on a layer's unit cost. Quantities already
+// consumed from it get a zero-quantity consumption for the extra cost, under
+// the movement that consumed them, so valuation and cost of goods sold both
+// carry it. Stock it sent to another shop takes its share along: the layers
+// the transfer opened there are raised by the share per unit received, and
+// so on down any later transfers.
+func raiseLayerCost(tx *gorm.DB, layerID string, perUnit float64) error {
+	if err := tx.Table("cost_layers").Where("id = ?", layerID).
+		Update("unit_cost", gorm.Expr("unit_cost + ?", perUnit)).Error; err != nil {
+		return err
+	}
+	if err := tx.Exec(`
+		INSERT INTO cost_consumptions (layer_id, movement_id, product_id, shop_id, reference_type, quantity, unit_cost, amount, consumed_at, created_at)
+		SELECT layer_id, movement_id, product_id, shop_id, reference_type, 0, ?, SUM(quantity) * ?, NOW(), NOW()
+		FROM cost_consumptions
+		WHERE layer_id = ? AND quantity > 0
+		GROUP BY layer_id, movement_id, product_id, shop_id, reference_type
+	`, perUnit, perUnit, layerID).Error; err != nil {
+		return err
+	}
+
+	var transfers []layerTransfer
+	if err := tx.Raw(`
+		SELECT m.reference_id, m.product_id, m.shop_id, m.batch_id, -m.quantity AS sent, SUM(cc.quantity) AS consumed
+		FROM cost_consumptions cc
+		JOIN stock_movements m ON m.id = cc.movement_id
+		WHERE cc.layer_id = ? AND cc.quantity > 0 AND cc.reference_type = 'TRANSFER'
+		GROUP BY m.id, m.reference_id, m.product_id, m.shop_id, m.batch_id, m.quantity
+	`, layerID).Scan(&transfers).Error; err != nil {
+		return err
+	}
+	for _, transfer := range transfers {
+		if transfer.Sent <= 0 {
+			continue
+		}
+		var received []string
+		if err := tx.Table("cost_layers").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("source_type = 'TRANSFER' AND source_id = ? AND product_id = ? AND shop_id <> ? AND batch_id IS NOT DISTINCT FROM ?",
+				transfer.ReferenceID, transfer.ProductID, transfer.ShopID, transfer.BatchID).
+			Pluck("id", &received).Error; err != nil {
+			return err
+		}
+		// Units lost short in transit keep their share at the sending shop
+		share := perUnit * transfer.Consumed / transfer.Sent
+		for _, receivedID := range received {
+			if err := raiseLayerCost(tx, receivedID, share); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueStrings drops repeats and sorts, so rows are locked in a stable order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for spreading a landed cost voucher over GRN lines
+func TestAllocateLandedCost(t *testing.T) {
+	line := func(id string, qty int, price float64) GRNItem {
+		item := GRNItem{GRNID: "grn-1", ProductID: "product-" + id, BatchNumber: "B-" + id, AcceptedQuantity: qty, UnitPrice: price}
+		item.ID = id
+		return item
+	}
+	lines := []GRNItem{line("a", 10, 100), line("b", 30, 20), line("c", 5, 40)}
+
+	tests := []struct {
+		name    string
+		method  string
+		total   float64
+		weights map[string]float64
+		want    []float64
+		wantErr bool
+	}{
+		{name: "by value", method: AllocateByValue, total: 180, want: []float64{100, 60, 20}},
+		{name: "by quantity", method: AllocateByQuantity, total: 90, want: []float64{20, 60, 10}},
+		{name: "by weight", method: AllocateByWeight, total: 100, weights: map[string]float64{"a": 1, "b": 2, "c": 1}, want: []float64{25, 50, 25}},
+		{name: "rounding goes to the largest line", method: AllocateByValue, total: 0.05, want: []float64{0.02, 0.02, 0.01}},
+		{name: "weight missing for a line", method: AllocateByWeight, total: 100, weights: map[string]float64{"a": 1, "b": 2}, wantErr: true},
+		{name: "nothing to allocate by", method: AllocateByWeight, total: 100, weights: map[string]float64{"a": 0, "b": 0, "c": 0}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			voucher := &LandedCostVoucher{AllocationMethod: tt.method, TotalAmount: tt.total, LineWeights: tt.weights}
+			allocations, err := allocateLandedCost(voucher, lines)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidLandedCost), "want ErrInvalidLandedCost, got %v", err)
+				return
+			}
+			assert.NoError(t, err)
+
+			var sum float64
+			for i, allocation := range allocations {
+				assert.Equal(t, tt.want[i], allocation.Amount, "line %s", lines[i].ID)
+				assert.Equal(t, lines[i].ID, allocation.GRNItemID)
+				sum += allocation.Amount
+			}
+			// The shares always add up to the voucher
+			assert.Equal(t, tt.total, roundPaise(sum))
+		})
+	}
+}
+
+// Table-driven tests for the stable lock order of ids
+func TestUniqueStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{name: "sorted and deduplicated", values: []string{"grn-2", "grn-1", "grn-2"}, want: []string{"grn-1", "grn-2"}},
+		{name: "blanks dropped", values: []string{"", "grn-1", ""}, want: []string{"grn-1"}},
+		{name: "empty", values: nil, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, uniqueStrings(tt.values))
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/yeelo/homeopathy-platform/shared-go/loyalty"
 	"gorm.io/gorm"
 )
 
@@ -258,45 +260,37 @@ func (h *LoyaltyHandler) RedeemLoyaltyPoints(c *gin.Context) {
 		return
 	}
 
-	// Check customer's current points balance
+	// Redemption is shared with POS bills in sales-service, which redeem
+	// points as split tenders under the same per-customer lock
+	var transactionID string
 	var balance float64
-	query := `
-		SELECT COALESCE(SUM(points_earned) - SUM(points_redeemed), 0)
-		FROM loyalty_transactions
-		WHERE customer_id = ? AND expiry_date > NOW()
-	`
-
-	if err := h.db.DB.WithContext(ctx).Raw(query, request.CustomerID).Scan(&balance).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check points balance"})
-		return
-	}
-
-	if balance < request.PointsToRedeem {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient points balance"})
-		return
-	}
-
-	// Create redemption transaction
-	transaction := LoyaltyTransaction{
-		CustomerID:     request.CustomerID,
-		RewardID:       request.RewardID,
-		TransactionType: "redeem",
-		PointsEarned:   0,
-		PointsRedeemed: request.PointsToRedeem,
-		Description:    request.Description,
-		ExpiryDate:     time.Now(),
-	}
-
-	if err := h.db.DB.WithContext(ctx).Create(&transaction).Error; err != nil {
+	err := h.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		transactionID, balance, err = loyalty.RedeemPoints(tx, loyalty.PointsRedemption{
+			CustomerID:  request.CustomerID,
+			Points:      request.PointsToRedeem,
+			RewardID:    request.RewardID,
+			Description: request.Description,
+		})
+		if errors.Is(err, loyalty.ErrInsufficientPoints) {
+			return errRedemption(http.StatusBadRequest, "Insufficient points balance")
+		}
+		return err
+	})
+	if err != nil {
+		if ge, ok := err.(*redemptionError); ok {
+			c.JSON(ge.status, gin.H{"error": ge.msg})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem loyalty points"})
 		return
 	}
 
 	response := map[string]interface{}{
-		"message":         "Points redeemed successfully",
-		"points_redeemed": request.PointsToRedeem,
-		"remaining_balance": balance - request.PointsToRedeem,
-		"transaction_id":  transaction.ID,
+		"message":           "Points redeemed successfully",
+		"points_redeemed":   request.PointsToRedeem,
+		"remaining_balance": balance,
+		"transaction_id":    transactionID,
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -555,67 +549,37 @@ func (h *LoyaltyHandler) RedeemGiftCard(c *gin.Context) {
 		return
 	}
 
-	// Find and validate gift card
-	var giftCard GiftCard
-	if err := h.db.DB.WithContext(ctx).Where("code = ? AND status = ?", request.GiftCardCode, "active").First(&giftCard).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Gift card not found or expired"})
+	// Redemption is shared with POS bills in sales-service, which redeem the
+	// same cards as split tenders under the same row lock
+	var redemption *loyalty.GiftCardRedemption
+	err := h.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		redemption, err = loyalty.RedeemGiftCard(tx, request.GiftCardCode, request.Amount, request.Description, time.Now())
+		switch {
+		case errors.Is(err, loyalty.ErrGiftCardNotFound):
+			return errRedemption(http.StatusNotFound, "Gift card not found or expired")
+		case errors.Is(err, loyalty.ErrGiftCardExpired):
+			return errRedemption(http.StatusBadRequest, "Gift card has expired")
+		case errors.Is(err, loyalty.ErrInsufficientBalance):
+			return errRedemption(http.StatusBadRequest, "Insufficient gift card balance")
+		}
+		return err
+	})
+	if err != nil {
+		if ge, ok := err.(*redemptionError); ok {
+			c.JSON(ge.status, gin.H{"error": ge.msg})
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve gift card"})
-		return
-	}
-
-	// Check expiry
-	if time.Now().After(giftCard.ExpiryDate) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Gift card has expired"})
-		return
-	}
-
-	// Check balance
-	if giftCard.Balance < request.Amount {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Insufficient gift card balance"})
-		return
-	}
-
-	// Update gift card balance
-	newBalance := giftCard.Balance - request.Amount
-	status := "active"
-	if newBalance <= 0 {
-		status = "redeemed"
-	}
-
-	updates := map[string]interface{}{
-		"balance": newBalance,
-		"status":  status,
-		"redeemed_at": time.Now(),
-	}
-
-	if err := h.db.DB.WithContext(ctx).Model(&giftCard).Updates(updates).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem gift card"})
 		return
 	}
 
-	// Log redemption
-	redemption := GiftCardRedemption{
-		GiftCardID:  giftCard.ID,
-		Amount:      request.Amount,
-		Balance:     newBalance,
-		Description: request.Description,
-		RedeemedAt:  time.Now(),
-	}
-
-	if err := h.db.DB.WithContext(ctx).Create(&redemption).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log redemption"})
-		return
-	}
-
 	response := map[string]interface{}{
 		"message":         "Gift card redeemed successfully",
 		"redeemed_amount": request.Amount,
-		"remaining_balance": newBalance,
-		"gift_card_code":  giftCard.Code,
-		"status":          status,
+		"remaining_balance": redemption.Balance,
+		"gift_card_code":  redemption.Code,
+		"status":          redemption.Status,
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -674,3 +638,16 @@ func generateGiftCardCode() string {
 	// Generate a unique gift card code
 	return fmt.Sprintf("GC%08d", time.Now().UnixNano()%100000000)
 }
+
+// redemptionError is a gift card or points redemption refused for a reason
+// the caller can fix
+type redemptionError struct {
+	status int
+	msg    string
+}
+
+func (e *redemptionError) Error() string { return e.msg }
+
+func errRedemption(status int, msg string) error {
+	return &redemptionError{status: status, msg: msg}
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -19,6 +20,8 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/redis/go-redis/v9"
 	"github.com/sony/gobreaker"
+	"github.com/yeelo/homeopathy-platform/shared-go/creditnote"
+	"github.com/yeelo/homeopathy-platform/shared-go/docno"
 	"golang.org/x/time/rate"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -146,9 +149,20 @@ func NewGORMDatabase(config DatabaseConfig) (*GORMDatabase, error) {
 		&CurrencyWorkflow{}, &LanguageWorkflow{},
 		&CRMLifecycle{}, &CRMInteraction{}, &LoyaltyProgram{},
 		&LoyaltyTier{}, &AnalyticsWorkflow{}, &MLModel{},
+		&IdempotencyKey{},
+		&Quotation{}, &QuotationItem{},
+		&GRN{}, &GRNItem{},
+		&VendorInvoice{}, &VendorInvoiceItem{}, &MatchTolerance{},
+		&PurchaseReturn{}, &PurchaseReturnItem{}, &DebitNote{}, &DebitNoteAdjustment{},
+		&LandedCostVoucher{}, &LandedCostCharge{}, &LandedCostAllocation{},
+		&POApprovalRule{}, &POApproval{},
+		&creditnote.CreditNote{}, &creditnote.Application{}, &docno.Sequence{},
 	); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
+	if err := migratePriceLists(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate price lists: %w", err)
+	}
 
 	return &GORMDatabase{DB: db}, nil
 }
@@ -471,6 +485,23 @@ func (m *Middleware) AuthRequired() gin.HandlerFunc {
 	}
 }
 
+// RequireRole lets through only users whose role is one of roles; it runs
+// after AuthRequired
+func (m *Middleware) RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("user_role")
+		for _, allowed := range roles {
+			if strings.EqualFold(role, allowed) {
+				c.Next()
+				return
+			}
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		c.Abort()
+	}
+}
+
 // Rate Limiting Middleware
 func (m *Middleware) RateLimit(rps int) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -687,6 +718,7 @@ func main() {
 	workflowService := NewWorkflowService(db, cache, circuitBreaker)
 	workflowProcessor := NewWorkflowProcessor(db, 10) // 10 worker goroutines
 	companyBranchHandler := NewCompanyBranchHandler(db, cache)
+	priceListHandler := NewPriceListHandler(db, cache)
 
 	// Initialize payment services
 	stripeService := NewStripeService("sk_test_mock", "whsec_mock")
@@ -957,6 +989,38 @@ func main() {
 			orders.GET("/customer/:customer_id", salesHandler.GetOrdersByCustomer)
 		}
 
+		// Price list routes
+		priceLists := api.Group("/price-lists")
+		priceLists.Use(middleware.RateLimit(100))
+		{
+			priceLists.GET("", priceListHandler.GetPriceLists)
+			priceLists.GET("/:id", priceListHandler.GetPriceList)
+			priceLists.POST("", middleware.AuthRequired(), priceListHandler.CreatePriceList)
+			priceLists.PUT("/:id", middleware.AuthRequired(), priceListHandler.UpdatePriceList)
+			priceLists.DELETE("/:id", middleware.AuthRequired(), priceListHandler.DeletePriceList)
+			priceLists.GET("/:id/items", priceListHandler.GetPriceListItems)
+			priceLists.POST("/:id/items", middleware.AuthRequired(), priceListHandler.CreatePriceListItem)
+			priceLists.PUT("/:id/items/:item_id", middleware.AuthRequired(), priceListHandler.UpdatePriceListItem)
+			priceLists.DELETE("/:id/items/:item_id", middleware.AuthRequired(), priceListHandler.DeletePriceListItem)
+		}
+
+		// Quotation routes
+		quotations := api.Group("/quotations")
+		quotations.Use(middleware.RateLimit(100))
+		{
+			quotations.GET("", salesHandler.GetQuotations)
+			quotations.GET("/conversion", salesHandler.GetQuoteConversion)
+			quotations.GET("/:id", salesHandler.GetQuotation)
+			quotations.GET("/:id/versions", salesHandler.GetQuotationVersions)
+			quotations.GET("/:id/pdf", salesHandler.GetQuotationPDF)
+			quotations.POST("", middleware.AuthRequired(), salesHandler.CreateQuotation)
+			quotations.POST("/:id/revise", middleware.AuthRequired(), salesHandler.ReviseQuotation)
+			quotations.POST("/:id/send", middleware.AuthRequired(), salesHandler.SendQuotation)
+			quotations.POST("/:id/accept", middleware.AuthRequired(), salesHandler.AcceptQuotation)
+			quotations.POST("/:id/reject", middleware.AuthRequired(), salesHandler.RejectQuotation)
+			quotations.POST("/:id/convert", middleware.AuthRequired(), salesHandler.ConvertQuotationToOrder)
+		}
+
 		// Return routes
 		returns := api.Group("/returns")
 		returns.Use(middleware.RateLimit(100))
@@ -1017,8 +1081,16 @@ func main() {
 			purchaseOrders.POST("", middleware.AuthRequired(), purchaseHandler.CreatePurchaseOrder)
 			purchaseOrders.PUT("/:id", middleware.AuthRequired(), purchaseHandler.UpdatePurchaseOrder)
 			purchaseOrders.DELETE("/:id", middleware.AuthRequired(), purchaseHandler.DeletePurchaseOrder)
+			purchaseOrders.POST("/:id/submit", middleware.AuthRequired(), purchaseHandler.SubmitPurchaseOrder)
 			purchaseOrders.PUT("/:id/approve", middleware.AuthRequired(), purchaseHandler.ApprovePurchaseOrder)
+			purchaseOrders.POST("/:id/reject", middleware.AuthRequired(), purchaseHandler.RejectPurchaseOrder)
+			purchaseOrders.POST("/:id/request-changes", middleware.AuthRequired(), purchaseHandler.RequestPurchaseOrderChanges)
+			purchaseOrders.POST("/:id/send", middleware.AuthRequired(), purchaseHandler.SendPurchaseOrder)
+			purchaseOrders.GET("/approval-rules", purchaseHandler.GetPOApprovalRules)
+			purchaseOrders.PUT("/approval-rules", middleware.AuthRequired(), middleware.RequireRole("admin", "owner"), purchaseHandler.SetPOApprovalRules)
 			purchaseOrders.GET("/vendor/:vendor_id", purchaseHandler.GetOrdersByVendor)
+			purchaseOrders.GET("/reorder-suggestions", purchaseHandler.GetReorderSuggestions)
+			purchaseOrders.POST("/reorder-drafts", middleware.AuthRequired(), purchaseHandler.CreateReorderDrafts)
 		}
 
 		// GRN routes
@@ -1030,6 +1102,7 @@ func main() {
 			grn.GET("/:id", purchaseHandler.GetGRNByID)
 			grn.POST("", middleware.AuthRequired(), purchaseHandler.CreateGRN)
 			grn.PUT("/:id", middleware.AuthRequired(), purchaseHandler.UpdateGRN)
+			grn.POST("/:id/post", middleware.AuthRequired(), purchaseHandler.PostGRN)
 			grn.DELETE("/:id", middleware.AuthRequired(), purchaseHandler.DeleteGRN)
 			grn.GET("/po/:po_id", purchaseHandler.GetGRNByPurchaseOrder)
 		}
@@ -1045,6 +1118,38 @@ func main() {
 			vendorInvoices.PUT("/:id", middleware.AuthRequired(), purchaseHandler.UpdateVendorInvoice)
 			vendorInvoices.DELETE("/:id", middleware.AuthRequired(), purchaseHandler.DeleteVendorInvoice)
 			vendorInvoices.PUT("/:id/approve", middleware.AuthRequired(), purchaseHandler.ApproveVendorInvoice)
+			vendorInvoices.POST("/:id/match", middleware.AuthRequired(), purchaseHandler.MatchVendorInvoice)
+			vendorInvoices.GET("/tolerances", purchaseHandler.GetMatchTolerances)
+			vendorInvoices.PUT("/tolerances", middleware.AuthRequired(), purchaseHandler.SetMatchTolerance)
+		}
+
+		// Purchase return routes
+		purchaseReturns := api.Group("/purchase-returns")
+		purchaseReturns.Use(middleware.RateLimit(100))
+		purchaseReturns.Use(middleware.Cache(2 * time.Minute))
+		{
+			purchaseReturns.GET("", purchaseHandler.GetPurchaseReturns)
+			purchaseReturns.GET("/:id", purchaseHandler.GetPurchaseReturn)
+			purchaseReturns.POST("", middleware.AuthRequired(), purchaseHandler.CreatePurchaseReturn)
+		}
+
+		// Landed cost routes
+		landedCosts := api.Group("/landed-costs")
+		landedCosts.Use(middleware.RateLimit(100))
+		landedCosts.Use(middleware.Cache(2 * time.Minute))
+		{
+			landedCosts.GET("", purchaseHandler.GetLandedCostVouchers)
+			landedCosts.GET("/:id", purchaseHandler.GetLandedCostVoucher)
+			landedCosts.POST("", middleware.AuthRequired(), purchaseHandler.CreateLandedCostVoucher)
+		}
+
+		// Debit note routes
+		debitNotes := api.Group("/debit-notes")
+		debitNotes.Use(middleware.RateLimit(100))
+		debitNotes.Use(middleware.Cache(2 * time.Minute))
+		{
+			debitNotes.GET("", purchaseHandler.GetDebitNotes)
+			debitNotes.GET("/:id", purchaseHandler.GetDebitNote)
 		}
 
 		// Vendor routes
@@ -1058,6 +1163,7 @@ func main() {
 			vendors.PUT("/:id", middleware.AuthRequired(), purchaseHandler.UpdateVendor)
 			vendors.DELETE("/:id", middleware.AuthRequired(), purchaseHandler.DeleteVendor)
 			vendors.GET("/performance", purchaseHandler.GetVendorPerformance)
+			vendors.GET("/:id/payable", purchaseHandler.GetVendorPayable)
 			// Finance routes
 		// Ledger routes
 		ledgers := api.Group("/ledgers")
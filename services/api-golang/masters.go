@@ -235,39 +235,40 @@ type IntegrationKey struct {
 
 // 1. Product Master
 type Product struct {
-	ID               string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	Code             string    `json:"code" gorm:"unique;not null;size:50" validate:"required,max=50"`
-	Name             string    `json:"name" gorm:"not null;size:500" validate:"required,min=2,max=500"`
-	Description      string    `json:"description" gorm:"type:text"`
-	CategoryID       string    `json:"category_id" gorm:"type:uuid;not null"`
-	Category         *ProductCategory `json:"category" gorm:"foreignKey:CategoryID"`
-	SubcategoryID    *string   `json:"subcategory_id" gorm:"type:uuid"`
-	Subcategory      *ProductSubcategory `json:"subcategory" gorm:"foreignKey:SubcategoryID"`
-	BrandID          *string   `json:"brand_id" gorm:"type:uuid"`
-	Brand            *ProductBrand `json:"brand" gorm:"foreignKey:BrandID"`
-	PotencyID        *string   `json:"potency_id" gorm:"type:uuid"`
-	Potency          *ProductPotency `json:"potency" gorm:"foreignKey:PotencyID"`
-	SizeID           *string   `json:"size_id" gorm:"type:uuid"`
-	Size             *ProductSize `json:"size" gorm:"foreignKey:SizeID"`
-	VariantID        *string   `json:"variant_id" gorm:"type:uuid"`
-	Variant          *ProductVariant `json:"variant" gorm:"foreignKey:VariantID"`
-	GroupID          *string   `json:"group_id" gorm:"type:uuid"`
-	Group            *ProductGroup `json:"group" gorm:"foreignKey:GroupID"`
-	HSNCode          string    `json:"hsn_code" gorm:"size:8"`
-	TaxSlabID        string    `json:"tax_slab_id" gorm:"type:uuid;not null"`
-	TaxSlab          *TaxSlab  `json:"tax_slab" gorm:"foreignKey:TaxSlabID"`
-	UOMID            string    `json:"uom_id" gorm:"type:uuid;not null"`
-	UOM              *UOM      `json:"uom" gorm:"foreignKey:UOMID"`
-	ReorderLevel     int       `json:"reorder_level" gorm:"default:10"`
-	MinStock         int       `json:"min_stock" gorm:"default:5"`
-	MaxStock         int       `json:"max_stock" gorm:"default:1000"`
-	PurchasePrice    float64   `json:"purchase_price" gorm:"type:decimal(10,2);default:0.00"`
-	MRP              float64   `json:"mrp" gorm:"type:decimal(10,2);default:0.00"`
-	SellingPrice     float64   `json:"selling_price" gorm:"type:decimal(10,2);default:0.00"`
-	DiscountPercent  float64   `json:"discount_percent" gorm:"type:decimal(5,2);default:0.00"`
-	IsActive         bool      `json:"is_active" gorm:"default:true"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
+	ID                string              `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Code              string              `json:"code" gorm:"unique;not null;size:50" validate:"required,max=50"`
+	Name              string              `json:"name" gorm:"not null;size:500" validate:"required,min=2,max=500"`
+	Description       string              `json:"description" gorm:"type:text"`
+	CategoryID        string              `json:"category_id" gorm:"type:uuid;not null"`
+	Category          *ProductCategory    `json:"category" gorm:"foreignKey:CategoryID"`
+	SubcategoryID     *string             `json:"subcategory_id" gorm:"type:uuid"`
+	Subcategory       *ProductSubcategory `json:"subcategory" gorm:"foreignKey:SubcategoryID"`
+	BrandID           *string             `json:"brand_id" gorm:"type:uuid"`
+	Brand             *ProductBrand       `json:"brand" gorm:"foreignKey:BrandID"`
+	PotencyID         *string             `json:"potency_id" gorm:"type:uuid"`
+	Potency           *ProductPotency     `json:"potency" gorm:"foreignKey:PotencyID"`
+	SizeID            *string             `json:"size_id" gorm:"type:uuid"`
+	Size              *ProductSize        `json:"size" gorm:"foreignKey:SizeID"`
+	VariantID         *string             `json:"variant_id" gorm:"type:uuid"`
+	Variant           *ProductVariant     `json:"variant" gorm:"foreignKey:VariantID"`
+	GroupID           *string             `json:"group_id" gorm:"type:uuid"`
+	Group             *ProductGroup       `json:"group" gorm:"foreignKey:GroupID"`
+	HSNCode           string              `json:"hsn_code" gorm:"size:8"`
+	TaxSlabID         string              `json:"tax_slab_id" gorm:"type:uuid;not null"`
+	TaxSlab           *TaxSlab            `json:"tax_slab" gorm:"foreignKey:TaxSlabID"`
+	UOMID             string              `json:"uom_id" gorm:"type:uuid;not null"`
+	UOM               *UOM                `json:"uom" gorm:"foreignKey:UOMID"`
+	ReorderLevel      int                 `json:"reorder_level" gorm:"default:10"`
+	MinStock          int                 `json:"min_stock" gorm:"default:5"`
+	MaxStock          int                 `json:"max_stock" gorm:"default:1000"`
+	PreferredVendorID *string             `json:"preferred_vendor_id" gorm:"type:uuid;index"`
+	PurchasePrice     float64             `json:"purchase_price" gorm:"type:decimal(10,2);default:0.00"`
+	MRP               float64             `json:"mrp" gorm:"type:decimal(10,2);default:0.00"`
+	SellingPrice      float64             `json:"selling_price" gorm:"type:decimal(10,2);default:0.00"`
+	DiscountPercent   float64             `json:"discount_percent" gorm:"type:decimal(5,2);default:0.00"`
+	IsActive          bool                `json:"is_active" gorm:"default:true"`
+	CreatedAt         time.Time           `json:"created_at"`
+	UpdatedAt         time.Time           `json:"updated_at"`
 }
 
 // 2. SKU / Item Code Master
@@ -428,47 +429,82 @@ type Warehouse struct {
 
 // 13. HSN Code Master
 type HSNCode struct {
-	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	Code         string    `json:"code" gorm:"unique;not null;size:8" validate:"required,len=8"`
-	Description  string    `json:"description" gorm:"not null;size:500" validate:"required,min=2,max=500"`
-	Chapter      string    `json:"chapter" gorm:"size:2"` // HSN Chapter
-	Heading      string    `json:"heading" gorm:"size:4"` // HSN Heading
-	IsActive     bool      `json:"is_active" gorm:"default:true"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID          string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Code        string    `json:"code" gorm:"unique;not null;size:8" validate:"required,len=8"`
+	Description string    `json:"description" gorm:"not null;size:500" validate:"required,min=2,max=500"`
+	Chapter     string    `json:"chapter" gorm:"size:2"`        // HSN Chapter
+	Heading     string    `json:"heading" gorm:"size:4"`        // HSN Heading
+	TaxSlabID   *string   `json:"tax_slab_id" gorm:"type:uuid"` // GST rate for products that carry no slab of their own
+	TaxSlab     *TaxSlab  `json:"tax_slab" gorm:"foreignKey:TaxSlabID"`
+	IsActive    bool      `json:"is_active" gorm:"default:true"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 // 14. Price List / Rate Master
 type PriceList struct {
-	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	Code         string    `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
-	Name         string    `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
-	Description  string    `json:"description" gorm:"type:text"`
-	Type         string    `json:"type" gorm:"size:20;not null"` // Purchase, Sale, MRP
-	CurrencyID   string    `json:"currency_id" gorm:"type:uuid;not null"`
-	Currency     *Currency `json:"currency" gorm:"foreignKey:CurrencyID"`
-	IsActive     bool      `json:"is_active" gorm:"default:true"`
-	EffectiveFrom *time.Time `json:"effective_from"`
-	EffectiveTo   *time.Time `json:"effective_to"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID               string          `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Code             string          `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
+	Name             string          `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
+	Description      string          `json:"description" gorm:"type:text"`
+	Type             string          `json:"type" gorm:"size:20;not null"` // Purchase, Sale, MRP
+	CurrencyID       string          `json:"currency_id" gorm:"type:uuid;not null"`
+	Currency         *Currency       `json:"currency" gorm:"foreignKey:CurrencyID"`
+	CustomerGroupID  *string         `json:"customer_group_id" gorm:"type:uuid"` // e.g. doctors; empty applies to everyone
+	CustomerGroup    *CustomerGroup  `json:"customer_group" gorm:"foreignKey:CustomerGroupID"`
+	PriceLevelID     *string         `json:"price_level_id" gorm:"type:uuid"`
+	PriceLevel       *PriceLevel     `json:"price_level" gorm:"foreignKey:PriceLevelID"`
+	BranchID         *string         `json:"branch_id" gorm:"type:uuid"`              // empty applies to every branch
+	Priority         int             `json:"priority" gorm:"default:0"`               // breaks ties between equally specific lists
+	PricesIncludeTax bool            `json:"prices_include_tax" gorm:"default:false"` // MRP lists always include tax
+	IsActive         bool            `json:"is_active" gorm:"default:true"`
+	EffectiveFrom    *time.Time      `json:"effective_from"`
+	EffectiveTo      *time.Time      `json:"effective_to"`
+	CreatedAt        time.Time       `json:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+	Items            []PriceListItem `json:"items,omitempty" gorm:"foreignKey:PriceListID"`
+}
+
+// Price List Line - rate for one product, optionally one size, in a price list
+type PriceListItem struct {
+	ID            string       `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	PriceListID   string       `json:"price_list_id" gorm:"type:uuid;not null;index"`
+	ProductID     string       `json:"product_id" gorm:"type:uuid;not null;index"`
+	Product       *Product     `json:"product" gorm:"foreignKey:ProductID"`
+	SizeID        *string      `json:"size_id" gorm:"type:uuid"`
+	Size          *ProductSize `json:"size" gorm:"foreignKey:SizeID"`
+	Price         float64      `json:"price" gorm:"type:decimal(10,2);not null" validate:"required,min=0"`
+	EffectiveFrom *time.Time   `json:"effective_from"`
+	EffectiveTo   *time.Time   `json:"effective_to"`
+	IsActive      bool         `json:"is_active" gorm:"default:true"`
+	CreatedAt     time.Time    `json:"created_at"`
+	UpdatedAt     time.Time    `json:"updated_at"`
 }
 
 // 15. Discount/Offer Master
 type Discount struct {
-	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	Code         string    `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
-	Name         string    `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
-	Description  string    `json:"description" gorm:"type:text"`
-	Type         string    `json:"type" gorm:"size:20;not null"` // Percentage, Fixed Amount
-	Value        float64   `json:"value" gorm:"type:decimal(10,2);not null" validate:"required,min=0"`
-	MinAmount    float64   `json:"min_amount" gorm:"type:decimal(10,2);default:0.00"`
-	MaxDiscount  float64   `json:"max_discount" gorm:"type:decimal(10,2);default:0.00"`
-	IsActive     bool      `json:"is_active" gorm:"default:true"`
+	ID            string     `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Code          string     `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
+	Name          string     `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
+	Description   string     `json:"description" gorm:"type:text"`
+	Type          string     `json:"type" gorm:"size:20;not null"` // Percentage, Fixed Amount, Buy X Get Y
+	Value         float64    `json:"value" gorm:"type:decimal(10,2);not null" validate:"required,min=0"`
+	MinAmount     float64    `json:"min_amount" gorm:"type:decimal(10,2);default:0.00"`
+	MaxDiscount   float64    `json:"max_discount" gorm:"type:decimal(10,2);default:0.00"`
+	Scope         string     `json:"scope" gorm:"size:20;default:BILL"` // BILL, BRAND, CATEGORY, PRODUCT
+	BrandID       *string    `json:"brand_id" gorm:"type:uuid"`
+	CategoryID    *string    `json:"category_id" gorm:"type:uuid"`
+	ProductID     *string    `json:"product_id" gorm:"type:uuid"`
+	BuyQuantity   int        `json:"buy_quantity" gorm:"default:0"`   // Buy X Get Y: units paid for
+	FreeQuantity  int        `json:"free_quantity" gorm:"default:0"`  // Buy X Get Y: units given free
+	Priority      int        `json:"priority" gorm:"default:0"`       // higher is tried first
+	Stackable     bool       `json:"stackable" gorm:"default:false"`  // combines with other stackable schemes
+	AutoApply     bool       `json:"auto_apply" gorm:"default:false"` // otherwise applies only when its code is entered
+	IsActive      bool       `json:"is_active" gorm:"default:true"`
 	EffectiveFrom *time.Time `json:"effective_from"`
 	EffectiveTo   *time.Time `json:"effective_to"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
 }
 
 // ==================== SALES MASTERS ====================
@@ -489,20 +525,22 @@ type SalesType struct {
 
 // 2. Invoice Series Master
 type InvoiceSeries struct {
-	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	Code         string    `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
-	Name         string    `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
-	Prefix       string    `json:"prefix" gorm:"size:10"` // INV, RET, etc.
-	StartNumber  int       `json:"start_number" gorm:"default:1"`
-	CurrentNumber int      `json:"current_number" gorm:"default:1"`
-	EndNumber    int       `json:"end_number" gorm:"default:999999"`
-	SalesTypeID  string    `json:"sales_type_id" gorm:"type:uuid;not null"`
-	SalesType    *SalesType `json:"sales_type" gorm:"foreignKey:SalesTypeID"`
-	BranchID     string    `json:"branch_id" gorm:"type:uuid;not null"`
-	Branch       *Branch   `json:"branch" gorm:"foreignKey:BranchID"`
-	IsActive     bool      `json:"is_active" gorm:"default:true"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID            string     `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Code          string     `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
+	Name          string     `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
+	Prefix        string     `json:"prefix" gorm:"size:10"` // INV, RET, etc.
+	Suffix        string     `json:"suffix" gorm:"size:10"`
+	Pattern       string     `json:"pattern" gorm:"size:50"` // e.g. {PREFIX}/{YY}/{SEQ:5}{SUFFIX}; numbers reset every financial year
+	StartNumber   int        `json:"start_number" gorm:"default:1"`
+	CurrentNumber int        `json:"current_number" gorm:"default:1"`
+	EndNumber     int        `json:"end_number" gorm:"default:999999"`
+	SalesTypeID   string     `json:"sales_type_id" gorm:"type:uuid;not null"`
+	SalesType     *SalesType `json:"sales_type" gorm:"foreignKey:SalesTypeID"`
+	BranchID      string     `json:"branch_id" gorm:"type:uuid;not null"`
+	Branch        *Branch    `json:"branch" gorm:"foreignKey:BranchID"`
+	IsActive      bool       `json:"is_active" gorm:"default:true"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
 }
 
 // 3. Price Level Master
@@ -586,14 +624,15 @@ type EInvoiceTemplate struct {
 
 // 9. Return Reason Master
 type ReturnReason struct {
-	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	Code         string    `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
-	Name         string    `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
-	Description  string    `json:"description" gorm:"type:text"`
-	Type         string    `json:"type" gorm:"size:20;not null"` // Sales Return, Purchase Return
-	IsActive     bool      `json:"is_active" gorm:"default:true"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID          string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Code        string    `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
+	Name        string    `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
+	Description string    `json:"description" gorm:"type:text"`
+	Type        string    `json:"type" gorm:"size:20;not null"`                // Sales Return, Purchase Return
+	Disposition string    `json:"disposition" gorm:"size:20;default:SELLABLE"` // SELLABLE goes back to its batch, DAMAGED to the damaged bin
+	IsActive    bool      `json:"is_active" gorm:"default:true"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 // ==================== PURCHASE MASTERS ====================
@@ -695,29 +734,33 @@ type GRNTemplate struct {
 
 // 1. Customer Master
 type Customer struct {
-	ID               string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	Code             string    `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
-	Name             string    `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
-	Type             string    `json:"type" gorm:"size:20;not null"` // Individual, Business
-	Email            string    `json:"email" gorm:"size:255" validate:"email"`
-	Phone            string    `json:"phone" gorm:"size:20"`
-	AlternatePhone   string    `json:"alternate_phone" gorm:"size:20"`
-	DateOfBirth      *time.Time `json:"date_of_birth"`
-	Anniversary      *time.Time `json:"anniversary"`
-	Gender           string    `json:"gender" gorm:"size:10"` // Male, Female, Other
-	GroupID          *string   `json:"group_id" gorm:"type:uuid"`
+	ID               string         `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	Code             string         `json:"code" gorm:"unique;not null;size:20" validate:"required,max=20"`
+	Name             string         `json:"name" gorm:"not null;size:255" validate:"required,min=2,max=255"`
+	Type             string         `json:"type" gorm:"size:20;not null"` // Individual, Business
+	Email            string         `json:"email" gorm:"size:255" validate:"email"`
+	Phone            string         `json:"phone" gorm:"size:20"`
+	AlternatePhone   string         `json:"alternate_phone" gorm:"size:20"`
+	DateOfBirth      *time.Time     `json:"date_of_birth"`
+	Anniversary      *time.Time     `json:"anniversary"`
+	Gender           string         `json:"gender" gorm:"size:10"` // Male, Female, Other
+	GroupID          *string        `json:"group_id" gorm:"type:uuid"`
 	Group            *CustomerGroup `json:"group" gorm:"foreignKey:GroupID"`
-	LoyaltyPoints    int       `json:"loyalty_points" gorm:"default:0"`
-	LoyaltyTier      string    `json:"loyalty_tier" gorm:"size:50;default:Bronze"`
-	TotalPurchase    float64   `json:"total_purchase" gorm:"type:decimal(12,2);default:0.00"`
-	LastPurchase     *time.Time `json:"last_purchase"`
-	MarketingConsent bool      `json:"marketing_consent" gorm:"default:true"`
-	ReferralSource   string    `json:"referral_source" gorm:"size:100"`
-	CreditLimit      float64   `json:"credit_limit" gorm:"type:decimal(12,2);default:0.00"`
-	PaymentTerms     int       `json:"payment_terms" gorm:"default:30"`
-	IsActive         bool      `json:"is_active" gorm:"default:true"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
+	PriceLevelID     *string        `json:"price_level_id" gorm:"type:uuid"`
+	PriceLevel       *PriceLevel    `json:"price_level" gorm:"foreignKey:PriceLevelID"`
+	LoyaltyPoints    int            `json:"loyalty_points" gorm:"default:0"`
+	LoyaltyTier      string         `json:"loyalty_tier" gorm:"size:50;default:Bronze"`
+	TotalPurchase    float64        `json:"total_purchase" gorm:"type:decimal(12,2);default:0.00"`
+	LastPurchase     *time.Time     `json:"last_purchase"`
+	MarketingConsent bool           `json:"marketing_consent" gorm:"default:true"`
+	ReferralSource   string         `json:"referral_source" gorm:"size:100"`
+	CreditLimit      float64        `json:"credit_limit" gorm:"type:decimal(12,2);default:0.00"`
+	PaymentTerms     int            `json:"payment_terms" gorm:"default:30"`
+	State            string         `json:"state" gorm:"size:100"` // Place of supply for GST
+	GSTNumber        string         `json:"gst_number" gorm:"size:15"`
+	IsActive         bool           `json:"is_active" gorm:"default:true"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
 }
 
 // 2. Customer Group Master
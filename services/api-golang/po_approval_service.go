@@ -0,0 +1,379 @@
+// PO Approval Service - Multi-level purchase order approval by branch and amount
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Purchase order statuses on the way to the vendor
+const (
+	POPendingApproval = "pending_approval"
+	POApproved        = "approved" // every step approved, not yet sent
+	PORejected        = "rejected"
+	POSent            = "sent"
+)
+
+// Actions recorded in a purchase order's approval history
+const (
+	POActionSubmitted        = "submitted"
+	POActionApproved         = "approved"
+	POActionRejected         = "rejected"
+	POActionChangesRequested = "changes_requested"
+	POActionSent             = "sent"
+)
+
+// ErrInvalidPOApproval is returned when a purchase order is not in a state
+// the approval action applies to
+var ErrInvalidPOApproval = errors.New("invalid purchase order approval")
+
+// ErrNotPOApprover is returned when the user is not the approver the
+// purchase order is waiting on
+var ErrNotPOApprover = errors.New("not the purchase order's approver")
+
+// POApprovalRule is one level of a branch's approval chain. It applies to
+// orders above MinAmount and, when MaxAmount is set, up to it; so a manager
+// rule from 0 and an owner rule from 50,000 send larger orders to the
+// manager and then the owner. Rules without a branch apply to branches that
+// have none of their own.
+type POApprovalRule struct {
+	BaseEntity
+	BranchID     *string  `gorm:"index" json:"branch_id"`
+	Level        int      `gorm:"not null" json:"level" validate:"min=1"`
+	Name         string   `gorm:"size:100" json:"name"`
+	MinAmount    float64  `gorm:"type:decimal(12,2);default:0" json:"min_amount" validate:"min=0"`
+	MaxAmount    *float64 `gorm:"type:decimal(12,2)" json:"max_amount"`
+	ApproverRole string   `gorm:"size:50" json:"approver_role"` // user role that may approve this level
+	ApproverID   *string  `gorm:"index" json:"approver_id"`     // or one named user
+}
+
+// POApprovalStep is one approval a submitted order needs, copied from the
+// rules when it was submitted so later rule changes do not move it
+type POApprovalStep struct {
+	Level        int        `json:"level"`
+	Name         string     `json:"name,omitempty"`
+	ApproverRole string     `json:"approver_role,omitempty"`
+	ApproverID   *string    `json:"approver_id,omitempty"`
+	ApprovedBy   *string    `json:"approved_by,omitempty"`
+	ApprovedAt   *time.Time `json:"approved_at,omitempty"`
+}
+
+// POApproval is an entry in a purchase order's approval history
+type POApproval struct {
+	BaseEntity
+	PurchaseOrderID string  `gorm:"not null;index" json:"purchase_order_id"`
+	Level           int     `gorm:"default:0" json:"level"`
+	Action          string  `gorm:"not null;size:20" json:"action"`
+	UserID          string  `gorm:"size:255" json:"user_id"`
+	UserRole        string  `gorm:"size:50" json:"user_role"`
+	Amount          float64 `gorm:"type:decimal(12,2)" json:"amount"` // order total at the time
+	Comments        string  `gorm:"type:text" json:"comments"`
+}
+
+// ==================== PURCHASE ORDER APPROVAL OPERATIONS ====================
+
+// SubmitPurchaseOrder sends a draft order for approval, fixing the steps it
+// needs from its branch's rules and its total. With no rules configured it
+// needs one approval from anyone.
+func (s *PurchaseService) SubmitPurchaseOrder(ctx context.Context, id, userID, role string) (*PurchaseOrder, error) {
+	var order *PurchaseOrder
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if order, err = lockOrderForApproval(tx, id); err != nil {
+			return err
+		}
+		if order.Status != "draft" {
+			return fmt.Errorf("%w: purchase order %s is %s, only drafts can be submitted", ErrInvalidPOApproval, order.PONumber, order.Status)
+		}
+
+		steps, err := approvalSteps(tx, order.BranchID, order.TotalAmount)
+		if err != nil {
+			return err
+		}
+		order.Status = POPendingApproval
+		order.ApprovalSteps = steps
+		order.ApprovalLevel = 0
+		order.ApprovedBy, order.ApprovedAt = nil, nil
+		if err := tx.Model(order).Select("status", "approval_steps", "approval_level", "approved_by", "approved_at").
+			Updates(order).Error; err != nil {
+			return err
+		}
+		return recordPOApproval(tx, order, 0, POActionSubmitted, userID, role, "")
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to submit purchase order: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "purchase_orders:*")
+	return order, nil
+}
+
+// ApprovePurchaseOrder approves the step the order is waiting on. Steps are
+// approved in order, the user who submitted the order cannot approve it and
+// one user cannot approve two steps of the same order; the order is approved
+// once the last step is.
+func (s *PurchaseService) ApprovePurchaseOrder(ctx context.Context, id, userID, role, comments string) (*PurchaseOrder, error) {
+	var order *PurchaseOrder
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if order, err = lockOrderForApproval(tx, id); err != nil {
+			return err
+		}
+		step, err := currentApprovalStep(order, userID, role)
+		if err != nil {
+			return err
+		}
+		if submitter := submittedBy(order); submitter != "" && submitter == userID {
+			return fmt.Errorf("%w: you submitted this order and cannot approve it", ErrNotPOApprover)
+		}
+		for _, earlier := range order.ApprovalSteps[:order.ApprovalLevel] {
+			if earlier.ApprovedBy != nil && *earlier.ApprovedBy == userID {
+				return fmt.Errorf("%w: you have already approved level %d of this order", ErrNotPOApprover, earlier.Level)
+			}
+		}
+
+		now := time.Now()
+		step.ApprovedBy = &userID
+		step.ApprovedAt = &now
+		order.ApprovalLevel++
+		columns := []string{"approval_steps", "approval_level"}
+		if order.ApprovalLevel == len(order.ApprovalSteps) {
+			order.Status = POApproved
+			order.ApprovedBy = &userID
+			order.ApprovedAt = &now
+			columns = append(columns, "status", "approved_by", "approved_at")
+		}
+		if err := tx.Model(order).Select(columns).Updates(order).Error; err != nil {
+			return err
+		}
+		return recordPOApproval(tx, order, step.Level, POActionApproved, userID, role, comments)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to approve purchase order: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "purchase_orders:*")
+	return order, nil
+}
+
+// RejectPurchaseOrder lets the approver the order is waiting on reject it
+// outright or, with requestChanges, send it back to draft for the buyer to
+// edit and resubmit. Either way a comment is required.
+func (s *PurchaseService) RejectPurchaseOrder(ctx context.Context, id, userID, role, comments string, requestChanges bool) (*PurchaseOrder, error) {
+	if strings.TrimSpace(comments) == "" {
+		return nil, fmt.Errorf("%w: comments are required", ErrInvalidPOApproval)
+	}
+
+	var order *PurchaseOrder
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if order, err = lockOrderForApproval(tx, id); err != nil {
+			return err
+		}
+		step, err := currentApprovalStep(order, userID, role)
+		if err != nil {
+			return err
+		}
+
+		action := POActionRejected
+		order.Status = PORejected
+		if requestChanges {
+			action = POActionChangesRequested
+			order.Status = "draft"
+			order.ApprovalSteps = nil
+			order.ApprovalLevel = 0
+		}
+		if err := tx.Model(order).Select("status", "approval_steps", "approval_level").
+			Updates(order).Error; err != nil {
+			return err
+		}
+		return recordPOApproval(tx, order, step.Level, action, userID, role, comments)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to reject purchase order: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "purchase_orders:*")
+	return order, nil
+}
+
+// SendPurchaseOrder marks a fully approved order as sent to its vendor
+func (s *PurchaseService) SendPurchaseOrder(ctx context.Context, id, userID, role string) (*PurchaseOrder, error) {
+	var order *PurchaseOrder
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if order, err = lockOrderForApproval(tx, id); err != nil {
+			return err
+		}
+		if order.Status != POApproved {
+			return fmt.Errorf("%w: purchase order %s is %s, only fully approved orders can be sent", ErrInvalidPOApproval, order.PONumber, order.Status)
+		}
+
+		order.Status = POSent
+		if err := tx.Model(order).Update("status", POSent).Error; err != nil {
+			return err
+		}
+		return recordPOApproval(tx, order, 0, POActionSent, userID, role, "")
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to send purchase order: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "purchase_orders:*")
+	return order, nil
+}
+
+// SetPOApprovalRules replaces the approval chain for a branch, or the default
+// chain when branchID is nil
+func (s *PurchaseService) SetPOApprovalRules(ctx context.Context, branchID *string, rules []POApprovalRule) ([]POApprovalRule, error) {
+	levels := make(map[int]bool, len(rules))
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Level < 1 {
+			return nil, fmt.Errorf("%w: levels start at 1", ErrInvalidPOApproval)
+		}
+		if rule.MinAmount < 0 || (rule.MaxAmount != nil && *rule.MaxAmount < rule.MinAmount) {
+			return nil, fmt.Errorf("%w: level %d has an invalid amount band", ErrInvalidPOApproval, rule.Level)
+		}
+		if strings.TrimSpace(rule.ApproverRole) == "" && rule.ApproverID == nil {
+			return nil, fmt.Errorf("%w: level %d needs an approver role or user", ErrInvalidPOApproval, rule.Level)
+		}
+		if levels[rule.Level] {
+			return nil, fmt.Errorf("%w: level %d appears twice", ErrInvalidPOApproval, rule.Level)
+		}
+		levels[rule.Level] = true
+		rule.ID = ""
+		rule.BranchID = branchID
+		rule.IsActive = true
+	}
+
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&POApprovalRule{}).Where("is_active = ?", true)
+		if branchID != nil {
+			query = query.Where("branch_id = ?", *branchID)
+		} else {
+			query = query.Where("branch_id IS NULL")
+		}
+		if err := query.Update("is_active", false).Error; err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+		return tx.Create(&rules).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save approval rules: %w", err)
+	}
+
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Level < rules[j].Level })
+	return rules, nil
+}
+
+// approvalSteps picks the branch's rules, or the default rules if the branch
+// has none, that apply to an order of the given total
+func approvalSteps(tx *gorm.DB, branchID *string, total float64) ([]POApprovalStep, error) {
+	var rules []POApprovalRule
+	if branchID != nil {
+		if err := tx.Where("branch_id = ? AND is_active = ?", *branchID, true).
+			Order("level").Find(&rules).Error; err != nil {
+			return nil, err
+		}
+	}
+	if len(rules) == 0 {
+		if err := tx.Where("branch_id IS NULL AND is_active = ?", true).
+			Order("level").Find(&rules).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	var steps []POApprovalStep
+	for _, rule := range rules {
+		if rule.MinAmount > 0 && total <= rule.MinAmount {
+			continue
+		}
+		if rule.MaxAmount != nil && total > *rule.MaxAmount {
+			continue
+		}
+		steps = append(steps, POApprovalStep{
+			Level:        rule.Level,
+			Name:         rule.Name,
+			ApproverRole: rule.ApproverRole,
+			ApproverID:   rule.ApproverID,
+		})
+	}
+	if len(steps) == 0 {
+		steps = []POApprovalStep{{Level: 1}}
+	}
+	return steps, nil
+}
+
+// currentApprovalStep is the step a pending order is waiting on, provided
+// the user may approve it
+func currentApprovalStep(order *PurchaseOrder, userID, role string) (*POApprovalStep, error) {
+	if order.Status != POPendingApproval || order.ApprovalLevel >= len(order.ApprovalSteps) {
+		return nil, fmt.Errorf("%w: purchase order %s is %s, not awaiting approval", ErrInvalidPOApproval, order.PONumber, order.Status)
+	}
+	step := &order.ApprovalSteps[order.ApprovalLevel]
+	switch {
+	case step.ApproverID != nil:
+		if *step.ApproverID != userID {
+			return nil, fmt.Errorf("%w: level %d is for a named approver", ErrNotPOApprover, step.Level)
+		}
+	case step.ApproverRole != "":
+		if !strings.EqualFold(step.ApproverRole, role) {
+			return nil, fmt.Errorf("%w: level %d needs the %s role", ErrNotPOApprover, step.Level, step.ApproverRole)
+		}
+	}
+	return step, nil
+}
+
+// submittedBy is the user who last submitted the order for approval
+func submittedBy(order *PurchaseOrder) string {
+	for i := len(order.Approvals) - 1; i >= 0; i-- {
+		if order.Approvals[i].Action == POActionSubmitted {
+			return order.Approvals[i].UserID
+		}
+	}
+	return ""
+}
+
+// recordPOApproval appends an entry to the order's approval history
+func recordPOApproval(tx *gorm.DB, order *PurchaseOrder, level int, action, userID, role, comments string) error {
+	entry := POApproval{
+		PurchaseOrderID: order.ID,
+		Level:           level,
+		Action:          action,
+		UserID:          userID,
+		UserRole:        role,
+		Amount:          order.TotalAmount,
+		Comments:        comments,
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return err
+	}
+	order.Approvals = append(order.Approvals, entry)
+	return nil
+}
+
+// lockOrderForApproval loads a purchase order FOR UPDATE with its approval history
+func lockOrderForApproval(tx *gorm.DB, id string) (*PurchaseOrder, error) {
+	var order PurchaseOrder
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Preload("Approvals", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Where("id = ? AND is_active = ?", id, true).
+		First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: purchase order not found", ErrInvalidPOApproval)
+		}
+		return nil, err
+	}
+	return &order, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for who may act on a purchase order's current approval level
+func TestCurrentApprovalStep(t *testing.T) {
+	manager := "user-manager"
+	steps := func(level int) *PurchaseOrder {
+		return &PurchaseOrder{
+			PONumber:      "PO-1",
+			Status:        POPendingApproval,
+			ApprovalLevel: level,
+			ApprovalSteps: []POApprovalStep{
+				{Level: 1, ApproverRole: "Manager"},
+				{Level: 2, ApproverID: &manager},
+				{Level: 3},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		order   *PurchaseOrder
+		userID  string
+		role    string
+		want    int
+		wantErr error
+	}{
+		{name: "role matches regardless of case", order: steps(0), userID: "user-1", role: "manager", want: 1},
+		{name: "wrong role", order: steps(0), userID: "user-1", role: "staff", wantErr: ErrNotPOApprover},
+		{name: "named approver", order: steps(1), userID: manager, role: "staff", want: 2},
+		{name: "someone else than the named approver", order: steps(1), userID: "user-1", role: "manager", wantErr: ErrNotPOApprover},
+		{name: "open step", order: steps(2), userID: "user-1", role: "staff", want: 3},
+		{name: "every level approved", order: steps(3), userID: manager, role: "manager", wantErr: ErrInvalidPOApproval},
+		{name: "not pending approval", order: &PurchaseOrder{PONumber: "PO-2", Status: "draft"}, userID: manager, role: "manager", wantErr: ErrInvalidPOApproval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := currentApprovalStep(tt.order, tt.userID, tt.role)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "want %v, got %v", tt.wantErr, err)
+				assert.Nil(t, step)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, step.Level)
+		})
+	}
+}
+
+// Table-driven tests for finding who submitted an order for approval
+func TestSubmittedBy(t *testing.T) {
+	tests := []struct {
+		name      string
+		approvals []POApproval
+		want      string
+	}{
+		{name: "never submitted", approvals: nil, want: ""},
+		{name: "submitted", approvals: []POApproval{{Action: POActionSubmitted, UserID: "user-1"}, {Action: POActionApproved, UserID: "user-2"}}, want: "user-1"},
+		{
+			name: "resubmitted after rejection",
+			approvals: []POApproval{
+				{Action: POActionSubmitted, UserID: "user-1"},
+				{Action: POActionRejected, UserID: "user-2"},
+				{Action: POActionSubmitted, UserID: "user-3"},
+			},
+			want: "user-3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, submittedBy(&PurchaseOrder{Approvals: tt.approvals}))
+		})
+	}
+}
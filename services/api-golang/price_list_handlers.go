@@ -0,0 +1,362 @@
+// Price List Handlers - price lists and their per-product lines
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// PriceListHandler manages the price lists sales-service prices bills from
+type PriceListHandler struct {
+	db    *GORMDatabase
+	cache *CacheService
+}
+
+// NewPriceListHandler creates a new price list handler
+func NewPriceListHandler(db *GORMDatabase, cache *CacheService) *PriceListHandler {
+	return &PriceListHandler{db: db, cache: cache}
+}
+
+// migratePriceLists creates the price list tables and the customer columns
+// the price resolver matches lists on. customers may have been created from
+// another Customer shape, so its columns are added directly.
+func migratePriceLists(db *gorm.DB) error {
+	if err := db.AutoMigrate(&CustomerGroup{}, &PriceLevel{}, &PriceList{}, &PriceListItem{}); err != nil {
+		return err
+	}
+	if !db.Migrator().HasTable("customers") {
+		return nil
+	}
+	return db.Exec(`
+		ALTER TABLE customers
+			ADD COLUMN IF NOT EXISTS group_id uuid,
+			ADD COLUMN IF NOT EXISTS price_level_id uuid
+	`).Error
+}
+
+// validPriceListTypes are the kinds of list the resolver understands
+var validPriceListTypes = map[string]bool{"Purchase": true, "Sale": true, "MRP": true}
+
+// validWindow reports whether an effective window is open or runs forwards
+func validWindow(from, to *time.Time) bool {
+	return from == nil || to == nil || !to.Before(*from)
+}
+
+// ==================== PRICE LIST HANDLERS ====================
+
+// GetPriceLists retrieves price lists, optionally by type, branch or customer group
+func (h *PriceListHandler) GetPriceLists(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var lists []PriceList
+	var total int64
+
+	query := h.db.DB.WithContext(ctx).Model(&PriceList{}).Where("is_active = ?", true)
+
+	if listType := c.Query("type"); listType != "" {
+		query = query.Where("type = ?", listType)
+	}
+	if branchID := c.Query("branch_id"); branchID != "" {
+		query = query.Where("branch_id = ?", branchID)
+	}
+	if groupID := c.Query("customer_group_id"); groupID != "" {
+		query = query.Where("customer_group_id = ?", groupID)
+	}
+
+	// Pagination
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count price lists"})
+		return
+	}
+
+	if err := query.Limit(limit).Offset(offset).Order("priority DESC, name").Find(&lists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve price lists"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"price_lists": lists,
+		"total":       total,
+		"limit":       limit,
+		"offset":      offset,
+	})
+}
+
+// GetPriceList retrieves a price list with its active lines
+func (h *PriceListHandler) GetPriceList(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var list PriceList
+	if err := h.db.DB.WithContext(ctx).
+		Preload("Items", "is_active = ?", true).
+		Where("id = ? AND is_active = ?", c.Param("id"), true).
+		First(&list).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve price list"})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// CreatePriceList creates a price list, with its lines if any are given
+func (h *PriceListHandler) CreatePriceList(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var list PriceList
+	if err := c.ShouldBindJSON(&list); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if msg := checkPriceList(&list); msg != "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": msg})
+		return
+	}
+	for i := range list.Items {
+		if msg := checkPriceListItem(&list.Items[i]); msg != "" {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": msg})
+			return
+		}
+		list.Items[i].IsActive = true
+	}
+
+	// Set default values
+	list.IsActive = true
+
+	if err := h.db.DB.WithContext(ctx).Create(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create price list"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, list)
+}
+
+// UpdatePriceList updates a price list's header; lines have their own routes
+func (h *PriceListHandler) UpdatePriceList(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var list PriceList
+	if err := h.db.DB.WithContext(ctx).Where("id = ? AND is_active = ?", c.Param("id"), true).First(&list).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve price list"})
+		return
+	}
+
+	var updateData PriceList
+	if err := c.ShouldBindJSON(&updateData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Update fields
+	list.Name = updateData.Name
+	list.Description = updateData.Description
+	list.Type = updateData.Type
+	list.CurrencyID = updateData.CurrencyID
+	list.CustomerGroupID = updateData.CustomerGroupID
+	list.PriceLevelID = updateData.PriceLevelID
+	list.BranchID = updateData.BranchID
+	list.Priority = updateData.Priority
+	list.PricesIncludeTax = updateData.PricesIncludeTax
+	list.EffectiveFrom = updateData.EffectiveFrom
+	list.EffectiveTo = updateData.EffectiveTo
+	if msg := checkPriceList(&list); msg != "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": msg})
+		return
+	}
+
+	if err := h.db.DB.WithContext(ctx).Omit("Items").Save(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update price list"})
+		return
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+// DeletePriceList deactivates a price list so the resolver stops using it
+func (h *PriceListHandler) DeletePriceList(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	result := h.db.DB.WithContext(ctx).Model(&PriceList{}).
+		Where("id = ? AND is_active = ?", c.Param("id"), true).
+		Update("is_active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete price list"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Price list deleted successfully"})
+}
+
+// ==================== PRICE LIST LINE HANDLERS ====================
+
+// GetPriceListItems retrieves the active lines of a price list
+func (h *PriceListHandler) GetPriceListItems(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var items []PriceListItem
+	query := h.db.DB.WithContext(ctx).Where("price_list_id = ? AND is_active = ?", c.Param("id"), true)
+	if productID := c.Query("product_id"); productID != "" {
+		query = query.Where("product_id = ?", productID)
+	}
+
+	if err := query.Order("product_id, effective_from DESC NULLS LAST").Find(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve price list lines"})
+		return
+	}
+
+	c.JSON(http.StatusOK, items)
+}
+
+// CreatePriceListItem adds a product rate to a price list
+func (h *PriceListHandler) CreatePriceListItem(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var count int64
+	if err := h.db.DB.WithContext(ctx).Model(&PriceList{}).
+		Where("id = ? AND is_active = ?", c.Param("id"), true).
+		Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve price list"})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price list not found"})
+		return
+	}
+
+	var item PriceListItem
+	if err := c.ShouldBindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if msg := checkPriceListItem(&item); msg != "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": msg})
+		return
+	}
+
+	item.ID = ""
+	item.PriceListID = c.Param("id")
+	item.IsActive = true
+
+	if err := h.db.DB.WithContext(ctx).Create(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create price list line"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, item)
+}
+
+// UpdatePriceListItem changes a line's rate, size or validity window
+func (h *PriceListHandler) UpdatePriceListItem(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var item PriceListItem
+	if err := h.db.DB.WithContext(ctx).
+		Where("id = ? AND price_list_id = ? AND is_active = ?", c.Param("item_id"), c.Param("id"), true).
+		First(&item).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Price list line not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve price list line"})
+		return
+	}
+
+	var updateData PriceListItem
+	if err := c.ShouldBindJSON(&updateData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Update fields
+	item.ProductID = updateData.ProductID
+	item.SizeID = updateData.SizeID
+	item.Price = updateData.Price
+	item.EffectiveFrom = updateData.EffectiveFrom
+	item.EffectiveTo = updateData.EffectiveTo
+	if msg := checkPriceListItem(&item); msg != "" {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": msg})
+		return
+	}
+
+	if err := h.db.DB.WithContext(ctx).Save(&item).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update price list line"})
+		return
+	}
+
+	c.JSON(http.StatusOK, item)
+}
+
+// DeletePriceListItem deactivates one line of a price list
+func (h *PriceListHandler) DeletePriceListItem(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	result := h.db.DB.WithContext(ctx).Model(&PriceListItem{}).
+		Where("id = ? AND price_list_id = ? AND is_active = ?", c.Param("item_id"), c.Param("id"), true).
+		Update("is_active", false)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete price list line"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Price list line not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Price list line deleted successfully"})
+}
+
+// checkPriceList returns why a price list header cannot be saved, if it cannot
+func checkPriceList(list *PriceList) string {
+	switch {
+	case list.Code == "" || list.Name == "":
+		return "code and name are required"
+	case !validPriceListTypes[list.Type]:
+		return "type must be Purchase, Sale or MRP"
+	case list.CurrencyID == "":
+		return "currency_id is required"
+	case !validWindow(list.EffectiveFrom, list.EffectiveTo):
+		return "effective_to is before effective_from"
+	}
+	return ""
+}
+
+// checkPriceListItem returns why a price list line cannot be saved, if it cannot
+func checkPriceListItem(item *PriceListItem) string {
+	switch {
+	case item.ProductID == "":
+		return "product_id is required"
+	case item.Price < 0:
+		return "price cannot be negative"
+	case !validWindow(item.EffectiveFrom, item.EffectiveTo):
+		return "effective_to is before effective_from"
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for price list validation
+func TestCheckPriceList(t *testing.T) {
+	from := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	before := from.AddDate(0, 0, -1)
+	after := from.AddDate(0, 3, 0)
+
+	valid := func() PriceList {
+		return PriceList{Code: "DOC", Name: "Doctor rates", Type: "Sale", CurrencyID: "inr"}
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(*PriceList)
+		wantErr string
+	}{
+		{name: "valid list", mutate: func(*PriceList) {}},
+		{name: "open ended window", mutate: func(l *PriceList) { l.EffectiveFrom = &from }},
+		{name: "forward window", mutate: func(l *PriceList) { l.EffectiveFrom, l.EffectiveTo = &from, &after }},
+		{name: "missing code", mutate: func(l *PriceList) { l.Code = "" }, wantErr: "code and name are required"},
+		{name: "unknown type", mutate: func(l *PriceList) { l.Type = "Wholesale" }, wantErr: "type must be Purchase, Sale or MRP"},
+		{name: "missing currency", mutate: func(l *PriceList) { l.CurrencyID = "" }, wantErr: "currency_id is required"},
+		{name: "backward window", mutate: func(l *PriceList) { l.EffectiveFrom, l.EffectiveTo = &from, &before }, wantErr: "effective_to is before effective_from"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := valid()
+			tt.mutate(&list)
+			assert.Equal(t, tt.wantErr, checkPriceList(&list))
+		})
+	}
+}
+
+// Table-driven tests for price list line validation
+func TestCheckPriceListItem(t *testing.T) {
+	from := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	before := from.AddDate(0, 0, -1)
+
+	tests := []struct {
+		name    string
+		item    PriceListItem
+		wantErr string
+	}{
+		{name: "valid line", item: PriceListItem{ProductID: "arnica-30c", Price: 85}},
+		{name: "free line", item: PriceListItem{ProductID: "arnica-30c", Price: 0}},
+		{name: "missing product", item: PriceListItem{Price: 85}, wantErr: "product_id is required"},
+		{name: "negative price", item: PriceListItem{ProductID: "arnica-30c", Price: -1}, wantErr: "price cannot be negative"},
+		{name: "backward window", item: PriceListItem{ProductID: "arnica-30c", Price: 85, EffectiveFrom: &from, EffectiveTo: &before}, wantErr: "effective_to is before effective_from"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantErr, checkPriceListItem(&tt.item))
+		})
+	}
+}
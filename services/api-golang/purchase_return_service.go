@@ -0,0 +1,454 @@
+// Purchase Return Service - Stock sent back to vendors and the debit notes raised for it
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/yeelo/homeopathy-platform/shared-go/gst"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Purchase return reasons
+const (
+	PurchaseReturnExpired   = "EXPIRED"
+	PurchaseReturnBreakage  = "BREAKAGE"
+	PurchaseReturnWrongItem = "WRONG_ITEM"
+	PurchaseReturnOther     = "OTHER"
+)
+
+// PurchaseReturnPosted is the status of a return once its stock has gone out
+const PurchaseReturnPosted = "posted"
+
+// Debit note statuses
+const (
+	DebitNoteOpen    = "open"
+	DebitNotePartial = "partial"
+	DebitNoteClosed  = "closed"
+)
+
+// ErrInvalidPurchaseReturn is returned when a return does not match what was received
+var ErrInvalidPurchaseReturn = errors.New("invalid purchase return")
+
+// PurchaseReturn sends stock received on a GRN back to the vendor. Posting it
+// takes the quantities out of their batches and raises a debit note.
+type PurchaseReturn struct {
+	BaseEntity
+	ReturnNumber string               `gorm:"uniqueIndex;not null;size:50" json:"return_number"`
+	GRNID        string               `gorm:"not null;index" json:"grn_id" validate:"required"`
+	VendorID     string               `gorm:"not null;index" json:"vendor_id"`
+	Vendor       Vendor               `gorm:"foreignKey:VendorID" json:"vendor,omitempty"`
+	ShopID       string               `gorm:"not null;index" json:"shop_id"`
+	ReturnDate   time.Time            `gorm:"not null" json:"return_date"`
+	ReasonID     *string              `gorm:"index" json:"reason_id"` // PurchaseReturnReason master
+	SupplyType   string               `gorm:"size:20" json:"supply_type"`
+	SubTotal     float64              `gorm:"type:decimal(12,2);default:0" json:"sub_total"`
+	CGSTAmount   float64              `gorm:"type:decimal(12,2);default:0" json:"cgst_amount"`
+	SGSTAmount   float64              `gorm:"type:decimal(12,2);default:0" json:"sgst_amount"`
+	IGSTAmount   float64              `gorm:"type:decimal(12,2);default:0" json:"igst_amount"`
+	TaxAmount    float64              `gorm:"type:decimal(12,2);default:0" json:"tax_amount"`
+	TotalAmount  float64              `gorm:"type:decimal(12,2);default:0" json:"total_amount"`
+	Status       string               `gorm:"not null;default:posted;size:20" json:"status"`
+	Notes        string               `gorm:"type:text" json:"notes"`
+	CreatedBy    string               `gorm:"size:255" json:"created_by"`
+	Items        []PurchaseReturnItem `gorm:"foreignKey:PurchaseReturnID" json:"items"`
+	DebitNote    *DebitNote           `gorm:"foreignKey:PurchaseReturnID" json:"debit_note,omitempty"`
+}
+
+// PurchaseReturnItem is part of one GRN line going back, from the batch it was
+// received into. Price and tax rate are the GRN's.
+type PurchaseReturnItem struct {
+	BaseEntity
+	PurchaseReturnID string  `gorm:"not null;index" json:"purchase_return_id"`
+	GRNItemID        string  `gorm:"not null;index" json:"grn_item_id" validate:"required"`
+	ProductID        string  `gorm:"not null;index" json:"product_id"`
+	BatchID          *string `gorm:"index" json:"batch_id"`
+	BatchNumber      string  `gorm:"size:50" json:"batch_number"`
+	Reason           string  `gorm:"not null;size:20" json:"reason" validate:"oneof=EXPIRED BREAKAGE WRONG_ITEM OTHER"`
+	Quantity         int     `gorm:"not null" json:"quantity" validate:"min=1"`
+	UnitPrice        float64 `gorm:"type:decimal(10,2);default:0" json:"unit_price"`
+	TaxPercent       float64 `gorm:"type:decimal(5,2);default:0" json:"tax_percent"`
+	TaxableValue     float64 `gorm:"type:decimal(12,2);default:0" json:"taxable_value"`
+	CGSTAmount       float64 `gorm:"type:decimal(12,2);default:0" json:"cgst_amount"`
+	SGSTAmount       float64 `gorm:"type:decimal(12,2);default:0" json:"sgst_amount"`
+	IGSTAmount       float64 `gorm:"type:decimal(12,2);default:0" json:"igst_amount"`
+	TaxAmount        float64 `gorm:"type:decimal(12,2);default:0" json:"tax_amount"`
+	TotalAmount      float64 `gorm:"type:decimal(12,2);default:0" json:"total_amount"`
+}
+
+// DebitNote is what the vendor owes back for a purchase return. Its balance
+// is set off against the vendor's approved invoices; what cannot be set off
+// yet stays open for the next one. Its tax is input credit reversed.
+type DebitNote struct {
+	BaseEntity
+	DebitNoteNumber  string                `gorm:"uniqueIndex;not null;size:50" json:"debit_note_number"`
+	PurchaseReturnID string                `gorm:"uniqueIndex;not null" json:"purchase_return_id"`
+	VendorID         string                `gorm:"not null;index" json:"vendor_id"`
+	GRNID            string                `gorm:"not null;index" json:"grn_id"`
+	IssueDate        time.Time             `gorm:"not null;index" json:"issue_date"`
+	TaxableValue     float64               `gorm:"type:decimal(12,2);default:0" json:"taxable_value"`
+	CGSTAmount       float64               `gorm:"type:decimal(12,2);default:0" json:"cgst_amount"`
+	SGSTAmount       float64               `gorm:"type:decimal(12,2);default:0" json:"sgst_amount"`
+	IGSTAmount       float64               `gorm:"type:decimal(12,2);default:0" json:"igst_amount"`
+	TaxAmount        float64               `gorm:"type:decimal(12,2);default:0" json:"tax_amount"`
+	Amount           float64               `gorm:"type:decimal(12,2);not null" json:"amount"`
+	Balance          float64               `gorm:"type:decimal(12,2);not null" json:"balance"`
+	Status           string                `gorm:"not null;default:open;size:20;index" json:"status" validate:"oneof=open partial closed"`
+	Adjustments      []DebitNoteAdjustment `gorm:"foreignKey:DebitNoteID" json:"adjustments,omitempty"`
+}
+
+// DebitNoteAdjustment sets part of a debit note off against a vendor invoice
+type DebitNoteAdjustment struct {
+	BaseEntity
+	DebitNoteID     string  `gorm:"not null;index" json:"debit_note_id"`
+	VendorInvoiceID string  `gorm:"not null;index" json:"vendor_invoice_id"`
+	Amount          float64 `gorm:"type:decimal(12,2);not null" json:"amount"`
+	CreatedBy       string  `gorm:"size:255" json:"created_by"`
+}
+
+// VendorPayable is what is owed to a vendor after debit notes
+type VendorPayable struct {
+	VendorID       string  `json:"vendor_id"`
+	InvoiceBalance float64 `json:"invoice_balance"`  // approved invoices not yet paid or set off
+	OpenDebitNotes float64 `json:"open_debit_notes"` // debit notes not yet set off
+	NetPayable     float64 `json:"net_payable"`
+}
+
+// ==================== PURCHASE RETURN OPERATIONS ====================
+
+// CreatePurchaseReturn posts a return against a GRN. In one transaction it
+// draws each line out of its batch, writes OUT movements (consuming the
+// GRN's cost layer first), raises a numbered debit note and sets it off
+// against the vendor's open invoices.
+func (s *PurchaseService) CreatePurchaseReturn(ctx context.Context, ret *PurchaseReturn) (*PurchaseReturn, error) {
+	if len(ret.Items) == 0 {
+		return nil, fmt.Errorf("%w: at least one item is required", ErrInvalidPurchaseReturn)
+	}
+	if ret.ReturnDate.IsZero() {
+		ret.ReturnDate = time.Now()
+	}
+
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var grn GRN
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND is_active = ?", ret.GRNID, true).
+			First(&grn).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: GRN not found", ErrInvalidPurchaseReturn)
+			}
+			return err
+		}
+		if grn.Status != GRNPosted {
+			return fmt.Errorf("%w: GRN %s is %s, only posted GRNs can be returned against", ErrInvalidPurchaseReturn, grn.GRNNumber, grn.Status)
+		}
+		if err := tx.Where("grn_id = ?", grn.ID).Find(&grn.Items).Error; err != nil {
+			return err
+		}
+		received := make(map[string]*GRNItem, len(grn.Items))
+		for i := range grn.Items {
+			received[grn.Items[i].ID] = &grn.Items[i]
+		}
+
+		returned, err := returnedAgainstGRN(tx, grn.ID)
+		if err != nil {
+			return err
+		}
+
+		ret.ID = ""
+		ret.VendorID = grn.VendorID
+		ret.ShopID = grn.ShopID
+		ret.Status = PurchaseReturnPosted
+		if ret.SupplyType, err = purchaseSupplyType(tx, grn.VendorID, grn.ShopID); err != nil {
+			return err
+		}
+		if ret.ReturnNumber, err = nextDailyNumber(tx, &PurchaseReturn{}, "return_number", "PR", ret.ReturnDate); err != nil {
+			return err
+		}
+
+		for i := range ret.Items {
+			item := &ret.Items[i]
+			source, ok := received[item.GRNItemID]
+			if !ok {
+				return fmt.Errorf("%w: item %s is not on GRN %s", ErrInvalidPurchaseReturn, item.GRNItemID, grn.GRNNumber)
+			}
+			item.Reason = strings.ToUpper(strings.TrimSpace(item.Reason))
+			switch item.Reason {
+			case PurchaseReturnExpired, PurchaseReturnBreakage, PurchaseReturnWrongItem, PurchaseReturnOther:
+			default:
+				return fmt.Errorf("%w: reason must be EXPIRED, BREAKAGE, WRONG_ITEM or OTHER", ErrInvalidPurchaseReturn)
+			}
+			if item.Quantity <= 0 {
+				return fmt.Errorf("%w: quantities must be positive", ErrInvalidPurchaseReturn)
+			}
+			if left := source.AcceptedQuantity - returned[source.ID]; item.Quantity > left {
+				return fmt.Errorf("%w: only %d of batch %s left to return", ErrInvalidPurchaseReturn, left, source.BatchNumber)
+			}
+			returned[source.ID] += item.Quantity
+
+			item.ID = ""
+			item.ProductID = source.ProductID
+			item.BatchID = source.BatchID
+			item.BatchNumber = source.BatchNumber
+			item.UnitPrice = source.UnitPrice
+			item.TaxPercent = source.TaxPercent
+			priceReturnLine(item, ret.SupplyType)
+
+			ret.SubTotal += item.TaxableValue
+			ret.CGSTAmount += item.CGSTAmount
+			ret.SGSTAmount += item.SGSTAmount
+			ret.IGSTAmount += item.IGSTAmount
+		}
+		ret.SubTotal = roundPaise(ret.SubTotal)
+		ret.CGSTAmount = roundPaise(ret.CGSTAmount)
+		ret.SGSTAmount = roundPaise(ret.SGSTAmount)
+		ret.IGSTAmount = roundPaise(ret.IGSTAmount)
+		ret.TaxAmount = roundPaise(ret.CGSTAmount + ret.SGSTAmount + ret.IGSTAmount)
+		ret.TotalAmount = roundPaise(ret.SubTotal + ret.TaxAmount)
+
+		ret.DebitNote = nil
+		if err := tx.Create(ret).Error; err != nil {
+			return err
+		}
+
+		for i := range ret.Items {
+			if err := returnToVendor(tx, ret, &ret.Items[i]); err != nil {
+				return err
+			}
+		}
+
+		debitNote := &DebitNote{
+			PurchaseReturnID: ret.ID,
+			VendorID:         ret.VendorID,
+			GRNID:            ret.GRNID,
+			IssueDate:        ret.ReturnDate,
+			TaxableValue:     ret.SubTotal,
+			CGSTAmount:       ret.CGSTAmount,
+			SGSTAmount:       ret.SGSTAmount,
+			IGSTAmount:       ret.IGSTAmount,
+			TaxAmount:        ret.TaxAmount,
+			Amount:           ret.TotalAmount,
+			Balance:          ret.TotalAmount,
+			Status:           DebitNoteOpen,
+		}
+		if debitNote.DebitNoteNumber, err = nextDailyNumber(tx, &DebitNote{}, "debit_note_number", "DN", ret.ReturnDate); err != nil {
+			return err
+		}
+		if err := tx.Create(debitNote).Error; err != nil {
+			return err
+		}
+		ret.DebitNote = debitNote
+
+		return setOffDebitNotes(tx, ret.VendorID, grn.PurchaseOrderID, ret.CreatedBy)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create purchase return: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "purchase_returns:*")
+	s.cache.DeletePattern(ctx, "vendor_invoices:*")
+
+	if err := s.db.DB.WithContext(ctx).Preload("Adjustments").First(ret.DebitNote, "id = ?", ret.DebitNote.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to get debit note: %w", err)
+	}
+	return ret, nil
+}
+
+// GetVendorPayable works out what is owed to a vendor once debit notes are
+// taken off
+func (s *PurchaseService) GetVendorPayable(ctx context.Context, vendorID string) (*VendorPayable, error) {
+	payable := &VendorPayable{VendorID: vendorID}
+	db := s.db.DB.WithContext(ctx)
+
+	if err := db.Model(&VendorInvoice{}).
+		Where("vendor_id = ? AND status = ? AND is_active = ?", vendorID, VendorInvoiceConfirmed, true).
+		Select("COALESCE(SUM(balance_amount), 0)").
+		Scan(&payable.InvoiceBalance).Error; err != nil {
+		return nil, fmt.Errorf("failed to total vendor invoices: %w", err)
+	}
+	if err := db.Model(&DebitNote{}).
+		Where("vendor_id = ? AND status <> ? AND is_active = ?", vendorID, DebitNoteClosed, true).
+		Select("COALESCE(SUM(balance), 0)").
+		Scan(&payable.OpenDebitNotes).Error; err != nil {
+		return nil, fmt.Errorf("failed to total debit notes: %w", err)
+	}
+
+	payable.InvoiceBalance = roundPaise(payable.InvoiceBalance)
+	payable.OpenDebitNotes = roundPaise(payable.OpenDebitNotes)
+	payable.NetPayable = roundPaise(payable.InvoiceBalance - payable.OpenDebitNotes)
+	return payable, nil
+}
+
+// returnToVendor takes a returned line out of its batch and the shop's stock
+func returnToVendor(tx *gorm.DB, ret *PurchaseReturn, item *PurchaseReturnItem) error {
+	qty := float64(item.Quantity)
+
+	if item.BatchID != nil {
+		var batches []struct {
+			ID       string
+			Quantity float64
+		}
+		if err := tx.Table("batches").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id, quantity").
+			Where("id = ?", *item.BatchID).
+			Find(&batches).Error; err != nil {
+			return err
+		}
+		if len(batches) == 0 {
+			return fmt.Errorf("%w: batch %s not found", ErrInvalidPurchaseReturn, item.BatchNumber)
+		}
+		if batches[0].Quantity < qty {
+			return fmt.Errorf("%w: batch %s has only %.0f left", ErrInsufficientStock, item.BatchNumber, batches[0].Quantity)
+		}
+		if err := tx.Table("batches").Where("id = ?", *item.BatchID).Updates(map[string]interface{}{
+			"quantity":   gorm.Expr("quantity - ?", qty),
+			"updated_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	// The stock goes back at what its GRN brought it in at; anything the
+	// GRN's layer no longer holds is costed at the GRN price
+	_, err := ledger.Post(tx, &ledger.StockMovement{
+		ProductID:      item.ProductID,
+		ShopID:         ret.ShopID,
+		MovementType:   "OUT",
+		Quantity:       -qty,
+		Reason:         item.Reason + " " + ret.ReturnNumber,
+		ReferenceType:  "PURCHASE_RETURN",
+		ReferenceID:    ret.ID,
+		BatchID:        item.BatchID,
+		CreatedBy:      ret.CreatedBy,
+		UnitCost:       item.UnitPrice,
+		CostSourceType: "GRN",
+		CostSourceID:   ret.GRNID,
+	})
+	return err
+}
+
+// setOffDebitNotes sets the vendor's open debit notes off against its
+// approved invoices that still have a balance, oldest first. Invoices for
+// purchaseOrderID, when given, are taken before the rest.
+func setOffDebitNotes(tx *gorm.DB, vendorID string, purchaseOrderID *string, by string) error {
+	var notes []DebitNote
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("vendor_id = ? AND status <> ? AND balance > 0 AND is_active = ?", vendorID, DebitNoteClosed, true).
+		Order("issue_date, created_at").
+		Find(&notes).Error; err != nil {
+		return err
+	}
+	if len(notes) == 0 {
+		return nil
+	}
+
+	query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("vendor_id = ? AND status = ? AND balance_amount > 0 AND is_active = ?", vendorID, VendorInvoiceConfirmed, true)
+	if purchaseOrderID != nil {
+		query = query.Order(clause.Expr{SQL: "purchase_order_id = ? DESC NULLS LAST", Vars: []interface{}{*purchaseOrderID}})
+	}
+	var invoices []VendorInvoice
+	if err := query.Order("invoice_date, created_at").Find(&invoices).Error; err != nil {
+		return err
+	}
+
+	n := 0
+	for i := range invoices {
+		invoice := &invoices[i]
+		for invoice.BalanceAmount > 0 && n < len(notes) {
+			note := &notes[n]
+			amount := roundPaise(math.Min(note.Balance, invoice.BalanceAmount))
+
+			if err := tx.Create(&DebitNoteAdjustment{
+				DebitNoteID:     note.ID,
+				VendorInvoiceID: invoice.ID,
+				Amount:          amount,
+				CreatedBy:       by,
+			}).Error; err != nil {
+				return err
+			}
+
+			note.Balance = roundPaise(note.Balance - amount)
+			invoice.BalanceAmount = roundPaise(invoice.BalanceAmount - amount)
+			invoice.DebitNoteAmount = roundPaise(invoice.DebitNoteAmount + amount)
+
+			status := DebitNotePartial
+			if note.Balance <= 0 {
+				status = DebitNoteClosed
+				n++
+			}
+			if err := tx.Model(note).Updates(map[string]interface{}{"balance": note.Balance, "status": status}).Error; err != nil {
+				return err
+			}
+		}
+
+		paymentStatus := "partial_paid"
+		if invoice.BalanceAmount <= 0 {
+			paymentStatus = "paid"
+		}
+		if err := tx.Model(invoice).Updates(map[string]interface{}{
+			"balance_amount":    invoice.BalanceAmount,
+			"debit_note_amount": invoice.DebitNoteAmount,
+			"payment_status":    paymentStatus,
+		}).Error; err != nil {
+			return err
+		}
+		if n == len(notes) {
+			break
+		}
+	}
+	return nil
+}
+
+// returnedAgainstGRN is what has already gone back per GRN line
+func returnedAgainstGRN(tx *gorm.DB, grnID string) (map[string]int, error) {
+	var rows []struct {
+		GRNItemID string
+		Quantity  int
+	}
+	if err := tx.Raw(`
+		SELECT pri.grn_item_id, SUM(pri.quantity) AS quantity
+		FROM purchase_return_items pri
+		JOIN purchase_returns pr ON pr.id = pri.purchase_return_id
+		WHERE pr.grn_id = ? AND pr.is_active = true AND pri.is_active = true
+		GROUP BY pri.grn_item_id
+	`, grnID).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	returned := make(map[string]int, len(rows))
+	for _, row := range rows {
+		returned[row.GRNItemID] = row.Quantity
+	}
+	return returned, nil
+}
+
+// purchaseSupplyType is inter-state when the vendor and the receiving shop's
+// branch are in different states
+func purchaseSupplyType(tx *gorm.DB, vendorID, shopID string) (string, error) {
+	vendorState, err := gst.State(tx, "vendors", vendorID)
+	if err != nil {
+		return "", err
+	}
+	shopState, err := gst.State(tx, "branches", shopID)
+	if err != nil {
+		return "", err
+	}
+	return gst.SupplyType(vendorState, shopState), nil
+}
+
+// priceReturnLine values a returned line at its GRN price and splits the tax
+func priceReturnLine(item *PurchaseReturnItem, supplyType string) {
+	line := gst.ComputeLine(float64(item.Quantity)*item.UnitPrice, item.TaxPercent, false, supplyType)
+	item.TaxableValue = line.TaxableValue
+	item.CGSTAmount = line.CGSTAmount
+	item.SGSTAmount = line.SGSTAmount
+	item.IGSTAmount = line.IGSTAmount
+	item.TaxAmount = line.TaxAmount
+	item.TotalAmount = line.Total
+}
@@ -0,0 +1,395 @@
+// Purchase Service - Goods receipts and the stock they bring in
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GRN statuses
+const (
+	GRNDraft     = "draft"
+	GRNPosted    = "posted"
+	GRNCancelled = "cancelled"
+)
+
+// Purchase order statuses derived from what has been received
+const (
+	POPartiallyReceived = "partially_received"
+	POClosed            = "closed"
+)
+
+// ErrInvalidGRN is returned when a goods receipt cannot be posted as sent
+var ErrInvalidGRN = errors.New("invalid GRN")
+
+// ErrInsufficientStock is returned when stock going out would leave a shop
+// or batch below zero. It is the shared ledger's, so shortfalls the ledger
+// finds are reported the same way.
+var ErrInsufficientStock = ledger.ErrInsufficientStock
+
+// GRN is a goods receipt note. It is saved as a draft and only brings stock
+// in when posted; a purchase order can be received over several GRNs.
+type GRN struct {
+	BaseEntity
+	GRNNumber       string     `gorm:"uniqueIndex;not null;size:50" json:"grn_number"`
+	PurchaseOrderID *string    `gorm:"index" json:"purchase_order_id"`
+	VendorID        string     `gorm:"not null;index" json:"vendor_id" validate:"required"`
+	Vendor          Vendor     `gorm:"foreignKey:VendorID" json:"vendor,omitempty"`
+	ShopID          string     `gorm:"not null;index" json:"shop_id" validate:"required"` // shop the stock is received into
+	ReceivedDate    time.Time  `gorm:"not null" json:"received_date"`
+	VendorInvoiceNo string     `gorm:"size:100" json:"vendor_invoice_no"`
+	Status          string     `gorm:"not null;default:draft;size:20;index" json:"status" validate:"oneof=draft posted cancelled"`
+	TotalQuantity   int        `gorm:"default:0" json:"total_quantity"`
+	TotalAmount     float64    `gorm:"type:decimal(12,2);default:0.00" json:"total_amount"`
+	Notes           string     `gorm:"type:text" json:"notes"`
+	CreatedBy       string     `gorm:"size:255" json:"created_by"`
+	PostedBy        string     `gorm:"size:255" json:"posted_by"`
+	PostedAt        *time.Time `json:"posted_at"`
+	Items           []GRNItem  `gorm:"foreignKey:GRNID" json:"items"`
+}
+
+// GRNItem is one batch of a product received on a GRN. Rejected quantity is
+// recorded but never stocked.
+type GRNItem struct {
+	BaseEntity
+	GRNID               string     `gorm:"not null;index" json:"grn_id"`
+	PurchaseOrderItemID *string    `gorm:"index" json:"purchase_order_item_id"`
+	ProductID           string     `gorm:"not null;index" json:"product_id" validate:"required"`
+	Product             Product    `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+	BatchNumber         string     `gorm:"not null;size:50" json:"batch_number" validate:"required"`
+	MfgDate             *time.Time `json:"mfg_date"`
+	ExpiryDate          *time.Time `json:"expiry_date"`
+	ReceivedQuantity    int        `gorm:"default:0" json:"received_quantity"`
+	AcceptedQuantity    int        `gorm:"default:0" json:"accepted_quantity"`
+	RejectedQuantity    int        `gorm:"default:0" json:"rejected_quantity"`
+	UnitPrice           float64    `gorm:"type:decimal(10,2);not null;default:0" json:"unit_price"` // purchase price per unit
+	MRP                 float64    `gorm:"type:decimal(10,2);default:0" json:"mrp"`
+	TaxPercent          float64    `gorm:"type:decimal(5,2);default:0" json:"tax_percent"`
+	TotalAmount         float64    `gorm:"type:decimal(12,2);default:0" json:"total_amount"`
+	BatchID             *string    `gorm:"index" json:"batch_id"`                           // set when posted
+	LandedCost          float64    `gorm:"type:decimal(12,2);default:0" json:"landed_cost"` // charges allocated by landed cost vouchers
+}
+
+// ==================== PURCHASE SERVICE ====================
+
+type PurchaseService struct {
+	db    *GORMDatabase
+	cache *CacheService
+}
+
+func NewPurchaseService(db *GORMDatabase, cache *CacheService) *PurchaseService {
+	return &PurchaseService{db: db, cache: cache}
+}
+
+// ==================== GRN OPERATIONS ====================
+
+// CreateGRN saves a draft GRN. Nothing is stocked until it is posted.
+func (s *PurchaseService) CreateGRN(ctx context.Context, grn *GRN) (*GRN, error) {
+	if len(grn.Items) == 0 {
+		return nil, fmt.Errorf("%w: at least one item is required", ErrInvalidGRN)
+	}
+	if grn.ReceivedDate.IsZero() {
+		grn.ReceivedDate = time.Now()
+	}
+	grn.Status = GRNDraft
+	grn.PostedBy, grn.PostedAt = "", nil
+	totalGRN(grn)
+
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if grn.GRNNumber == "" {
+			number, err := nextGRNNumber(tx, grn.ReceivedDate)
+			if err != nil {
+				return err
+			}
+			grn.GRNNumber = number
+		}
+		return tx.Create(grn).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GRN: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "grn:*")
+	return grn, nil
+}
+
+// PostGRN brings a draft GRN's accepted quantities into stock. In one
+// transaction it creates or tops up each batch with its expiry, MRP and
+// purchase price, credits the shop's stock, writes an IN movement (with its
+// cost layer and outbox event, as inventory-service would), adds the
+// quantities to the purchase order lines and derives the order's status.
+// A line may not take a PO line past what was ordered.
+func (s *PurchaseService) PostGRN(ctx context.Context, id, postedBy string) (*GRN, error) {
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var grn GRN
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND is_active = ?", id, true).
+			First(&grn).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: GRN not found", ErrInvalidGRN)
+			}
+			return err
+		}
+		if grn.Status != GRNDraft {
+			return fmt.Errorf("%w: GRN %s is already %s", ErrInvalidGRN, grn.GRNNumber, grn.Status)
+		}
+		if grn.ShopID == "" {
+			return fmt.Errorf("%w: shop_id is required to post", ErrInvalidGRN)
+		}
+		if err := tx.Where("grn_id = ?", grn.ID).Find(&grn.Items).Error; err != nil {
+			return err
+		}
+
+		var order *PurchaseOrder
+		if grn.PurchaseOrderID != nil {
+			var err error
+			if order, err = lockPurchaseOrder(tx, *grn.PurchaseOrderID); err != nil {
+				return err
+			}
+			if order.VendorID != grn.VendorID {
+				return fmt.Errorf("%w: purchase order %s is from a different vendor", ErrInvalidGRN, order.PONumber)
+			}
+		}
+
+		for i := range grn.Items {
+			item := &grn.Items[i]
+			if item.AcceptedQuantity <= 0 {
+				continue
+			}
+			if item.ExpiryDate == nil {
+				return fmt.Errorf("%w: batch %s needs an expiry date", ErrInvalidGRN, item.BatchNumber)
+			}
+			if order != nil {
+				if err := receiveAgainstOrder(order, item); err != nil {
+					return err
+				}
+			}
+
+			batchID, err := receiveBatch(tx, item)
+			if err != nil {
+				return err
+			}
+			item.BatchID = &batchID
+			if err := tx.Model(item).Updates(map[string]interface{}{
+				"batch_id":               batchID,
+				"purchase_order_item_id": item.PurchaseOrderItemID,
+			}).Error; err != nil {
+				return err
+			}
+
+			if err := stockIn(tx, &grn, item, postedBy); err != nil {
+				return err
+			}
+		}
+
+		if order != nil {
+			if err := saveOrderReceipt(tx, order); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		return tx.Model(&grn).Updates(map[string]interface{}{
+			"status":    GRNPosted,
+			"posted_by": postedBy,
+			"posted_at": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to post GRN: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "grn:*")
+	s.cache.DeletePattern(ctx, "purchase_orders:*")
+
+	var grn GRN
+	if err := s.db.DB.WithContext(ctx).Preload("Items").First(&grn, "id = ?", id).Error; err != nil {
+		return nil, fmt.Errorf("failed to get GRN: %w", err)
+	}
+	return &grn, nil
+}
+
+// totalGRN adds up the accepted quantities and their value
+func totalGRN(grn *GRN) {
+	grn.TotalQuantity = 0
+	grn.TotalAmount = 0
+	for i := range grn.Items {
+		item := &grn.Items[i]
+		if item.ReceivedQuantity == 0 {
+			item.ReceivedQuantity = item.AcceptedQuantity + item.RejectedQuantity
+		}
+		taxable := float64(item.AcceptedQuantity) * item.UnitPrice
+		item.TotalAmount = roundPaise(taxable + taxable*item.TaxPercent/100)
+
+		grn.TotalQuantity += item.AcceptedQuantity
+		grn.TotalAmount += item.TotalAmount
+	}
+	grn.TotalAmount = roundPaise(grn.TotalAmount)
+}
+
+func lockPurchaseOrder(tx *gorm.DB, id string) (*PurchaseOrder, error) {
+	var order PurchaseOrder
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND is_active = ?", id, true).
+		First(&order).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: purchase order not found", ErrInvalidGRN)
+		}
+		return nil, err
+	}
+	switch order.Status {
+	case "draft", POPendingApproval, POApproved, PORejected, "cancelled", POClosed:
+		return nil, fmt.Errorf("%w: purchase order %s is %s", ErrInvalidGRN, order.PONumber, order.Status)
+	}
+	if err := tx.Where("purchase_order_id = ? AND is_active = ?", order.ID, true).
+		Order("created_at").
+		Find(&order.Items).Error; err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// receiveAgainstOrder adds an accepted quantity to its PO line, matched by id
+// or else by the first line of the product with quantity still open
+func receiveAgainstOrder(order *PurchaseOrder, item *GRNItem) error {
+	var line *PurchaseOrderItem
+	for i := range order.Items {
+		candidate := &order.Items[i]
+		if item.PurchaseOrderItemID != nil {
+			if candidate.ID == *item.PurchaseOrderItemID {
+				line = candidate
+				break
+			}
+			continue
+		}
+		if candidate.ProductID == item.ProductID && candidate.ReceivedQty < candidate.Quantity {
+			line = candidate
+			break
+		}
+	}
+	if line == nil || line.ProductID != item.ProductID {
+		return fmt.Errorf("%w: product %s is not open on purchase order %s", ErrInvalidGRN, item.ProductID, order.PONumber)
+	}
+
+	if open := line.Quantity - line.ReceivedQty; item.AcceptedQuantity > open {
+		return fmt.Errorf("%w: only %d of product %s left to receive on purchase order %s", ErrInvalidGRN, open, item.ProductID, order.PONumber)
+	}
+	line.ReceivedQty += item.AcceptedQuantity
+	item.PurchaseOrderItemID = &line.ID
+	return nil
+}
+
+// saveOrderReceipt stores the received quantities and derives the order's
+// status: closed once every line is fully received, partially received before
+func saveOrderReceipt(tx *gorm.DB, order *PurchaseOrder) error {
+	received, closed := 0, true
+	for i := range order.Items {
+		line := &order.Items[i]
+		if err := tx.Model(line).Update("received_qty", line.ReceivedQty).Error; err != nil {
+			return err
+		}
+		received += line.ReceivedQty
+		if line.ReceivedQty < line.Quantity {
+			closed = false
+		}
+	}
+
+	status := POPartiallyReceived
+	if closed {
+		status = POClosed
+	}
+	order.Status = status
+	order.ReceivedQty = received
+	return tx.Model(order).Updates(map[string]interface{}{
+		"status":       status,
+		"received_qty": received,
+	}).Error
+}
+
+// receiveBatch tops up the product's active batch of the same number, taking
+// the receipt's expiry, MRP and purchase price, or creates the batch. The
+// batches table belongs to inventory-service.
+func receiveBatch(tx *gorm.DB, item *GRNItem) (string, error) {
+	var batchIDs []string
+	if err := tx.Table("batches").Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("product_id = ? AND batch_no = ? AND status = ?", item.ProductID, item.BatchNumber, "ACTIVE").
+		Order("created_at").
+		Limit(1).
+		Pluck("id", &batchIDs).Error; err != nil {
+		return "", err
+	}
+
+	if len(batchIDs) > 0 {
+		updates := map[string]interface{}{
+			"quantity":       gorm.Expr("quantity + ?", item.AcceptedQuantity),
+			"expiry_date":    *item.ExpiryDate,
+			"purchase_price": item.UnitPrice,
+			"updated_at":     time.Now(),
+		}
+		if item.MRP > 0 {
+			updates["mrp"] = item.MRP
+		}
+		if item.MfgDate != nil {
+			updates["mfg_date"] = *item.MfgDate
+		}
+		if err := tx.Table("batches").Where("id = ?", batchIDs[0]).Updates(updates).Error; err != nil {
+			return "", err
+		}
+		return batchIDs[0], nil
+	}
+
+	var batchID string
+	if err := tx.Raw(`
+		INSERT INTO batches (product_id, batch_no, mfg_date, expiry_date, quantity, mrp, purchase_price, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 'ACTIVE', NOW(), NOW())
+		RETURNING id
+	`, item.ProductID, item.BatchNumber, item.MfgDate, *item.ExpiryDate, item.AcceptedQuantity, item.MRP, item.UnitPrice).
+		Scan(&batchID).Error; err != nil {
+		return "", err
+	}
+	return batchID, nil
+}
+
+// stockIn credits the shop's stock with a GRN line through the shared
+// ledger, which opens the line's cost layer at the GRN price
+func stockIn(tx *gorm.DB, grn *GRN, item *GRNItem, createdBy string) error {
+	_, err := ledger.Post(tx, &ledger.StockMovement{
+		ProductID:     item.ProductID,
+		ShopID:        grn.ShopID,
+		MovementType:  "IN",
+		Quantity:      float64(item.AcceptedQuantity),
+		Reason:        "GRN " + grn.GRNNumber,
+		ReferenceType: "GRN",
+		ReferenceID:   grn.ID,
+		BatchID:       item.BatchID,
+		CreatedBy:     createdBy,
+		UnitCost:      item.UnitPrice,
+	})
+	return err
+}
+
+// nextGRNNumber numbers GRNs per day as GRNyyyymmdd-nnnn
+func nextGRNNumber(tx *gorm.DB, at time.Time) (string, error) {
+	return nextDailyNumber(tx, &GRN{}, "grn_number", "GRN", at)
+}
+
+// nextDailyNumber numbers a purchase document per day as <code>yyyymmdd-nnnn,
+// under an advisory lock so concurrent postings cannot take the same number
+func nextDailyNumber(tx *gorm.DB, model interface{}, column, code string, at time.Time) (string, error) {
+	prefix := fmt.Sprintf("%s%s-", code, at.Format("20060102"))
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "document-number:"+prefix).Error; err != nil {
+		return "", err
+	}
+
+	var count int64
+	if err := tx.Model(model).Where(column+" LIKE ?", prefix+"%").Count(&count).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%04d", prefix, count+1), nil
+}
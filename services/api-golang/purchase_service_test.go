@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for GRN totals
+func TestTotalGRN(t *testing.T) {
+	tests := []struct {
+		name         string
+		items        []GRNItem
+		wantQuantity int
+		wantAmount   float64
+		wantReceived []int
+	}{
+		{
+			name:         "accepted quantity with tax",
+			items:        []GRNItem{{AcceptedQuantity: 10, UnitPrice: 50, TaxPercent: 12}},
+			wantQuantity: 10,
+			wantAmount:   560,
+			wantReceived: []int{10},
+		},
+		{
+			name:         "rejected units are received but not valued",
+			items:        []GRNItem{{AcceptedQuantity: 8, RejectedQuantity: 2, UnitPrice: 25}},
+			wantQuantity: 8,
+			wantAmount:   200,
+			wantReceived: []int{10},
+		},
+		{
+			name: "several lines",
+			items: []GRNItem{
+				{AcceptedQuantity: 3, UnitPrice: 33.33, TaxPercent: 5},
+				{ReceivedQuantity: 6, AcceptedQuantity: 5, RejectedQuantity: 1, UnitPrice: 10},
+			},
+			wantQuantity: 8,
+			wantAmount:   154.99, // 104.99 + 50
+			wantReceived: []int{3, 6},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grn := &GRN{Items: tt.items}
+			totalGRN(grn)
+
+			assert.Equal(t, tt.wantQuantity, grn.TotalQuantity)
+			assert.Equal(t, tt.wantAmount, grn.TotalAmount)
+			for i, want := range tt.wantReceived {
+				assert.Equal(t, want, grn.Items[i].ReceivedQuantity)
+			}
+		})
+	}
+}
+
+// Table-driven tests for receiving GRN lines against a purchase order
+func TestReceiveAgainstOrder(t *testing.T) {
+	newOrder := func() *PurchaseOrder {
+		order := &PurchaseOrder{PONumber: "PO20250401-0001"}
+		order.Items = []PurchaseOrderItem{
+			{ProductID: "arnica", Quantity: 10, ReceivedQty: 10},
+			{ProductID: "arnica", Quantity: 20, ReceivedQty: 5},
+			{ProductID: "calendula", Quantity: 6},
+		}
+		order.Items[0].ID, order.Items[1].ID, order.Items[2].ID = "line-1", "line-2", "line-3"
+		return order
+	}
+	lineID := func(id string) *string { return &id }
+
+	tests := []struct {
+		name     string
+		item     GRNItem
+		wantLine string
+		wantQty  int
+		wantErr  bool
+	}{
+		{name: "first open line of the product", item: GRNItem{ProductID: "arnica", AcceptedQuantity: 15}, wantLine: "line-2", wantQty: 20},
+		{name: "named line", item: GRNItem{ProductID: "calendula", AcceptedQuantity: 6, PurchaseOrderItemID: lineID("line-3")}, wantLine: "line-3", wantQty: 6},
+		{name: "more than is open", item: GRNItem{ProductID: "arnica", AcceptedQuantity: 16}, wantErr: true},
+		{name: "product not on the order", item: GRNItem{ProductID: "belladonna", AcceptedQuantity: 1}, wantErr: true},
+		{name: "named line of another product", item: GRNItem{ProductID: "arnica", AcceptedQuantity: 1, PurchaseOrderItemID: lineID("line-3")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := newOrder()
+			err := receiveAgainstOrder(order, &tt.item)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidGRN), "want ErrInvalidGRN, got %v", err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantLine, *tt.item.PurchaseOrderItemID)
+			for _, line := range order.Items {
+				if line.ID == tt.wantLine {
+					assert.Equal(t, tt.wantQty, line.ReceivedQty)
+				}
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -96,6 +97,7 @@ func (h *PurchaseHandler) GetPurchaseOrder(c *gin.Context) {
 		Preload("Vendor").
 		Preload("Items").
 		Preload("Items.Product").
+		Preload("Approvals", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
 		Where("id = ? AND is_active = ?", id, true).
 		First(&order).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -126,8 +128,10 @@ func (h *PurchaseHandler) CreatePurchaseOrder(c *gin.Context) {
 		order.CreatedBy = userID.(string)
 	}
 
-	// Set default status
+	// Set default status; approval starts when the order is submitted
 	order.Status = "draft"
+	order.ApprovalSteps, order.ApprovalLevel, order.Approvals = nil, 0, nil
+	order.ApprovedBy, order.ApprovedAt = nil, nil
 
 	// Calculate totals
 	for i := range order.Items {
@@ -176,6 +180,12 @@ func (h *PurchaseHandler) UpdatePurchaseOrder(c *gin.Context) {
 		return
 	}
 
+	// Only a draft can change; anything else has been or is being approved as it stands
+	if order.Status != "draft" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only a draft purchase order can be edited"})
+		return
+	}
+
 	var updateData PurchaseOrder
 	if err := c.ShouldBindJSON(&updateData); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -184,6 +194,7 @@ func (h *PurchaseHandler) UpdatePurchaseOrder(c *gin.Context) {
 
 	// Update fields
 	order.VendorID = updateData.VendorID
+	order.BranchID = updateData.BranchID
 	order.PaymentTerms = updateData.PaymentTerms
 	order.Notes = updateData.Notes
 
@@ -219,17 +230,40 @@ func (h *PurchaseHandler) UpdatePurchaseOrder(c *gin.Context) {
 	c.JSON(http.StatusOK, order)
 }
 
-// DeletePurchaseOrder soft deletes a purchase order
+// DeletePurchaseOrder soft deletes a draft or rejected purchase order
 func (h *PurchaseHandler) DeletePurchaseOrder(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
 
 	id := c.Param("id")
+	var order PurchaseOrder
+
+	if err := h.db.DB.WithContext(ctx).Where("id = ? AND is_active = ?", id, true).First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Purchase order not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve purchase order"})
+		return
+	}
+
+	// An order in approval, approved or sent is a commitment to the vendor
+	if order.Status != "draft" && order.Status != PORejected {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only a draft or rejected purchase order can be deleted"})
+		return
+	}
 
-	if err := h.db.DB.WithContext(ctx).Model(&PurchaseOrder{}).Where("id = ?", id).Update("is_active", false).Error; err != nil {
+	res := h.db.DB.WithContext(ctx).Model(&PurchaseOrder{}).
+		Where("id = ? AND status IN ?", id, []string{"draft", PORejected}).
+		Update("is_active", false)
+	if res.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete purchase order"})
 		return
 	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only a draft or rejected purchase order can be deleted"})
+		return
+	}
 
 	// Clear cache
 	h.cache.DeletePattern(ctx, "purchase_orders:*")
@@ -237,30 +271,144 @@ func (h *PurchaseHandler) DeletePurchaseOrder(c *gin.Context) {
 	c.JSON(http.StatusNoContent, nil)
 }
 
-// ApprovePurchaseOrder approves a purchase order for processing
+// SubmitPurchaseOrder sends a draft purchase order for approval
+func (h *PurchaseHandler) SubmitPurchaseOrder(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	order, err := NewPurchaseService(h.db, h.cache).SubmitPurchaseOrder(ctx, c.Param("id"), c.GetString("user_id"), c.GetString("user_role"))
+	if err != nil {
+		poApprovalErrorResponse(c, err, "Failed to submit purchase order")
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// ApprovePurchaseOrder approves the level a purchase order is waiting on. The
+// order is approved once every level its branch and amount need has been.
 func (h *PurchaseHandler) ApprovePurchaseOrder(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
 
-	id := c.Param("id")
-	userID, _ := c.Get("user_id")
+	var req struct {
+		Comments string `json:"comments"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	order, err := NewPurchaseService(h.db, h.cache).ApprovePurchaseOrder(ctx, c.Param("id"), c.GetString("user_id"), c.GetString("user_role"), req.Comments)
+	if err != nil {
+		poApprovalErrorResponse(c, err, "Failed to approve purchase order")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Purchase order approved successfully", "order": order})
+}
+
+// RejectPurchaseOrder rejects a purchase order awaiting approval
+func (h *PurchaseHandler) RejectPurchaseOrder(c *gin.Context) {
+	h.rejectPurchaseOrder(c, false)
+}
+
+// RequestPurchaseOrderChanges sends a purchase order awaiting approval back
+// to draft for changes
+func (h *PurchaseHandler) RequestPurchaseOrderChanges(c *gin.Context) {
+	h.rejectPurchaseOrder(c, true)
+}
 
-	updates := map[string]interface{}{
-		"status":     "sent",
-		"approved_by": userID.(string),
-		"approved_at": time.Now(),
-		"updated_at": time.Now(),
+func (h *PurchaseHandler) rejectPurchaseOrder(c *gin.Context, requestChanges bool) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var req struct {
+		Comments string `json:"comments" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	if err := h.db.DB.WithContext(ctx).Model(&PurchaseOrder{}).Where("id = ?", id).Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve purchase order"})
+	order, err := NewPurchaseService(h.db, h.cache).RejectPurchaseOrder(ctx, c.Param("id"), c.GetString("user_id"), c.GetString("user_role"), req.Comments, requestChanges)
+	if err != nil {
+		poApprovalErrorResponse(c, err, "Failed to reject purchase order")
 		return
 	}
 
-	// Clear cache
-	h.cache.DeletePattern(ctx, "purchase_orders:*")
+	c.JSON(http.StatusOK, order)
+}
+
+// SendPurchaseOrder marks a fully approved purchase order as sent to the vendor
+func (h *PurchaseHandler) SendPurchaseOrder(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	order, err := NewPurchaseService(h.db, h.cache).SendPurchaseOrder(ctx, c.Param("id"), c.GetString("user_id"), c.GetString("user_role"))
+	if err != nil {
+		poApprovalErrorResponse(c, err, "Failed to send purchase order")
+		return
+	}
+
+	c.JSON(http.StatusOK, order)
+}
+
+// GetPOApprovalRules lists purchase order approval rules, optionally for one branch
+func (h *PurchaseHandler) GetPOApprovalRules(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var rules []POApprovalRule
+	query := h.db.DB.WithContext(ctx).Where("is_active = ?", true)
+	if branchID := c.Query("branch_id"); branchID != "" {
+		query = query.Where("branch_id = ?", branchID)
+	}
+
+	if err := query.Order("branch_id NULLS FIRST, level").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve approval rules"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rules)
+}
+
+// SetPOApprovalRules replaces a branch's approval chain, or the default chain
+// when branch_id is omitted
+func (h *PurchaseHandler) SetPOApprovalRules(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var req struct {
+		BranchID *string          `json:"branch_id"`
+		Rules    []POApprovalRule `json:"rules"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rules, err := NewPurchaseService(h.db, h.cache).SetPOApprovalRules(ctx, req.BranchID, req.Rules)
+	if err != nil {
+		poApprovalErrorResponse(c, err, "Failed to save approval rules")
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Purchase order approved successfully"})
+	c.JSON(http.StatusOK, rules)
+}
+
+// poApprovalErrorResponse reports a purchase order approval action that was refused
+func poApprovalErrorResponse(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrNotPOApprover):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidPOApproval):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
 }
 
 // GetOrdersByVendor retrieves purchase orders for a specific vendor
@@ -358,7 +506,7 @@ func (h *PurchaseHandler) GetGRNByID(c *gin.Context) {
 	c.JSON(http.StatusOK, grn)
 }
 
-// CreateGRN creates a new GRN
+// CreateGRN creates a new draft GRN; stock moves only when it is posted
 func (h *PurchaseHandler) CreateGRN(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
@@ -375,32 +523,27 @@ func (h *PurchaseHandler) CreateGRN(c *gin.Context) {
 		grn.CreatedBy = userID.(string)
 	}
 
-	// Set default status
-	grn.Status = "draft"
+	if _, err := NewPurchaseService(h.db, h.cache).CreateGRN(ctx, &grn); err != nil {
+		grnErrorResponse(c, err, "Failed to create GRN")
+		return
+	}
 
-	// Calculate totals
-	grn.TotalQuantity = 0
-	grn.TotalAmount = 0
+	c.JSON(http.StatusCreated, grn)
+}
 
-	for _, item := range grn.Items {
-		grn.TotalQuantity += item.AcceptedQuantity
-		grn.TotalAmount += item.TotalAmount
-	}
+// PostGRN posts a draft GRN, creating its batches and stock movements and
+// updating the purchase order's received quantities
+func (h *PurchaseHandler) PostGRN(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
 
-	if err := h.db.DB.WithContext(ctx).Create(&grn).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create GRN"})
+	grn, err := NewPurchaseService(h.db, h.cache).PostGRN(ctx, c.Param("id"), c.GetString("user_id"))
+	if err != nil {
+		grnErrorResponse(c, err, "Failed to post GRN")
 		return
 	}
 
-	// Update purchase order status if linked
-	if grn.PurchaseOrderID != nil {
-		h.updatePurchaseOrderStatus(ctx, *grn.PurchaseOrderID, "received")
-	}
-
-	// Clear cache
-	h.cache.DeletePattern(ctx, "grn:*")
-
-	c.JSON(http.StatusCreated, grn)
+	c.JSON(http.StatusOK, grn)
 }
 
 // UpdateGRN updates an existing GRN
@@ -420,6 +563,12 @@ func (h *PurchaseHandler) UpdateGRN(c *gin.Context) {
 		return
 	}
 
+	// A posted GRN has moved stock; it can no longer be edited
+	if grn.Status != GRNDraft {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only a draft GRN can be edited"})
+		return
+	}
+
 	var updateData GRN
 	if err := c.ShouldBindJSON(&updateData); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -428,17 +577,8 @@ func (h *PurchaseHandler) UpdateGRN(c *gin.Context) {
 
 	// Update fields
 	grn.Notes = updateData.Notes
-
-	// Recalculate totals
-	grn.TotalQuantity = 0
-	grn.TotalAmount = 0
-
-	for _, item := range updateData.Items {
-		grn.TotalQuantity += item.AcceptedQuantity
-		grn.TotalAmount += item.TotalAmount
-	}
-
 	grn.Items = updateData.Items
+	totalGRN(&grn)
 
 	if err := h.db.DB.WithContext(ctx).Save(&grn).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update GRN"})
@@ -451,17 +591,40 @@ func (h *PurchaseHandler) UpdateGRN(c *gin.Context) {
 	c.JSON(http.StatusOK, grn)
 }
 
-// DeleteGRN soft deletes a GRN
+// DeleteGRN soft deletes a draft GRN
 func (h *PurchaseHandler) DeleteGRN(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
 
 	id := c.Param("id")
+	var grn GRN
+
+	if err := h.db.DB.WithContext(ctx).Where("id = ? AND is_active = ?", id, true).First(&grn).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "GRN not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve GRN"})
+		return
+	}
+
+	// A posted GRN has moved stock and billed the order; deleting it would orphan both
+	if grn.Status != GRNDraft {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only a draft GRN can be deleted"})
+		return
+	}
 
-	if err := h.db.DB.WithContext(ctx).Model(&GRN{}).Where("id = ?", id).Update("is_active", false).Error; err != nil {
+	res := h.db.DB.WithContext(ctx).Model(&GRN{}).
+		Where("id = ? AND status = ?", id, GRNDraft).
+		Update("is_active", false)
+	if res.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete GRN"})
 		return
 	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only a draft GRN can be deleted"})
+		return
+	}
 
 	// Clear cache
 	h.cache.DeletePattern(ctx, "grn:*")
@@ -488,14 +651,13 @@ func (h *PurchaseHandler) GetGRNByPurchaseOrder(c *gin.Context) {
 	c.JSON(http.StatusOK, grns)
 }
 
-// updatePurchaseOrderStatus updates the status of a purchase order
-func (h *PurchaseHandler) updatePurchaseOrderStatus(ctx context.Context, poID string, status string) {
-	updates := map[string]interface{}{
-		"status":     status,
-		"updated_at": time.Now(),
+// grnErrorResponse reports a GRN that could not be saved or posted
+func grnErrorResponse(c *gin.Context, err error, fallback string) {
+	if errors.Is(err, ErrInvalidGRN) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
 	}
-
-	h.db.DB.WithContext(ctx).Model(&PurchaseOrder{}).Where("id = ?", poID).Updates(updates)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
 }
 
 // ==================== VENDOR INVOICE HANDLERS ====================
@@ -553,6 +715,7 @@ func (h *PurchaseHandler) GetVendorInvoice(c *gin.Context) {
 
 	if err := h.db.DB.WithContext(ctx).
 		Preload("Vendor").
+		Preload("Items").
 		Where("id = ? AND is_active = ?", id, true).
 		First(&invoice).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
@@ -566,7 +729,8 @@ func (h *PurchaseHandler) GetVendorInvoice(c *gin.Context) {
 	c.JSON(http.StatusOK, invoice)
 }
 
-// CreateVendorInvoice creates a new vendor invoice
+// CreateVendorInvoice records a vendor invoice and matches it against its
+// purchase order and GRNs; a mismatch leaves it held
 func (h *PurchaseHandler) CreateVendorInvoice(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
@@ -583,21 +747,28 @@ func (h *PurchaseHandler) CreateVendorInvoice(c *gin.Context) {
 		invoice.CreatedBy = userID.(string)
 	}
 
-	// Set default status
-	invoice.Status = "draft"
-	invoice.PaymentStatus = "unpaid"
-
-	if err := h.db.DB.WithContext(ctx).Create(&invoice).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create vendor invoice"})
+	if _, err := NewPurchaseService(h.db, h.cache).CreateVendorInvoice(ctx, &invoice); err != nil {
+		vendorInvoiceErrorResponse(c, err, "Failed to create vendor invoice")
 		return
 	}
 
-	// Clear cache
-	h.cache.DeletePattern(ctx, "vendor_invoices:*")
-
 	c.JSON(http.StatusCreated, invoice)
 }
 
+// MatchVendorInvoice re-runs the three-way match on a vendor invoice
+func (h *PurchaseHandler) MatchVendorInvoice(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	invoice, err := NewPurchaseService(h.db, h.cache).MatchVendorInvoice(ctx, c.Param("id"))
+	if err != nil {
+		vendorInvoiceErrorResponse(c, err, "Failed to match vendor invoice")
+		return
+	}
+
+	c.JSON(http.StatusOK, invoice)
+}
+
 // UpdateVendorInvoice updates an existing vendor invoice
 func (h *PurchaseHandler) UpdateVendorInvoice(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
@@ -654,30 +825,324 @@ func (h *PurchaseHandler) DeleteVendorInvoice(c *gin.Context) {
 	c.JSON(http.StatusNoContent, nil)
 }
 
-// ApproveVendorInvoice approves a vendor invoice for payment
+// ApproveVendorInvoice approves a vendor invoice for payment. Only an invoice
+// that still matches its purchase order and GRNs is approved; otherwise it is
+// held and its discrepancies are returned.
 func (h *PurchaseHandler) ApproveVendorInvoice(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
 
-	id := c.Param("id")
-	userID, _ := c.Get("user_id")
+	invoice, err := NewPurchaseService(h.db, h.cache).ApproveVendorInvoice(ctx, c.Param("id"), c.GetString("user_id"))
+	if err != nil {
+		vendorInvoiceErrorResponse(c, err, "Failed to approve vendor invoice")
+		return
+	}
+	if invoice.Status != VendorInvoiceConfirmed {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":         "Vendor invoice does not match its purchase order and GRNs",
+			"discrepancies": invoice.Discrepancies,
+			"invoice":       invoice,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Vendor invoice approved successfully", "invoice": invoice})
+}
 
-	updates := map[string]interface{}{
-		"status":     "confirmed",
-		"approved_by": userID.(string),
-		"approved_at": time.Now(),
-		"updated_at": time.Now(),
+// GetMatchTolerances lists the configured three-way match tolerances
+func (h *PurchaseHandler) GetMatchTolerances(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var tolerances []MatchTolerance
+	if err := h.db.DB.WithContext(ctx).
+		Where("is_active = ?", true).
+		Order("vendor_id NULLS FIRST").
+		Find(&tolerances).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve match tolerances"})
+		return
 	}
 
-	if err := h.db.DB.WithContext(ctx).Model(&VendorInvoice{}).Where("id = ?", id).Updates(updates).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve vendor invoice"})
+	c.JSON(http.StatusOK, gin.H{"tolerances": tolerances, "default": defaultMatchTolerance})
+}
+
+// SetMatchTolerance sets the default tolerance, or a vendor's own when
+// vendor_id is given
+func (h *PurchaseHandler) SetMatchTolerance(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var req MatchTolerance
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.QuantityPercent < 0 || req.PricePercent < 0 || req.AmountTolerance < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tolerances cannot be negative"})
 		return
 	}
 
-	// Clear cache
-	h.cache.DeletePattern(ctx, "vendor_invoices:*")
+	var tolerance MatchTolerance
+	query := h.db.DB.WithContext(ctx).Where("is_active = ?", true)
+	if req.VendorID != nil {
+		query = query.Where("vendor_id = ?", *req.VendorID)
+	} else {
+		query = query.Where("vendor_id IS NULL")
+	}
+	if err := query.First(&tolerance).Error; err != nil && err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve match tolerance"})
+		return
+	}
+
+	tolerance.VendorID = req.VendorID
+	tolerance.QuantityPercent = req.QuantityPercent
+	tolerance.PricePercent = req.PricePercent
+	tolerance.AmountTolerance = req.AmountTolerance
+	tolerance.IsActive = true
+	if err := h.db.DB.WithContext(ctx).Save(&tolerance).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save match tolerance"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tolerance)
+}
+
+// vendorInvoiceErrorResponse reports a vendor invoice that could not be saved,
+// matched or approved
+func vendorInvoiceErrorResponse(c *gin.Context, err error, fallback string) {
+	if errors.Is(err, ErrInvalidVendorInvoice) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+}
+
+// ==================== PURCHASE RETURN HANDLERS ====================
+
+// GetPurchaseReturns retrieves purchase returns
+func (h *PurchaseHandler) GetPurchaseReturns(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var returns []PurchaseReturn
+	var total int64
+
+	query := h.db.DB.WithContext(ctx).
+		Preload("Vendor").
+		Model(&PurchaseReturn{}).
+		Where("is_active = ?", true)
+
+	// Apply filters
+	if vendorID := c.Query("vendor_id"); vendorID != "" {
+		query = query.Where("vendor_id = ?", vendorID)
+	}
+	if grnID := c.Query("grn_id"); grnID != "" {
+		query = query.Where("grn_id = ?", grnID)
+	}
+
+	// Pagination
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count purchase returns"})
+		return
+	}
+
+	if err := query.Limit(limit).Offset(offset).Order("created_at DESC").Find(&returns).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve purchase returns"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"returns": returns,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// GetPurchaseReturn retrieves a purchase return with its items and debit note
+func (h *PurchaseHandler) GetPurchaseReturn(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var ret PurchaseReturn
+	if err := h.db.DB.WithContext(ctx).
+		Preload("Vendor").
+		Preload("Items").
+		Preload("DebitNote.Adjustments").
+		Where("id = ? AND is_active = ?", c.Param("id"), true).
+		First(&ret).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Purchase return not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve purchase return"})
+		return
+	}
+
+	c.JSON(http.StatusOK, ret)
+}
+
+// CreatePurchaseReturn returns stock received on a GRN to the vendor and
+// raises a debit note for it
+func (h *PurchaseHandler) CreatePurchaseReturn(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var ret PurchaseReturn
+	if err := c.ShouldBindJSON(&ret); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ret.CreatedBy = c.GetString("user_id")
+
+	if _, err := NewPurchaseService(h.db, h.cache).CreatePurchaseReturn(ctx, &ret); err != nil {
+		purchaseReturnErrorResponse(c, err, "Failed to create purchase return")
+		return
+	}
+
+	c.JSON(http.StatusCreated, ret)
+}
+
+// GetDebitNotes retrieves debit notes, optionally only those still open
+func (h *PurchaseHandler) GetDebitNotes(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var notes []DebitNote
+	query := h.db.DB.WithContext(ctx).Where("is_active = ?", true)
+	if vendorID := c.Query("vendor_id"); vendorID != "" {
+		query = query.Where("vendor_id = ?", vendorID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	if err := query.Order("issue_date DESC").Find(&notes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve debit notes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, notes)
+}
+
+// GetDebitNote retrieves a debit note with the invoices it was set off against
+func (h *PurchaseHandler) GetDebitNote(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var note DebitNote
+	if err := h.db.DB.WithContext(ctx).
+		Preload("Adjustments").
+		Where("id = ? AND is_active = ?", c.Param("id"), true).
+		First(&note).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Debit note not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve debit note"})
+		return
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+// purchaseReturnErrorResponse reports a purchase return that could not be posted
+func purchaseReturnErrorResponse(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrInsufficientStock):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrInvalidPurchaseReturn):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
+// ==================== LANDED COST HANDLERS ====================
+
+// GetLandedCostVouchers retrieves landed cost vouchers, optionally those on a GRN
+func (h *PurchaseHandler) GetLandedCostVouchers(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var vouchers []LandedCostVoucher
+	var total int64
+
+	query := h.db.DB.WithContext(ctx).Model(&LandedCostVoucher{}).Where("is_active = ?", true)
+	if grnID := c.Query("grn_id"); grnID != "" {
+		query = query.Where("grn_ids @> ?::jsonb", `["`+grnID+`"]`)
+	}
+
+	// Pagination
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count landed cost vouchers"})
+		return
+	}
+
+	if err := query.Preload("Charges").Limit(limit).Offset(offset).Order("voucher_date DESC").Find(&vouchers).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve landed cost vouchers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"vouchers": vouchers,
+		"total":    total,
+		"limit":    limit,
+		"offset":   offset,
+	})
+}
+
+// GetLandedCostVoucher retrieves a landed cost voucher with its allocations
+func (h *PurchaseHandler) GetLandedCostVoucher(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var voucher LandedCostVoucher
+	if err := h.db.DB.WithContext(ctx).
+		Preload("Charges").
+		Preload("Allocations").
+		Where("id = ? AND is_active = ?", c.Param("id"), true).
+		First(&voucher).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Landed cost voucher not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve landed cost voucher"})
+		return
+	}
+
+	c.JSON(http.StatusOK, voucher)
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Vendor invoice approved successfully"})
+// CreateLandedCostVoucher posts freight and other charges against one or more
+// GRNs and allocates them into the cost of the received batches
+func (h *PurchaseHandler) CreateLandedCostVoucher(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var voucher LandedCostVoucher
+	if err := c.ShouldBindJSON(&voucher); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	voucher.CreatedBy = c.GetString("user_id")
+
+	if _, err := NewPurchaseService(h.db, h.cache).CreateLandedCostVoucher(ctx, &voucher); err != nil {
+		if errors.Is(err, ErrInvalidLandedCost) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to post landed cost voucher"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, voucher)
 }
 
 // ==================== VENDOR HANDLERS ====================
@@ -857,6 +1322,20 @@ func (h *PurchaseHandler) GetVendorPerformance(c *gin.Context) {
 	c.JSON(http.StatusOK, performance)
 }
 
+// GetVendorPayable retrieves what is owed to a vendor net of open debit notes
+func (h *PurchaseHandler) GetVendorPayable(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	payable, err := NewPurchaseService(h.db, h.cache).GetVendorPayable(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve vendor payable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, payable)
+}
+
 // GetVendorPriceComparison compares prices across vendors for products
 func (h *PurchaseHandler) GetVendorPriceComparison(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
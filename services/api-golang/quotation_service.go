@@ -0,0 +1,490 @@
+// Quotation Service - Versioned quotes that are accepted or rejected and convert to sales orders
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Quotation statuses
+const (
+	QuotationDraft      = "draft"
+	QuotationSent       = "sent"
+	QuotationAccepted   = "accepted"
+	QuotationRejected   = "rejected"
+	QuotationSuperseded = "superseded" // replaced by a later version
+	QuotationConverted  = "converted"  // turned into a sales order
+)
+
+// ErrInvalidQuotation is returned when a quotation cannot move as asked
+var ErrInvalidQuotation = errors.New("invalid quotation")
+
+// ErrQuotationNotFound is returned when there is no active quotation by that id
+var ErrQuotationNotFound = errors.New("quotation not found")
+
+// Quotation is a priced offer to a customer. Revising a quote creates a new
+// version under the same number and supersedes the old one; only the latest
+// version can be accepted, rejected or converted.
+type Quotation struct {
+	BaseEntity
+	QuotationNumber   string          `gorm:"not null;size:100;uniqueIndex:idx_quotation_version" json:"quotation_number"`
+	Version           int             `gorm:"not null;default:1;uniqueIndex:idx_quotation_version" json:"version"`
+	PreviousVersionID *string         `gorm:"index" json:"previous_version_id"`
+	CustomerID        string          `gorm:"not null;index" json:"customer_id" validate:"required"`
+	Customer          Customer        `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
+	BranchID          string          `gorm:"index" json:"branch_id"`
+	QuoteDate         time.Time       `gorm:"not null" json:"quote_date"`
+	ValidUntil        time.Time       `gorm:"not null" json:"valid_until"`
+	Subtotal          float64         `gorm:"type:decimal(15,2);not null;default:0" json:"subtotal"`
+	DiscountAmount    float64         `gorm:"type:decimal(15,2);not null;default:0" json:"discount_amount"`
+	TaxAmount         float64         `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount"`
+	TotalAmount       float64         `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount"`
+	Status            string          `gorm:"not null;default:draft;size:20;index" json:"status" validate:"oneof=draft sent accepted rejected superseded converted"`
+	PaymentTerms      string          `gorm:"size:100" json:"payment_terms"`
+	Terms             string          `gorm:"type:text" json:"terms"`
+	Notes             string          `gorm:"type:text" json:"notes"`
+	SalesmanID        string          `gorm:"index" json:"salesman_id"`
+	CreatedBy         string          `gorm:"size:255" json:"created_by"`
+	SentAt            *time.Time      `gorm:"null" json:"sent_at"`
+	AcceptedAt        *time.Time      `gorm:"null" json:"accepted_at"`
+	RejectedAt        *time.Time      `gorm:"null" json:"rejected_at"`
+	RejectionReason   string          `gorm:"size:500" json:"rejection_reason"`
+	SalesOrderID      *string         `gorm:"index" json:"sales_order_id"`
+	ConvertedAt       *time.Time      `gorm:"null" json:"converted_at"`
+	Items             []QuotationItem `gorm:"foreignKey:QuotationID" json:"items"`
+}
+
+// QuotationItem is one quoted line; its price is what the order will carry
+type QuotationItem struct {
+	BaseEntity
+	QuotationID     string  `gorm:"not null;index" json:"quotation_id"`
+	ProductID       string  `gorm:"not null;index" json:"product_id" validate:"required"`
+	Product         Product `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+	ProductName     string  `gorm:"not null;size:255" json:"product_name" validate:"required"`
+	ProductCode     string  `gorm:"size:100" json:"product_code"`
+	Quantity        int     `gorm:"not null;default:1" json:"quantity" validate:"min=1"`
+	UnitPrice       float64 `gorm:"type:decimal(15,2);not null;default:0" json:"unit_price" validate:"min=0"`
+	TaxInclusive    bool    `gorm:"default:false" json:"tax_inclusive"`
+	DiscountPercent float64 `gorm:"default:0" json:"discount_percent" validate:"min=0,max=100"`
+	DiscountAmount  float64 `gorm:"type:decimal(15,2);not null;default:0" json:"discount_amount"`
+	HSNCode         string  `gorm:"size:8" json:"hsn_code"`
+	TaxableValue    float64 `gorm:"type:decimal(15,2);not null;default:0" json:"taxable_value"`
+	TaxPercent      float64 `gorm:"default:0" json:"tax_percent"`
+	TaxAmount       float64 `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount"`
+	TotalAmount     float64 `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount"`
+}
+
+// QuoteConversion is how a salesperson's quotes turned into orders. Each
+// quotation number counts once, whatever its versions.
+type QuoteConversion struct {
+	SalesmanID     string  `json:"salesman_id"`
+	Quoted         int     `json:"quoted"`
+	Accepted       int     `json:"accepted"`
+	Rejected       int     `json:"rejected"`
+	Converted      int     `json:"converted"`
+	QuotedValue    float64 `json:"quoted_value"`
+	ConvertedValue float64 `json:"converted_value"`
+	Ratio          float64 `json:"ratio"` // converted / quoted
+}
+
+// ==================== QUOTATION OPERATIONS ====================
+
+func (s *SalesService) GetQuotationByID(ctx context.Context, id string) (*Quotation, error) {
+	var quotation Quotation
+	if err := s.db.DB.WithContext(ctx).
+		Preload("Customer").
+		Preload("Items").
+		Where("id = ? AND is_active = ?", id, true).
+		First(&quotation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get quotation: %w", err)
+	}
+	return &quotation, nil
+}
+
+// CreateQuotation prices and numbers a new quotation. Validity defaults to
+// 15 days from the quote date.
+func (s *SalesService) CreateQuotation(ctx context.Context, quotation *Quotation) (*Quotation, error) {
+	if len(quotation.Items) == 0 {
+		return nil, fmt.Errorf("%w: at least one item is required", ErrInvalidQuotation)
+	}
+	if quotation.QuoteDate.IsZero() {
+		quotation.QuoteDate = time.Now()
+	}
+	if quotation.ValidUntil.IsZero() {
+		quotation.ValidUntil = quotation.QuoteDate.AddDate(0, 0, 15)
+	}
+	if quotation.ValidUntil.Before(quotation.QuoteDate) {
+		return nil, fmt.Errorf("%w: valid_until is before the quote date", ErrInvalidQuotation)
+	}
+	quotation.Version = 1
+	quotation.PreviousVersionID = nil
+	quotation.Status = QuotationDraft
+
+	if err := s.priceQuotation(ctx, quotation); err != nil {
+		return nil, err
+	}
+
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		number, err := nextQuotationNumber(tx, quotation.QuoteDate)
+		if err != nil {
+			return err
+		}
+		quotation.QuotationNumber = number
+		return tx.Create(quotation).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create quotation: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "quotations:*")
+	return quotation, nil
+}
+
+// ReviseQuotation issues a new version of an open quotation with the revised
+// lines and terms. The previous version is kept, marked superseded.
+func (s *SalesService) ReviseQuotation(ctx context.Context, id string, revised *Quotation) (*Quotation, error) {
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		current, err := lockQuotation(tx, id)
+		if err != nil {
+			return err
+		}
+		if current.Status != QuotationDraft && current.Status != QuotationSent {
+			return fmt.Errorf("%w: a %s quotation cannot be revised", ErrInvalidQuotation, current.Status)
+		}
+		if len(revised.Items) == 0 {
+			return fmt.Errorf("%w: at least one item is required", ErrInvalidQuotation)
+		}
+
+		revised.ID = ""
+		revised.QuotationNumber = current.QuotationNumber
+		revised.Version = current.Version + 1
+		revised.PreviousVersionID = &current.ID
+		revised.CustomerID = current.CustomerID
+		revised.Status = QuotationDraft
+		revised.SalesOrderID = nil
+		revised.SentAt, revised.AcceptedAt, revised.RejectedAt, revised.ConvertedAt = nil, nil, nil, nil
+		if revised.BranchID == "" {
+			revised.BranchID = current.BranchID
+		}
+		if revised.SalesmanID == "" {
+			revised.SalesmanID = current.SalesmanID
+		}
+		revised.QuoteDate = time.Now()
+		if revised.ValidUntil.IsZero() {
+			revised.ValidUntil = revised.QuoteDate.Add(current.ValidUntil.Sub(current.QuoteDate))
+		}
+		for i := range revised.Items {
+			revised.Items[i].ID = ""
+			revised.Items[i].QuotationID = ""
+		}
+
+		if err := s.priceQuotation(ctx, revised); err != nil {
+			return err
+		}
+		if err := tx.Model(current).Update("status", QuotationSuperseded).Error; err != nil {
+			return err
+		}
+		return tx.Create(revised).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to revise quotation: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "quotations:*")
+	return revised, nil
+}
+
+// UpdateQuotationStatus moves a quotation through its life: a draft is sent,
+// and a draft or sent quote is accepted or rejected. A quote past its validity
+// can no longer be accepted; it has to be revised.
+func (s *SalesService) UpdateQuotationStatus(ctx context.Context, id, status, reason string) (*Quotation, error) {
+	var quotation *Quotation
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if quotation, err = lockQuotation(tx, id); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		updates := map[string]interface{}{"status": status}
+		switch {
+		case status == QuotationSent && quotation.Status == QuotationDraft:
+			updates["sent_at"] = now
+		case status == QuotationAccepted && (quotation.Status == QuotationDraft || quotation.Status == QuotationSent):
+			if now.After(quotation.ValidUntil) {
+				return fmt.Errorf("%w: quotation %s expired on %s", ErrInvalidQuotation, quotation.QuotationNumber, quotation.ValidUntil.Format("2006-01-02"))
+			}
+			updates["accepted_at"] = now
+		case status == QuotationRejected && (quotation.Status == QuotationDraft || quotation.Status == QuotationSent):
+			updates["rejected_at"] = now
+			updates["rejection_reason"] = reason
+		default:
+			return fmt.Errorf("%w: cannot move a %s quotation to %s", ErrInvalidQuotation, quotation.Status, status)
+		}
+
+		return tx.Model(quotation).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update quotation: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "quotations:*")
+	return s.GetQuotationByID(ctx, id)
+}
+
+// ConvertQuotationToOrder turns an accepted quotation into a sales order. The
+// order carries the quoted prices, discounts and tax as they were accepted;
+// nothing is repriced.
+func (s *SalesService) ConvertQuotationToOrder(ctx context.Context, id, createdBy string) (*SalesOrder, error) {
+	var order *SalesOrder
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		quotation, err := lockQuotation(tx, id)
+		if err != nil {
+			return err
+		}
+		if quotation.Status != QuotationAccepted {
+			return fmt.Errorf("%w: only an accepted quotation can be converted, this one is %s", ErrInvalidQuotation, quotation.Status)
+		}
+		if err := tx.Where("quotation_id = ?", quotation.ID).Find(&quotation.Items).Error; err != nil {
+			return err
+		}
+
+		if createdBy == "" {
+			createdBy = quotation.CreatedBy
+		}
+		order = &SalesOrder{
+			OrderNumber:    "SO-" + quotation.QuotationNumber,
+			QuotationID:    &quotation.ID,
+			CustomerID:     quotation.CustomerID,
+			OrderDate:      time.Now(),
+			Subtotal:       quotation.Subtotal,
+			DiscountAmount: quotation.DiscountAmount,
+			TaxAmount:      quotation.TaxAmount,
+			TotalAmount:    quotation.TotalAmount,
+			Status:         "draft",
+			PaymentStatus:  "unpaid",
+			PaymentTerms:   quotation.PaymentTerms,
+			Notes:          quotation.Notes,
+			SalesmanID:     quotation.SalesmanID,
+			CreatedBy:      createdBy,
+			Items:          make([]SalesOrderItem, len(quotation.Items)),
+		}
+		for i, item := range quotation.Items {
+			order.Items[i] = SalesOrderItem{
+				ProductID:       item.ProductID,
+				ProductName:     item.ProductName,
+				ProductCode:     item.ProductCode,
+				Quantity:        item.Quantity,
+				UnitPrice:       item.UnitPrice,
+				DiscountPercent: item.DiscountPercent,
+				DiscountAmount:  item.DiscountAmount,
+				TaxPercent:      item.TaxPercent,
+				TaxAmount:       item.TaxAmount,
+				TotalAmount:     item.TotalAmount,
+			}
+		}
+		if err := tx.Create(order).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		return tx.Model(quotation).Updates(map[string]interface{}{
+			"status":         QuotationConverted,
+			"sales_order_id": order.ID,
+			"converted_at":   now,
+		}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert quotation: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "quotations:*")
+	s.cache.DeletePattern(ctx, "sales_orders:*")
+	return order, nil
+}
+
+// GetQuoteConversion reports the quote-to-order ratio per salesperson for
+// quotations first issued between from and to
+func (s *SalesService) GetQuoteConversion(ctx context.Context, from, to time.Time) ([]QuoteConversion, error) {
+	var rows []QuoteConversion
+	if err := s.db.DB.WithContext(ctx).Raw(`
+		WITH latest AS (
+			SELECT DISTINCT ON (quotation_number) quotation_number, salesman_id, status, total_amount
+			FROM quotations
+			WHERE is_active = true
+			ORDER BY quotation_number, version DESC
+		), first AS (
+			SELECT quotation_number, MIN(quote_date) AS quote_date
+			FROM quotations
+			WHERE is_active = true
+			GROUP BY quotation_number
+		)
+		SELECT COALESCE(l.salesman_id, '') AS salesman_id,
+			COUNT(*) AS quoted,
+			COUNT(*) FILTER (WHERE l.status IN ('accepted', 'converted')) AS accepted,
+			COUNT(*) FILTER (WHERE l.status = 'rejected') AS rejected,
+			COUNT(*) FILTER (WHERE l.status = 'converted') AS converted,
+			COALESCE(SUM(l.total_amount), 0) AS quoted_value,
+			COALESCE(SUM(l.total_amount) FILTER (WHERE l.status = 'converted'), 0) AS converted_value
+		FROM latest l
+		JOIN first f ON f.quotation_number = l.quotation_number
+		WHERE f.quote_date >= ? AND f.quote_date < ?
+		GROUP BY 1
+		ORDER BY converted DESC, quoted DESC
+	`, from, to).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to compute quote conversion: %w", err)
+	}
+
+	for i := range rows {
+		rows[i].QuotedValue = roundPaise(rows[i].QuotedValue)
+		rows[i].ConvertedValue = roundPaise(rows[i].ConvertedValue)
+		if rows[i].Quoted > 0 {
+			rows[i].Ratio = roundPaise(float64(rows[i].Converted) / float64(rows[i].Quoted))
+		}
+	}
+	return rows, nil
+}
+
+// priceQuotation prices the quote through the same GST engine as invoices,
+// so the order it becomes bills at the quoted figures
+func (s *SalesService) priceQuotation(ctx context.Context, quotation *Quotation) error {
+	draft := Invoice{
+		CustomerID:  quotation.CustomerID,
+		BranchID:    quotation.BranchID,
+		InvoiceDate: quotation.QuoteDate,
+		Items:       make([]InvoiceItem, len(quotation.Items)),
+	}
+	for i, item := range quotation.Items {
+		draft.Items[i] = InvoiceItem{
+			ProductID:       item.ProductID,
+			ProductName:     item.ProductName,
+			Quantity:        item.Quantity,
+			UnitPrice:       item.UnitPrice,
+			DiscountPercent: item.DiscountPercent,
+			TaxInclusive:    item.TaxInclusive,
+		}
+	}
+
+	if err := s.applyGST(ctx, &draft); err != nil {
+		return err
+	}
+
+	for i := range quotation.Items {
+		priced := draft.Items[i]
+		item := &quotation.Items[i]
+		item.DiscountAmount = priced.DiscountAmount
+		item.HSNCode = priced.HSNCode
+		item.TaxableValue = priced.TaxableValue
+		item.TaxPercent = priced.TaxPercent
+		item.TaxAmount = priced.TaxAmount
+		item.TotalAmount = priced.TotalAmount
+	}
+	quotation.Subtotal = draft.Subtotal
+	quotation.DiscountAmount = draft.DiscountAmount
+	quotation.TaxAmount = draft.TaxAmount
+	quotation.TotalAmount = draft.TotalAmount
+	return nil
+}
+
+// lockQuotation loads a quotation for update
+func lockQuotation(tx *gorm.DB, id string) (*Quotation, error) {
+	var quotation Quotation
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND is_active = ?", id, true).
+		First(&quotation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrQuotationNotFound
+		}
+		return nil, err
+	}
+	return &quotation, nil
+}
+
+// nextQuotationNumber numbers quotations per day as QTyyyymmdd-nnnn
+func nextQuotationNumber(tx *gorm.DB, at time.Time) (string, error) {
+	prefix := fmt.Sprintf("QT%s-", at.Format("20060102"))
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "quotations:"+prefix).Error; err != nil {
+		return "", err
+	}
+
+	var count int64
+	if err := tx.Model(&Quotation{}).
+		Where("quotation_number LIKE ? AND version = 1", prefix+"%").
+		Count(&count).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%04d", prefix, count+1), nil
+}
+
+// RenderQuotationPDF prints a quotation for sending to the customer
+func RenderQuotationPDF(quotation *Quotation) []byte {
+	doc := newPDFDocument()
+
+	doc.row(16, true, pdfCell{0, "QUOTATION"})
+	doc.space(6)
+	doc.row(10, false,
+		pdfCell{0, fmt.Sprintf("Quotation No: %s (v%d)", quotation.QuotationNumber, quotation.Version)},
+		pdfCell{300, "Date: " + quotation.QuoteDate.Format("02-Jan-2006")})
+	doc.row(10, false,
+		pdfCell{0, "Customer: " + quotation.Customer.Name},
+		pdfCell{300, "Valid until: " + quotation.ValidUntil.Format("02-Jan-2006")})
+	if quotation.Customer.GSTNumber != "" {
+		doc.row(10, false, pdfCell{0, "GSTIN: " + quotation.Customer.GSTNumber})
+	}
+	if quotation.PaymentTerms != "" {
+		doc.row(10, false, pdfCell{0, "Payment terms: " + quotation.PaymentTerms})
+	}
+	doc.space(8)
+
+	columns := []float64{0, 30, 245, 290, 345, 390, 445}
+	doc.row(9, true,
+		pdfCell{columns[0], "#"}, pdfCell{columns[1], "Item"}, pdfCell{columns[2], "Qty"},
+		pdfCell{columns[3], "Rate"}, pdfCell{columns[4], "Disc"}, pdfCell{columns[5], "GST %"},
+		pdfCell{columns[6], "Amount"})
+	doc.rule()
+	for i, item := range quotation.Items {
+		name := item.ProductName
+		if runes := []rune(name); len(runes) > 40 {
+			name = string(runes[:40])
+		}
+		doc.row(9, false,
+			pdfCell{columns[0], fmt.Sprint(i + 1)},
+			pdfCell{columns[1], name},
+			pdfCell{columns[2], fmt.Sprint(item.Quantity)},
+			pdfCell{columns[3], fmt.Sprintf("%.2f", item.UnitPrice)},
+			pdfCell{columns[4], fmt.Sprintf("%.2f", item.DiscountAmount)},
+			pdfCell{columns[5], fmt.Sprintf("%.1f", item.TaxPercent)},
+			pdfCell{columns[6], fmt.Sprintf("%.2f", item.TotalAmount)})
+	}
+	doc.rule()
+
+	for _, line := range []struct {
+		label  string
+		amount float64
+	}{
+		{"Taxable value", quotation.Subtotal},
+		{"Discount", quotation.DiscountAmount},
+		{"GST", quotation.TaxAmount},
+	} {
+		doc.row(10, false, pdfCell{345, line.label}, pdfCell{columns[6], fmt.Sprintf("%.2f", line.amount)})
+	}
+	doc.row(11, true, pdfCell{345, "Total (Rs.)"}, pdfCell{columns[6], fmt.Sprintf("%.2f", quotation.TotalAmount)})
+
+	if quotation.Terms != "" {
+		doc.space(12)
+		doc.row(10, true, pdfCell{0, "Terms & Conditions"})
+		for _, line := range strings.Split(quotation.Terms, "\n") {
+			doc.row(9, false, pdfCell{0, line})
+		}
+	}
+	return doc.bytes()
+}
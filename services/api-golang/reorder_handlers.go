@@ -0,0 +1,244 @@
+// Reorder Planner - Suggests purchase quantities from stock, open POs and sales velocity
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ReorderSuggestion is the proposed purchase of one product
+type ReorderSuggestion struct {
+	ProductID         string  `json:"product_id"`
+	ProductName       string  `json:"product_name"`
+	VendorID          string  `json:"vendor_id"`
+	OnHand            float64 `json:"on_hand"`
+	OnOrder           float64 `json:"on_order"`
+	DailyVelocity     float64 `json:"daily_velocity"`
+	ProjectedStock    float64 `json:"projected_stock"`
+	ReorderLevel      int     `json:"reorder_level"`
+	MaxStock          int     `json:"max_stock"`
+	SuggestedQuantity int     `json:"suggested_quantity"`
+	UnitPrice         float64 `json:"unit_price"`
+}
+
+// VendorReorder groups the suggestions that go on one vendor's purchase order
+type VendorReorder struct {
+	VendorID    string              `json:"vendor_id"`
+	Items       []ReorderSuggestion `json:"items"`
+	TotalAmount float64             `json:"total_amount"`
+}
+
+// reorderParams controls how far back velocity is measured and how long a
+// vendor takes to deliver
+type reorderParams struct {
+	VelocityDays int `json:"velocity_days"`
+	LeadTimeDays int `json:"lead_time_days"`
+}
+
+func (p *reorderParams) setDefaults() {
+	if p.VelocityDays <= 0 {
+		p.VelocityDays = 30
+	}
+	if p.LeadTimeDays <= 0 {
+		p.LeadTimeDays = 7
+	}
+}
+
+// planReorders works out what to buy. A product is due when the stock left
+// after the vendor's lead time, counting what is already on order, falls to
+// its reorder level; the suggestion tops it back up to max stock.
+func planReorders(db *gorm.DB, params reorderParams) ([]VendorReorder, []ReorderSuggestion, error) {
+	var rows []ReorderSuggestion
+
+	since := time.Now().AddDate(0, 0, -params.VelocityDays)
+
+	query := `
+		SELECT
+			p.id AS product_id,
+			p.name AS product_name,
+			COALESCE(p.preferred_vendor_id::text, '') AS vendor_id,
+			p.reorder_level,
+			p.max_stock,
+			p.purchase_price AS unit_price,
+			COALESCE(stock.on_hand, 0) AS on_hand,
+			COALESCE(open_po.on_order, 0) AS on_order,
+			COALESCE(sold.quantity, 0) / ? AS daily_velocity
+		FROM products p
+		LEFT JOIN (
+			SELECT product_id, SUM(available_qty) AS on_hand
+			FROM inventory_items
+			WHERE is_active = true
+			GROUP BY product_id
+		) stock ON stock.product_id = p.id
+		LEFT JOIN (
+			SELECT poi.product_id, SUM(poi.quantity - poi.received_qty) AS on_order
+			FROM purchase_order_items poi
+			JOIN purchase_orders po ON po.id = poi.purchase_order_id
+			WHERE po.is_active = true AND po.status IN ('draft', 'pending_approval', 'approved', 'sent', 'partially_received')
+			GROUP BY poi.product_id
+		) open_po ON open_po.product_id = p.id
+		LEFT JOIN (
+			SELECT ii.product_id, SUM(ii.quantity) AS quantity
+			FROM invoice_items ii
+			JOIN invoices i ON i.id = ii.invoice_id
+			WHERE i.invoice_date >= ? AND i.status NOT IN ('cancelled', 'CANCELLED')
+			GROUP BY ii.product_id
+		) sold ON sold.product_id = p.id
+		WHERE p.is_active = true
+	`
+
+	if err := db.Raw(query, float64(params.VelocityDays), since).Scan(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+
+	byVendor := map[string]*VendorReorder{}
+	var vendorOrder []string
+	var unassigned []ReorderSuggestion
+
+	for _, row := range rows {
+		row.ProjectedStock = row.OnHand + row.OnOrder - row.DailyVelocity*float64(params.LeadTimeDays)
+		if row.ProjectedStock > float64(row.ReorderLevel) {
+			continue
+		}
+
+		row.SuggestedQuantity = int(math.Ceil(float64(row.MaxStock) - row.ProjectedStock))
+		if row.SuggestedQuantity <= 0 {
+			continue
+		}
+
+		// Products without a preferred vendor are reported but never drafted
+		if row.VendorID == "" {
+			unassigned = append(unassigned, row)
+			continue
+		}
+
+		group, ok := byVendor[row.VendorID]
+		if !ok {
+			group = &VendorReorder{VendorID: row.VendorID}
+			byVendor[row.VendorID] = group
+			vendorOrder = append(vendorOrder, row.VendorID)
+		}
+		group.Items = append(group.Items, row)
+		group.TotalAmount += float64(row.SuggestedQuantity) * row.UnitPrice
+	}
+
+	vendors := make([]VendorReorder, 0, len(vendorOrder))
+	for _, vendorID := range vendorOrder {
+		vendors = append(vendors, *byVendor[vendorID])
+	}
+
+	return vendors, unassigned, nil
+}
+
+// GetReorderSuggestions lists proposed order quantities grouped by preferred vendor
+func (h *PurchaseHandler) GetReorderSuggestions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var params reorderParams
+	params.VelocityDays, _ = strconv.Atoi(c.DefaultQuery("velocity_days", "30"))
+	params.LeadTimeDays, _ = strconv.Atoi(c.DefaultQuery("lead_time_days", "7"))
+	params.setDefaults()
+
+	vendors, unassigned, err := planReorders(h.db.DB.WithContext(ctx), params)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute reorder suggestions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"vendors":        vendors,
+		"unassigned":     unassigned,
+		"velocity_days":  params.VelocityDays,
+		"lead_time_days": params.LeadTimeDays,
+	})
+}
+
+// CreateReorderDrafts turns the current suggestions into one draft purchase
+// order per vendor. Drafts count as open orders, so running it twice does
+// not order the same shortfall again.
+func (h *PurchaseHandler) CreateReorderDrafts(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var req struct {
+		reorderParams
+		VendorIDs []string `json:"vendor_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.setDefaults()
+
+	wanted := make(map[string]bool, len(req.VendorIDs))
+	for _, vendorID := range req.VendorIDs {
+		wanted[vendorID] = true
+	}
+
+	var orders []PurchaseOrder
+	err := h.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Serialise planners so two runs cannot both draft the same shortfall
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('purchase_orders:reorder'))").Error; err != nil {
+			return err
+		}
+
+		vendors, _, err := planReorders(tx, req.reorderParams)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for i, vendor := range vendors {
+			if len(wanted) > 0 && !wanted[vendor.VendorID] {
+				continue
+			}
+
+			order := PurchaseOrder{
+				PONumber:  fmt.Sprintf("PO-%d-%d", now.UnixNano(), i+1),
+				VendorID:  vendor.VendorID,
+				OrderDate: now,
+				Status:    "draft",
+				Notes:     fmt.Sprintf("Reorder draft: %d-day velocity, %d-day lead time", req.VelocityDays, req.LeadTimeDays),
+			}
+			for _, s := range vendor.Items {
+				lineTotal := float64(s.SuggestedQuantity) * s.UnitPrice
+				order.Items = append(order.Items, PurchaseOrderItem{
+					ProductID: s.ProductID,
+					Quantity:  s.SuggestedQuantity,
+					UnitPrice: s.UnitPrice,
+					LineTotal: lineTotal,
+				})
+				order.SubTotal += lineTotal
+			}
+			order.TotalAmount = order.SubTotal
+
+			if err := tx.Create(&order).Error; err != nil {
+				return err
+			}
+			orders = append(orders, order)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create draft purchase orders"})
+		return
+	}
+
+	// Clear cache
+	h.cache.DeletePattern(ctx, "purchase_orders:*")
+
+	c.JSON(http.StatusCreated, gin.H{
+		"orders": orders,
+		"count":  len(orders),
+	})
+}
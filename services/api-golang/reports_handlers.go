@@ -473,31 +473,58 @@ func (h *ReportsHandler) GetStockMovement(c *gin.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
-// GetInventoryValuation retrieves inventory valuation report
+// GetInventoryValuation values closing stock by category from
+// inventory-service's cost layers: everything received by the as_of date
+// less everything consumed by then, at the cost it came in at
 func (h *ReportsHandler) GetInventoryValuation(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
 
+	asOf := time.Now()
+	if v := c.Query("as_of"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "as_of must be YYYY-MM-DD"})
+			return
+		}
+		asOf = t.AddDate(0, 0, 1)
+	}
+
+	db := h.db.DB.WithContext(ctx)
+	if !db.Migrator().HasTable("cost_layers") {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Inventory costing is not set up"})
+		return
+	}
+
 	var valuation []map[string]interface{}
 
 	query := `
 		SELECT
 			p.category_id,
 			c.name as category_name,
-			COUNT(p.id) as product_count,
-			COALESCE(SUM(p.purchase_price * (
-				COALESCE(SUM(CASE WHEN il.transaction_type = 'in' THEN il.quantity ELSE 0 END), 0) -
-				COALESCE(SUM(CASE WHEN il.transaction_type = 'out' THEN il.quantity ELSE 0 END), 0)
-			)), 0) as total_value
-		FROM products p
-		JOIN categories c ON p.category_id = c.id
-		LEFT JOIN inventory_levels il ON p.id = il.product_id AND il.is_active = true
-		WHERE p.is_active = true AND c.is_active = true
+			COUNT(DISTINCT v.product_id) as product_count,
+			COALESCE(SUM(v.qty), 0) as closing_qty,
+			COALESCE(SUM(v.value), 0) as total_value
+		FROM (
+			SELECT product_id, quantity AS qty, quantity * unit_cost AS value
+			FROM cost_layers
+			WHERE received_at < @as_of AND (@shop_id = '' OR shop_id::text = @shop_id)
+			UNION ALL
+			SELECT product_id, -quantity, -amount
+			FROM cost_consumptions
+			WHERE consumed_at < @as_of AND (@shop_id = '' OR shop_id::text = @shop_id)
+		) v
+		JOIN products p ON p.id = v.product_id
+		LEFT JOIN categories c ON c.id = p.category_id
 		GROUP BY p.category_id, c.name
+		HAVING SUM(v.qty) <> 0 OR SUM(v.value) <> 0
 		ORDER BY total_value DESC
 	`
 
-	if err := h.db.DB.WithContext(ctx).Raw(query).Scan(&valuation).Error; err != nil {
+	if err := db.Raw(query, map[string]interface{}{
+		"as_of":   asOf,
+		"shop_id": c.Query("shop_id"),
+	}).Scan(&valuation).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate inventory valuation"})
 		return
 	}
@@ -510,6 +537,7 @@ func (h *ReportsHandler) GetInventoryValuation(c *gin.Context) {
 	}
 
 	response := map[string]interface{}{
+		"as_of":            asOf.AddDate(0, 0, -1).Format("2006-01-02"),
 		"categories":       valuation,
 		"total_categories": len(valuation),
 		"total_value":      totalValue,
@@ -644,7 +672,10 @@ func (h *ReportsHandler) GetProfitAnalysis(c *gin.Context) {
 		WHERE invoice_date BETWEEN ? AND ? AND is_active = true
 	`
 
-	// Cost of goods sold (based on purchase prices)
+	// Cost of goods sold, per invoice: from the cost layers its sale consumed
+	// when inventory-service keeps them (purchase price plus landed cost),
+	// otherwise, as for bills posted before costing, from product purchase
+	// prices on its lines
 	cogsQuery := `
 		SELECT COALESCE(SUM(ii.quantity * p.purchase_price), 0) as total_cogs
 		FROM invoice_items ii
@@ -652,6 +683,26 @@ func (h *ReportsHandler) GetProfitAnalysis(c *gin.Context) {
 		JOIN invoices i ON ii.invoice_id = i.id
 		WHERE i.invoice_date BETWEEN ? AND ? AND i.is_active = true
 	`
+	if h.db.DB.Migrator().HasTable("cost_consumptions") {
+		cogsQuery = `
+			SELECT COALESCE(SUM(COALESCE(consumed.amount, lines.amount, 0)), 0) as total_cogs
+			FROM invoices i
+			LEFT JOIN (
+				SELECT m.reference_id::text AS invoice_id, SUM(cc.amount) AS amount
+				FROM cost_consumptions cc
+				JOIN stock_movements m ON m.id = cc.movement_id
+				WHERE cc.reference_type = 'SALE'
+				GROUP BY m.reference_id
+			) consumed ON consumed.invoice_id = i.id::text
+			LEFT JOIN (
+				SELECT ii.invoice_id::text AS invoice_id, SUM(ii.quantity * p.purchase_price) AS amount
+				FROM invoice_items ii
+				JOIN products p ON ii.product_id = p.id
+				GROUP BY ii.invoice_id
+			) lines ON lines.invoice_id = i.id::text
+			WHERE i.invoice_date BETWEEN ? AND ? AND i.is_active = true
+		`
+	}
 
 	// Operating expenses
 	expensesQuery := `
@@ -3,6 +3,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -117,11 +118,20 @@ func (h *SalesHandler) GetInvoice(c *gin.Context) {
 	c.JSON(http.StatusOK, invoice)
 }
 
-// CreateInvoice creates a new invoice
+// CreateInvoice creates a new invoice. Credit limits and payment terms are
+// not checked here; only sales-service billing enforces them, so a credit
+// invoice raised here relies on ApproveInvoice for that control.
 func (h *SalesHandler) CreateInvoice(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
 	defer cancel()
 
+	// Counters on flaky networks retry; a repeat returns the original invoice
+	claim, done := beginIdempotent(ctx, h.db.DB, c, "api-golang:invoices")
+	if done {
+		return
+	}
+	defer claim.release(h.db.DB)
+
 	var invoice Invoice
 	if err := c.ShouldBindJSON(&invoice); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -138,38 +148,47 @@ func (h *SalesHandler) CreateInvoice(c *gin.Context) {
 	invoice.Status = "draft"
 	invoice.PaymentStatus = "unpaid"
 
-	// Calculate totals
-	for i := range invoice.Items {
-		item := &invoice.Items[i]
-		item.TotalAmount = item.Quantity * item.UnitPrice
-		item.DiscountAmount = (item.TotalAmount * item.DiscountPercent) / 100
-		item.TaxAmount = ((item.TotalAmount - item.DiscountAmount) * item.TaxPercent) / 100
-		item.TotalAmount = item.TotalAmount - item.DiscountAmount + item.TaxAmount
-	}
-
-	invoice.Subtotal = 0
-	invoice.TaxAmount = 0
-	invoice.TotalAmount = 0
-
-	for _, item := range invoice.Items {
-		invoice.Subtotal += item.Quantity * item.UnitPrice
-		invoice.TaxAmount += item.TaxAmount
-		invoice.TotalAmount += item.TotalAmount
+	// Calculate totals with GST resolved from the masters
+	if err := NewSalesService(h.db, h.cache).applyGST(ctx, &invoice); err != nil {
+		taxErrorResponse(c, err)
+		return
 	}
 
 	invoice.OutstandingAmount = invoice.TotalAmount
 
-	// Generate invoice number if series is specified
-	if invoice.InvoiceSeriesID != "" {
-		var series InvoiceSeries
-		if err := h.db.DB.WithContext(ctx).Where("id = ? AND is_active = ?", invoice.InvoiceSeriesID, true).First(&series).Error; err == nil {
-			invoice.InvoiceNumber = fmt.Sprintf("%s%06d", series.Prefix, series.CurrentNumber)
-			series.CurrentNumber++
-			h.db.DB.WithContext(ctx).Save(&series)
+	err := h.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Generate invoice number if series is specified
+		if invoice.InvoiceSeriesID != "" {
+			if invoice.InvoiceDate.IsZero() {
+				invoice.InvoiceDate = time.Now()
+			}
+			number, err := nextSeriesInvoiceNo(tx, invoice.InvoiceSeriesID, invoice.InvoiceDate)
+			if err != nil {
+				return err
+			}
+			invoice.InvoiceNumber = number
 		}
-	}
 
-	if err := h.db.DB.WithContext(ctx).Create(&invoice).Error; err != nil {
+		if err := tx.Create(&invoice).Error; err != nil {
+			return err
+		}
+
+		// Store the response with the invoice so a retry gets it back
+		return claim.complete(tx, http.StatusCreated, invoice)
+	})
+	if errors.Is(err, errClaimLost) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A retry with this " + IdempotencyKeyHeader + " took the request over"})
+		return
+	}
+	if errors.Is(err, errInvoiceSeriesNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, errInvoiceSeriesExhausted) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invoice"})
 		return
 	}
@@ -217,25 +236,15 @@ func (h *SalesHandler) UpdateInvoice(c *gin.Context) {
 	invoice.Notes = updateData.Notes
 	invoice.SalesmanID = updateData.SalesmanID
 
-	// Recalculate totals from items
-	for i := range updateData.Items {
-		item := &updateData.Items[i]
-		item.TotalAmount = item.Quantity * item.UnitPrice
-		item.DiscountAmount = (item.TotalAmount * item.DiscountPercent) / 100
-		item.TaxAmount = ((item.TotalAmount - item.DiscountAmount) * item.TaxPercent) / 100
-		item.TotalAmount = item.TotalAmount - item.DiscountAmount + item.TaxAmount
-	}
-
+	// Recalculate totals from items with GST resolved from the masters
 	invoice.Items = updateData.Items
-
-	invoice.Subtotal = 0
-	invoice.TaxAmount = 0
-	invoice.TotalAmount = 0
-
-	for _, item := range invoice.Items {
-		invoice.Subtotal += item.Quantity * item.UnitPrice
-		invoice.TaxAmount += item.TaxAmount
-		invoice.TotalAmount += item.TotalAmount
+	if updateData.BranchID != "" {
+		invoice.BranchID = updateData.BranchID
+	}
+	invoice.PlaceOfSupply = updateData.PlaceOfSupply
+	if err := NewSalesService(h.db, h.cache).applyGST(ctx, &invoice); err != nil {
+		taxErrorResponse(c, err)
+		return
 	}
 
 	invoice.OutstandingAmount = invoice.TotalAmount - invoice.PaidAmount
@@ -974,6 +983,269 @@ func (h *SalesHandler) GetOrdersByCustomer(c *gin.Context) {
 	c.JSON(http.StatusOK, orders)
 }
 
+// ==================== QUOTATION HANDLERS ====================
+
+// GetQuotations retrieves quotations; superseded versions are left out
+// unless asked for
+func (h *SalesHandler) GetQuotations(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var quotations []Quotation
+
+	query := h.db.DB.WithContext(ctx).
+		Preload("Customer").
+		Preload("Items").
+		Model(&Quotation{}).
+		Where("is_active = ?", true)
+
+	if customerID := c.Query("customer_id"); customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+	if salesmanID := c.Query("salesman_id"); salesmanID != "" {
+		query = query.Where("salesman_id = ?", salesmanID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	} else if c.Query("include_superseded") != "true" {
+		query = query.Where("status <> ?", QuotationSuperseded)
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count quotations"})
+		return
+	}
+
+	if err := query.Limit(limit).Offset(offset).Order("created_at DESC").Find(&quotations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quotations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"quotations": quotations,
+		"total":      total,
+		"limit":      limit,
+		"offset":     offset,
+	})
+}
+
+// GetQuotation retrieves a specific quotation version
+func (h *SalesHandler) GetQuotation(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	quotation, err := NewSalesService(h.db, h.cache).GetQuotationByID(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quotation"})
+		return
+	}
+	if quotation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quotation not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, quotation)
+}
+
+// GetQuotationVersions lists every version issued under a quotation's number
+func (h *SalesHandler) GetQuotationVersions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var quotation Quotation
+	if err := h.db.DB.WithContext(ctx).Where("id = ? AND is_active = ?", c.Param("id"), true).First(&quotation).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Quotation not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quotation"})
+		return
+	}
+
+	var versions []Quotation
+	if err := h.db.DB.WithContext(ctx).
+		Preload("Items").
+		Where("quotation_number = ? AND is_active = ?", quotation.QuotationNumber, true).
+		Order("version").
+		Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quotation versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+// CreateQuotation creates a new quotation, priced and taxed like an invoice
+func (h *SalesHandler) CreateQuotation(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var quotation Quotation
+	if err := c.ShouldBindJSON(&quotation); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if quotation.CreatedBy == "" {
+		quotation.CreatedBy = c.GetString("user_id")
+	}
+
+	if _, err := NewSalesService(h.db, h.cache).CreateQuotation(ctx, &quotation); err != nil {
+		quotationErrorResponse(c, err, "Failed to create quotation")
+		return
+	}
+
+	c.JSON(http.StatusCreated, quotation)
+}
+
+// ReviseQuotation issues the next version of a quotation
+func (h *SalesHandler) ReviseQuotation(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	var revised Quotation
+	if err := c.ShouldBindJSON(&revised); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if revised.CreatedBy == "" {
+		revised.CreatedBy = c.GetString("user_id")
+	}
+
+	if _, err := NewSalesService(h.db, h.cache).ReviseQuotation(ctx, c.Param("id"), &revised); err != nil {
+		quotationErrorResponse(c, err, "Failed to revise quotation")
+		return
+	}
+
+	c.JSON(http.StatusCreated, revised)
+}
+
+// SendQuotation marks a draft quotation as sent to the customer
+func (h *SalesHandler) SendQuotation(c *gin.Context) {
+	h.moveQuotation(c, QuotationSent, "")
+}
+
+// AcceptQuotation records the customer's acceptance of a quotation
+func (h *SalesHandler) AcceptQuotation(c *gin.Context) {
+	h.moveQuotation(c, QuotationAccepted, "")
+}
+
+// RejectQuotation records the customer's rejection of a quotation
+func (h *SalesHandler) RejectQuotation(c *gin.Context) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.moveQuotation(c, QuotationRejected, req.Reason)
+}
+
+func (h *SalesHandler) moveQuotation(c *gin.Context, status, reason string) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	quotation, err := NewSalesService(h.db, h.cache).UpdateQuotationStatus(ctx, c.Param("id"), status, reason)
+	if err != nil {
+		quotationErrorResponse(c, err, "Failed to update quotation")
+		return
+	}
+
+	c.JSON(http.StatusOK, quotation)
+}
+
+// ConvertQuotationToOrder creates a sales order from an accepted quotation at
+// the quoted prices
+func (h *SalesHandler) ConvertQuotationToOrder(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	order, err := NewSalesService(h.db, h.cache).ConvertQuotationToOrder(ctx, c.Param("id"), c.GetString("user_id"))
+	if err != nil {
+		quotationErrorResponse(c, err, "Failed to convert quotation")
+		return
+	}
+
+	c.JSON(http.StatusCreated, order)
+}
+
+// GetQuotationPDF downloads a quotation as a PDF
+func (h *SalesHandler) GetQuotationPDF(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	quotation, err := NewSalesService(h.db, h.cache).GetQuotationByID(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quotation"})
+		return
+	}
+	if quotation == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quotation not found"})
+		return
+	}
+
+	filename := fmt.Sprintf("%s-v%d.pdf", quotation.QuotationNumber, quotation.Version)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(http.StatusOK, "application/pdf", RenderQuotationPDF(quotation))
+}
+
+// GetQuoteConversion reports the quote-to-order ratio per salesperson. The
+// period defaults to the current month.
+func (h *SalesHandler) GetQuoteConversion(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	to := from.AddDate(0, 1, 0)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be YYYY-MM-DD"})
+			return
+		}
+		from = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be YYYY-MM-DD"})
+			return
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+
+	rows, err := NewSalesService(h.db, h.cache).GetQuoteConversion(ctx, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute quote conversion"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":        from.Format("2006-01-02"),
+		"to":          to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"salespeople": rows,
+	})
+}
+
+// quotationErrorResponse reports a quotation that could not be saved or moved
+func quotationErrorResponse(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrQuotationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quotation not found"})
+	case errors.Is(err, ErrInvalidQuotation):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNoTaxRate):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
 // ==================== INVOICE SERIES HANDLERS ====================
 
 // GetInvoiceSeries retrieves all invoice series
@@ -1166,30 +1438,18 @@ func (h *SalesHandler) CreateReturn(c *gin.Context) {
 		return
 	}
 
-	// Calculate totals
-	for i := range returnRecord.Items {
-		item := &returnRecord.Items[i]
-		item.TotalAmount = item.Quantity * item.UnitPrice
-	}
-
-	returnRecord.Subtotal = 0
-	returnRecord.TaxAmount = 0
-	returnRecord.TotalAmount = 0
-
-	for _, item := range returnRecord.Items {
-		returnRecord.Subtotal += item.Quantity * item.UnitPrice
-		returnRecord.TaxAmount += item.TaxAmount
-		returnRecord.TotalAmount += item.TotalAmount
-	}
+	returnRecord.ProcessedBy = c.GetString("user_id")
 
-	if err := h.db.DB.WithContext(ctx).Create(&returnRecord).Error; err != nil {
+	// Quantities and amounts are checked against the original invoice
+	if _, err := NewSalesService(h.db, h.cache).CreateReturn(ctx, &returnRecord); err != nil {
+		if errors.Is(err, ErrInvalidReturn) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create return"})
 		return
 	}
 
-	// Clear cache
-	h.cache.DeletePattern(ctx, "returns:*")
-
 	c.JSON(http.StatusCreated, returnRecord)
 }
 
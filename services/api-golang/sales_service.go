@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/yeelo/homeopathy-platform/shared-go/creditnote"
+	"github.com/yeelo/homeopathy-platform/shared-go/docno"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // ==================== SALES & INVOICING MODELS ====================
@@ -13,21 +19,21 @@ import (
 // Invoice represents sales invoices
 type Invoice struct {
 	BaseEntity
-	InvoiceNumber     string    `gorm:"not null;uniqueIndex;size:100" json:"invoice_number" validate:"required"`
-	CustomerID        string    `gorm:"not null;index" json:"customer_id" validate:"required"`
-	Customer          Customer  `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
-	InvoiceDate       time.Time `gorm:"not null" json:"invoice_date"`
-	DueDate           time.Time `gorm:"not null" json:"due_date"`
-	Subtotal          float64   `gorm:"type:decimal(15,2);not null;default:0" json:"subtotal" validate:"min=0"`
-	TaxAmount         float64   `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount" validate:"min=0"`
-	DiscountAmount    float64   `gorm:"type:decimal(15,2);not null;default:0" json:"discount_amount" validate:"min=0"`
-	TotalAmount       float64   `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount" validate:"min=0"`
-	PaidAmount        float64   `gorm:"type:decimal(15,2);not null;default:0" json:"paid_amount" validate:"min=0"`
-	OutstandingAmount float64   `gorm:"type:decimal(15,2);not null;default:0" json:"outstanding_amount" validate:"min=0"`
-	Status            string    `gorm:"not null;default:draft;size:20" json:"status" validate:"oneof=draft confirmed cancelled paid overdue"`
-	PaymentStatus     string    `gorm:"not null;default:unpaid;size:20" json:"payment_status" validate:"oneof=unpaid partial_paid paid refunded"`
-	PaymentTerms      string    `gorm:"size:100" json:"payment_terms"`
-	Notes             string    `gorm:"type:text" json:"notes"`
+	InvoiceNumber     string        `gorm:"not null;uniqueIndex;size:100" json:"invoice_number" validate:"required"`
+	CustomerID        string        `gorm:"not null;index" json:"customer_id" validate:"required"`
+	Customer          Customer      `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
+	InvoiceDate       time.Time     `gorm:"not null" json:"invoice_date"`
+	DueDate           time.Time     `gorm:"not null" json:"due_date"`
+	Subtotal          float64       `gorm:"type:decimal(15,2);not null;default:0" json:"subtotal" validate:"min=0"`
+	TaxAmount         float64       `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount" validate:"min=0"`
+	DiscountAmount    float64       `gorm:"type:decimal(15,2);not null;default:0" json:"discount_amount" validate:"min=0"`
+	TotalAmount       float64       `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount" validate:"min=0"`
+	PaidAmount        float64       `gorm:"type:decimal(15,2);not null;default:0" json:"paid_amount" validate:"min=0"`
+	OutstandingAmount float64       `gorm:"type:decimal(15,2);not null;default:0" json:"outstanding_amount" validate:"min=0"`
+	Status            string        `gorm:"not null;default:draft;size:20" json:"status" validate:"oneof=draft confirmed cancelled paid overdue"`
+	PaymentStatus     string        `gorm:"not null;default:unpaid;size:20" json:"payment_status" validate:"oneof=unpaid partial_paid paid refunded"`
+	PaymentTerms      string        `gorm:"size:100" json:"payment_terms"`
+	Notes             string        `gorm:"type:text" json:"notes"`
 	Items             []InvoiceItem `gorm:"foreignKey:InvoiceID" json:"items"`
 	Payments          []Payment     `gorm:"foreignKey:InvoiceID" json:"payments"`
 	SalesmanID        string        `gorm:"index" json:"salesman_id"`
@@ -37,25 +43,41 @@ type Invoice struct {
 	ShippedAt         *time.Time    `gorm:"null" json:"shipped_at"`
 	CancelledAt       *time.Time    `gorm:"null" json:"cancelled_at"`
 	InvoiceSeriesID   string        `gorm:"index" json:"invoice_series_id"`
+	BranchID          string        `gorm:"index" json:"branch_id"`
+	PlaceOfSupply     string        `gorm:"size:100" json:"place_of_supply"`
+	SupplyType        string        `gorm:"size:20" json:"supply_type"` // INTRA_STATE, INTER_STATE
+	CGSTAmount        float64       `gorm:"type:decimal(15,2);not null;default:0" json:"cgst_amount"`
+	SGSTAmount        float64       `gorm:"type:decimal(15,2);not null;default:0" json:"sgst_amount"`
+	IGSTAmount        float64       `gorm:"type:decimal(15,2);not null;default:0" json:"igst_amount"`
+	RoundOff          float64       `gorm:"type:decimal(15,2);not null;default:0" json:"round_off"`
 }
 
 // InvoiceItem represents individual items in an invoice
 type InvoiceItem struct {
 	BaseEntity
-	InvoiceID     string    `gorm:"not null;index" json:"invoice_id"`
-	ProductID     string    `gorm:"not null;index" json:"product_id" validate:"required"`
-	Product       Product   `gorm:"foreignKey:ProductID" json:"product,omitempty"`
-	ProductName   string    `gorm:"not null;size:255" json:"product_name" validate:"required"`
-	ProductCode   string    `gorm:"size:100" json:"product_code"`
-	Quantity      int       `gorm:"not null;default:1" json:"quantity" validate:"min=1"`
-	UnitPrice     float64   `gorm:"type:decimal(15,2);not null;default:0" json:"unit_price" validate:"min=0"`
-	DiscountPercent float64 `gorm:"default:0;check:discount >= 0 AND discount <= 100" json:"discount_percent" validate:"min=0,max=100"`
-	DiscountAmount float64  `gorm:"type:decimal(15,2);not null;default:0" json:"discount_amount" validate:"min=0"`
-	TaxPercent    float64   `gorm:"default:0;check:tax >= 0 AND tax <= 100" json:"tax_percent" validate:"min=0,max=100"`
-	TaxAmount     float64   `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount" validate:"min=0"`
-	TotalAmount   float64   `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount" validate:"min=0"`
-	BatchNumber   string    `gorm:"size:100" json:"batch_number"`
-	ExpiryDate    *time.Time `gorm:"null" json:"expiry_date"`
+	InvoiceID       string     `gorm:"not null;index" json:"invoice_id"`
+	ProductID       string     `gorm:"not null;index" json:"product_id" validate:"required"`
+	Product         Product    `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+	ProductName     string     `gorm:"not null;size:255" json:"product_name" validate:"required"`
+	ProductCode     string     `gorm:"size:100" json:"product_code"`
+	Quantity        int        `gorm:"not null;default:1" json:"quantity" validate:"min=1"`
+	UnitPrice       float64    `gorm:"type:decimal(15,2);not null;default:0" json:"unit_price" validate:"min=0"`
+	DiscountPercent float64    `gorm:"default:0;check:discount >= 0 AND discount <= 100" json:"discount_percent" validate:"min=0,max=100"`
+	DiscountAmount  float64    `gorm:"type:decimal(15,2);not null;default:0" json:"discount_amount" validate:"min=0"`
+	TaxPercent      float64    `gorm:"default:0;check:tax >= 0 AND tax <= 100" json:"tax_percent" validate:"min=0,max=100"`
+	TaxAmount       float64    `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount" validate:"min=0"`
+	TaxInclusive    bool       `gorm:"default:false" json:"tax_inclusive"` // unit price is MRP including GST
+	HSNCode         string     `gorm:"size:8" json:"hsn_code"`
+	TaxableValue    float64    `gorm:"type:decimal(15,2);not null;default:0" json:"taxable_value"`
+	CGSTRate        float64    `gorm:"type:decimal(5,2);not null;default:0" json:"cgst_rate"`
+	CGSTAmount      float64    `gorm:"type:decimal(15,2);not null;default:0" json:"cgst_amount"`
+	SGSTRate        float64    `gorm:"type:decimal(5,2);not null;default:0" json:"sgst_rate"`
+	SGSTAmount      float64    `gorm:"type:decimal(15,2);not null;default:0" json:"sgst_amount"`
+	IGSTRate        float64    `gorm:"type:decimal(5,2);not null;default:0" json:"igst_rate"`
+	IGSTAmount      float64    `gorm:"type:decimal(15,2);not null;default:0" json:"igst_amount"`
+	TotalAmount     float64    `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount" validate:"min=0"`
+	BatchNumber     string     `gorm:"size:100" json:"batch_number"`
+	ExpiryDate      *time.Time `gorm:"null" json:"expiry_date"`
 }
 
 // Payment represents payments made against invoices
@@ -76,22 +98,23 @@ type Payment struct {
 // SalesOrder represents sales orders/quotations
 type SalesOrder struct {
 	BaseEntity
-	OrderNumber     string    `gorm:"not null;uniqueIndex;size:100" json:"order_number" validate:"required"`
-	CustomerID      string    `gorm:"not null;index" json:"customer_id" validate:"required"`
-	Customer        Customer  `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
-	OrderDate       time.Time `gorm:"not null" json:"order_date"`
-	DeliveryDate    *time.Time `gorm:"null" json:"delivery_date"`
-	Subtotal        float64   `gorm:"type:decimal(15,2);not null;default:0" json:"subtotal" validate:"min=0"`
-	TaxAmount       float64   `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount" validate:"min=0"`
-	DiscountAmount  float64   `gorm:"type:decimal(15,2);not null;default:0" json:"discount_amount" validate:"min=0"`
-	TotalAmount     float64   `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount" validate:"min=0"`
-	Status          string    `gorm:"not null;default:draft;size:20" json:"status" validate:"oneof=draft confirmed shipped delivered cancelled"`
-	PaymentStatus   string    `gorm:"not null;default:unpaid;size:20" json:"payment_status" validate:"oneof=unpaid partial_paid paid"`
-	PaymentTerms    string    `gorm:"size:100" json:"payment_terms"`
-	Notes           string    `gorm:"type:text" json:"notes"`
-	Items           []SalesOrderItem `gorm:"foreignKey:SalesOrderID" json:"items"`
-	SalesmanID      string    `gorm:"index" json:"salesman_id"`
-	CreatedBy       string    `gorm:"not null;size:255" json:"created_by" validate:"required"`
+	OrderNumber    string           `gorm:"not null;uniqueIndex;size:100" json:"order_number" validate:"required"`
+	QuotationID    *string          `gorm:"index" json:"quotation_id"` // set when converted from a quotation
+	CustomerID     string           `gorm:"not null;index" json:"customer_id" validate:"required"`
+	Customer       Customer         `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
+	OrderDate      time.Time        `gorm:"not null" json:"order_date"`
+	DeliveryDate   *time.Time       `gorm:"null" json:"delivery_date"`
+	Subtotal       float64          `gorm:"type:decimal(15,2);not null;default:0" json:"subtotal" validate:"min=0"`
+	TaxAmount      float64          `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount" validate:"min=0"`
+	DiscountAmount float64          `gorm:"type:decimal(15,2);not null;default:0" json:"discount_amount" validate:"min=0"`
+	TotalAmount    float64          `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount" validate:"min=0"`
+	Status         string           `gorm:"not null;default:draft;size:20" json:"status" validate:"oneof=draft confirmed shipped delivered cancelled"`
+	PaymentStatus  string           `gorm:"not null;default:unpaid;size:20" json:"payment_status" validate:"oneof=unpaid partial_paid paid"`
+	PaymentTerms   string           `gorm:"size:100" json:"payment_terms"`
+	Notes          string           `gorm:"type:text" json:"notes"`
+	Items          []SalesOrderItem `gorm:"foreignKey:SalesOrderID" json:"items"`
+	SalesmanID     string           `gorm:"index" json:"salesman_id"`
+	CreatedBy      string           `gorm:"not null;size:255" json:"created_by" validate:"required"`
 }
 
 // SalesOrderItem represents individual items in a sales order
@@ -116,25 +139,26 @@ type SalesOrderItem struct {
 // Return represents sales returns and credit notes
 type Return struct {
 	BaseEntity
-	ReturnNumber     string    `gorm:"not null;uniqueIndex;size:100" json:"return_number" validate:"required"`
-	InvoiceID        string    `gorm:"not null;index" json:"invoice_id" validate:"required"`
-	Invoice          Invoice   `gorm:"foreignKey:InvoiceID" json:"invoice,omitempty"`
-	CustomerID       string    `gorm:"not null;index" json:"customer_id" validate:"required"`
-	Customer         Customer  `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
-	ReturnDate       time.Time `gorm:"not null" json:"return_date"`
-	Reason           string    `gorm:"not null;size:255" json:"reason" validate:"required"`
-	Subtotal         float64   `gorm:"type:decimal(15,2);not null;default:0" json:"subtotal" validate:"min=0"`
-	TaxAmount        float64   `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount" validate:"min=0"`
-	TotalAmount      float64   `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount" validate:"min=0"`
-	Status           string    `gorm:"not null;default:pending;size:20" json:"status" validate:"oneof=pending approved rejected completed"`
-	ApprovedBy       string    `gorm:"size:255" json:"approved_by"`
-	ApprovedAt       *time.Time `gorm:"null" json:"approved_at"`
-	ProcessedBy      string    `gorm:"size:255" json:"processed_by"`
-	ProcessedAt      *time.Time `gorm:"null" json:"processed_at"`
-	Items            []ReturnItem `gorm:"foreignKey:ReturnID" json:"items"`
-	RefundMethod     string    `gorm:"size:50" json:"refund_method"`
-	RefundReference  string    `gorm:"size:255" json:"refund_reference"`
-	Notes            string    `gorm:"type:text" json:"notes"`
+	ReturnNumber    string                 `gorm:"not null;uniqueIndex;size:100" json:"return_number" validate:"required"`
+	InvoiceID       string                 `gorm:"not null;index" json:"invoice_id" validate:"required"`
+	Invoice         Invoice                `gorm:"foreignKey:InvoiceID" json:"invoice,omitempty"`
+	CustomerID      string                 `gorm:"not null;index" json:"customer_id" validate:"required"`
+	Customer        Customer               `gorm:"foreignKey:CustomerID" json:"customer,omitempty"`
+	ReturnDate      time.Time              `gorm:"not null" json:"return_date"`
+	Reason          string                 `gorm:"not null;size:255" json:"reason" validate:"required"`
+	Subtotal        float64                `gorm:"type:decimal(15,2);not null;default:0" json:"subtotal" validate:"min=0"`
+	TaxAmount       float64                `gorm:"type:decimal(15,2);not null;default:0" json:"tax_amount" validate:"min=0"`
+	TotalAmount     float64                `gorm:"type:decimal(15,2);not null;default:0" json:"total_amount" validate:"min=0"`
+	Status          string                 `gorm:"not null;default:pending;size:20" json:"status" validate:"oneof=pending approved rejected completed"`
+	ApprovedBy      string                 `gorm:"size:255" json:"approved_by"`
+	ApprovedAt      *time.Time             `gorm:"null" json:"approved_at"`
+	ProcessedBy     string                 `gorm:"size:255" json:"processed_by"`
+	ProcessedAt     *time.Time             `gorm:"null" json:"processed_at"`
+	Items           []ReturnItem           `gorm:"foreignKey:ReturnID" json:"items"`
+	RefundMethod    string                 `gorm:"size:50" json:"refund_method"`
+	RefundReference string                 `gorm:"size:255" json:"refund_reference"`
+	Notes           string                 `gorm:"type:text" json:"notes"`
+	CreditNote      *creditnote.CreditNote `gorm:"foreignKey:ReturnID" json:"credit_note,omitempty"`
 }
 
 // ReturnItem represents individual items in a return
@@ -272,42 +296,33 @@ func (s *SalesService) GetInvoices(ctx context.Context, filters map[string]inter
 }
 
 func (s *SalesService) CreateInvoice(ctx context.Context, invoice *Invoice) (*Invoice, error) {
-	// Generate invoice number from series
-	if invoice.InvoiceSeriesID != "" {
-		series, err := s.GetInvoiceSeriesByID(ctx, invoice.InvoiceSeriesID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get invoice series: %w", err)
-		}
-		invoice.InvoiceNumber = fmt.Sprintf("%s%06d", series.Prefix, series.CurrentNumber)
-		series.CurrentNumber++
-		if err := s.db.DB.WithContext(ctx).Save(series).Error; err != nil {
-			return nil, fmt.Errorf("failed to update invoice series: %w", err)
-		}
-	}
-
-	// Calculate totals
-	for i := range invoice.Items {
-		item := &invoice.Items[i]
-		item.TotalAmount = item.Quantity * item.UnitPrice
-		item.DiscountAmount = (item.TotalAmount * item.DiscountPercent) / 100
-		item.TaxAmount = ((item.TotalAmount - item.DiscountAmount) * item.TaxPercent) / 100
-		item.TotalAmount = item.TotalAmount - item.DiscountAmount + item.TaxAmount
+	if invoice.InvoiceDate.IsZero() {
+		invoice.InvoiceDate = time.Now()
 	}
 
-	invoice.Subtotal = 0
-	invoice.TaxAmount = 0
-	invoice.TotalAmount = 0
-
-	for _, item := range invoice.Items {
-		invoice.Subtotal += item.Quantity * item.UnitPrice
-		invoice.TaxAmount += item.TaxAmount
-		invoice.TotalAmount += item.TotalAmount
+	// Calculate totals with GST resolved from the masters
+	if err := s.applyGST(ctx, invoice); err != nil {
+		return nil, err
 	}
 
 	invoice.OutstandingAmount = invoice.TotalAmount
 
-	if err := s.db.DB.WithContext(ctx).Create(invoice).Error; err != nil {
-		return nil, fmt.Errorf("failed to create invoice: %w", err)
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if invoice.InvoiceSeriesID != "" {
+			number, err := nextSeriesInvoiceNo(tx, invoice.InvoiceSeriesID, invoice.InvoiceDate)
+			if err != nil {
+				return err
+			}
+			invoice.InvoiceNumber = number
+		}
+
+		if err := tx.Create(invoice).Error; err != nil {
+			return fmt.Errorf("failed to create invoice: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Clear cache for related data
@@ -316,6 +331,38 @@ func (s *SalesService) CreateInvoice(ctx context.Context, invoice *Invoice) (*In
 	return invoice, nil
 }
 
+var (
+	errInvoiceSeriesNotFound  = errors.New("invoice series not found or inactive")
+	errInvoiceSeriesExhausted = errors.New("invoice series is exhausted")
+)
+
+// nextSeriesInvoiceNo numbers an invoice from its series. The counter is the
+// one sales-service draws from, advanced inside tx so the series stays
+// gap-free and two invoices never share a number.
+func nextSeriesInvoiceNo(tx *gorm.DB, seriesID string, at time.Time) (string, error) {
+	var series InvoiceSeries
+	if err := tx.Where("id = ? AND is_active = ?", seriesID, true).First(&series).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", errInvoiceSeriesNotFound
+		}
+		return "", fmt.Errorf("failed to get invoice series: %w", err)
+	}
+
+	start := series.StartNumber
+	if start <= 0 {
+		start = 1
+	}
+	fy := docno.FinancialYear(at)
+	seq, err := docno.NextSequence(tx, series.ID, fy, start)
+	if err != nil {
+		return "", fmt.Errorf("failed to number invoice: %w", err)
+	}
+	if series.EndNumber > 0 && seq > series.EndNumber {
+		return "", fmt.Errorf("%w: %s for %s", errInvoiceSeriesExhausted, series.Code, fy)
+	}
+	return docno.Format(series.Pattern, series.Prefix, series.Suffix, fy, seq), nil
+}
+
 func (s *SalesService) UpdateInvoice(ctx context.Context, id string, invoice *Invoice) (*Invoice, error) {
 	existing, err := s.GetInvoiceByID(ctx, id)
 	if err != nil {
@@ -330,23 +377,12 @@ func (s *SalesService) UpdateInvoice(ctx context.Context, id string, invoice *In
 		return nil, fmt.Errorf("cannot edit issued invoice")
 	}
 
-	// Calculate totals
-	for i := range invoice.Items {
-		item := &invoice.Items[i]
-		item.TotalAmount = item.Quantity * item.UnitPrice
-		item.DiscountAmount = (item.TotalAmount * item.DiscountPercent) / 100
-		item.TaxAmount = ((item.TotalAmount - item.DiscountAmount) * item.TaxPercent) / 100
-		item.TotalAmount = item.TotalAmount - item.DiscountAmount + item.TaxAmount
+	// Calculate totals with GST resolved from the masters
+	if invoice.BranchID == "" {
+		invoice.BranchID = existing.BranchID
 	}
-
-	invoice.Subtotal = 0
-	invoice.TaxAmount = 0
-	invoice.TotalAmount = 0
-
-	for _, item := range invoice.Items {
-		invoice.Subtotal += item.Quantity * item.UnitPrice
-		invoice.TaxAmount += item.TaxAmount
-		invoice.TotalAmount += item.TotalAmount
+	if err := s.applyGST(ctx, invoice); err != nil {
+		return nil, err
 	}
 
 	invoice.OutstandingAmount = invoice.TotalAmount - existing.PaidAmount
@@ -592,24 +628,169 @@ func (s *SalesService) GetReturnByID(ctx context.Context, id string) (*Return, e
 	return &returnRecord, nil
 }
 
+// ErrInvalidReturn is returned when a return does not match what was sold
+var ErrInvalidReturn = errors.New("invalid return")
+
+// CreateReturn records a return against an invoice. Each line must name an
+// item on that invoice and may not take back more than is left unreturned;
+// amounts are credited pro rata from the invoice line rather than trusted
+// from the client. The units go back into the invoice branch's stock through
+// the shared ledger, sellable ones into their batch and damaged ones into its
+// damaged bin, and the return is credited to the customer as a numbered
+// credit note.
 func (s *SalesService) CreateReturn(ctx context.Context, returnRecord *Return) (*Return, error) {
-	// Calculate totals
-	for i := range returnRecord.Items {
-		item := &returnRecord.Items[i]
-		item.TotalAmount = item.Quantity * item.UnitPrice
-	}
+	now := time.Now()
+	if returnRecord.ReturnDate.IsZero() {
+		returnRecord.ReturnDate = now
+	}
+	// Stock the invoice took out goes back as the return is recorded
+	returnRecord.ProcessedAt = &now
+
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Lock the invoice so concurrent returns cannot both take the last unit
+		var invoice Invoice
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND is_active = ?", returnRecord.InvoiceID, true).
+			First(&invoice).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return fmt.Errorf("%w: invoice not found", ErrInvalidReturn)
+			}
+			return err
+		}
+		if invoice.Status == "cancelled" {
+			return fmt.Errorf("%w: invoice %s is cancelled", ErrInvalidReturn, invoice.InvoiceNumber)
+		}
+		if invoice.BranchID == "" {
+			return fmt.Errorf("%w: invoice %s has no branch to restock", ErrInvalidReturn, invoice.InvoiceNumber)
+		}
 
-	returnRecord.Subtotal = 0
-	returnRecord.TaxAmount = 0
-	returnRecord.TotalAmount = 0
+		var invoiceItems []InvoiceItem
+		if err := tx.Where("invoice_id = ?", invoice.ID).Find(&invoiceItems).Error; err != nil {
+			return err
+		}
+		byID := make(map[string]InvoiceItem, len(invoiceItems))
+		for _, item := range invoiceItems {
+			byID[item.ID] = item
+		}
 
-	for _, item := range returnRecord.Items {
-		returnRecord.Subtotal += item.Quantity * item.UnitPrice
-		returnRecord.TaxAmount += item.TaxAmount
-		returnRecord.TotalAmount += item.TotalAmount
-	}
+		var prior []struct {
+			InvoiceItemID string
+			Quantity      int
+		}
+		if err := tx.Raw(`
+			SELECT ri.invoice_item_id, SUM(ri.quantity) AS quantity
+			FROM return_items ri
+			JOIN returns r ON r.id = ri.return_id
+			WHERE r.invoice_id = ? AND r.is_active = true AND r.status <> 'rejected'
+			GROUP BY ri.invoice_item_id
+		`, invoice.ID).Scan(&prior).Error; err != nil {
+			return err
+		}
+		returned := make(map[string]int, len(prior))
+		for _, p := range prior {
+			returned[p.InvoiceItemID] = p.Quantity
+		}
+
+		returnRecord.CustomerID = invoice.CustomerID
+		returnRecord.Subtotal = 0
+		returnRecord.TaxAmount = 0
+		returnRecord.TotalAmount = 0
+
+		for i := range returnRecord.Items {
+			item := &returnRecord.Items[i]
+			sold, ok := byID[item.InvoiceItemID]
+			if !ok {
+				return fmt.Errorf("%w: item %s is not on invoice %s", ErrInvalidReturn, item.InvoiceItemID, invoice.InvoiceNumber)
+			}
+			if item.Quantity <= 0 {
+				return fmt.Errorf("%w: each item needs a positive quantity", ErrInvalidReturn)
+			}
+			item.Condition = strings.ToUpper(item.Condition)
+			if item.Condition != ledger.ReturnSellable && item.Condition != ledger.ReturnDamaged {
+				return fmt.Errorf("%w: condition must be SELLABLE or DAMAGED", ErrInvalidReturn)
+			}
+			if left := sold.Quantity - returned[sold.ID]; item.Quantity > left {
+				return fmt.Errorf("%w: only %d of %s (batch %s) left to return", ErrInvalidReturn, left, sold.ProductName, sold.BatchNumber)
+			}
+			returned[sold.ID] += item.Quantity
+
+			share := float64(item.Quantity) / float64(sold.Quantity)
+			item.ProductID = sold.ProductID
+			item.ProductName = sold.ProductName
+			item.UnitPrice = sold.UnitPrice
+			item.DiscountAmount = roundPaise(sold.DiscountAmount * share)
+			item.TaxAmount = roundPaise(sold.TaxAmount * share)
+			item.TotalAmount = roundPaise(sold.TotalAmount * share)
+
+			returnRecord.Subtotal += item.TotalAmount - item.TaxAmount
+			returnRecord.TaxAmount += item.TaxAmount
+			returnRecord.TotalAmount += item.TotalAmount
+		}
+
+		returnRecord.Subtotal = roundPaise(returnRecord.Subtotal)
+		returnRecord.TaxAmount = roundPaise(returnRecord.TaxAmount)
+		returnRecord.TotalAmount = roundPaise(returnRecord.TotalAmount)
+
+		if err := tx.Create(returnRecord).Error; err != nil {
+			return err
+		}
+
+		for i := range returnRecord.Items {
+			item := &returnRecord.Items[i]
+			sold := byID[item.InvoiceItemID]
+
+			// Only stock the invoice took out of the shop goes back in
+			batchID, posted, err := saleBatch(tx, invoice.ID, sold.ProductID, sold.BatchNumber)
+			if err != nil {
+				return err
+			}
+			if !posted {
+				continue
+			}
+
+			_, disposition, err := ledger.Restock(tx, ledger.Return{
+				ProductID:     item.ProductID,
+				ShopID:        invoice.BranchID,
+				BatchID:       batchID,
+				BatchNo:       sold.BatchNumber,
+				Quantity:      float64(item.Quantity),
+				Disposition:   item.Condition,
+				Reason:        "Sales return " + returnRecord.ReturnNumber,
+				ReferenceType: "RETURN",
+				ReferenceID:   returnRecord.ID,
+				CreatedBy:     returnRecord.ProcessedBy,
+				At:            returnRecord.ReturnDate,
+			})
+			if errors.Is(err, ledger.ErrBatchNotFound) {
+				return fmt.Errorf("%w: batch %s of %s was not found to restock", ErrInvalidReturn, sold.BatchNumber, sold.ProductName)
+			}
+			if err != nil {
+				return err
+			}
+			// An expired or blocked batch cannot take sellable units back
+			if disposition != item.Condition {
+				item.Condition = disposition
+				if err := tx.Model(item).Update("condition", disposition).Error; err != nil {
+					return err
+				}
+			}
+		}
 
-	if err := s.db.DB.WithContext(ctx).Create(returnRecord).Error; err != nil {
+		note := &creditnote.CreditNote{
+			ReturnID:   returnRecord.ID,
+			InvoiceID:  invoice.ID,
+			CustomerID: invoice.CustomerID,
+			ShopID:     invoice.BranchID,
+			IssueDate:  returnRecord.ReturnDate,
+			Amount:     returnRecord.TotalAmount,
+		}
+		if err := creditnote.Issue(tx, note); err != nil {
+			return err
+		}
+		returnRecord.CreditNote = note
+		return nil
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to create return: %w", err)
 	}
 
@@ -619,6 +800,45 @@ func (s *SalesService) CreateReturn(ctx context.Context, returnRecord *Return) (
 	return returnRecord, nil
 }
 
+// saleMovement is a SALE movement an invoice posted and the batch it named
+type saleMovement struct {
+	BatchID *string
+	BatchNo *string
+}
+
+// saleBatch finds the SALE movements an invoice posted for a product and
+// matches one to a batch number (see matchSaleBatch)
+func saleBatch(tx *gorm.DB, invoiceID, productID, batchNo string) (*string, bool, error) {
+	var sales []saleMovement
+	if err := tx.Raw(`
+		SELECT m.batch_id, b.batch_no
+		FROM stock_movements m
+		LEFT JOIN batches b ON b.id = m.batch_id
+		WHERE m.reference_type = 'SALE' AND m.reference_id = ? AND m.product_id = ?
+		ORDER BY m.created_at ASC
+	`, invoiceID, productID).Scan(&sales).Error; err != nil {
+		return nil, false, err
+	}
+	batchID, posted := matchSaleBatch(sales, batchNo)
+	return batchID, posted, nil
+}
+
+// matchSaleBatch reports whether the invoice took the product out of stock
+// at all; posted is false for invoices created here, which post no
+// movements. batchID is the exact batch row the sale of batchNo drew from,
+// if a movement named one.
+func matchSaleBatch(sales []saleMovement, batchNo string) (batchID *string, posted bool) {
+	if len(sales) == 0 {
+		return nil, false
+	}
+	for _, sale := range sales {
+		if sale.BatchID != nil && sale.BatchNo != nil && *sale.BatchNo == batchNo {
+			return sale.BatchID, true
+		}
+	}
+	return nil, true
+}
+
 // ==================== COMMISSION OPERATIONS ====================
 
 func (s *SalesService) GetCommissions(ctx context.Context, filters map[string]interface{}, limit, offset int) ([]SalesmanCommission, int64, error) {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for matching a returned line to the sale that took it out of stock
+func TestMatchSaleBatch(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name        string
+		sales       []saleMovement
+		batchNo     string
+		wantBatchID *string
+		wantPosted  bool
+	}{
+		{
+			name:       "invoice never posted a sale",
+			batchNo:    "B1",
+			wantPosted: false,
+		},
+		{
+			name:        "exact batch row sold from",
+			sales:       []saleMovement{{BatchID: str("row-1"), BatchNo: str("B0")}, {BatchID: str("row-2"), BatchNo: str("B1")}},
+			batchNo:     "B1",
+			wantBatchID: str("row-2"),
+			wantPosted:  true,
+		},
+		{
+			name:       "sale named no batch",
+			sales:      []saleMovement{{}},
+			batchNo:    "B1",
+			wantPosted: true,
+		},
+		{
+			name:       "sale of another batch number",
+			sales:      []saleMovement{{BatchID: str("row-1"), BatchNo: str("B0")}},
+			batchNo:    "B1",
+			wantPosted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batchID, posted := matchSaleBatch(tt.sales, tt.batchNo)
+			assert.Equal(t, tt.wantPosted, posted)
+			assert.Equal(t, tt.wantBatchID, batchID)
+		})
+	}
+}
@@ -1123,6 +1123,7 @@ func seedPriceLists(db *gorm.DB) error {
 			Description:  "Standard retail price list",
 			Type:         "Sale",
 			CurrencyID:   inr.ID,
+			PricesIncludeTax: true,
 			IsActive:     true,
 		},
 		{
@@ -1179,6 +1180,7 @@ func seedDiscounts(db *gorm.DB) error {
 			Type:        "Percentage",
 			Value:       5.0,
 			MinAmount:   5000.0,
+			AutoApply:   true,
 			IsActive:    true,
 		},
 	}
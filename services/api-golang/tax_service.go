@@ -0,0 +1,96 @@
+// Tax Service - Server-side GST computation with CGST/SGST/IGST split by place of supply
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yeelo/homeopathy-platform/shared-go/gst"
+)
+
+// ErrNoTaxRate is returned when a product has no GST rate in force
+var ErrNoTaxRate = gst.ErrNoRate
+
+// applyGST prices every invoice line from the product masters through the
+// shared GST engine sales-service bills with. Client-supplied tax figures
+// are overwritten.
+func (s *SalesService) applyGST(ctx context.Context, invoice *Invoice) error {
+	db := s.db.DB.WithContext(ctx)
+
+	productIDs := make([]string, 0, len(invoice.Items))
+	for _, item := range invoice.Items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	rates, err := gst.Rates(db, productIDs, invoice.InvoiceDate)
+	if err != nil {
+		return fmt.Errorf("failed to resolve tax rates: %w", err)
+	}
+
+	invoice.PlaceOfSupply, invoice.SupplyType, err = gst.ResolveSupply(db, invoice.BranchID, invoice.CustomerID, invoice.PlaceOfSupply)
+	if err != nil {
+		return fmt.Errorf("failed to resolve place of supply: %w", err)
+	}
+
+	invoice.Subtotal, invoice.DiscountAmount, invoice.TaxAmount = 0, 0, 0
+	invoice.CGSTAmount, invoice.SGSTAmount, invoice.IGSTAmount = 0, 0, 0
+
+	var total float64
+	for i := range invoice.Items {
+		item := &invoice.Items[i]
+		rate, ok := rates[item.ProductID]
+		if !ok {
+			return fmt.Errorf("%w for %s", ErrNoTaxRate, item.ProductName)
+		}
+		applyLineGST(item, rate, invoice.SupplyType)
+
+		invoice.Subtotal += item.TaxableValue
+		invoice.DiscountAmount += item.DiscountAmount
+		invoice.CGSTAmount += item.CGSTAmount
+		invoice.SGSTAmount += item.SGSTAmount
+		invoice.IGSTAmount += item.IGSTAmount
+		total += item.TotalAmount
+	}
+
+	invoice.Subtotal = roundPaise(invoice.Subtotal)
+	invoice.DiscountAmount = roundPaise(invoice.DiscountAmount)
+	invoice.CGSTAmount = roundPaise(invoice.CGSTAmount)
+	invoice.SGSTAmount = roundPaise(invoice.SGSTAmount)
+	invoice.IGSTAmount = roundPaise(invoice.IGSTAmount)
+	invoice.TaxAmount = roundPaise(invoice.CGSTAmount + invoice.SGSTAmount + invoice.IGSTAmount)
+	invoice.TotalAmount, invoice.RoundOff = gst.RoundOff(total)
+
+	return nil
+}
+
+// applyLineGST prices one line after its percentage discount
+func applyLineGST(item *InvoiceItem, rate gst.Rate, supplyType string) {
+	gross := float64(item.Quantity) * item.UnitPrice
+	item.DiscountAmount = roundPaise(gross * item.DiscountPercent / 100)
+
+	line := gst.ComputeLine(gross-item.DiscountAmount, rate.Rate, item.TaxInclusive, supplyType)
+	item.HSNCode = rate.HSNCode
+	item.TaxPercent = rate.Rate
+	item.TaxableValue = line.TaxableValue
+	item.CGSTRate, item.CGSTAmount = line.CGSTRate, line.CGSTAmount
+	item.SGSTRate, item.SGSTAmount = line.SGSTRate, line.SGSTAmount
+	item.IGSTRate, item.IGSTAmount = line.IGSTRate, line.IGSTAmount
+	item.TaxAmount = line.TaxAmount
+	item.TotalAmount = line.Total
+}
+
+// taxErrorResponse reports a failure to price an invoice
+func taxErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, ErrNoTaxRate) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute tax"})
+}
+
+func roundPaise(v float64) float64 {
+	return gst.RoundPaise(v)
+}
@@ -0,0 +1,468 @@
+// Vendor Invoice Service - Three-way match of vendor bills against purchase orders and GRNs
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Vendor invoice statuses
+const (
+	VendorInvoiceDraft     = "draft"
+	VendorInvoiceMatched   = "matched"   // agrees with the PO and GRNs, ready to approve
+	VendorInvoiceHeld      = "held"      // has discrepancies, cannot be approved
+	VendorInvoiceConfirmed = "confirmed" // approved for payment
+	VendorInvoiceCancelled = "cancelled"
+)
+
+// Discrepancy types found by the three-way match
+const (
+	DiscrepancyNoPurchaseOrder = "NO_PURCHASE_ORDER"
+	DiscrepancyNotOrdered      = "NOT_ORDERED"
+	DiscrepancyQuantity        = "QUANTITY"
+	DiscrepancyPrice           = "PRICE"
+	DiscrepancyTotal           = "TOTAL"
+)
+
+// ErrInvalidVendorInvoice is returned when a vendor invoice cannot be saved or approved
+var ErrInvalidVendorInvoice = errors.New("invalid vendor invoice")
+
+// VendorInvoice is a distributor's bill. It is matched against what was
+// ordered and what was received before it can be approved for payment.
+type VendorInvoice struct {
+	BaseEntity
+	InvoiceNumber   string              `gorm:"not null;size:100;uniqueIndex:idx_vendor_invoice_number" json:"invoice_number" validate:"required"`
+	VendorID        string              `gorm:"not null;index;uniqueIndex:idx_vendor_invoice_number" json:"vendor_id" validate:"required"`
+	Vendor          Vendor              `gorm:"foreignKey:VendorID" json:"vendor,omitempty"`
+	PurchaseOrderID *string             `gorm:"index" json:"purchase_order_id"`
+	InvoiceDate     time.Time           `gorm:"not null" json:"invoice_date"`
+	DueDate         *time.Time          `json:"due_date"`
+	Subtotal        float64             `gorm:"type:decimal(12,2);default:0.00" json:"subtotal"`
+	TaxAmount       float64             `gorm:"type:decimal(12,2);default:0.00" json:"tax_amount"`
+	TotalAmount     float64             `gorm:"type:decimal(12,2);default:0.00" json:"total_amount"`      // as billed
+	DebitNoteAmount float64             `gorm:"type:decimal(12,2);default:0.00" json:"debit_note_amount"` // set off by debit notes
+	BalanceAmount   float64             `gorm:"type:decimal(12,2);default:0.00" json:"balance_amount"`    // still to pay
+	Status          string              `gorm:"not null;default:draft;size:20;index" json:"status" validate:"oneof=draft matched held confirmed cancelled"`
+	PaymentStatus   string              `gorm:"not null;default:unpaid;size:20" json:"payment_status" validate:"oneof=unpaid partial_paid paid"`
+	PaymentTerms    string              `gorm:"size:100" json:"payment_terms"`
+	Notes           string              `gorm:"type:text" json:"notes"`
+	CreatedBy       string              `gorm:"size:255" json:"created_by"`
+	ApprovedBy      *string             `gorm:"index" json:"approved_by"`
+	ApprovedAt      *time.Time          `json:"approved_at"`
+	MatchedAt       *time.Time          `json:"matched_at"`
+	Discrepancies   []MatchDiscrepancy  `gorm:"serializer:json;type:jsonb" json:"discrepancies"`
+	Items           []VendorInvoiceItem `gorm:"foreignKey:VendorInvoiceID" json:"items"`
+}
+
+// VendorInvoiceItem is one billed line
+type VendorInvoiceItem struct {
+	BaseEntity
+	VendorInvoiceID     string  `gorm:"not null;index" json:"vendor_invoice_id"`
+	PurchaseOrderItemID *string `gorm:"index" json:"purchase_order_item_id"`
+	ProductID           string  `gorm:"not null;index" json:"product_id" validate:"required"`
+	Product             Product `gorm:"foreignKey:ProductID" json:"product,omitempty"`
+	Quantity            int     `gorm:"not null" json:"quantity" validate:"min=1"`
+	UnitPrice           float64 `gorm:"type:decimal(10,2);not null" json:"unit_price"`
+	DiscountPercent     float64 `gorm:"type:decimal(5,2);default:0.00" json:"discount_percent"`
+	TaxPercent          float64 `gorm:"type:decimal(5,2);default:0.00" json:"tax_percent"`
+	TotalAmount         float64 `gorm:"type:decimal(12,2);default:0.00" json:"total_amount"`
+}
+
+// MatchDiscrepancy is one way a vendor invoice disagrees with its purchase
+// order or the goods received against it
+type MatchDiscrepancy struct {
+	Type                string  `json:"type"`
+	ProductID           string  `json:"product_id,omitempty"`
+	PurchaseOrderItemID string  `json:"purchase_order_item_id,omitempty"`
+	Ordered             int     `json:"ordered,omitempty"`
+	Received            int     `json:"received,omitempty"`
+	PreviouslyInvoiced  int     `json:"previously_invoiced,omitempty"`
+	Invoiced            int     `json:"invoiced,omitempty"`
+	OrderPrice          float64 `json:"order_price,omitempty"`
+	InvoicePrice        float64 `json:"invoice_price,omitempty"`
+	Expected            float64 `json:"expected,omitempty"`
+	Billed              float64 `json:"billed,omitempty"`
+	Message             string  `json:"message"`
+}
+
+// MatchTolerance sets how far a vendor invoice may stray from the PO and
+// GRNs and still match. The row without a vendor is the default; a vendor's
+// own row overrides it.
+type MatchTolerance struct {
+	BaseEntity
+	VendorID        *string `gorm:"uniqueIndex" json:"vendor_id"`
+	QuantityPercent float64 `gorm:"type:decimal(5,2);default:0" json:"quantity_percent"`  // billed over received
+	PricePercent    float64 `gorm:"type:decimal(5,2);default:0" json:"price_percent"`     // billed unit price over PO price
+	AmountTolerance float64 `gorm:"type:decimal(12,2);default:0" json:"amount_tolerance"` // billed total against its lines, in rupees
+}
+
+// defaultMatchTolerance applies when no tolerance has been configured: exact
+// quantities, and a rupee of rounding on the total
+var defaultMatchTolerance = MatchTolerance{AmountTolerance: 1}
+
+// ==================== VENDOR INVOICE OPERATIONS ====================
+
+// CreateVendorInvoice saves a vendor invoice and matches it straight away;
+// it comes out matched or held
+func (s *PurchaseService) CreateVendorInvoice(ctx context.Context, invoice *VendorInvoice) (*VendorInvoice, error) {
+	if len(invoice.Items) == 0 {
+		return nil, fmt.Errorf("%w: at least one item is required", ErrInvalidVendorInvoice)
+	}
+	if invoice.InvoiceDate.IsZero() {
+		invoice.InvoiceDate = time.Now()
+	}
+	invoice.Status = VendorInvoiceDraft
+	invoice.PaymentStatus = "unpaid"
+	invoice.ApprovedBy, invoice.ApprovedAt = nil, nil
+
+	billed := invoice.TotalAmount
+	totalVendorInvoice(invoice)
+	if billed > 0 {
+		invoice.TotalAmount = roundPaise(billed)
+	}
+	invoice.DebitNoteAmount = 0
+	invoice.BalanceAmount = invoice.TotalAmount
+
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(invoice).Error; err != nil {
+			return err
+		}
+		return matchVendorInvoice(tx, invoice)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vendor invoice: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "vendor_invoices:*")
+	return invoice, nil
+}
+
+// MatchVendorInvoice re-runs the match, e.g. after a late GRN was posted
+func (s *PurchaseService) MatchVendorInvoice(ctx context.Context, id string) (*VendorInvoice, error) {
+	var invoice *VendorInvoice
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if invoice, err = lockVendorInvoice(tx, id); err != nil {
+			return err
+		}
+		if invoice.Status == VendorInvoiceConfirmed || invoice.Status == VendorInvoiceCancelled {
+			return fmt.Errorf("%w: a %s invoice cannot be rematched", ErrInvalidVendorInvoice, invoice.Status)
+		}
+		return matchVendorInvoice(tx, invoice)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to match vendor invoice: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "vendor_invoices:*")
+	return invoice, nil
+}
+
+// ApproveVendorInvoice matches the invoice once more and approves it for
+// payment if it still agrees, setting any open debit notes for the vendor off
+// against it. An invoice that no longer matches is held and returned
+// unapproved with its discrepancies.
+func (s *PurchaseService) ApproveVendorInvoice(ctx context.Context, id, approvedBy string) (*VendorInvoice, error) {
+	var invoice *VendorInvoice
+	err := s.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if invoice, err = lockVendorInvoice(tx, id); err != nil {
+			return err
+		}
+		if invoice.Status == VendorInvoiceConfirmed || invoice.Status == VendorInvoiceCancelled {
+			return fmt.Errorf("%w: invoice %s is already %s", ErrInvalidVendorInvoice, invoice.InvoiceNumber, invoice.Status)
+		}
+		if err := matchVendorInvoice(tx, invoice); err != nil {
+			return err
+		}
+		if invoice.Status != VendorInvoiceMatched {
+			return nil
+		}
+
+		now := time.Now()
+		invoice.Status = VendorInvoiceConfirmed
+		invoice.ApprovedBy = &approvedBy
+		invoice.ApprovedAt = &now
+		if err := tx.Model(invoice).Updates(map[string]interface{}{
+			"status":      VendorInvoiceConfirmed,
+			"approved_by": approvedBy,
+			"approved_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		if err := setOffDebitNotes(tx, invoice.VendorID, invoice.PurchaseOrderID, approvedBy); err != nil {
+			return err
+		}
+		return tx.First(invoice, "id = ?", invoice.ID).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to approve vendor invoice: %w", err)
+	}
+
+	s.cache.DeletePattern(ctx, "vendor_invoices:*")
+	return invoice, nil
+}
+
+// matchVendorInvoice compares each billed line with its purchase order line
+// and with the quantity accepted on posted GRNs, less what other matched or
+// approved invoices have already billed. The purchase order is locked so two
+// invoices cannot bill the same receipt. The invoice is saved as matched, or
+// held with its discrepancies.
+func matchVendorInvoice(tx *gorm.DB, invoice *VendorInvoice) error {
+	tolerance, err := matchToleranceFor(tx, invoice.VendorID)
+	if err != nil {
+		return err
+	}
+
+	var found []MatchDiscrepancy
+	var order *PurchaseOrder
+
+	if invoice.PurchaseOrderID == nil {
+		found = append(found, MatchDiscrepancy{
+			Type:    DiscrepancyNoPurchaseOrder,
+			Message: "Invoice is not linked to a purchase order",
+		})
+	} else {
+		order = &PurchaseOrder{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND is_active = ?", *invoice.PurchaseOrderID, true).
+			First(order).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: purchase order not found", ErrInvalidVendorInvoice)
+			}
+			return err
+		}
+		if order.VendorID != invoice.VendorID {
+			return fmt.Errorf("%w: purchase order %s is from a different vendor", ErrInvalidVendorInvoice, order.PONumber)
+		}
+		if err := tx.Where("purchase_order_id = ? AND is_active = ?", order.ID, true).
+			Order("created_at").
+			Find(&order.Items).Error; err != nil {
+			return err
+		}
+	}
+
+	received, invoiced, err := receiptPosition(tx, invoice)
+	if err != nil {
+		return err
+	}
+
+	linked := make([]*string, len(invoice.Items))
+	for i := range invoice.Items {
+		linked[i] = invoice.Items[i].PurchaseOrderItemID
+	}
+	found = append(found, compareVendorInvoice(invoice, order, received, invoiced, tolerance)...)
+	for i := range invoice.Items {
+		item := &invoice.Items[i]
+		if item.PurchaseOrderItemID == nil || (linked[i] != nil && *linked[i] == *item.PurchaseOrderItemID) {
+			continue
+		}
+		if err := tx.Model(item).Update("purchase_order_item_id", *item.PurchaseOrderItemID).Error; err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	invoice.Discrepancies = found
+	invoice.MatchedAt = &now
+	invoice.Status = VendorInvoiceMatched
+	if len(found) > 0 {
+		invoice.Status = VendorInvoiceHeld
+	}
+	return tx.Model(invoice).Select("status", "discrepancies", "matched_at").Updates(invoice).Error
+}
+
+// compareVendorInvoice is the three-way match itself. Each billed line is
+// linked to its purchase order line and checked against the ordered price,
+// and each order line's billed quantity against what was received and not
+// yet billed; the invoice total is checked against its lines. order is nil
+// for an invoice without a purchase order, which is only checked for its total.
+func compareVendorInvoice(invoice *VendorInvoice, order *PurchaseOrder, received, invoiced map[string]int, tolerance MatchTolerance) []MatchDiscrepancy {
+	var found []MatchDiscrepancy
+	var lineTotal float64
+	billedByLine := map[string]int{}
+	for i := range invoice.Items {
+		item := &invoice.Items[i]
+		lineTotal += item.TotalAmount
+		if order == nil {
+			continue
+		}
+
+		line := orderLineFor(order, item)
+		if line == nil {
+			found = append(found, MatchDiscrepancy{
+				Type:      DiscrepancyNotOrdered,
+				ProductID: item.ProductID,
+				Invoiced:  item.Quantity,
+				Message:   fmt.Sprintf("Product %s is not on purchase order %s", item.ProductID, order.PONumber),
+			})
+			continue
+		}
+		item.PurchaseOrderItemID = &line.ID
+
+		orderPrice := roundPaise(line.UnitPrice * (1 - line.DiscountPercent/100))
+		invoicePrice := roundPaise(item.UnitPrice * (1 - item.DiscountPercent/100))
+		if invoicePrice > roundPaise(orderPrice*(1+tolerance.PricePercent/100)) {
+			found = append(found, MatchDiscrepancy{
+				Type:                DiscrepancyPrice,
+				ProductID:           item.ProductID,
+				PurchaseOrderItemID: line.ID,
+				OrderPrice:          orderPrice,
+				InvoicePrice:        invoicePrice,
+				Message:             fmt.Sprintf("Billed at %.2f, ordered at %.2f", invoicePrice, orderPrice),
+			})
+		}
+		billedByLine[line.ID] += item.Quantity
+	}
+
+	if order != nil {
+		for i := range order.Items {
+			line := &order.Items[i]
+			billed, ok := billedByLine[line.ID]
+			if !ok {
+				continue
+			}
+			open := received[line.ID] - invoiced[line.ID]
+			if float64(billed) > float64(open)*(1+tolerance.QuantityPercent/100) {
+				found = append(found, MatchDiscrepancy{
+					Type:                DiscrepancyQuantity,
+					ProductID:           line.ProductID,
+					PurchaseOrderItemID: line.ID,
+					Ordered:             line.Quantity,
+					Received:            received[line.ID],
+					PreviouslyInvoiced:  invoiced[line.ID],
+					Invoiced:            billed,
+					Message:             fmt.Sprintf("Billed %d, only %d received and not yet billed", billed, open),
+				})
+			}
+		}
+	}
+
+	lineTotal = roundPaise(lineTotal)
+	if math.Abs(invoice.TotalAmount-lineTotal) > tolerance.AmountTolerance {
+		found = append(found, MatchDiscrepancy{
+			Type:     DiscrepancyTotal,
+			Expected: lineTotal,
+			Billed:   invoice.TotalAmount,
+			Message:  fmt.Sprintf("Invoice total %.2f does not add up to its lines (%.2f)", invoice.TotalAmount, lineTotal),
+		})
+	}
+	return found
+}
+
+// receiptPosition returns, per purchase order line, the quantity accepted on
+// posted GRNs and the quantity billed by the vendor's other live invoices
+func receiptPosition(tx *gorm.DB, invoice *VendorInvoice) (map[string]int, map[string]int, error) {
+	received, invoiced := map[string]int{}, map[string]int{}
+	if invoice.PurchaseOrderID == nil {
+		return received, invoiced, nil
+	}
+
+	var rows []struct {
+		LineID   string
+		Quantity int
+	}
+	if err := tx.Raw(`
+		SELECT gi.purchase_order_item_id AS line_id, SUM(gi.accepted_quantity) AS quantity
+		FROM grn_items gi
+		JOIN grns g ON g.id = gi.grn_id
+		WHERE g.purchase_order_id = ? AND g.status = ? AND g.is_active = true
+			AND gi.is_active = true AND gi.purchase_order_item_id IS NOT NULL
+		GROUP BY gi.purchase_order_item_id
+	`, *invoice.PurchaseOrderID, GRNPosted).Scan(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, row := range rows {
+		received[row.LineID] = row.Quantity
+	}
+
+	rows = nil
+	if err := tx.Raw(`
+		SELECT vii.purchase_order_item_id AS line_id, SUM(vii.quantity) AS quantity
+		FROM vendor_invoice_items vii
+		JOIN vendor_invoices vi ON vi.id = vii.vendor_invoice_id
+		WHERE vi.purchase_order_id = ? AND vi.id <> ? AND vi.status IN (?, ?) AND vi.is_active = true
+			AND vii.is_active = true AND vii.purchase_order_item_id IS NOT NULL
+		GROUP BY vii.purchase_order_item_id
+	`, *invoice.PurchaseOrderID, invoice.ID, VendorInvoiceMatched, VendorInvoiceConfirmed).Scan(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, row := range rows {
+		invoiced[row.LineID] = row.Quantity
+	}
+	return received, invoiced, nil
+}
+
+// orderLineFor finds the PO line a billed line is for: the one it names, or
+// the first line of the same product
+func orderLineFor(order *PurchaseOrder, item *VendorInvoiceItem) *PurchaseOrderItem {
+	for i := range order.Items {
+		line := &order.Items[i]
+		if item.PurchaseOrderItemID != nil {
+			if line.ID == *item.PurchaseOrderItemID && line.ProductID == item.ProductID {
+				return line
+			}
+			continue
+		}
+		if line.ProductID == item.ProductID {
+			return line
+		}
+	}
+	return nil
+}
+
+// matchToleranceFor returns the vendor's tolerance, else the default row,
+// else defaultMatchTolerance
+func matchToleranceFor(tx *gorm.DB, vendorID string) (MatchTolerance, error) {
+	var tolerances []MatchTolerance
+	if err := tx.Where("(vendor_id = ? OR vendor_id IS NULL) AND is_active = ?", vendorID, true).
+		Order("vendor_id NULLS LAST").
+		Limit(1).
+		Find(&tolerances).Error; err != nil {
+		return MatchTolerance{}, err
+	}
+	if len(tolerances) == 0 {
+		return defaultMatchTolerance, nil
+	}
+	return tolerances[0], nil
+}
+
+// totalVendorInvoice prices each billed line and adds them up
+func totalVendorInvoice(invoice *VendorInvoice) {
+	invoice.Subtotal, invoice.TaxAmount, invoice.TotalAmount = 0, 0, 0
+	for i := range invoice.Items {
+		item := &invoice.Items[i]
+		taxable := roundPaise(float64(item.Quantity) * item.UnitPrice * (1 - item.DiscountPercent/100))
+		tax := roundPaise(taxable * item.TaxPercent / 100)
+		item.TotalAmount = roundPaise(taxable + tax)
+
+		invoice.Subtotal += taxable
+		invoice.TaxAmount += tax
+		invoice.TotalAmount += item.TotalAmount
+	}
+	invoice.Subtotal = roundPaise(invoice.Subtotal)
+	invoice.TaxAmount = roundPaise(invoice.TaxAmount)
+	invoice.TotalAmount = roundPaise(invoice.TotalAmount)
+}
+
+func lockVendorInvoice(tx *gorm.DB, id string) (*VendorInvoice, error) {
+	var invoice VendorInvoice
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND is_active = ?", id, true).
+		First(&invoice).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: vendor invoice not found", ErrInvalidVendorInvoice)
+		}
+		return nil, err
+	}
+	if err := tx.Where("vendor_invoice_id = ? AND is_active = ?", invoice.ID, true).Find(&invoice.Items).Error; err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
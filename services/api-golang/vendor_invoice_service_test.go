@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for the three-way match of a vendor invoice with its
+// purchase order and the goods received
+func TestCompareVendorInvoice(t *testing.T) {
+	newOrder := func() *PurchaseOrder {
+		order := &PurchaseOrder{PONumber: "PO20250401-0001"}
+		order.Items = []PurchaseOrderItem{
+			{ProductID: "arnica", Quantity: 10, UnitPrice: 100},
+			{ProductID: "calendula", Quantity: 5, UnitPrice: 200, DiscountPercent: 10},
+		}
+		order.Items[0].ID, order.Items[1].ID = "line-1", "line-2"
+		return order
+	}
+	bill := func(productID string, qty int, price, discount float64) VendorInvoiceItem {
+		return VendorInvoiceItem{ProductID: productID, Quantity: qty, UnitPrice: price, DiscountPercent: discount}
+	}
+
+	tests := []struct {
+		name      string
+		items     []VendorInvoiceItem
+		noOrder   bool
+		received  map[string]int
+		invoiced  map[string]int
+		tolerance MatchTolerance
+		total     float64 // billed total; the lines' own when zero
+		want      []string
+	}{
+		{
+			name:     "matches order and receipt",
+			items:    []VendorInvoiceItem{bill("arnica", 10, 100, 0), bill("calendula", 5, 180, 0)},
+			received: map[string]int{"line-1": 10, "line-2": 5},
+		},
+		{
+			name:     "billed above the ordered price",
+			items:    []VendorInvoiceItem{bill("arnica", 10, 105, 0)},
+			received: map[string]int{"line-1": 10},
+			want:     []string{DiscrepancyPrice},
+		},
+		{
+			name:      "price within tolerance",
+			items:     []VendorInvoiceItem{bill("arnica", 10, 102, 0)},
+			received:  map[string]int{"line-1": 10},
+			tolerance: MatchTolerance{PricePercent: 2, AmountTolerance: 1},
+		},
+		{
+			name:     "billed more than received",
+			items:    []VendorInvoiceItem{bill("arnica", 10, 100, 0)},
+			received: map[string]int{"line-1": 8},
+			want:     []string{DiscrepancyQuantity},
+		},
+		{
+			name:     "receipt already billed by another invoice",
+			items:    []VendorInvoiceItem{bill("arnica", 5, 100, 0)},
+			received: map[string]int{"line-1": 10},
+			invoiced: map[string]int{"line-1": 6},
+			want:     []string{DiscrepancyQuantity},
+		},
+		{
+			name:     "product not ordered",
+			items:    []VendorInvoiceItem{bill("belladonna", 1, 50, 0)},
+			received: map[string]int{},
+			want:     []string{DiscrepancyNotOrdered},
+		},
+		{
+			name:     "total does not add up",
+			items:    []VendorInvoiceItem{bill("arnica", 10, 100, 0)},
+			received: map[string]int{"line-1": 10},
+			total:    1010,
+			want:     []string{DiscrepancyTotal},
+		},
+		{
+			name:    "without an order only the total is checked",
+			items:   []VendorInvoiceItem{bill("belladonna", 1, 50, 0)},
+			noOrder: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invoice := &VendorInvoice{Items: tt.items}
+			totalVendorInvoice(invoice)
+			if tt.total != 0 {
+				invoice.TotalAmount = tt.total
+			}
+			var order *PurchaseOrder
+			if !tt.noOrder {
+				order = newOrder()
+			}
+			tolerance := tt.tolerance
+			if tolerance == (MatchTolerance{}) {
+				tolerance = defaultMatchTolerance
+			}
+
+			found := compareVendorInvoice(invoice, order, tt.received, tt.invoiced, tolerance)
+
+			var types []string
+			for _, d := range found {
+				types = append(types, d.Type)
+			}
+			assert.Equal(t, tt.want, types)
+			if order != nil && len(tt.want) == 0 {
+				for _, item := range invoice.Items {
+					assert.NotNil(t, item.PurchaseOrderItemID, "line for %s not linked", item.ProductID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+)
+
+// Cost layers and consumptions are written by the shared ledger package
+// whenever a movement is posted
+type (
+	CostingSetting  = ledger.CostingSetting
+	CostingShop     = ledger.CostingShop
+	CostLayer       = ledger.CostLayer
+	CostConsumption = ledger.CostConsumption
+)
+
+// ValuationLine is the closing position of one product at one shop
+type ValuationLine struct {
+	ProductID    string  `json:"product_id"`
+	ShopID       string  `json:"shop_id"`
+	ClosingQty   float64 `json:"closing_qty"`
+	ClosingValue float64 `json:"closing_value"`
+	UnitCost     float64 `json:"unit_cost"`
+}
+
+// COGSLine is the cost drawn by one product over a period, split by reference type
+type COGSLine struct {
+	ProductID     string  `json:"product_id"`
+	ReferenceType string  `json:"reference_type"`
+	Quantity      float64 `json:"quantity"`
+	Amount        float64 `json:"amount"`
+}
+
+// receiveStock books a priced receipt such as a GRN line. The unit cost
+// defaults to the batch purchase price; landed cost is spread over the quantity.
+func receiveStock(c *fiber.Ctx) error {
+	type ReceiptRequest struct {
+		ProductID     string  `json:"product_id"`
+		ShopID        string  `json:"shop_id"`
+		BatchID       *string `json:"batch_id"`
+		Quantity      float64 `json:"quantity"`
+		UnitCost      float64 `json:"unit_cost"`
+		LandedCost    float64 `json:"landed_cost"`
+		ReferenceType string  `json:"reference_type"`
+		ReferenceID   string  `json:"reference_id"`
+		CreatedBy     string  `json:"created_by"`
+	}
+
+	var req ReceiptRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.ProductID == "" || req.ShopID == "" || req.Quantity <= 0 {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "product_id, shop_id and a positive quantity are required",
+		})
+	}
+	if req.ReferenceType == "" {
+		req.ReferenceType = "GRN"
+	}
+
+	var stock *Stock
+	var movement StockMovement
+	err := db.Transaction(func(tx *gorm.DB) error {
+		unitCost := req.UnitCost
+		if unitCost <= 0 && req.BatchID != nil {
+			var batch Batch
+			if err := tx.First(&batch, "id = ?", *req.BatchID).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return &stockError{status: 404, msg: "Batch not found"}
+				}
+				return err
+			}
+			unitCost = batch.PurchasePrice
+		}
+		unitCost += req.LandedCost / req.Quantity
+
+		var err error
+		if stock, err = ledger.ApplyDelta(tx, req.ProductID, req.ShopID, req.Quantity); err != nil {
+			return err
+		}
+
+		movement = StockMovement{
+			ProductID:     req.ProductID,
+			ShopID:        req.ShopID,
+			MovementType:  "IN",
+			Quantity:      req.Quantity,
+			Reason:        "Receipt",
+			ReferenceType: req.ReferenceType,
+			ReferenceID:   req.ReferenceID,
+			CreatedBy:     req.CreatedBy,
+			UnitCost:      unitCost,
+			BatchID:       req.BatchID,
+		}
+		if err := tx.Create(&movement).Error; err != nil {
+			return err
+		}
+		return ledger.EnqueueStockAdjusted(tx, stock, &movement)
+	})
+	if err != nil {
+		return stockErrorResponse(c, err, "Failed to receive stock")
+	}
+
+	return c.Status(201).JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"stock":      stock,
+			"movement":   movement,
+			"unit_cost":  movement.UnitCost,
+			"cost_value": movement.CostAmount,
+		},
+		Message: "Stock received successfully",
+	})
+}
+
+func getCostingSetting(c *fiber.Ctx) error {
+	companyID := c.Params("company_id")
+
+	setting := CostingSetting{CompanyID: companyID, Method: ledger.CostingFIFO}
+	db.First(&setting, "company_id = ?", companyID)
+
+	var shops []CostingShop
+	db.Where("company_id = ?", companyID).Find(&shops)
+
+	return c.JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"setting": setting,
+			"shops":   shops,
+		},
+	})
+}
+
+func updateCostingSetting(c *fiber.Ctx) error {
+	type CostingRequest struct {
+		Method    string   `json:"method"`
+		ShopIDs   []string `json:"shop_ids"`
+		UpdatedBy string   `json:"updated_by"`
+	}
+
+	var req CostingRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.Method != ledger.CostingFIFO && req.Method != ledger.CostingWeightedAverage {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "method must be FIFO or WEIGHTED_AVERAGE",
+		})
+	}
+
+	setting := CostingSetting{
+		CompanyID: c.Params("company_id"),
+		Method:    req.Method,
+		UpdatedBy: req.UpdatedBy,
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&setting).Error; err != nil {
+			return err
+		}
+		for _, shopID := range req.ShopIDs {
+			if err := tx.Save(&CostingShop{ShopID: shopID, CompanyID: setting.CompanyID}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to update costing method",
+		})
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    setting,
+		Message: "Costing method updated",
+	})
+}
+
+// getValuation values closing stock as of a date from the cost layers:
+// everything received by then less everything consumed by then
+func getValuation(c *fiber.Ctx) error {
+	asOf := time.Now()
+	if v := c.Query("as_of"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return c.Status(400).JSON(Response{
+				Success: false,
+				Error:   "as_of must be YYYY-MM-DD",
+			})
+		}
+		asOf = t.AddDate(0, 0, 1)
+	}
+
+	shopID := c.Query("shop_id")
+	productID := c.Query("product_id")
+
+	var lines []ValuationLine
+	query := `
+		SELECT product_id, shop_id,
+			SUM(qty) AS closing_qty,
+			SUM(value) AS closing_value
+		FROM (
+			SELECT product_id, shop_id, quantity AS qty, quantity * unit_cost AS value
+			FROM cost_layers
+			WHERE received_at < @as_of
+			UNION ALL
+			SELECT product_id, shop_id, -quantity, -amount
+			FROM cost_consumptions
+			WHERE consumed_at < @as_of
+		) ledger
+		WHERE (@shop_id = '' OR shop_id::text = @shop_id)
+			AND (@product_id = '' OR product_id::text = @product_id)
+		GROUP BY product_id, shop_id
+		HAVING SUM(qty) <> 0 OR SUM(value) <> 0
+		ORDER BY product_id, shop_id
+	`
+	if err := db.Raw(query, map[string]interface{}{
+		"as_of":      asOf,
+		"shop_id":    shopID,
+		"product_id": productID,
+	}).Scan(&lines).Error; err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to value inventory",
+		})
+	}
+
+	var totalValue float64
+	for i := range lines {
+		if lines[i].ClosingQty != 0 {
+			lines[i].UnitCost = lines[i].ClosingValue / lines[i].ClosingQty
+		}
+		totalValue += lines[i].ClosingValue
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"as_of":       asOf.AddDate(0, 0, -1).Format("2006-01-02"),
+			"lines":       lines,
+			"total_value": totalValue,
+		},
+	})
+}
+
+// getCOGS totals consumed cost over a date range. Sales make up cost of goods
+// sold; transfers, write-offs and count losses are reported alongside.
+func getCOGS(c *fiber.Ctx) error {
+	from, err := time.Parse("2006-01-02", c.Query("from"))
+	if err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "from must be YYYY-MM-DD",
+		})
+	}
+	to, err := time.Parse("2006-01-02", c.Query("to"))
+	if err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "to must be YYYY-MM-DD",
+		})
+	}
+
+	query := db.Model(&CostConsumption{}).
+		Select("product_id, reference_type, SUM(quantity) AS quantity, SUM(amount) AS amount").
+		Where("consumed_at >= ? AND consumed_at < ?", from, to.AddDate(0, 0, 1))
+
+	if shopID := c.Query("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	var lines []COGSLine
+	if err := query.Group("product_id, reference_type").Order("product_id").Scan(&lines).Error; err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to compute cost of goods sold",
+		})
+	}
+
+	var cogs, otherOutflows float64
+	for _, line := range lines {
+		if line.ReferenceType == "SALE" {
+			cogs += line.Amount
+		} else {
+			otherOutflows += line.Amount
+		}
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"from":           from.Format("2006-01-02"),
+			"to":             to.Format("2006-01-02"),
+			"lines":          lines,
+			"cogs":           cogs,
+			"other_outflows": otherOutflows,
+		},
+	})
+}
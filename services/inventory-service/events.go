@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Inventory event topics
+const (
+	TopicInventoryAdjusted    = ledger.TopicInventoryAdjusted
+	TopicInventoryTransferred = "inventory.transferred"
+	TopicBatchCreated         = "batch.created"
+	TopicBatchExpiring        = "batch.expiring"
+)
+
+// eventVersion is the envelope version consumers can switch on
+const eventVersion = "1"
+
+// OutboxEvent is an event waiting to be shipped to Kafka. Services that post
+// stock through the shared ledger package write to the same outbox.
+type OutboxEvent = ledger.OutboxEvent
+
+// InventoryEvent is the envelope published to Kafka, matching the shape
+// worker-golang already consumes
+type InventoryEvent struct {
+	ID        string          `json:"id"`
+	Timestamp string          `json:"timestamp"`
+	Version   string          `json:"version"`
+	Source    string          `json:"source"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// TransferEventItem is one line of an inventory.transferred payload
+type TransferEventItem struct {
+	ProductID        string  `json:"productId"`
+	QuantitySent     float64 `json:"quantitySent"`
+	QuantityReceived float64 `json:"quantityReceived"`
+}
+
+// StockTransferredData is the payload of inventory.transferred
+type StockTransferredData struct {
+	TransferID string              `json:"transferId"`
+	TransferNo string              `json:"transferNo"`
+	FromShopID string              `json:"fromShopId"`
+	ToShopID   string              `json:"toShopId"`
+	Status     string              `json:"status"`
+	Items      []TransferEventItem `json:"items"`
+}
+
+// BatchEventData is the payload of batch.created and batch.expiring
+type BatchEventData struct {
+	BatchID    string  `json:"batchId"`
+	ProductID  string  `json:"productId"`
+	BatchNo    string  `json:"batchNo"`
+	ExpiryDate string  `json:"expiryDate"`
+	Quantity   float64 `json:"quantity"`
+	DaysLeft   int     `json:"daysLeft,omitempty"`
+}
+
+func enqueueStockTransferred(tx *gorm.DB, transfer *StockTransfer) error {
+	data := StockTransferredData{
+		TransferID: transfer.ID,
+		TransferNo: transfer.TransferNo,
+		FromShopID: transfer.FromShopID,
+		ToShopID:   transfer.ToShopID,
+		Status:     transfer.Status,
+	}
+	for _, item := range transfer.Items {
+		data.Items = append(data.Items, TransferEventItem{
+			ProductID:        item.ProductID,
+			QuantitySent:     item.QuantitySent,
+			QuantityReceived: item.QuantityReceived,
+		})
+	}
+	return ledger.Enqueue(tx, TopicInventoryTransferred, transfer.ID, data)
+}
+
+func enqueueBatchEvent(tx *gorm.DB, topic string, batch *Batch, daysLeft int) error {
+	return ledger.Enqueue(tx, topic, batch.ProductID, BatchEventData{
+		BatchID:    batch.ID,
+		ProductID:  batch.ProductID,
+		BatchNo:    batch.BatchNo,
+		ExpiryDate: batch.ExpiryDate.Format("2006-01-02"),
+		Quantity:   batch.Quantity,
+		DaysLeft:   daysLeft,
+	})
+}
+
+// newEventWriter builds a Kafka writer that routes each message by its own
+// topic and keeps events for one key on one partition
+func newEventWriter(brokers string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(strings.Split(brokers, ",")...),
+		Balancer:               &kafka.Hash{},
+		BatchTimeout:           10 * time.Millisecond,
+		AllowAutoTopicCreation: true,
+	}
+}
+
+// relayOutbox ships one page of unpublished events to Kafka and marks them
+// published. Rows are locked with SKIP LOCKED so several replicas can relay
+// side by side; delivery is at least once.
+func relayOutbox(writer *kafka.Writer, source string, limit int) (int, error) {
+	published := 0
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var events []OutboxEvent
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("published_at IS NULL").
+			Order("created_at ASC").
+			Limit(limit).
+			Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		messages := make([]kafka.Message, 0, len(events))
+		for _, event := range events {
+			value, err := json.Marshal(InventoryEvent{
+				ID:        event.ID,
+				Timestamp: event.CreatedAt.UTC().Format(time.RFC3339),
+				Version:   eventVersion,
+				Source:    source,
+				Type:      event.Topic,
+				Data:      json.RawMessage(event.Payload),
+			})
+			if err != nil {
+				return err
+			}
+			messages = append(messages, kafka.Message{
+				Topic: event.Topic,
+				Key:   []byte(event.EventKey),
+				Value: value,
+				Time:  event.CreatedAt,
+			})
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		ids := make([]string, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+		}
+
+		if err := writer.WriteMessages(ctx, messages...); err != nil {
+			// Record the failure and keep the rows for the next pass
+			return tx.Model(&OutboxEvent{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+				"attempts":   gorm.Expr("attempts + 1"),
+				"last_error": err.Error(),
+			}).Error
+		}
+
+		published = len(events)
+		return tx.Model(&OutboxEvent{}).Where("id IN ?", ids).Update("published_at", time.Now()).Error
+	})
+
+	return published, err
+}
+
+// runOutboxRelay polls the outbox until the process exits
+func runOutboxRelay(writer *kafka.Writer, source string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			n, err := relayOutbox(writer, source, 100)
+			if err != nil {
+				log.Printf("Outbox relay failed: %v", err)
+			}
+			// Drain a backlog without waiting for the next tick
+			if err != nil || n < 100 {
+				break
+			}
+		}
+	}
+}
+
+// queueExpiringBatches enqueues batch.expiring once for each batch that
+// falls inside the alert window
+func queueExpiringBatches(days int) (int, error) {
+	now := time.Now()
+	cutoff := now.AddDate(0, 0, days)
+	queued := 0
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var batches []Batch
+		if err := tx.Clauses(forUpdate).
+			Where("expiry_date <= ? AND expiry_date > ? AND quantity > 0 AND expiry_notified_at IS NULL", cutoff, now).
+			Find(&batches).Error; err != nil {
+			return err
+		}
+
+		for i := range batches {
+			batch := &batches[i]
+			daysLeft := int(batch.ExpiryDate.Sub(now).Hours() / 24)
+			if err := enqueueBatchEvent(tx, TopicBatchExpiring, batch, daysLeft); err != nil {
+				return err
+			}
+			if err := tx.Model(batch).Update("expiry_notified_at", now).Error; err != nil {
+				return err
+			}
+		}
+		queued = len(batches)
+		return nil
+	})
+
+	return queued, err
+}
+
+// runExpiryScan checks for expiring batches on a fixed interval
+func runExpiryScan(days int, interval time.Duration) {
+	for {
+		n, err := queueExpiringBatches(days)
+		if err != nil {
+			log.Printf("Batch expiry scan failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Queued %d batch.expiring events", n)
+		}
+		time.Sleep(interval)
+	}
+}
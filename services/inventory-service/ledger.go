@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// StockSnapshot is the on-hand quantity of a product at a shop at the start
+// of SnapshotDate, i.e. the sum of every movement before that day
+type StockSnapshot struct {
+	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	SnapshotDate time.Time `json:"snapshot_date" gorm:"type:date;not null;uniqueIndex:idx_snapshot_key"`
+	ProductID    string    `json:"product_id" gorm:"type:uuid;not null;uniqueIndex:idx_snapshot_key"`
+	ShopID       string    `json:"shop_id" gorm:"type:uuid;not null;uniqueIndex:idx_snapshot_key"`
+	Quantity     float64   `json:"quantity" gorm:"not null"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// StockPosition is the quantity of a product at a shop at a point in time
+type StockPosition struct {
+	ProductID string  `json:"product_id"`
+	ShopID    string  `json:"shop_id"`
+	Quantity  float64 `json:"quantity"`
+}
+
+const (
+	defaultMovementLimit = 50
+	maxMovementLimit     = 500
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// dayStart truncates t to midnight in its own location
+func dayStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// errFutureSnapshot is returned for a snapshot of a day that has not begun
+var errFutureSnapshot = errors.New("snapshot date must not be after today")
+
+// snapshotDate is the day a snapshot for date opens. A day's opening stock is
+// only settled once the day has begun, so days after today are refused.
+func snapshotDate(date, now time.Time) (time.Time, error) {
+	date = dayStart(date)
+	if date.After(dayStart(now)) {
+		return time.Time{}, errFutureSnapshot
+	}
+	return date, nil
+}
+
+// asOfCutoff is the instant stock "as of" a date is taken at: the close of
+// that day, which is the opening of the next
+func asOfCutoff(date time.Time) time.Time {
+	return dayStart(date).AddDate(0, 0, 1)
+}
+
+// takeSnapshot writes the snapshot for date by rolling the latest earlier
+// snapshot forward with the movements in between. An existing snapshot is
+// left alone unless rebuild is set, in which case it is replaced and every
+// later snapshot, having been rolled forward from it, is dropped.
+func takeSnapshot(date time.Time, rebuild bool) (int64, error) {
+	date, err := snapshotDate(date, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	var rows int64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if rebuild {
+			if err := tx.Where("snapshot_date >= ?", date).Delete(&StockSnapshot{}).Error; err != nil {
+				return err
+			}
+		} else {
+			var exists int64
+			if err := tx.Model(&StockSnapshot{}).Where("snapshot_date = ?", date).Count(&exists).Error; err != nil {
+				return err
+			}
+			if exists > 0 {
+				return nil
+			}
+		}
+
+		var prev StockSnapshot
+		err := tx.Where("snapshot_date < ?", date).Order("snapshot_date DESC").First(&prev).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		since := prev.SnapshotDate // zero time when there is no earlier snapshot
+
+		result := tx.Exec(`
+			INSERT INTO stock_snapshots (snapshot_date, product_id, shop_id, quantity, created_at)
+			SELECT @date, product_id, shop_id, SUM(qty), NOW()
+			FROM (
+				SELECT product_id, shop_id, quantity AS qty
+				FROM stock_snapshots
+				WHERE snapshot_date = @since
+				UNION ALL
+				SELECT product_id, shop_id, quantity
+				FROM stock_movements
+				WHERE created_at >= @since AND created_at < @date
+			) ledger
+			GROUP BY product_id, shop_id
+			ON CONFLICT (snapshot_date, product_id, shop_id) DO NOTHING
+		`, map[string]interface{}{
+			"date":  date,
+			"since": since,
+		})
+		rows = result.RowsAffected
+		return result.Error
+	})
+	return rows, err
+}
+
+// runSnapshots makes sure today's opening snapshot exists, checking on a fixed interval
+func runSnapshots(interval time.Duration) {
+	for {
+		n, err := takeSnapshot(time.Now(), false)
+		if err != nil {
+			log.Printf("Stock snapshot failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Wrote %d stock snapshot rows", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// createSnapshot takes the snapshot for a date, rebuilding it if one exists
+func createSnapshot(c *fiber.Ctx) error {
+	date := time.Now()
+	if v := c.Query("date"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return c.Status(400).JSON(Response{
+				Success: false,
+				Error:   "date must be YYYY-MM-DD",
+			})
+		}
+		date = t
+	}
+
+	rows, err := takeSnapshot(date, true)
+	if errors.Is(err, errFutureSnapshot) {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to take snapshot",
+		})
+	}
+
+	return c.Status(201).JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"snapshot_date": dayStart(date).Format("2006-01-02"),
+			"rows":          rows,
+		},
+		Message: "Snapshot taken",
+	})
+}
+
+// getStockAsOf returns stock at the close of a date. Product and shop queries
+// start from the nearest snapshot at or before that date and add the
+// movements since; batch queries sum the batch's movements directly. Every
+// outbound movement is posted against the batches it drew from, so only
+// stock received without a batch is missing from the batch figures.
+func getStockAsOf(c *fiber.Ctx) error {
+	t, err := time.ParseInLocation("2006-01-02", c.Query("date"), time.Local)
+	if err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "date must be YYYY-MM-DD",
+		})
+	}
+	cutoff := asOfCutoff(t)
+
+	productID := c.Query("product_id")
+	shopID := c.Query("shop_id")
+	batchID := c.Query("batch_id")
+
+	var positions []StockPosition
+
+	if batchID != "" {
+		query := db.Model(&StockMovement{}).
+			Select("product_id, shop_id, SUM(quantity) AS quantity").
+			Where("batch_id = ? AND created_at < ?", batchID, cutoff)
+		if shopID != "" {
+			query = query.Where("shop_id = ?", shopID)
+		}
+		err = query.Group("product_id, shop_id").Scan(&positions).Error
+	} else {
+		var snap StockSnapshot
+		err = db.Where("snapshot_date <= ?", cutoff).Order("snapshot_date DESC").First(&snap).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(500).JSON(Response{
+				Success: false,
+				Error:   "Failed to load stock snapshot",
+			})
+		}
+
+		err = db.Raw(`
+			SELECT product_id, shop_id, SUM(qty) AS quantity
+			FROM (
+				SELECT product_id, shop_id, quantity AS qty
+				FROM stock_snapshots
+				WHERE snapshot_date = @since
+				UNION ALL
+				SELECT product_id, shop_id, quantity
+				FROM stock_movements
+				WHERE created_at >= @since AND created_at < @cutoff
+			) ledger
+			WHERE (@product_id = '' OR product_id::text = @product_id)
+				AND (@shop_id = '' OR shop_id::text = @shop_id)
+			GROUP BY product_id, shop_id
+			ORDER BY product_id, shop_id
+		`, map[string]interface{}{
+			"since":      snap.SnapshotDate,
+			"cutoff":     cutoff,
+			"product_id": productID,
+			"shop_id":    shopID,
+		}).Scan(&positions).Error
+	}
+	if err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to compute stock",
+		})
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"as_of": t.Format("2006-01-02"),
+			"stock": positions,
+		},
+	})
+}
+
+// listMovements pages through the ledger newest first. The cursor is opaque
+// to clients and encodes the (created_at, id) of the last row returned.
+func listMovements(c *fiber.Ctx) error {
+	var movements []StockMovement
+
+	query := db.Model(&StockMovement{})
+
+	if productID := c.Query("product_id"); productID != "" {
+		query = query.Where("product_id = ?", productID)
+	}
+
+	if shopID := c.Query("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	if batchID := c.Query("batch_id"); batchID != "" {
+		query = query.Where("batch_id = ?", batchID)
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		createdAt, id, err := decodeCursor(cursor)
+		if err != nil {
+			return c.Status(400).JSON(Response{
+				Success: false,
+				Error:   err.Error(),
+			})
+		}
+		query = query.Where("(created_at, id) < (?, ?)", createdAt, id)
+	}
+
+	limit := c.QueryInt("limit", defaultMovementLimit)
+	if limit <= 0 || limit > maxMovementLimit {
+		limit = defaultMovementLimit
+	}
+
+	// Fetch one extra row to learn whether another page exists
+	query.Order("created_at DESC, id DESC").Limit(limit + 1).Find(&movements)
+
+	nextCursor := ""
+	if len(movements) > limit {
+		movements = movements[:limit]
+		last := movements[limit-1]
+		nextCursor = encodeCursor(last.CreatedAt, last.ID)
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"movements":   movements,
+			"next_cursor": nextCursor,
+			"limit":       limit,
+		},
+	})
+}
+
+func encodeCursor(createdAt time.Time, id string) string {
+	raw := createdAt.UTC().Format(time.RFC3339Nano) + "|" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", errBadCursor
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return time.Time{}, "", errBadCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", errBadCursor
+	}
+	return createdAt, parts[1], nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for which days may be snapshotted
+func TestSnapshotDate(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		date    time.Time
+		want    time.Time
+		wantErr error
+	}{
+		{name: "past day", date: time.Date(2026, 3, 9, 18, 0, 0, 0, time.UTC), want: time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC)},
+		{name: "today opens at midnight", date: now, want: time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)},
+		{name: "tomorrow has not begun", date: now.AddDate(0, 0, 1), wantErr: errFutureSnapshot},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := snapshotDate(tt.date, now)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.True(t, got.Equal(tt.want), "snapshotDate() = %v, want %v", got, tt.want)
+		})
+	}
+}
+
+// Stock as of a date is taken at the close of that day, whatever the time of
+// day given and across a daylight saving change
+func TestAsOfCutoff(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+
+	tests := []struct {
+		name string
+		date time.Time
+		want time.Time
+	}{
+		{name: "midnight", date: time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC), want: time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)},
+		{name: "late in the day", date: time.Date(2026, 3, 9, 23, 59, 0, 0, time.UTC), want: time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)},
+		{name: "month end", date: time.Date(2026, 2, 28, 12, 0, 0, 0, time.UTC), want: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "short day", date: time.Date(2026, 3, 29, 12, 0, 0, 0, berlin), want: time.Date(2026, 3, 30, 0, 0, 0, 0, berlin)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := asOfCutoff(tt.date)
+			assert.True(t, got.Equal(tt.want), "asOfCutoff() = %v, want %v", got, tt.want)
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"os"
@@ -13,6 +12,7 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/joho/godotenv"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -26,45 +26,29 @@ type Config struct {
 	ServiceName  string
 }
 
-// Stock model
-type Stock struct {
-	ID        string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	ProductID string    `json:"product_id" gorm:"type:uuid;not null;index"`
-	ShopID    string    `json:"shop_id" gorm:"type:uuid;not null;index"`
-	Quantity  float64   `json:"quantity" gorm:"not null;default:0"`
-	Reserved  float64   `json:"reserved" gorm:"not null;default:0"`
-	Available float64   `json:"available" gorm:"not null;default:0"`
-	RackID    *string   `json:"rack_id" gorm:"type:uuid"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-}
+// Stock and StockMovement are the ledger rows. Other services post to the
+// same tables in their own transactions through the shared ledger package.
+type (
+	Stock         = ledger.Stock
+	StockMovement = ledger.StockMovement
+)
 
 // Batch model
 type Batch struct {
-	ID         string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	ProductID  string    `json:"product_id" gorm:"type:uuid;not null;index"`
-	BatchNo    string    `json:"batch_no" gorm:"not null;index"`
-	MfgDate    time.Time `json:"mfg_date"`
-	ExpiryDate time.Time `json:"expiry_date" gorm:"index"`
-	Quantity   float64   `json:"quantity" gorm:"not null"`
-	MRP        float64   `json:"mrp"`
-	PurchasePrice float64 `json:"purchase_price"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
-}
-
-// StockMovement model
-type StockMovement struct {
-	ID            string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	ProductID     string    `json:"product_id" gorm:"type:uuid;not null;index"`
-	ShopID        string    `json:"shop_id" gorm:"type:uuid;not null;index"`
-	MovementType  string    `json:"movement_type" gorm:"not null"` // IN, OUT, ADJUST, TRANSFER
-	Quantity      float64   `json:"quantity" gorm:"not null"`
-	Reason        string    `json:"reason"`
-	ReferenceType string    `json:"reference_type"` // SALE, PURCHASE, ADJUSTMENT, TRANSFER
-	ReferenceID   string    `json:"reference_id" gorm:"type:uuid"`
-	CreatedBy     string    `json:"created_by" gorm:"type:uuid"`
-	CreatedAt     time.Time `json:"created_at"`
+	ID               string     `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ProductID        string     `json:"product_id" gorm:"type:uuid;not null;index"`
+	BatchNo          string     `json:"batch_no" gorm:"not null;index"`
+	MfgDate          time.Time  `json:"mfg_date"`
+	ExpiryDate       time.Time  `json:"expiry_date" gorm:"index"`
+	Quantity         float64    `json:"quantity" gorm:"not null"`
+	MRP              float64    `json:"mrp"`
+	PurchasePrice    float64    `json:"purchase_price"`
+	ExpiryNotifiedAt *time.Time `json:"expiry_notified_at"`
+	Status           string     `json:"status" gorm:"not null;default:'ACTIVE';index"` // ACTIVE, QUARANTINED, RECALLED
+	StatusReason     string     `json:"status_reason"`
+	DamagedBin       bool       `json:"damaged_bin" gorm:"not null;default:false;index"` // holds a batch's damaged returns
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
 }
 
 // Response wrapper
@@ -91,7 +75,13 @@ func main() {
 	}
 
 	// Auto-migrate models
-	db.AutoMigrate(&Stock{}, &Batch{}, &StockMovement{})
+	db.AutoMigrate(&Stock{}, &Batch{}, &StockMovement{}, &StockTransfer{}, &StockTransferItem{},
+		&CountSession{}, &CountLine{}, &StockReservation{}, &StockReservationItem{}, &OutboxEvent{},
+		&CostingSetting{}, &CostingShop{}, &CostLayer{}, &CostConsumption{}, &StockSnapshot{},
+		&WriteOff{}, &WriteOffItem{})
+
+	// Damaged bins used to be told apart by their status reason alone
+	db.Exec("UPDATE batches SET damaged_bin = true WHERE status_reason = 'Damaged return' AND NOT damaged_bin")
 
 	// Initialize Fiber app
 	app := fiber.New(fiber.Config{
@@ -108,6 +98,19 @@ func main() {
 	// Routes
 	setupRoutes(app)
 
+	// Release reservations whose TTL has lapsed
+	go runReservationExpiry(time.Minute)
+
+	// Ship outbox events to Kafka and queue expiry warnings
+	writer := newEventWriter(config.KafkaBrokers)
+	defer writer.Close()
+	go runOutboxRelay(writer, config.ServiceName, time.Second)
+	go runExpiryScan(30, time.Hour)
+	go runQuarantine(time.Hour)
+
+	// Close each day with a stock snapshot
+	go runSnapshots(time.Hour)
+
 	// Graceful shutdown
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -187,7 +190,39 @@ func setupRoutes(app *fiber.App) {
 	stock.Get("/stock/:product_id", getStockByProduct)
 	stock.Post("/adjust", adjustStock)
 	stock.Post("/transfer", transferStock)
-	stock.Post("/reconcile", reconcileStock)
+	stock.Post("/reconcile", createCountSession)
+
+	// Inter-shop transfers
+	transfers := v1.Group("/inventory/transfers")
+	transfers.Get("", listTransfers)
+	transfers.Get("/:id", getTransfer)
+	transfers.Post("/:id/in-transit", markTransferInTransit)
+	transfers.Post("/:id/receive", receiveTransfer)
+
+	// Cycle counts and reconciliation
+	counts := v1.Group("/inventory/counts")
+	counts.Get("", listCountSessions)
+	counts.Post("", createCountSession)
+	counts.Get("/:id", getCountSession)
+	counts.Post("/:id/counts", submitCounts)
+	counts.Post("/:id/recount", requestRecount)
+	counts.Get("/:id/variance", getCountVariance)
+	counts.Post("/:id/approve", approveCountSession)
+
+	// Stock reservations
+	reservations := v1.Group("/inventory/reservations")
+	reservations.Get("", listReservations)
+	reservations.Post("", createReservation)
+	reservations.Get("/:id", getReservation)
+	reservations.Post("/:id/release", releaseReservation)
+	reservations.Post("/:id/convert", convertReservation)
+
+	// Receipts, costing and valuation
+	stock.Post("/receipts", receiveStock)
+	stock.Get("/valuation", getValuation)
+	stock.Get("/cogs", getCOGS)
+	stock.Get("/costing/:company_id", getCostingSetting)
+	stock.Put("/costing/:company_id", updateCostingSetting)
 
 	// Batch endpoints
 	batches := v1.Group("/inventory/batches")
@@ -195,9 +230,19 @@ func setupRoutes(app *fiber.App) {
 	batches.Get("/:id", getBatch)
 	batches.Post("", createBatch)
 	batches.Get("/expiry-alerts", getExpiryAlerts)
+	batches.Post("/:id/recall", recallBatch)
+	batches.Get("/:id/customers", listBatchCustomers)
+
+	// Write-offs
+	writeOffs := v1.Group("/inventory/write-offs")
+	writeOffs.Get("", listWriteOffs)
+	writeOffs.Post("", createWriteOff)
+	writeOffs.Get("/:id", getWriteOff)
 
-	// Movement history
+	// Movement history and point-in-time stock
 	v1.Get("/inventory/movements", listMovements)
+	stock.Get("/stock-as-of", getStockAsOf)
+	stock.Post("/snapshots", createSnapshot)
 }
 
 // Handlers
@@ -260,6 +305,7 @@ func adjustStock(c *fiber.Ctx) error {
 	type AdjustRequest struct {
 		ProductID string  `json:"product_id"`
 		ShopID    string  `json:"shop_id"`
+		BatchID   *string `json:"batch_id"`
 		Quantity  float64 `json:"quantity"`
 		Reason    string  `json:"reason"`
 	}
@@ -272,69 +318,44 @@ func adjustStock(c *fiber.Ctx) error {
 		})
 	}
 
-	// Begin transaction
-	tx := db.Begin()
+	// Update stock and record the movement together
+	var stock *Stock
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		stock, err = ledger.ApplyDelta(tx, req.ProductID, req.ShopID, req.Quantity)
+		if err != nil {
+			return err
+		}
 
-	// Update stock
-	var stock Stock
-	if err := tx.Where("product_id = ? AND shop_id = ?", req.ProductID, req.ShopID).First(&stock).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			// Create new stock record
-			stock = Stock{
-				ProductID: req.ProductID,
-				ShopID:    req.ShopID,
-				Quantity:  req.Quantity,
-				Available: req.Quantity,
-			}
-			if err := tx.Create(&stock).Error; err != nil {
-				tx.Rollback()
-				return c.Status(500).JSON(Response{
-					Success: false,
-					Error:   "Failed to create stock",
-				})
+		movement := StockMovement{
+			ProductID:     req.ProductID,
+			ShopID:        req.ShopID,
+			MovementType:  "ADJUST",
+			Quantity:      req.Quantity,
+			Reason:        req.Reason,
+			ReferenceType: "ADJUSTMENT",
+			BatchID:       req.BatchID,
+		}
+
+		// A reduction that names no batch comes out of the shop's batches
+		if req.BatchID == nil && req.Quantity < 0 {
+			return postOutbound(tx, stock, movement)
+		}
+		if req.BatchID != nil {
+			if err := tx.Model(&Batch{}).Where("id = ?", *req.BatchID).
+				Update("quantity", gorm.Expr("GREATEST(quantity + ?, 0)", req.Quantity)).Error; err != nil {
+				return err
 			}
-		} else {
-			tx.Rollback()
-			return c.Status(500).JSON(Response{
-				Success: false,
-				Error:   "Database error",
-			})
 		}
-	} else {
-		// Update existing stock
-		stock.Quantity += req.Quantity
-		stock.Available += req.Quantity
-		if err := tx.Save(&stock).Error; err != nil {
-			tx.Rollback()
-			return c.Status(500).JSON(Response{
-				Success: false,
-				Error:   "Failed to update stock",
-			})
+		if err := tx.Create(&movement).Error; err != nil {
+			return err
 		}
+		return ledger.EnqueueStockAdjusted(tx, stock, &movement)
+	})
+	if err != nil {
+		return stockErrorResponse(c, err, "Failed to adjust stock")
 	}
 
-	// Record movement
-	movement := StockMovement{
-		ProductID:     req.ProductID,
-		ShopID:        req.ShopID,
-		MovementType:  "ADJUST",
-		Quantity:      req.Quantity,
-		Reason:        req.Reason,
-		ReferenceType: "ADJUSTMENT",
-	}
-	if err := tx.Create(&movement).Error; err != nil {
-		tx.Rollback()
-		return c.Status(500).JSON(Response{
-			Success: false,
-			Error:   "Failed to record movement",
-		})
-	}
-
-	// Commit transaction
-	tx.Commit()
-
-	// TODO: Publish event to Kafka (inventory.adjusted)
-
 	return c.JSON(Response{
 		Success: true,
 		Data:    stock,
@@ -342,39 +363,6 @@ func adjustStock(c *fiber.Ctx) error {
 	})
 }
 
-func transferStock(c *fiber.Ctx) error {
-	type TransferRequest struct {
-		ProductID    string  `json:"product_id"`
-		FromShopID   string  `json:"from_shop_id"`
-		ToShopID     string  `json:"to_shop_id"`
-		Quantity     float64 `json:"quantity"`
-		Reason       string  `json:"reason"`
-	}
-
-	var req TransferRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(Response{
-			Success: false,
-			Error:   err.Error(),
-		})
-	}
-
-	// TODO: Implement stock transfer logic with transaction
-
-	return c.JSON(Response{
-		Success: true,
-		Message: "Stock transfer endpoint - to be implemented",
-	})
-}
-
-func reconcileStock(c *fiber.Ctx) error {
-	// TODO: Implement stock reconciliation
-	return c.JSON(Response{
-		Success: true,
-		Message: "Stock reconciliation endpoint - to be implemented",
-	})
-}
-
 func listBatches(c *fiber.Ctx) error {
 	var batches []Batch
 	
@@ -383,6 +371,10 @@ func listBatches(c *fiber.Ctx) error {
 	if productID := c.Query("product_id"); productID != "" {
 		query = query.Where("product_id = ?", productID)
 	}
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
 	
 	query.Order("expiry_date ASC").Find(&batches)
 
@@ -418,7 +410,13 @@ func createBatch(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := db.Create(&batch).Error; err != nil {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&batch).Error; err != nil {
+			return err
+		}
+		return enqueueBatchEvent(tx, TopicBatchCreated, &batch, 0)
+	})
+	if err != nil {
 		return c.Status(500).JSON(Response{
 			Success: false,
 			Error:   "Failed to create batch",
@@ -449,23 +447,3 @@ func getExpiryAlerts(c *fiber.Ctx) error {
 	})
 }
 
-func listMovements(c *fiber.Ctx) error {
-	var movements []StockMovement
-	
-	query := db.Model(&StockMovement{})
-	
-	if productID := c.Query("product_id"); productID != "" {
-		query = query.Where("product_id = ?", productID)
-	}
-	
-	if shopID := c.Query("shop_id"); shopID != "" {
-		query = query.Where("shop_id = ?", shopID)
-	}
-	
-	query.Order("created_at DESC").Limit(100).Find(&movements)
-
-	return c.JSON(Response{
-		Success: true,
-		Data:    movements,
-	})
-}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+)
+
+// Count session statuses
+const (
+	CountOpen      = "OPEN"
+	CountSubmitted = "SUBMITTED"
+	CountApproved  = "APPROVED"
+)
+
+// CountSession is a physical stock-take of one shop, optionally limited to a rack
+type CountSession struct {
+	ID         string      `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	SessionNo  string      `json:"session_no" gorm:"uniqueIndex;not null"`
+	ShopID     string      `json:"shop_id" gorm:"type:uuid;not null;index"`
+	RackID     *string     `json:"rack_id" gorm:"type:uuid"`
+	BlindMode  bool        `json:"blind_mode" gorm:"not null;default:false"`
+	Status     string      `json:"status" gorm:"not null;index"` // OPEN, SUBMITTED, APPROVED
+	Notes      string      `json:"notes"`
+	CreatedBy  string      `json:"created_by" gorm:"type:uuid"`
+	ApprovedBy string      `json:"approved_by" gorm:"type:uuid"`
+	ApprovedAt *time.Time  `json:"approved_at"`
+	CreatedAt  time.Time   `json:"created_at"`
+	UpdatedAt  time.Time   `json:"updated_at"`
+	Lines      []CountLine `json:"lines" gorm:"foreignKey:SessionID"`
+}
+
+// CountLine is the physical count of one product within a session
+type CountLine struct {
+	ID            string     `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	SessionID     string     `json:"session_id" gorm:"type:uuid;not null;index"`
+	ProductID     string     `json:"product_id" gorm:"type:uuid;not null"`
+	ExpectedQty   float64    `json:"expected_qty" gorm:"not null;default:0"`
+	CountedQty    *float64   `json:"counted_qty"`
+	PreviousCount *float64   `json:"previous_count"`
+	Round         int        `json:"round" gorm:"not null;default:1"`
+	NeedsRecount  bool       `json:"needs_recount" gorm:"not null;default:false"`
+	CountedBy     string     `json:"counted_by" gorm:"type:uuid"`
+	CountedAt     *time.Time `json:"counted_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// VarianceLine is one row of a count variance report. SystemQty is what the
+// system held when the line was counted: the quantity expected when the
+// session opened plus what moved in or out of the shop until the count.
+type VarianceLine struct {
+	ProductID    string  `json:"product_id"`
+	ExpectedQty  float64 `json:"expected_qty"`
+	MovedQty     float64 `json:"moved_qty"`
+	SystemQty    float64 `json:"system_qty"`
+	CountedQty   float64 `json:"counted_qty"`
+	Variance     float64 `json:"variance"`
+	Round        int     `json:"round"`
+	Uncounted    bool    `json:"uncounted"`
+	NeedsRecount bool    `json:"needs_recount"`
+}
+
+var errCountNotFound = errors.New("count session not found")
+
+func createCountSession(c *fiber.Ctx) error {
+	type CountSessionRequest struct {
+		ShopID    string  `json:"shop_id"`
+		RackID    *string `json:"rack_id"`
+		BlindMode bool    `json:"blind_mode"`
+		Notes     string  `json:"notes"`
+		CreatedBy string  `json:"created_by"`
+	}
+
+	var req CountSessionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.ShopID == "" {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "shop_id is required",
+		})
+	}
+
+	session := CountSession{
+		SessionNo: fmt.Sprintf("CNT-%d", time.Now().UnixNano()),
+		ShopID:    req.ShopID,
+		RackID:    req.RackID,
+		BlindMode: req.BlindMode,
+		Status:    CountOpen,
+		Notes:     req.Notes,
+		CreatedBy: req.CreatedBy,
+	}
+
+	// Seed one line per stocked product on the shop (or rack) being counted
+	var stocks []Stock
+	query := db.Where("shop_id = ?", req.ShopID)
+	if req.RackID != nil && *req.RackID != "" {
+		query = query.Where("rack_id = ?", *req.RackID)
+	}
+	if err := query.Find(&stocks).Error; err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to load stock for count",
+		})
+	}
+	for _, s := range stocks {
+		session.Lines = append(session.Lines, CountLine{
+			ProductID:   s.ProductID,
+			ExpectedQty: s.Quantity,
+			Round:       1,
+		})
+	}
+
+	if err := db.Create(&session).Error; err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to create count session",
+		})
+	}
+
+	return c.Status(201).JSON(Response{
+		Success: true,
+		Data:    session.forCounter(),
+		Message: "Count session created successfully",
+	})
+}
+
+func listCountSessions(c *fiber.Ctx) error {
+	var sessions []CountSession
+
+	query := db.Model(&CountSession{})
+
+	if shopID := c.Query("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	query.Order("created_at DESC").Find(&sessions)
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    sessions,
+	})
+}
+
+func getCountSession(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var session CountSession
+
+	if err := db.Preload("Lines").First(&session, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Count session not found",
+		})
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    session.forCounter(),
+	})
+}
+
+func submitCounts(c *fiber.Ctx) error {
+	type CountEntry struct {
+		ProductID  string  `json:"product_id"`
+		CountedQty float64 `json:"counted_qty"`
+	}
+
+	type SubmitRequest struct {
+		CountedBy string       `json:"counted_by"`
+		Counts    []CountEntry `json:"counts"`
+	}
+
+	var req SubmitRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	id := c.Params("id")
+	var session CountSession
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockCountSession(tx, id, &session); err != nil {
+			return err
+		}
+		if session.Status != CountOpen && session.Status != CountSubmitted {
+			return &stockError{status: 409, msg: "Count session is closed"}
+		}
+
+		lines := make(map[string]*CountLine, len(session.Lines))
+		for i := range session.Lines {
+			lines[session.Lines[i].ProductID] = &session.Lines[i]
+		}
+
+		var added []*CountLine
+		now := time.Now()
+		for _, entry := range req.Counts {
+			if entry.ProductID == "" || entry.CountedQty < 0 {
+				return &stockError{status: 400, msg: "Each count needs a product_id and a non-negative counted_qty"}
+			}
+
+			line, ok := lines[entry.ProductID]
+			if !ok {
+				// Found on the shelf but not in the system for this shop
+				line = &CountLine{
+					SessionID: session.ID,
+					ProductID: entry.ProductID,
+					Round:     1,
+				}
+				lines[entry.ProductID] = line
+				added = append(added, line)
+			} else if line.CountedQty != nil && !line.NeedsRecount {
+				// Only lines sent back for recount may be counted again
+				return &stockError{status: 409, msg: fmt.Sprintf("Product %s is already counted; request a recount to count it again", entry.ProductID)}
+			}
+
+			qty := entry.CountedQty
+			line.CountedQty = &qty
+			line.NeedsRecount = false
+			line.CountedBy = req.CountedBy
+			line.CountedAt = &now
+			if err := tx.Save(line).Error; err != nil {
+				return err
+			}
+		}
+
+		for _, line := range added {
+			session.Lines = append(session.Lines, *line)
+		}
+
+		session.Status = CountSubmitted
+		for _, line := range session.Lines {
+			if line.CountedQty == nil || line.NeedsRecount {
+				session.Status = CountOpen
+				break
+			}
+		}
+		return tx.Omit("Lines").Save(&session).Error
+	})
+	if err != nil {
+		return countErrorResponse(c, err, "Failed to submit counts")
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    session.forCounter(),
+		Message: "Counts submitted successfully",
+	})
+}
+
+func requestRecount(c *fiber.Ctx) error {
+	type RecountRequest struct {
+		ProductIDs []string `json:"product_ids"`
+	}
+
+	var req RecountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	wanted := make(map[string]bool, len(req.ProductIDs))
+	for _, productID := range req.ProductIDs {
+		wanted[productID] = true
+	}
+
+	id := c.Params("id")
+	var session CountSession
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockCountSession(tx, id, &session); err != nil {
+			return err
+		}
+		if session.Status != CountOpen && session.Status != CountSubmitted {
+			return &stockError{status: 409, msg: "Count session is closed"}
+		}
+
+		for i := range session.Lines {
+			line := &session.Lines[i]
+			if !wanted[line.ProductID] || line.CountedQty == nil {
+				continue
+			}
+
+			line.PreviousCount = line.CountedQty
+			line.CountedQty = nil
+			line.NeedsRecount = true
+			line.Round++
+			if err := tx.Save(line).Error; err != nil {
+				return err
+			}
+		}
+
+		session.Status = CountOpen
+		return tx.Omit("Lines").Save(&session).Error
+	})
+	if err != nil {
+		return countErrorResponse(c, err, "Failed to request recount")
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    session.forCounter(),
+		Message: "Recount requested",
+	})
+}
+
+func getCountVariance(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var session CountSession
+
+	if err := db.Preload("Lines").First(&session, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Count session not found",
+		})
+	}
+
+	report, err := buildVarianceReport(db, &session)
+	if err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to build variance report",
+		})
+	}
+
+	// The approver reviews a submitted count in full; while a blind count is
+	// still open its counter must not see what the system expects
+	blind := session.BlindMode && session.Status == CountOpen
+	if blind {
+		report = hideSystemQty(report)
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"session": session.forCounter(),
+			"lines":   report,
+			"blind":   blind,
+		},
+	})
+}
+
+func approveCountSession(c *fiber.Ctx) error {
+	type ApproveRequest struct {
+		ApprovedBy string `json:"approved_by"`
+	}
+
+	var req ApproveRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	id := c.Params("id")
+	var session CountSession
+	var report []VarianceLine
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockCountSession(tx, id, &session); err != nil {
+			return err
+		}
+		if session.Status != CountSubmitted {
+			return &stockError{status: 409, msg: "Only fully counted sessions can be approved"}
+		}
+
+		var err error
+		report, err = buildVarianceReport(tx, &session)
+		if err != nil {
+			return err
+		}
+
+		// Post one ADJUST movement per line whose count differs from the system
+		for _, line := range report {
+			if line.Variance == 0 {
+				continue
+			}
+			stock, err := ledger.ApplyDelta(tx, line.ProductID, session.ShopID, line.Variance)
+			if err != nil {
+				return err
+			}
+			movement := StockMovement{
+				ProductID:     line.ProductID,
+				ShopID:        session.ShopID,
+				MovementType:  "ADJUST",
+				Quantity:      line.Variance,
+				Reason:        "Cycle count " + session.SessionNo,
+				ReferenceType: "RECONCILIATION",
+				ReferenceID:   session.ID,
+				CreatedBy:     req.ApprovedBy,
+			}
+			// Losses come out of the shop's batches; gains cannot be placed in one
+			if movement.Quantity < 0 {
+				if err := postOutbound(tx, stock, movement); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Create(&movement).Error; err != nil {
+				return err
+			}
+			if err := ledger.EnqueueStockAdjusted(tx, stock, &movement); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		session.Status = CountApproved
+		session.ApprovedBy = req.ApprovedBy
+		session.ApprovedAt = &now
+		return tx.Omit("Lines").Save(&session).Error
+	})
+	if err != nil {
+		return countErrorResponse(c, err, "Failed to approve count session")
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"session": session,
+			"lines":   report,
+		},
+		Message: "Count session approved and stock adjusted",
+	})
+}
+
+// buildVarianceReport compares each counted line with what the system held
+// when it was counted. Sales, transfers and receipts posted while the count
+// was under way are not variances, so they are added to the expected quantity
+// rather than reading the live Stock.Quantity.
+func buildVarianceReport(tx *gorm.DB, session *CountSession) ([]VarianceLine, error) {
+	var rows []struct {
+		ProductID string
+		Moved     float64
+	}
+	if err := tx.Raw(`
+		SELECT l.product_id, COALESCE(SUM(m.quantity), 0) AS moved
+		FROM count_lines l
+		LEFT JOIN stock_movements m ON m.product_id = l.product_id AND m.shop_id = ?
+			AND m.created_at > ? AND m.created_at <= COALESCE(l.counted_at, NOW())
+		WHERE l.session_id = ?
+		GROUP BY l.product_id
+	`, session.ShopID, session.CreatedAt, session.ID).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	moved := make(map[string]float64, len(rows))
+	for _, row := range rows {
+		moved[row.ProductID] = row.Moved
+	}
+	return varianceLines(session.Lines, moved), nil
+}
+
+// varianceLines is the variance report for lines given how much of each
+// product moved between the session opening and the line being counted
+func varianceLines(lines []CountLine, moved map[string]float64) []VarianceLine {
+	report := make([]VarianceLine, 0, len(lines))
+	for _, line := range lines {
+		row := VarianceLine{
+			ProductID:    line.ProductID,
+			ExpectedQty:  line.ExpectedQty,
+			MovedQty:     moved[line.ProductID],
+			SystemQty:    line.ExpectedQty + moved[line.ProductID],
+			Round:        line.Round,
+			NeedsRecount: line.NeedsRecount,
+		}
+		if line.CountedQty == nil {
+			row.Uncounted = true
+		} else {
+			row.CountedQty = *line.CountedQty
+			row.Variance = row.CountedQty - row.SystemQty
+		}
+		report = append(report, row)
+	}
+	return report
+}
+
+// forCounter hides expected quantities while a blind count is still in progress
+func (s CountSession) forCounter() CountSession {
+	if !s.BlindMode || s.Status == CountApproved {
+		return s
+	}
+
+	lines := make([]CountLine, len(s.Lines))
+	copy(lines, s.Lines)
+	for i := range lines {
+		lines[i].ExpectedQty = 0
+	}
+	s.Lines = lines
+	return s
+}
+
+// hideSystemQty blanks system quantities, and the variances that would give
+// them away, while a blind count is still in progress
+func hideSystemQty(report []VarianceLine) []VarianceLine {
+	for i := range report {
+		report[i].ExpectedQty = 0
+		report[i].MovedQty = 0
+		report[i].SystemQty = 0
+		report[i].Variance = 0
+	}
+	return report
+}
+
+// lockCountSession loads a session with its lines and holds a row lock on the header
+func lockCountSession(tx *gorm.DB, id string, session *CountSession) error {
+	if err := tx.Clauses(forUpdate).Preload("Lines").First(session, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errCountNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func countErrorResponse(c *fiber.Ctx, err error, fallback string) error {
+	if errors.Is(err, errCountNotFound) {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Count session not found",
+		})
+	}
+	return stockErrorResponse(c, err, fallback)
+}
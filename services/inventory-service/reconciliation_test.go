@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for the count variance report
+func TestVarianceLines(t *testing.T) {
+	counted := func(qty float64) *float64 { return &qty }
+
+	tests := []struct {
+		name         string
+		line         CountLine
+		moved        float64
+		wantSystem   float64
+		wantVariance float64
+		uncounted    bool
+	}{
+		{name: "count matches", line: CountLine{ExpectedQty: 20, CountedQty: counted(20)}, wantSystem: 20},
+		{name: "shortage", line: CountLine{ExpectedQty: 20, CountedQty: counted(17)}, wantSystem: 20, wantVariance: -3},
+		{name: "sale during the count is not a variance", line: CountLine{ExpectedQty: 20, CountedQty: counted(15)}, moved: -5, wantSystem: 15},
+		{name: "receipt during the count is not a variance", line: CountLine{ExpectedQty: 20, CountedQty: counted(30)}, moved: 10, wantSystem: 30},
+		{name: "loss on top of a sale", line: CountLine{ExpectedQty: 20, CountedQty: counted(12)}, moved: -5, wantSystem: 15, wantVariance: -3},
+		{name: "found on the shelf only", line: CountLine{CountedQty: counted(4)}, wantVariance: 4},
+		{name: "not counted yet", line: CountLine{ExpectedQty: 20}, moved: -2, wantSystem: 18, uncounted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.line.ProductID = "product-1"
+			report := varianceLines([]CountLine{tt.line}, map[string]float64{"product-1": tt.moved})
+
+			assert.Len(t, report, 1)
+			assert.Equal(t, tt.line.ExpectedQty, report[0].ExpectedQty)
+			assert.Equal(t, tt.moved, report[0].MovedQty)
+			assert.Equal(t, tt.wantSystem, report[0].SystemQty)
+			assert.Equal(t, tt.wantVariance, report[0].Variance)
+			assert.Equal(t, tt.uncounted, report[0].Uncounted)
+		})
+	}
+}
+
+// Table-driven tests for what a blind count shows its counter
+func TestForCounter(t *testing.T) {
+	tests := []struct {
+		name   string
+		blind  bool
+		status string
+		want   float64
+	}{
+		{name: "open count shows expected quantities", status: CountOpen, want: 20},
+		{name: "blind count hides them", blind: true, status: CountOpen},
+		{name: "submitted blind count still hides them", blind: true, status: CountSubmitted},
+		{name: "approved blind count shows them", blind: true, status: CountApproved, want: 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := CountSession{BlindMode: tt.blind, Status: tt.status, Lines: []CountLine{{ExpectedQty: 20}}}
+			assert.Equal(t, tt.want, session.forCounter().Lines[0].ExpectedQty)
+			// The session itself is left alone
+			assert.Equal(t, 20.0, session.Lines[0].ExpectedQty)
+		})
+	}
+}
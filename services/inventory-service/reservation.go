@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+)
+
+// Reservation statuses
+const (
+	ReservationActive    = "ACTIVE"
+	ReservationReleased  = "RELEASED"
+	ReservationExpired   = "EXPIRED"
+	ReservationConverted = "CONVERTED"
+)
+
+// defaultReservationTTL applies when a request does not set ttl_minutes
+const defaultReservationTTL = 30 * time.Minute
+
+// StockReservation holds stock at a shop for a sales order or held bill
+type StockReservation struct {
+	ID            string                 `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ReservationNo string                 `json:"reservation_no" gorm:"uniqueIndex;not null"`
+	ShopID        string                 `json:"shop_id" gorm:"type:uuid;not null;index"`
+	ReferenceType string                 `json:"reference_type" gorm:"not null"` // SALES_ORDER, HELD_BILL
+	ReferenceID   string                 `json:"reference_id" gorm:"type:uuid;not null;index"`
+	Status        string                 `json:"status" gorm:"not null;index"` // ACTIVE, RELEASED, EXPIRED, CONVERTED
+	ExpiresAt     time.Time              `json:"expires_at" gorm:"not null;index"`
+	InvoiceID     string                 `json:"invoice_id" gorm:"type:uuid"`
+	CreatedBy     string                 `json:"created_by" gorm:"type:uuid"`
+	ReleasedAt    *time.Time             `json:"released_at"`
+	ConvertedAt   *time.Time             `json:"converted_at"`
+	CreatedAt     time.Time              `json:"created_at"`
+	UpdatedAt     time.Time              `json:"updated_at"`
+	Items         []StockReservationItem `json:"items" gorm:"foreignKey:ReservationID"`
+}
+
+// StockReservationItem is the quantity of one product held by a reservation
+type StockReservationItem struct {
+	ID            string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ReservationID string    `json:"reservation_id" gorm:"type:uuid;not null;index"`
+	ProductID     string    `json:"product_id" gorm:"type:uuid;not null"`
+	Quantity      float64   `json:"quantity" gorm:"not null"`
+	QuantitySold  float64   `json:"quantity_sold" gorm:"not null;default:0"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+var errReservationNotFound = errors.New("reservation not found")
+
+func createReservation(c *fiber.Ctx) error {
+	type ReservationLine struct {
+		ProductID string  `json:"product_id"`
+		Quantity  float64 `json:"quantity"`
+	}
+
+	type ReservationRequest struct {
+		ShopID        string            `json:"shop_id"`
+		ReferenceType string            `json:"reference_type"`
+		ReferenceID   string            `json:"reference_id"`
+		TTLMinutes    int               `json:"ttl_minutes"`
+		CreatedBy     string            `json:"created_by"`
+		Items         []ReservationLine `json:"items"`
+	}
+
+	var req ReservationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.ShopID == "" || req.ReferenceID == "" {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "shop_id and reference_id are required",
+		})
+	}
+	if req.ReferenceType != "SALES_ORDER" && req.ReferenceType != "HELD_BILL" {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "reference_type must be SALES_ORDER or HELD_BILL",
+		})
+	}
+	if len(req.Items) == 0 {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "At least one item is required",
+		})
+	}
+
+	ttl := defaultReservationTTL
+	if req.TTLMinutes > 0 {
+		ttl = time.Duration(req.TTLMinutes) * time.Minute
+	}
+
+	reservation := StockReservation{
+		ReservationNo: fmt.Sprintf("RSV-%d", time.Now().UnixNano()),
+		ShopID:        req.ShopID,
+		ReferenceType: req.ReferenceType,
+		ReferenceID:   req.ReferenceID,
+		Status:        ReservationActive,
+		ExpiresAt:     time.Now().Add(ttl),
+		CreatedBy:     req.CreatedBy,
+	}
+	for _, line := range req.Items {
+		if line.ProductID == "" || line.Quantity <= 0 {
+			return c.Status(400).JSON(Response{
+				Success: false,
+				Error:   "Each item needs a product_id and a positive quantity",
+			})
+		}
+		reservation.Items = append(reservation.Items, StockReservationItem{
+			ProductID: line.ProductID,
+			Quantity:  line.Quantity,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Only one live reservation per order or held bill
+		var existing int64
+		if err := tx.Model(&StockReservation{}).
+			Where("reference_type = ? AND reference_id = ? AND status = ?", req.ReferenceType, req.ReferenceID, ReservationActive).
+			Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return &stockError{status: 409, msg: "An active reservation already exists for this reference"}
+		}
+
+		for _, item := range reservation.Items {
+			if _, err := reserveStock(tx, item.ProductID, reservation.ShopID, item.Quantity); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&reservation).Error
+	})
+	if err != nil {
+		return reservationErrorResponse(c, err, "Failed to reserve stock")
+	}
+
+	return c.Status(201).JSON(Response{
+		Success: true,
+		Data:    reservation,
+		Message: "Stock reserved successfully",
+	})
+}
+
+func listReservations(c *fiber.Ctx) error {
+	var reservations []StockReservation
+
+	query := db.Model(&StockReservation{}).Preload("Items")
+
+	if shopID := c.Query("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	if referenceID := c.Query("reference_id"); referenceID != "" {
+		query = query.Where("reference_id = ?", referenceID)
+	}
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	query.Order("created_at DESC").Find(&reservations)
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    reservations,
+	})
+}
+
+func getReservation(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var reservation StockReservation
+
+	if err := db.Preload("Items").First(&reservation, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Reservation not found",
+		})
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    reservation,
+	})
+}
+
+func releaseReservation(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var reservation StockReservation
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockReservation(tx, id, &reservation); err != nil {
+			return err
+		}
+		if reservation.Status != ReservationActive {
+			return &stockError{status: 409, msg: "Reservation is no longer active"}
+		}
+		return releaseHeldStock(tx, &reservation, ReservationReleased)
+	})
+	if err != nil {
+		return reservationErrorResponse(c, err, "Failed to release reservation")
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    reservation,
+		Message: "Reservation released",
+	})
+}
+
+// convertReservation closes a reservation against an invoice that billed its
+// goods. Lines may be sold short. Every held unit goes back to available
+// stock; the invoice's own sale movements take what was sold, so converting
+// never moves stock. Invoices that name the reservation convert it
+// themselves.
+func convertReservation(c *fiber.Ctx) error {
+	type SoldLine struct {
+		ProductID string  `json:"product_id"`
+		Quantity  float64 `json:"quantity"`
+	}
+
+	type ConvertRequest struct {
+		InvoiceID string     `json:"invoice_id"`
+		Items     []SoldLine `json:"items"`
+	}
+
+	var req ConvertRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.InvoiceID == "" {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "invoice_id is required",
+		})
+	}
+
+	id := c.Params("id")
+	var reservation StockReservation
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		held, err := ledger.LockReservation(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// Lines left out of the request are taken as sold in full
+		sold := held.Held()
+		for _, line := range req.Items {
+			if line.Quantity < 0 || line.Quantity > sold[line.ProductID] {
+				return &stockError{status: 400, msg: fmt.Sprintf("Sold quantity for product %s must be between 0 and %.2f", line.ProductID, sold[line.ProductID])}
+			}
+		}
+		for _, line := range req.Items {
+			sold[line.ProductID] = line.Quantity
+		}
+
+		if err := ledger.ConvertReservation(tx, held, req.InvoiceID, sold); err != nil {
+			return err
+		}
+		return tx.Preload("Items").First(&reservation, "id = ?", id).Error
+	})
+	if err != nil {
+		return reservationErrorResponse(c, err, "Failed to convert reservation")
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    reservation,
+		Message: "Reservation converted to sale",
+	})
+}
+
+// releaseHeldStock returns every line of a reservation to available stock and
+// closes it with the given status
+func releaseHeldStock(tx *gorm.DB, reservation *StockReservation, status string) error {
+	for _, item := range reservation.Items {
+		if _, err := ledger.Unreserve(tx, item.ProductID, reservation.ShopID, item.Quantity); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	reservation.Status = status
+	reservation.ReleasedAt = &now
+	return tx.Omit("Items").Save(reservation).Error
+}
+
+// expireReservations releases every active reservation past its TTL
+func expireReservations() (int, error) {
+	var ids []string
+	if err := db.Model(&StockReservation{}).
+		Where("status = ? AND expires_at <= ?", ReservationActive, time.Now()).
+		Pluck("id", &ids).Error; err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, id := range ids {
+		released := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var reservation StockReservation
+			if err := lockReservation(tx, id, &reservation); err != nil {
+				return err
+			}
+			// Converted or released while we were looking
+			if reservation.Status != ReservationActive {
+				return nil
+			}
+			released = true
+			return releaseHeldStock(tx, &reservation, ReservationExpired)
+		})
+		if err != nil {
+			return expired, err
+		}
+		// Count only what actually committed
+		if released {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// runReservationExpiry sweeps expired reservations on a fixed interval
+func runReservationExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := expireReservations()
+		if err != nil {
+			log.Printf("Reservation expiry failed: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Released %d expired reservations", n)
+		}
+	}
+}
+
+// lockReservation loads a reservation with its items and holds a row lock on the header
+func lockReservation(tx *gorm.DB, id string, reservation *StockReservation) error {
+	if err := tx.Clauses(forUpdate).Preload("Items").First(reservation, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errReservationNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func reservationErrorResponse(c *fiber.Ctx, err error, fallback string) error {
+	if errors.Is(err, errReservationNotFound) || errors.Is(err, ledger.ErrReservationNotFound) {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Reservation not found",
+		})
+	}
+	if errors.Is(err, ledger.ErrReservationClosed) {
+		return c.Status(409).JSON(Response{
+			Success: false,
+			Error:   "Reservation is no longer active",
+		})
+	}
+	return stockErrorResponse(c, err, fallback)
+}
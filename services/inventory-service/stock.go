@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// forUpdate locks the selected rows until the surrounding transaction ends
+var forUpdate = clause.Locking{Strength: "UPDATE"}
+
+// stockError carries the HTTP status a stock operation should fail with
+type stockError struct {
+	status int
+	msg    string
+}
+
+func (e *stockError) Error() string { return e.msg }
+
+// reserveStock holds qty of a shop's available stock against a later sale
+func reserveStock(tx *gorm.DB, productID, shopID string, qty float64) (*Stock, error) {
+	stock, err := ledger.LockStock(tx, productID, shopID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &stockError{status: 409, msg: fmt.Sprintf("No stock of product %s at shop %s", productID, shopID)}
+		}
+		return nil, err
+	}
+
+	if stock.Available < qty {
+		return nil, &stockError{status: 409, msg: fmt.Sprintf("Insufficient stock for product %s: available %.2f, requested %.2f", productID, stock.Available, qty)}
+	}
+
+	stock.Reserved += qty
+	stock.UpdateAvailable()
+	if err := tx.Save(stock).Error; err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// batchShare is the part of an outbound quantity drawn from one batch.
+// BatchID is nil for whatever the shop does not hold under a batch.
+type batchShare struct {
+	BatchID  *string
+	Quantity float64
+}
+
+// shareByBatch splits qty of a product leaving a shop over the active batches
+// the shop holds, earliest expiry first
+func shareByBatch(tx *gorm.DB, productID, shopID string, qty float64) ([]batchShare, error) {
+	batches, err := ledger.ShopBatches(tx, productID, shopID)
+	if err != nil {
+		return nil, err
+	}
+	return shareBatches(batches, qty), nil
+}
+
+// shareBatches draws qty from the active batches in the order given, each up
+// to what the shop holds of it, and leaves the rest on a share without a
+// batch. Quarantined and recalled units are out of available stock, so
+// nothing is drawn from them.
+func shareBatches(batches []ledger.ShopBatch, qty float64) []batchShare {
+	var shares []batchShare
+	remaining := qty
+	for _, batch := range batches {
+		if remaining <= 0 {
+			break
+		}
+		if batch.Status != BatchActive {
+			continue
+		}
+		take := math.Min(remaining, batch.Held)
+		batchID := batch.ID
+		shares = append(shares, batchShare{BatchID: &batchID, Quantity: take})
+		remaining -= take
+	}
+	if remaining > 0 {
+		shares = append(shares, batchShare{Quantity: remaining})
+	}
+	return shares
+}
+
+// postOutbound writes an outbound movement that names no batch as one
+// movement per batch it draws from, drawing each batch down, and queues
+// inventory.adjusted for each part. The shop's stock must already be moved.
+func postOutbound(tx *gorm.DB, stock *Stock, m StockMovement) error {
+	shares, err := shareByBatch(tx, m.ProductID, m.ShopID, -m.Quantity)
+	if err != nil {
+		return err
+	}
+
+	for _, share := range shares {
+		part := m
+		part.Quantity = -share.Quantity
+		part.BatchID = share.BatchID
+		if share.BatchID != nil {
+			if err := tx.Model(&Batch{}).Where("id = ?", *share.BatchID).
+				Update("quantity", gorm.Expr("GREATEST(quantity - ?, 0)", share.Quantity)).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Create(&part).Error; err != nil {
+			return err
+		}
+		if err := ledger.EnqueueStockAdjusted(tx, stock, &part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stockErrorResponse maps an error from a stock transaction onto a response
+func stockErrorResponse(c *fiber.Ctx, err error, fallback string) error {
+	var se *stockError
+	switch {
+	case errors.As(err, &se):
+		return c.Status(se.status).JSON(Response{
+			Success: false,
+			Error:   se.msg,
+		})
+	case errors.Is(err, ledger.ErrInsufficientStock):
+		return c.Status(409).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	case errors.Is(err, errTransferNotFound):
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Transfer not found",
+		})
+	case errors.Is(err, errTransferState):
+		return c.Status(409).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	return c.Status(500).JSON(Response{
+		Success: false,
+		Error:   fallback,
+	})
+}
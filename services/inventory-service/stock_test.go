@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+)
+
+// Table-driven tests for splitting outbound stock over a shop's batches
+func TestShareBatches(t *testing.T) {
+	batches := []ledger.ShopBatch{
+		{ID: "b-early", Status: BatchActive, Held: 5},
+		{ID: "b-late", Status: BatchActive, Held: 10},
+	}
+
+	tests := []struct {
+		name    string
+		batches []ledger.ShopBatch
+		qty     float64
+		want    map[string]float64 // batch id to quantity, "" for no batch
+		order   []string
+	}{
+		{name: "earliest expiry first", batches: batches, qty: 3, want: map[string]float64{"b-early": 3}, order: []string{"b-early"}},
+		{name: "spills into the next batch", batches: batches, qty: 8, want: map[string]float64{"b-early": 5, "b-late": 3}, order: []string{"b-early", "b-late"}},
+		{name: "takes every batch exactly", batches: batches, qty: 15, want: map[string]float64{"b-early": 5, "b-late": 10}, order: []string{"b-early", "b-late"}},
+		{name: "rest goes without a batch", batches: batches, qty: 18, want: map[string]float64{"b-early": 5, "b-late": 10, "": 3}, order: []string{"b-early", "b-late", ""}},
+		{name: "no batches held", batches: nil, qty: 4, want: map[string]float64{"": 4}, order: []string{""}},
+		{
+			name: "skips quarantined and recalled batches",
+			batches: []ledger.ShopBatch{
+				{ID: "b-expired", Status: BatchQuarantined, Held: 4},
+				{ID: "b-recalled", Status: BatchRecalled, Held: 2},
+				{ID: "b-late", Status: BatchActive, Held: 10},
+			},
+			qty:   6,
+			want:  map[string]float64{"b-late": 6},
+			order: []string{"b-late"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares := shareBatches(tt.batches, tt.qty)
+
+			var order []string
+			got := map[string]float64{}
+			var total float64
+			for _, share := range shares {
+				id := ""
+				if share.BatchID != nil {
+					id = *share.BatchID
+				}
+				order = append(order, id)
+				got[id] += share.Quantity
+				total += share.Quantity
+			}
+			assert.Equal(t, tt.order, order)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.qty, total)
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+)
+
+// Transfer statuses
+const (
+	TransferDispatched = "DISPATCHED"
+	TransferInTransit  = "IN_TRANSIT"
+	TransferReceived   = "RECEIVED"
+)
+
+// StockTransfer is an inter-shop transfer document
+type StockTransfer struct {
+	ID           string              `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	TransferNo   string              `json:"transfer_no" gorm:"uniqueIndex;not null"`
+	FromShopID   string              `json:"from_shop_id" gorm:"type:uuid;not null;index"`
+	ToShopID     string              `json:"to_shop_id" gorm:"type:uuid;not null;index"`
+	Status       string              `json:"status" gorm:"not null;index"` // DISPATCHED, IN_TRANSIT, RECEIVED
+	Reason       string              `json:"reason"`
+	ShortageNote string              `json:"shortage_note"`
+	DispatchedBy string              `json:"dispatched_by" gorm:"type:uuid"`
+	DispatchedAt time.Time           `json:"dispatched_at"`
+	InTransitAt  *time.Time          `json:"in_transit_at"`
+	ReceivedBy   string              `json:"received_by" gorm:"type:uuid"`
+	ReceivedAt   *time.Time          `json:"received_at"`
+	CreatedAt    time.Time           `json:"created_at"`
+	UpdatedAt    time.Time           `json:"updated_at"`
+	Items        []StockTransferItem `json:"items" gorm:"foreignKey:TransferID"`
+}
+
+// StockTransferItem is a product line on a transfer document
+type StockTransferItem struct {
+	ID               string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	TransferID       string    `json:"transfer_id" gorm:"type:uuid;not null;index"`
+	ProductID        string    `json:"product_id" gorm:"type:uuid;not null"`
+	BatchID          *string   `json:"batch_id" gorm:"type:uuid"`
+	QuantitySent     float64   `json:"quantity_sent" gorm:"not null"`
+	QuantityReceived float64   `json:"quantity_received" gorm:"not null;default:0"`
+	ShortQuantity    float64   `json:"short_quantity" gorm:"not null;default:0"`
+	UnitCost         float64   `json:"unit_cost" gorm:"not null;default:0"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+var (
+	errTransferNotFound = errors.New("transfer not found")
+	errTransferState    = errors.New("transfer is not awaiting this action")
+)
+
+func transferStock(c *fiber.Ctx) error {
+	type TransferLine struct {
+		ProductID string  `json:"product_id"`
+		Quantity  float64 `json:"quantity"`
+	}
+
+	type TransferRequest struct {
+		ProductID  string         `json:"product_id"`
+		FromShopID string         `json:"from_shop_id"`
+		ToShopID   string         `json:"to_shop_id"`
+		Quantity   float64        `json:"quantity"`
+		Reason     string         `json:"reason"`
+		CreatedBy  string         `json:"created_by"`
+		Items      []TransferLine `json:"items"`
+	}
+
+	var req TransferRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	// Single-product requests are kept for older clients
+	if len(req.Items) == 0 && req.ProductID != "" {
+		req.Items = []TransferLine{{ProductID: req.ProductID, Quantity: req.Quantity}}
+	}
+
+	if req.FromShopID == "" || req.ToShopID == "" || req.FromShopID == req.ToShopID {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "from_shop_id and to_shop_id must be two different shops",
+		})
+	}
+	if len(req.Items) == 0 {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "At least one item is required",
+		})
+	}
+
+	transfer := StockTransfer{
+		TransferNo:   fmt.Sprintf("TRF-%d", time.Now().UnixNano()),
+		FromShopID:   req.FromShopID,
+		ToShopID:     req.ToShopID,
+		Status:       TransferDispatched,
+		Reason:       req.Reason,
+		DispatchedBy: req.CreatedBy,
+		DispatchedAt: time.Now(),
+	}
+	for _, line := range req.Items {
+		if line.ProductID == "" || line.Quantity <= 0 {
+			return c.Status(400).JSON(Response{
+				Success: false,
+				Error:   "Each item needs a product_id and a positive quantity",
+			})
+		}
+		transfer.Items = append(transfer.Items, StockTransferItem{
+			ProductID:    line.ProductID,
+			QuantitySent: line.Quantity,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Send the source shop's batches, so the receiving shop holds them
+		var items []StockTransferItem
+		for _, line := range transfer.Items {
+			parts, err := splitByBatch(tx, transfer.FromShopID, line)
+			if err != nil {
+				return err
+			}
+			items = append(items, parts...)
+		}
+		transfer.Items = items
+
+		if err := tx.Create(&transfer).Error; err != nil {
+			return err
+		}
+
+		// Debit the source shop and write the outbound half of each pair
+		for i := range transfer.Items {
+			item := &transfer.Items[i]
+			if _, err := ledger.Debit(tx, item.ProductID, transfer.FromShopID, item.QuantitySent); err != nil {
+				return err
+			}
+			movement := StockMovement{
+				ProductID:     item.ProductID,
+				ShopID:        transfer.FromShopID,
+				MovementType:  "TRANSFER",
+				Quantity:      -item.QuantitySent,
+				Reason:        "Transfer out " + transfer.TransferNo,
+				ReferenceType: "TRANSFER",
+				ReferenceID:   transfer.ID,
+				BatchID:       item.BatchID,
+				CreatedBy:     transfer.DispatchedBy,
+			}
+			if err := tx.Create(&movement).Error; err != nil {
+				return err
+			}
+
+			// The receiving shop takes the goods in at the cost they left at
+			item.UnitCost = movement.CostAmount / item.QuantitySent
+			if err := tx.Model(item).Update("unit_cost", item.UnitCost).Error; err != nil {
+				return err
+			}
+		}
+		return enqueueStockTransferred(tx, &transfer)
+	})
+	if err != nil {
+		return stockErrorResponse(c, err, "Failed to dispatch transfer")
+	}
+
+	return c.Status(201).JSON(Response{
+		Success: true,
+		Data:    transfer,
+		Message: "Stock transfer dispatched successfully",
+	})
+}
+
+// splitByBatch breaks a transfer line into one item per batch the shop holds,
+// earliest expiry first. Whatever the shop does not hold under a batch goes
+// on an item of its own without one.
+func splitByBatch(tx *gorm.DB, shopID string, line StockTransferItem) ([]StockTransferItem, error) {
+	shares, err := shareByBatch(tx, line.ProductID, shopID, line.QuantitySent)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]StockTransferItem, 0, len(shares))
+	for _, share := range shares {
+		items = append(items, StockTransferItem{
+			ProductID:    line.ProductID,
+			BatchID:      share.BatchID,
+			QuantitySent: share.Quantity,
+		})
+	}
+	return items, nil
+}
+
+func listTransfers(c *fiber.Ctx) error {
+	var transfers []StockTransfer
+
+	query := db.Model(&StockTransfer{}).Preload("Items")
+
+	if shopID := c.Query("shop_id"); shopID != "" {
+		query = query.Where("from_shop_id = ? OR to_shop_id = ?", shopID, shopID)
+	}
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	query.Order("created_at DESC").Find(&transfers)
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    transfers,
+	})
+}
+
+func getTransfer(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var transfer StockTransfer
+
+	if err := db.Preload("Items").First(&transfer, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Transfer not found",
+		})
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    transfer,
+	})
+}
+
+func markTransferInTransit(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var transfer StockTransfer
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockTransfer(tx, id, &transfer); err != nil {
+			return err
+		}
+		if transfer.Status != TransferDispatched {
+			return errTransferState
+		}
+
+		now := time.Now()
+		transfer.Status = TransferInTransit
+		transfer.InTransitAt = &now
+		// Items carry the unit cost dispatch set; leave them alone
+		return tx.Omit("Items").Save(&transfer).Error
+	})
+	if err != nil {
+		return stockErrorResponse(c, err, "Failed to update transfer")
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    transfer,
+		Message: "Transfer marked in transit",
+	})
+}
+
+func receiveTransfer(c *fiber.Ctx) error {
+	type ReceiveLine struct {
+		ItemID           string  `json:"item_id"`
+		QuantityReceived float64 `json:"quantity_received"`
+	}
+
+	type ReceiveRequest struct {
+		ReceivedBy   string        `json:"received_by"`
+		ShortageNote string        `json:"shortage_note"`
+		Items        []ReceiveLine `json:"items"`
+	}
+
+	var req ReceiveRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	// Lines left out of the request are taken as received in full
+	received := make(map[string]float64, len(req.Items))
+	for _, line := range req.Items {
+		received[line.ItemID] = line.QuantityReceived
+	}
+
+	id := c.Params("id")
+	var transfer StockTransfer
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockTransfer(tx, id, &transfer); err != nil {
+			return err
+		}
+		if transfer.Status != TransferDispatched && transfer.Status != TransferInTransit {
+			return errTransferState
+		}
+
+		hasShortage := false
+		for i := range transfer.Items {
+			item := &transfer.Items[i]
+			qty, ok := received[item.ID]
+			if !ok {
+				qty = item.QuantitySent
+			}
+			if qty < 0 || qty > item.QuantitySent {
+				return &stockError{status: 400, msg: fmt.Sprintf("Received quantity for item %s must be between 0 and %.2f", item.ID, item.QuantitySent)}
+			}
+
+			item.QuantityReceived = qty
+			item.ShortQuantity = item.QuantitySent - qty
+			if item.ShortQuantity > 0 {
+				hasShortage = true
+			}
+			if err := tx.Save(item).Error; err != nil {
+				return err
+			}
+
+			if qty == 0 {
+				continue
+			}
+
+			// Credit the destination shop and write the inbound half of the pair
+			if _, err := ledger.ApplyDelta(tx, item.ProductID, transfer.ToShopID, qty); err != nil {
+				return err
+			}
+			if err := tx.Create(&StockMovement{
+				ProductID:     item.ProductID,
+				ShopID:        transfer.ToShopID,
+				MovementType:  "TRANSFER",
+				Quantity:      qty,
+				Reason:        "Transfer in " + transfer.TransferNo,
+				ReferenceType: "TRANSFER",
+				ReferenceID:   transfer.ID,
+				BatchID:       item.BatchID,
+				CreatedBy:     req.ReceivedBy,
+				UnitCost:      item.UnitCost,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		if hasShortage && req.ShortageNote == "" {
+			return &stockError{status: 400, msg: "A shortage_note is required when fewer items are received than sent"}
+		}
+
+		now := time.Now()
+		transfer.Status = TransferReceived
+		transfer.ShortageNote = req.ShortageNote
+		transfer.ReceivedBy = req.ReceivedBy
+		transfer.ReceivedAt = &now
+		if err := tx.Omit("Items").Save(&transfer).Error; err != nil {
+			return err
+		}
+		return enqueueStockTransferred(tx, &transfer)
+	})
+	if err != nil {
+		return stockErrorResponse(c, err, "Failed to receive transfer")
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    transfer,
+		Message: "Transfer received successfully",
+	})
+}
+
+// lockTransfer loads a transfer with its items and holds a row lock on the header
+func lockTransfer(tx *gorm.DB, id string, transfer *StockTransfer) error {
+	if err := tx.Clauses(forUpdate).Preload("Items").First(transfer, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errTransferNotFound
+		}
+		return err
+	}
+	return nil
+}
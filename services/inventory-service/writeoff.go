@@ -0,0 +1,459 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+)
+
+// Batch statuses. Only ACTIVE batches can be sold.
+const (
+	BatchActive      = "ACTIVE"
+	BatchQuarantined = "QUARANTINED"
+	BatchRecalled    = "RECALLED"
+)
+
+// Write-off reason codes
+var writeOffReasons = map[string]bool{
+	"EXPIRED":  true,
+	"DAMAGED":  true,
+	"BREAKAGE": true,
+	"RECALLED": true,
+	"THEFT":    true,
+	"OTHER":    true,
+}
+
+// WriteOff is a document taking unsaleable stock off a shop's books
+type WriteOff struct {
+	ID         string         `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	WriteOffNo string         `json:"write_off_no" gorm:"uniqueIndex;not null"`
+	ShopID     string         `json:"shop_id" gorm:"type:uuid;not null;index"`
+	ReasonCode string         `json:"reason_code" gorm:"not null;index"` // EXPIRED, DAMAGED, BREAKAGE, RECALLED, THEFT, OTHER
+	Notes      string         `json:"notes"`
+	CreatedBy  string         `json:"created_by" gorm:"type:uuid"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	Items      []WriteOffItem `json:"items" gorm:"foreignKey:WriteOffID"`
+}
+
+// WriteOffItem is one product, optionally one batch, on a write-off
+type WriteOffItem struct {
+	ID         string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	WriteOffID string    `json:"write_off_id" gorm:"type:uuid;not null;index"`
+	ProductID  string    `json:"product_id" gorm:"type:uuid;not null"`
+	BatchID    *string   `json:"batch_id" gorm:"type:uuid"`
+	Quantity   float64   `json:"quantity" gorm:"not null"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// BatchCustomer is a sale of a recalled batch
+type BatchCustomer struct {
+	CustomerID  string    `json:"customer_id"`
+	InvoiceID   string    `json:"invoice_id"`
+	InvoiceNo   string    `json:"invoice_no"`
+	InvoiceDate time.Time `json:"invoice_date"`
+	ShopID      string    `json:"shop_id"`
+	Quantity    float64   `json:"quantity"`
+}
+
+// quarantineExpiredBatches moves every active batch past its expiry date into
+// quarantine, taking what each shop holds of it out of available stock
+func quarantineExpiredBatches() (int64, error) {
+	var quarantined int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var batches []Batch
+		if err := tx.Clauses(forUpdate).
+			Where("status = ? AND expiry_date <= ?", BatchActive, time.Now()).
+			Find(&batches).Error; err != nil {
+			return err
+		}
+		if len(batches) == 0 {
+			return nil
+		}
+
+		if err := quarantineHeld(tx, batches); err != nil {
+			return err
+		}
+
+		ids := make([]string, len(batches))
+		for i, batch := range batches {
+			ids[i] = batch.ID
+		}
+		result := tx.Model(&Batch{}).Where("id IN ?", ids).
+			Updates(map[string]interface{}{
+				"status":        BatchQuarantined,
+				"status_reason": "Expired",
+			})
+		quarantined = result.RowsAffected
+		return result.Error
+	})
+	return quarantined, err
+}
+
+// quarantineHeld takes what every shop holds of the active batches among
+// batches out of its available stock. It must run before the batches leave
+// ACTIVE, while the ledger still places the shops' stock in them.
+func quarantineHeld(tx *gorm.DB, batches []Batch) error {
+	blocked := map[string]map[string]bool{} // batch ids by product
+	for _, batch := range batches {
+		if batch.Status != BatchActive {
+			continue
+		}
+		if blocked[batch.ProductID] == nil {
+			blocked[batch.ProductID] = map[string]bool{}
+		}
+		blocked[batch.ProductID][batch.ID] = true
+	}
+
+	// Lock stock rows in a fixed order
+	productIDs := make([]string, 0, len(blocked))
+	for productID := range blocked {
+		productIDs = append(productIDs, productID)
+	}
+	sort.Strings(productIDs)
+
+	for _, productID := range productIDs {
+		var shopIDs []string
+		if err := tx.Model(&Stock{}).Where("product_id = ?", productID).
+			Order("shop_id").Pluck("shop_id", &shopIDs).Error; err != nil {
+			return err
+		}
+		for _, shopID := range shopIDs {
+			held, err := ledger.ShopBatches(tx, productID, shopID)
+			if err != nil {
+				return err
+			}
+			qty := heldOf(held, blocked[productID])
+			if qty <= 0 {
+				continue
+			}
+			if _, err := ledger.Quarantine(tx, productID, shopID, qty); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// heldOf totals what a shop holds of the given batches
+func heldOf(batches []ledger.ShopBatch, ids map[string]bool) float64 {
+	var qty float64
+	for _, batch := range batches {
+		if ids[batch.ID] {
+			qty += batch.Held
+		}
+	}
+	return qty
+}
+
+// runQuarantine quarantines expired batches on a fixed interval
+func runQuarantine(interval time.Duration) {
+	for {
+		n, err := quarantineExpiredBatches()
+		if err != nil {
+			log.Printf("Batch quarantine failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Quarantined %d expired batches", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func createWriteOff(c *fiber.Ctx) error {
+	type WriteOffLine struct {
+		ProductID string  `json:"product_id"`
+		BatchID   *string `json:"batch_id"`
+		Quantity  float64 `json:"quantity"`
+	}
+
+	type WriteOffRequest struct {
+		ShopID     string         `json:"shop_id"`
+		ReasonCode string         `json:"reason_code"`
+		Notes      string         `json:"notes"`
+		CreatedBy  string         `json:"created_by"`
+		Items      []WriteOffLine `json:"items"`
+	}
+
+	var req WriteOffRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.ShopID == "" || len(req.Items) == 0 {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "shop_id and at least one item are required",
+		})
+	}
+	if !writeOffReasons[req.ReasonCode] {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "reason_code must be one of EXPIRED, DAMAGED, BREAKAGE, RECALLED, THEFT, OTHER",
+		})
+	}
+
+	writeOff := WriteOff{
+		WriteOffNo: fmt.Sprintf("WO-%d", time.Now().UnixNano()),
+		ShopID:     req.ShopID,
+		ReasonCode: req.ReasonCode,
+		Notes:      req.Notes,
+		CreatedBy:  req.CreatedBy,
+	}
+	for _, line := range req.Items {
+		if line.ProductID == "" || line.Quantity <= 0 {
+			return c.Status(400).JSON(Response{
+				Success: false,
+				Error:   "Each item needs a product_id and a positive quantity",
+			})
+		}
+		writeOff.Items = append(writeOff.Items, WriteOffItem{
+			ProductID: line.ProductID,
+			BatchID:   line.BatchID,
+			Quantity:  line.Quantity,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&writeOff).Error; err != nil {
+			return err
+		}
+
+		for _, item := range writeOff.Items {
+			// Units of a quarantined or recalled batch are already out of
+			// available stock; write them off from there
+			blocked := false
+			if item.BatchID != nil {
+				batch, err := drawDownBatch(tx, *item.BatchID, item.ProductID, item.Quantity)
+				if err != nil {
+					return err
+				}
+				blocked = batch.Status != BatchActive
+			}
+
+			debit := ledger.Debit
+			if blocked {
+				debit = ledger.DebitQuarantined
+			}
+			stock, err := debit(tx, item.ProductID, writeOff.ShopID, item.Quantity)
+			if err != nil {
+				return err
+			}
+			movement := StockMovement{
+				ProductID:     item.ProductID,
+				ShopID:        writeOff.ShopID,
+				MovementType:  "OUT",
+				Quantity:      -item.Quantity,
+				Reason:        writeOff.ReasonCode + " " + writeOff.WriteOffNo,
+				ReferenceType: "WRITE_OFF",
+				ReferenceID:   writeOff.ID,
+				BatchID:       item.BatchID,
+				CreatedBy:     writeOff.CreatedBy,
+			}
+			if item.BatchID == nil {
+				if err := postOutbound(tx, stock, movement); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Create(&movement).Error; err != nil {
+				return err
+			}
+			if err := ledger.EnqueueStockAdjusted(tx, stock, &movement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stockErrorResponse(c, err, "Failed to post write-off")
+	}
+
+	return c.Status(201).JSON(Response{
+		Success: true,
+		Data:    writeOff,
+		Message: "Write-off posted successfully",
+	})
+}
+
+// drawDownBatch takes qty out of a batch, refusing to go below zero, and
+// returns the batch
+func drawDownBatch(tx *gorm.DB, batchID, productID string, qty float64) (*Batch, error) {
+	var batch Batch
+	if err := tx.Clauses(forUpdate).First(&batch, "id = ?", batchID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &stockError{status: 404, msg: "Batch " + batchID + " not found"}
+		}
+		return nil, err
+	}
+	if batch.ProductID != productID {
+		return nil, &stockError{status: 400, msg: fmt.Sprintf("Batch %s does not belong to product %s", batch.BatchNo, productID)}
+	}
+	if batch.Quantity < qty {
+		return nil, &stockError{status: 409, msg: fmt.Sprintf("Batch %s holds only %.2f", batch.BatchNo, batch.Quantity)}
+	}
+	return &batch, tx.Model(&batch).Update("quantity", batch.Quantity-qty).Error
+}
+
+func listWriteOffs(c *fiber.Ctx) error {
+	var writeOffs []WriteOff
+
+	query := db.Model(&WriteOff{}).Preload("Items")
+
+	if shopID := c.Query("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	if reason := c.Query("reason_code"); reason != "" {
+		query = query.Where("reason_code = ?", reason)
+	}
+
+	query.Order("created_at DESC").Find(&writeOffs)
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    writeOffs,
+	})
+}
+
+func getWriteOff(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var writeOff WriteOff
+
+	if err := db.Preload("Items").First(&writeOff, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Write-off not found",
+		})
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    writeOff,
+	})
+}
+
+// recallBatch blocks every row of a batch number for the product, which
+// stops it selling at any shop and takes it out of every shop's available
+// stock, and returns the customers who bought it
+func recallBatch(c *fiber.Ctx) error {
+	type RecallRequest struct {
+		Reason string `json:"reason"`
+	}
+
+	var req RecallRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.Reason == "" {
+		return c.Status(400).JSON(Response{
+			Success: false,
+			Error:   "reason is required",
+		})
+	}
+
+	var batch Batch
+	if err := db.First(&batch, "id = ?", c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Batch not found",
+		})
+	}
+
+	var blocked int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var rows []Batch
+		if err := tx.Clauses(forUpdate).
+			Where("product_id = ? AND batch_no = ?", batch.ProductID, batch.BatchNo).
+			Find(&rows).Error; err != nil {
+			return err
+		}
+		if err := quarantineHeld(tx, rows); err != nil {
+			return err
+		}
+
+		result := tx.Model(&Batch{}).
+			Where("product_id = ? AND batch_no = ?", batch.ProductID, batch.BatchNo).
+			Updates(map[string]interface{}{
+				"status":        BatchRecalled,
+				"status_reason": req.Reason,
+			})
+		blocked = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to recall batch",
+		})
+	}
+
+	customers, err := batchCustomers(batch.ProductID, batch.BatchNo)
+	if err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Batch recalled but failed to list customers",
+		})
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data: fiber.Map{
+			"product_id":      batch.ProductID,
+			"batch_no":        batch.BatchNo,
+			"batches_blocked": blocked,
+			"customers":       customers,
+		},
+		Message: "Batch recalled",
+	})
+}
+
+func listBatchCustomers(c *fiber.Ctx) error {
+	var batch Batch
+	if err := db.First(&batch, "id = ?", c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(Response{
+			Success: false,
+			Error:   "Batch not found",
+		})
+	}
+
+	customers, err := batchCustomers(batch.ProductID, batch.BatchNo)
+	if err != nil {
+		return c.Status(500).JSON(Response{
+			Success: false,
+			Error:   "Failed to list customers",
+		})
+	}
+
+	return c.JSON(Response{
+		Success: true,
+		Data:    customers,
+	})
+}
+
+// batchCustomers reads sales-service invoices for every sale of the batch
+func batchCustomers(productID, batchNo string) ([]BatchCustomer, error) {
+	var customers []BatchCustomer
+	err := db.Raw(`
+		SELECT COALESCE(i.customer_id::text, '') AS customer_id, i.id AS invoice_id, i.invoice_no, i.invoice_date, i.shop_id,
+			SUM(ii.quantity) AS quantity
+		FROM invoice_items ii
+		JOIN invoices i ON i.id = ii.invoice_id
+		WHERE ii.product_id = ? AND ii.batch_no = ? AND i.status <> 'CANCELLED'
+		GROUP BY i.customer_id, i.id, i.invoice_no, i.invoice_date, i.shop_id
+		ORDER BY i.invoice_date DESC
+	`, productID, batchNo).Scan(&customers).Error
+	return customers, err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+)
+
+// Table-driven tests for what a shop holds of the batches being blocked
+func TestHeldOf(t *testing.T) {
+	held := []ledger.ShopBatch{
+		{ID: "b-expired", Held: 4},
+		{ID: "b-recalled", Held: 2},
+		{ID: "b-active", Held: 10},
+	}
+
+	tests := []struct {
+		name string
+		ids  map[string]bool
+		want float64
+	}{
+		{name: "one batch", ids: map[string]bool{"b-expired": true}, want: 4},
+		{name: "several batches", ids: map[string]bool{"b-expired": true, "b-recalled": true}, want: 6},
+		{name: "batch the shop does not hold", ids: map[string]bool{"b-elsewhere": true}, want: 0},
+		{name: "no batches", ids: nil, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, heldOf(held, tt.ids))
+		})
+	}
+}
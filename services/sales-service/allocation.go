@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+)
+
+// Batch is the inventory-service batch row. The table is owned and migrated
+// by inventory-service; sales-service only reads and draws it down. What a
+// shop holds of a batch comes from the ledger, see ledger.ShopBatches.
+type Batch struct {
+	ID         string    `json:"id" gorm:"primaryKey;type:uuid"`
+	ProductID  string    `json:"product_id"`
+	BatchNo    string    `json:"batch_no"`
+	ExpiryDate time.Time `json:"expiry_date"`
+	Quantity   float64   `json:"quantity"`
+	Status     string    `json:"status"` // ACTIVE, QUARANTINED, RECALLED
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// allocationError carries the HTTP status a batch allocation should fail with
+type allocationError struct {
+	status int
+	msg    string
+}
+
+func (e *allocationError) Error() string { return e.msg }
+
+// allocateBatches assigns the shop's batches to each requested line
+// first-expiry-first-out. Only batches the shop holds are picked, and
+// quarantined and recalled batches never are; a line may not take stock the
+// shop has reserved, except what the invoice's own reservation holds. A line
+// is split into one invoice item per batch it draws from, and the batch
+// quantities are decremented inside tx. A line that names a batch_no is drawn
+// from that batch only.
+func allocateBatches(tx *gorm.DB, shopID string, lines []InvoiceItem, at time.Time, reservation *ledger.Reservation) ([]InvoiceItem, error) {
+	var allocated []InvoiceItem
+	taken := map[string]float64{} // drawn from each batch by earlier lines of the bill
+	sold := map[string]float64{}  // drawn of each product by earlier lines of the bill
+
+	var held map[string]float64 // held for this invoice by its reservation
+	if reservation != nil {
+		held = reservation.Held()
+	}
+
+	for _, line := range lines {
+		if line.ProductID == "" || line.Quantity <= 0 {
+			return nil, &allocationError{status: http.StatusBadRequest, msg: "Each item needs a product_id and a positive quantity"}
+		}
+
+		// Stock reserved for sales orders and held bills is not for sale,
+		// unless it is reserved for this invoice
+		available, err := availableStock(tx, line.ProductID, shopID)
+		if err != nil {
+			return nil, err
+		}
+		if free := available + held[line.ProductID] - sold[line.ProductID]; free < line.Quantity {
+			return nil, &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Insufficient stock for %s: %.2f available after reservations, %.2f requested", line.ProductName, math.Max(free, 0), line.Quantity)}
+		}
+		sold[line.ProductID] += line.Quantity
+
+		batches, err := ledger.ShopBatches(tx, line.ProductID, shopID)
+		if err != nil {
+			return nil, err
+		}
+
+		remaining := line.Quantity
+		var parts []InvoiceItem
+		for i := range batches {
+			if remaining <= 0 {
+				break
+			}
+			batch := &batches[i]
+			if line.BatchNo != "" && batch.BatchNo != line.BatchNo {
+				continue
+			}
+			if batch.Status != "ACTIVE" {
+				if line.BatchNo != "" {
+					return nil, &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Batch %s of %s is %s and cannot be sold", batch.BatchNo, line.ProductName, strings.ToLower(batch.Status))}
+				}
+				continue
+			}
+			if !batch.ExpiryDate.After(at) {
+				if line.BatchNo != "" {
+					return nil, &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Batch %s of %s expired on %s", batch.BatchNo, line.ProductName, batch.ExpiryDate.Format("2006-01-02"))}
+				}
+				continue
+			}
+
+			free := math.Min(batch.Held, batch.Quantity) - taken[batch.ID]
+			if free <= 0 {
+				continue
+			}
+			take := math.Min(remaining, free)
+			if err := tx.Model(&Batch{}).Where("id = ?", batch.ID).
+				Update("quantity", gorm.Expr("quantity - ?", take)).Error; err != nil {
+				return nil, err
+			}
+			taken[batch.ID] += take
+
+			batchID := batch.ID
+			part := line
+			part.Quantity = take
+			part.BatchNo = batch.BatchNo
+			part.BatchID = &batchID
+			parts = append(parts, part)
+			remaining -= take
+		}
+
+		if remaining > 0 {
+			return nil, &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Insufficient unexpired stock for %s: short by %.2f", line.ProductName, remaining)}
+		}
+
+		allocated = append(allocated, splitAmounts(line, parts)...)
+	}
+
+	return allocated, nil
+}
+
+// availableStock locks the shop's stock row for the product and returns what
+// is on hand less what is reserved
+func availableStock(tx *gorm.DB, productID, shopID string) (float64, error) {
+	stock, err := ledger.LockStock(tx, productID, shopID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return stock.Available, nil
+}
+
+// claimReservation locks the reservation an invoice bills, if it names one.
+// The reservation must still be active and hold stock at the invoice's shop.
+func claimReservation(tx *gorm.DB, invoice *Invoice) (*ledger.Reservation, error) {
+	if invoice.ReservationID == nil || *invoice.ReservationID == "" {
+		return nil, nil
+	}
+
+	reservation, err := ledger.LockReservation(tx, *invoice.ReservationID)
+	if errors.Is(err, ledger.ErrReservationNotFound) {
+		return nil, &allocationError{status: http.StatusNotFound, msg: "Reservation not found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reservation.ShopID != invoice.ShopID {
+		return nil, &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Reservation %s holds stock at another shop", reservation.ReservationNo)}
+	}
+	if reservation.Status != "ACTIVE" || !reservation.ExpiresAt.After(time.Now()) {
+		return nil, &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Reservation %s is no longer active", reservation.ReservationNo)}
+	}
+	return reservation, nil
+}
+
+// convertReservation closes the invoice's reservation, if any, returning its
+// held units to available stock for postSale to take. It must run before
+// postSale.
+func convertReservation(tx *gorm.DB, reservation *ledger.Reservation, invoice *Invoice) error {
+	if reservation == nil {
+		return nil
+	}
+	return ledger.ConvertReservation(tx, reservation, invoice.ID, soldByProduct(invoice.Items))
+}
+
+// soldByProduct totals the quantity an invoice bills of each product
+func soldByProduct(items []InvoiceItem) map[string]float64 {
+	sold := make(map[string]float64)
+	for _, item := range items {
+		sold[item.ProductID] += item.Quantity
+	}
+	return sold
+}
+
+// postSale takes each invoice item out of the shop's stock through the
+// inventory ledger: the stock row, a SALE movement tagged with the batch,
+// its cost consumption and its inventory.adjusted event all commit with the
+// invoice
+func postSale(tx *gorm.DB, invoice *Invoice) error {
+	for _, item := range invoice.Items {
+		if _, err := ledger.Post(tx, &ledger.StockMovement{
+			ProductID:     item.ProductID,
+			ShopID:        invoice.ShopID,
+			MovementType:  "OUT",
+			Quantity:      -item.Quantity,
+			Reason:        "Sale " + invoice.InvoiceNo,
+			ReferenceType: "SALE",
+			ReferenceID:   invoice.ID,
+			BatchID:       item.BatchID,
+			CreatedBy:     invoice.CreatedBy,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitAmounts spreads the line's tax, discount and total over its batch parts
+// pro rata, leaving any rounding remainder on the last part
+func splitAmounts(line InvoiceItem, parts []InvoiceItem) []InvoiceItem {
+	if len(parts) == 1 {
+		return parts
+	}
+
+	var tax, discount, total float64
+	for i := range parts {
+		// The scheme explanation covers the whole line; keep it once
+		if i > 0 {
+			parts[i].Schemes = nil
+		}
+		if i == len(parts)-1 {
+			parts[i].TaxAmount = line.TaxAmount - tax
+			parts[i].Discount = line.Discount - discount
+			parts[i].Total = line.Total - total
+			break
+		}
+		share := parts[i].Quantity / line.Quantity
+		parts[i].TaxAmount = roundPaise(line.TaxAmount * share)
+		parts[i].Discount = roundPaise(line.Discount * share)
+		parts[i].Total = roundPaise(line.Total * share)
+		tax += parts[i].TaxAmount
+		discount += parts[i].Discount
+		total += parts[i].Total
+	}
+	return parts
+}
+
+func roundPaise(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// allocationErrorResponse maps an error from invoice creation onto a response
+func allocationErrorResponse(c echo.Context, err error, fallback string) error {
+	var ae *allocationError
+	if errors.As(err, &ae) {
+		return c.JSON(ae.status, Response{
+			Success: false,
+			Error:   ae.msg,
+		})
+	}
+	if errors.Is(err, ledger.ErrInsufficientStock) {
+		return c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusInternalServerError, Response{
+		Success: false,
+		Error:   fallback,
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Credit checks a bill on credit can fail
+const (
+	CreditLimitExceeded = "CREDIT_LIMIT_EXCEEDED"
+	CreditOverdue       = "OVERDUE_INVOICES"
+)
+
+// creditOverride is a manager's approval to bill past a customer's credit terms
+type creditOverride struct {
+	ApprovedBy string `json:"approved_by"`
+	Reason     string `json:"reason"`
+}
+
+// creditPosition is where a customer stands against their credit terms.
+// Limits and terms come from api-golang's customer and credit limit masters.
+type creditPosition struct {
+	CustomerID    string   `json:"customer_id"`
+	CreditLimit   float64  `json:"credit_limit"`
+	Outstanding   float64  `json:"outstanding"`
+	NewBill       float64  `json:"new_bill"`
+	TermDays      int      `json:"term_days"`
+	OverdueCount  int      `json:"overdue_count"`
+	OverdueAmount float64  `json:"overdue_amount"`
+	Violations    []string `json:"violations"`
+}
+
+// AuditLog is a row in the shared audit log. The table is owned by
+// api-golang; sales-service only appends to it.
+type AuditLog struct {
+	ID         string          `gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	UserID     *string         `gorm:"type:uuid"`
+	Action     string          `gorm:"not null"`
+	Resource   string          `gorm:"not null"`
+	ResourceID string          `gorm:"size:100"`
+	NewValues  json.RawMessage `gorm:"type:jsonb"`
+	IPAddress  string          `gorm:"size:45"`
+	UserAgent  string          `gorm:"size:500"`
+	CreatedAt  time.Time
+}
+
+// creditPositionFor works out the customer's exposure if newBill were added.
+// Outstanding is unpaid invoices less advances and open credit notes; an
+// invoice is overdue once it is unpaid past the customer's term days. A limit
+// of zero means no credit has been granted.
+func creditPositionFor(tx *gorm.DB, customerID string, newBill float64, at time.Time) (*creditPosition, error) {
+	pos := &creditPosition{CustomerID: customerID, NewBill: roundPaise(newBill)}
+
+	if tx.Migrator().HasTable("customers") {
+		// payment_terms is a day count in api-golang's customer master and a
+		// payment term code or name elsewhere, so it is read as text either way
+		var terms struct {
+			CreditLimit  float64
+			PaymentTerms string
+		}
+		if err := tx.Raw(`
+			SELECT COALESCE(credit_limit, 0) AS credit_limit, COALESCE(payment_terms::text, '') AS payment_terms
+			FROM customers WHERE id = ?
+		`, customerID).Scan(&terms).Error; err != nil {
+			return nil, err
+		}
+		pos.CreditLimit = terms.CreditLimit
+
+		var master []paymentTerm
+		if strings.TrimSpace(terms.PaymentTerms) != "" && tx.Migrator().HasTable("payment_terms") {
+			if err := tx.Raw(`
+				SELECT code, name, days FROM payment_terms
+				WHERE is_active = true AND (LOWER(code) = LOWER(TRIM(?)) OR LOWER(name) = LOWER(TRIM(?)))
+			`, terms.PaymentTerms, terms.PaymentTerms).Scan(&master).Error; err != nil {
+				return nil, err
+			}
+		}
+		days, err := termDays(terms.PaymentTerms, master)
+		if err != nil {
+			return nil, &allocationError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("Customer %s: %v", customerID, err)}
+		}
+		pos.TermDays = days
+	}
+
+	// A credit limit master entry in force takes precedence over the customer
+	// record. api-golang and api-golang-v2 shape the table differently.
+	var limits []float64
+	switch {
+	case tx.Migrator().HasColumn("credit_limits", "limit_amount"):
+		if err := tx.Raw(`
+			SELECT limit_amount FROM credit_limits
+			WHERE customer_id = ? AND is_active = true
+				AND (effective_from IS NULL OR effective_from <= ?)
+				AND (effective_to IS NULL OR effective_to >= ?)
+			ORDER BY effective_from DESC NULLS LAST
+			LIMIT 1
+		`, customerID, at, at).Scan(&limits).Error; err != nil {
+			return nil, err
+		}
+	case tx.Migrator().HasColumn("credit_limits", "limit"):
+		if err := tx.Raw(`
+			SELECT "limit" FROM credit_limits
+			WHERE customer_id = ? AND is_active = true
+			ORDER BY updated_at DESC
+			LIMIT 1
+		`, customerID).Scan(&limits).Error; err != nil {
+			return nil, err
+		}
+	}
+	if len(limits) > 0 {
+		pos.CreditLimit = limits[0]
+	}
+
+	var dues struct {
+		Outstanding   float64
+		OverdueCount  int
+		OverdueAmount float64
+	}
+	if err := tx.Raw(`
+		SELECT COALESCE(SUM(due_amount), 0) AS outstanding,
+			COUNT(*) FILTER (WHERE invoice_date < ?) AS overdue_count,
+			COALESCE(SUM(due_amount) FILTER (WHERE invoice_date < ?), 0) AS overdue_amount
+		FROM invoices
+		WHERE customer_id = ? AND status <> 'CANCELLED' AND due_amount > 0
+	`, at.AddDate(0, 0, -pos.TermDays), at.AddDate(0, 0, -pos.TermDays), customerID).Scan(&dues).Error; err != nil {
+		return nil, err
+	}
+
+	var credits float64
+	if err := tx.Raw(`
+		SELECT COALESCE((SELECT SUM(unallocated) FROM receipts WHERE customer_id = @customer), 0)
+			+ COALESCE((SELECT SUM(balance) FROM credit_notes WHERE customer_id = @customer AND status <> 'CLOSED'), 0)
+	`, map[string]interface{}{"customer": customerID}).Scan(&credits).Error; err != nil {
+		return nil, err
+	}
+
+	pos.Outstanding = roundPaise(dues.Outstanding - credits)
+	pos.OverdueCount = dues.OverdueCount
+	pos.OverdueAmount = roundPaise(dues.OverdueAmount)
+
+	if pos.Outstanding+pos.NewBill > pos.CreditLimit {
+		pos.Violations = append(pos.Violations, CreditLimitExceeded)
+	}
+	if pos.OverdueCount > 0 {
+		pos.Violations = append(pos.Violations, CreditOverdue)
+	}
+	return pos, nil
+}
+
+// enforceCredit checks a bill left partly or wholly unpaid against the
+// customer's credit terms. A bill that breaks them is refused unless it
+// carries a manager override, in which case the override is stamped on the
+// invoice and the position is returned so it can be audited. Invoices raised
+// through api-golang do not pass through this check.
+func enforceCredit(tx *gorm.DB, invoice *Invoice) (*creditPosition, error) {
+	if invoice.DueAmount <= 0 {
+		return nil, nil
+	}
+	if invoice.CustomerID == "" {
+		return nil, &allocationError{status: http.StatusBadRequest, msg: "A customer is required to bill on credit"}
+	}
+
+	// Serialise credit bills per customer so two counters cannot both use
+	// the last of a limit
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "invoices:credit:"+invoice.CustomerID).Error; err != nil {
+		return nil, err
+	}
+
+	pos, err := creditPositionFor(tx, invoice.CustomerID, invoice.DueAmount, invoice.InvoiceDate)
+	if err != nil {
+		return nil, err
+	}
+	if len(pos.Violations) == 0 {
+		return nil, nil
+	}
+
+	override := invoice.CreditOverride
+	if override == nil || override.ApprovedBy == "" || override.Reason == "" {
+		var reasons []string
+		for _, v := range pos.Violations {
+			switch v {
+			case CreditLimitExceeded:
+				reasons = append(reasons, fmt.Sprintf("outstanding %.2f plus this bill %.2f exceeds the credit limit of %.2f", pos.Outstanding, pos.NewBill, pos.CreditLimit))
+			case CreditOverdue:
+				reasons = append(reasons, fmt.Sprintf("%d invoices totalling %.2f are overdue past %d days", pos.OverdueCount, pos.OverdueAmount, pos.TermDays))
+			}
+		}
+		return nil, &allocationError{status: http.StatusPaymentRequired, msg: "Credit check failed: " + strings.Join(reasons, "; ") + ". A manager override is required"}
+	}
+
+	if err := checkOverrideApprover(tx, override.ApprovedBy); err != nil {
+		return nil, err
+	}
+
+	invoice.CreditOverrideBy = &override.ApprovedBy
+	invoice.CreditOverrideReason = override.Reason
+	return pos, nil
+}
+
+// creditOverrideRoles may approve a bill past a customer's credit terms
+var creditOverrideRoles = []string{"admin", "owner", "manager"}
+
+// checkOverrideApprover makes sure a credit override names an active user of
+// api-golang with a role allowed to approve it
+func checkOverrideApprover(tx *gorm.DB, userID string) error {
+	if !tx.Migrator().HasTable("users") {
+		return &allocationError{status: http.StatusForbidden, msg: "Credit overrides cannot be verified until the user master is set up"}
+	}
+
+	query := tx.Table("users").Where("id::text = ? AND is_active = true", userID)
+	if tx.Migrator().HasColumn("users", "is_locked") {
+		query = query.Where("is_locked = false")
+	}
+
+	var roles []string
+	if err := query.Limit(1).Pluck("LOWER(COALESCE(role, ''))", &roles).Error; err != nil {
+		return err
+	}
+	if len(roles) == 0 {
+		return &allocationError{status: http.StatusForbidden, msg: "Credit override approver not found or inactive"}
+	}
+	for _, role := range creditOverrideRoles {
+		if roles[0] == role {
+			return nil
+		}
+	}
+	return &allocationError{status: http.StatusForbidden, msg: fmt.Sprintf("A %s cannot approve a credit override", roles[0])}
+}
+
+// paymentTerm is a row of api-golang's payment term master
+type paymentTerm struct {
+	Code string
+	Name string
+	Days int
+}
+
+var errUnknownPaymentTerms = errors.New("unknown payment terms")
+
+// termDays resolves a customer's payment terms to credit days. A bare number
+// is a day count; anything else must name a payment term in the master by
+// code or name. No terms give no credit days.
+func termDays(terms string, master []paymentTerm) (int, error) {
+	terms = strings.TrimSpace(terms)
+	if terms == "" {
+		return 0, nil
+	}
+	if days, err := strconv.Atoi(terms); err == nil && days >= 0 {
+		return days, nil
+	}
+	for _, term := range master {
+		if strings.EqualFold(term.Code, terms) || strings.EqualFold(term.Name, terms) {
+			return term.Days, nil
+		}
+	}
+	return 0, fmt.Errorf("%w %q", errUnknownPaymentTerms, terms)
+}
+
+// recordCreditOverride writes an approved override to the audit log
+func recordCreditOverride(tx *gorm.DB, c echo.Context, invoice *Invoice, pos *creditPosition) error {
+	values, err := json.Marshal(map[string]interface{}{
+		"invoice_no":  invoice.InvoiceNo,
+		"customer_id": invoice.CustomerID,
+		"approved_by": invoice.CreditOverrideBy,
+		"reason":      invoice.CreditOverrideReason,
+		"position":    pos,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&AuditLog{
+		UserID:     invoice.CreditOverrideBy,
+		Action:     "invoice.credit_override",
+		Resource:   "invoices",
+		ResourceID: invoice.ID,
+		NewValues:  values,
+		IPAddress:  c.RealIP(),
+		UserAgent:  c.Request().UserAgent(),
+	}).Error
+}
+
+// getCreditPosition lets the counter check a customer before billing.
+// amount is the bill being considered.
+func getCreditPosition(c echo.Context) error {
+	var amount float64
+	if v := c.QueryParam("amount"); v != "" {
+		if _, err := fmt.Sscanf(v, "%f", &amount); err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "amount must be a number",
+			})
+		}
+	}
+
+	pos, err := creditPositionFor(db, c.Param("id"), amount, time.Now())
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to check credit")
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    pos,
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Table-driven tests for resolving payment terms to credit days
+func TestTermDays(t *testing.T) {
+	master := []paymentTerm{
+		{Code: "NET30", Name: "Net 30", Days: 30},
+		{Code: "NET45", Name: "Net 45 days", Days: 45},
+		{Code: "CASH", Name: "Cash", Days: 0},
+	}
+
+	tests := []struct {
+		name    string
+		terms   string
+		want    int
+		wantErr error
+	}{
+		{name: "bare number", terms: "30", want: 30},
+		{name: "bare number with spaces", terms: " 15 ", want: 15},
+		{name: "master code", terms: "NET30", want: 30},
+		{name: "master name ignores case", terms: "net 45 days", want: 45},
+		{name: "master term with no credit", terms: "Cash", want: 0},
+		{name: "no terms", terms: "", want: 0},
+		{name: "free text not in the master", terms: "Net 60", wantErr: errUnknownPaymentTerms},
+		{name: "negative number", terms: "-5", wantErr: errUnknownPaymentTerms},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := termDays(tt.terms, master)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// Without a master, only a day count can be resolved
+func TestTermDaysWithoutMaster(t *testing.T) {
+	days, err := termDays("7", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, days)
+
+	_, err = termDays("Net 30", nil)
+	assert.ErrorIs(t, err, errUnknownPaymentTerms)
+}
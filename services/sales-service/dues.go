@@ -0,0 +1,514 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Receipt is money collected from a customer. It is allocated across their
+// outstanding invoices; whatever is not allocated is held on account as an
+// advance and can be allocated later.
+type Receipt struct {
+	ID          string              `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ReceiptNo   string              `json:"receipt_no" gorm:"uniqueIndex;not null"`
+	CustomerID  string              `json:"customer_id" gorm:"type:uuid;not null;index"`
+	ShopID      string              `json:"shop_id" gorm:"type:uuid;not null;index"`
+	ReceiptDate time.Time           `json:"receipt_date" gorm:"not null"`
+	Amount      float64             `json:"amount" gorm:"not null"`
+	Unallocated float64             `json:"unallocated" gorm:"not null;default:0"` // advance held on account
+	PaymentMode string              `json:"payment_mode"`                          // CASH, CARD, UPI, CHEQUE, BANK
+	Reference   string              `json:"reference"`
+	Notes       string              `json:"notes"`
+	CreatedBy   string              `json:"created_by" gorm:"type:uuid"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+	Allocations []ReceiptAllocation `json:"allocations" gorm:"foreignKey:ReceiptID"`
+}
+
+// ReceiptAllocation is the part of a receipt settled against one invoice
+type ReceiptAllocation struct {
+	ID        string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ReceiptID string    `json:"receipt_id" gorm:"type:uuid;not null;index"`
+	InvoiceID string    `json:"invoice_id" gorm:"type:uuid;not null;index"`
+	InvoiceNo string    `json:"invoice_no"`
+	Amount    float64   `json:"amount" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StatementLine is one entry on a customer statement. Debits are what the
+// customer owes; the balance is positive while they owe the shop and negative
+// while the shop holds their money.
+type StatementLine struct {
+	Date       time.Time `json:"date"`
+	Type       string    `json:"type"` // INVOICE, RECEIPT, CREDIT_NOTE, REFUND
+	DocumentID string    `json:"document_id"`
+	DocumentNo string    `json:"document_no"`
+	Debit      float64   `json:"debit"`
+	Credit     float64   `json:"credit"`
+	Balance    float64   `json:"balance"`
+}
+
+// dueAllocation asks for part of a receipt to go to one invoice
+type dueAllocation struct {
+	InvoiceID string  `json:"invoice_id"`
+	Amount    float64 `json:"amount"`
+}
+
+// allocateReceipt settles the receipt's unallocated amount against the
+// customer's invoices. With no allocations given it pays off the oldest
+// invoices first; otherwise it pays exactly the invoices and amounts asked
+// for. The receipt must be locked by the caller.
+func allocateReceipt(tx *gorm.DB, receipt *Receipt, wanted []dueAllocation) error {
+	if len(wanted) == 0 {
+		var invoices []Invoice
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("customer_id = ? AND status <> ? AND due_amount > 0", receipt.CustomerID, "CANCELLED").
+			Order("invoice_date ASC, created_at ASC").
+			Find(&invoices).Error; err != nil {
+			return err
+		}
+
+		for i := range invoices {
+			if receipt.Unallocated <= 0 {
+				break
+			}
+			amount := minAmount(receipt.Unallocated, invoices[i].DueAmount)
+			if err := settleInvoice(tx, receipt, &invoices[i], amount); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, want := range wanted {
+		if want.Amount <= 0 {
+			return &allocationError{status: http.StatusBadRequest, msg: "Each allocation needs a positive amount"}
+		}
+		if roundPaise(want.Amount) > receipt.Unallocated {
+			return &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Receipt %s has only %.2f left to allocate", receipt.ReceiptNo, receipt.Unallocated)}
+		}
+
+		var invoice Invoice
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invoice, "id = ?", want.InvoiceID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &allocationError{status: http.StatusNotFound, msg: "Invoice " + want.InvoiceID + " not found"}
+			}
+			return err
+		}
+		if invoice.CustomerID != receipt.CustomerID {
+			return &allocationError{status: http.StatusBadRequest, msg: fmt.Sprintf("Invoice %s belongs to another customer", invoice.InvoiceNo)}
+		}
+		if invoice.Status == "CANCELLED" {
+			return &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Invoice %s is cancelled", invoice.InvoiceNo)}
+		}
+		if roundPaise(want.Amount) > invoice.DueAmount {
+			return &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Invoice %s has only %.2f due", invoice.InvoiceNo, invoice.DueAmount)}
+		}
+
+		if err := settleInvoice(tx, receipt, &invoice, want.Amount); err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(receipt).Update("unallocated", receipt.Unallocated).Error
+}
+
+// settleInvoice applies amount of the receipt to one invoice
+func settleInvoice(tx *gorm.DB, receipt *Receipt, invoice *Invoice, amount float64) error {
+	amount = roundPaise(amount)
+
+	invoice.PaidAmount = roundPaise(invoice.PaidAmount + amount)
+	invoice.DueAmount = roundPaise(invoice.DueAmount - amount)
+	if invoice.DueAmount <= 0 {
+		invoice.DueAmount = 0
+		invoice.Status = "PAID"
+	} else {
+		invoice.Status = "PARTIAL"
+	}
+	if err := tx.Model(invoice).Updates(map[string]interface{}{
+		"paid_amount": invoice.PaidAmount,
+		"due_amount":  invoice.DueAmount,
+		"status":      invoice.Status,
+	}).Error; err != nil {
+		return err
+	}
+
+	allocation := ReceiptAllocation{
+		ReceiptID: receipt.ID,
+		InvoiceID: invoice.ID,
+		InvoiceNo: invoice.InvoiceNo,
+		Amount:    amount,
+	}
+	if err := tx.Create(&allocation).Error; err != nil {
+		return err
+	}
+
+	receipt.Unallocated = roundPaise(receipt.Unallocated - amount)
+	receipt.Allocations = append(receipt.Allocations, allocation)
+	return nil
+}
+
+// createReceipt records a receipt and allocates it in one transaction
+func createReceipt(c echo.Context) error {
+	type ReceiptRequest struct {
+		CustomerID  string          `json:"customer_id"`
+		ShopID      string          `json:"shop_id"`
+		Amount      float64         `json:"amount"`
+		PaymentMode string          `json:"payment_mode"`
+		Reference   string          `json:"reference"`
+		Notes       string          `json:"notes"`
+		CreatedBy   string          `json:"created_by"`
+		Allocations []dueAllocation `json:"allocations"` // empty pays oldest invoices first
+	}
+
+	var req ReceiptRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.CustomerID == "" || req.ShopID == "" || req.Amount <= 0 {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "customer_id, shop_id and a positive amount are required",
+		})
+	}
+
+	receipt := Receipt{
+		CustomerID:  req.CustomerID,
+		ShopID:      req.ShopID,
+		PaymentMode: req.PaymentMode,
+		Reference:   req.Reference,
+		Notes:       req.Notes,
+		CreatedBy:   req.CreatedBy,
+	}
+
+	if err := postReceipt(&receipt, req.Amount, req.Allocations); err != nil {
+		return allocationErrorResponse(c, err, "Failed to record receipt")
+	}
+
+	return c.JSON(http.StatusCreated, Response{
+		Success: true,
+		Data:    receipt,
+		Message: "Receipt " + receipt.ReceiptNo + " recorded",
+	})
+}
+
+// postReceipt numbers, saves and allocates a new receipt
+func postReceipt(receipt *Receipt, amount float64, wanted []dueAllocation) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		no, err := nextDocumentNo(tx, "receipt", "RCT", now)
+		if err != nil {
+			return err
+		}
+
+		receipt.ReceiptNo = no
+		receipt.ReceiptDate = now
+		receipt.Amount = roundPaise(amount)
+		receipt.Unallocated = receipt.Amount
+		if receipt.PaymentMode == "" {
+			receipt.PaymentMode = "CASH"
+		}
+		if err := tx.Create(receipt).Error; err != nil {
+			return err
+		}
+
+		return allocateReceipt(tx, receipt, wanted)
+	})
+}
+
+// allocateAdvance allocates money already held on account
+func allocateAdvance(c echo.Context) error {
+	type AllocateRequest struct {
+		Allocations []dueAllocation `json:"allocations"` // empty pays oldest invoices first
+	}
+
+	var req AllocateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	var receipt Receipt
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&receipt, "id = ?", c.Param("id")).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &allocationError{status: http.StatusNotFound, msg: "Receipt not found"}
+			}
+			return err
+		}
+		if receipt.Unallocated <= 0 {
+			return &allocationError{status: http.StatusConflict, msg: "Receipt " + receipt.ReceiptNo + " is fully allocated"}
+		}
+
+		return allocateReceipt(tx, &receipt, req.Allocations)
+	})
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to allocate receipt")
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    receipt,
+		Message: "Receipt allocated",
+	})
+}
+
+func listReceipts(c echo.Context) error {
+	var receipts []Receipt
+
+	query := db.Model(&Receipt{}).Preload("Allocations")
+
+	if customerID := c.QueryParam("customer_id"); customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+
+	if shopID := c.QueryParam("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	if c.QueryParam("unallocated") == "true" {
+		query = query.Where("unallocated > 0")
+	}
+
+	query.Order("receipt_date DESC").Find(&receipts)
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    receipts,
+	})
+}
+
+func getReceipt(c echo.Context) error {
+	var receipt Receipt
+
+	if err := db.Preload("Allocations").First(&receipt, "id = ?", c.Param("id")).Error; err != nil {
+		return c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Receipt not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    receipt,
+	})
+}
+
+func listDues(c echo.Context) error {
+	var invoices []Invoice
+
+	query := db.Where("status <> ? AND due_amount > 0", "CANCELLED")
+
+	if customerID := c.QueryParam("customer_id"); customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+
+	if shopID := c.QueryParam("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	query.Order("invoice_date ASC").Find(&invoices)
+
+	var totalDue float64
+	for _, invoice := range invoices {
+		totalDue += invoice.DueAmount
+	}
+
+	data := map[string]interface{}{
+		"invoices":  invoices,
+		"total_due": roundPaise(totalDue),
+	}
+
+	// A single customer's advances can be set off against these dues
+	if customerID := c.QueryParam("customer_id"); customerID != "" {
+		var advance float64
+		db.Model(&Receipt{}).
+			Where("customer_id = ?", customerID).
+			Select("COALESCE(SUM(unallocated), 0)").
+			Scan(&advance)
+		data["advance"] = roundPaise(advance)
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    data,
+	})
+}
+
+// recordPayment collects a payment against one invoice. Anything paid over
+// the invoice's due is held on account as an advance.
+func recordPayment(c echo.Context) error {
+	type PaymentRequest struct {
+		Amount      float64 `json:"amount"`
+		PaymentMode string  `json:"payment_mode"`
+		Reference   string  `json:"reference"`
+		Notes       string  `json:"notes"`
+		CreatedBy   string  `json:"created_by"`
+	}
+
+	var req PaymentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.Amount <= 0 {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "amount must be positive",
+		})
+	}
+
+	var invoice Invoice
+	if err := db.First(&invoice, "id = ?", c.Param("id")).Error; err != nil {
+		return c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Invoice not found",
+		})
+	}
+
+	if invoice.Status == "CANCELLED" || invoice.DueAmount <= 0 {
+		return c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Error:   "Invoice " + invoice.InvoiceNo + " has nothing due",
+		})
+	}
+
+	receipt := Receipt{
+		CustomerID:  invoice.CustomerID,
+		ShopID:      invoice.ShopID,
+		PaymentMode: req.PaymentMode,
+		Reference:   req.Reference,
+		Notes:       req.Notes,
+		CreatedBy:   req.CreatedBy,
+	}
+	wanted := []dueAllocation{{
+		InvoiceID: invoice.ID,
+		Amount:    minAmount(roundPaise(req.Amount), invoice.DueAmount),
+	}}
+
+	if err := postReceipt(&receipt, req.Amount, wanted); err != nil {
+		return allocationErrorResponse(c, err, "Failed to record payment")
+	}
+
+	return c.JSON(http.StatusCreated, Response{
+		Success: true,
+		Data:    receipt,
+		Message: "Payment recorded against " + invoice.InvoiceNo,
+	})
+}
+
+// customerStatement lists a customer's invoices, receipts, credit notes and
+// refunds between from and to with a running balance. What was paid at the
+// counter is credited against its invoice; receipts are credited on their
+// own, so the part of paid_amount they settled is left out of that line.
+func customerStatement(c echo.Context) error {
+	customerID := c.Param("id")
+
+	var from, to time.Time
+	if v := c.QueryParam("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "from must be a date (YYYY-MM-DD)",
+			})
+		}
+		from = t
+	}
+	to = time.Now()
+	if v := c.QueryParam("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "to must be a date (YYYY-MM-DD)",
+			})
+		}
+		to = t.AddDate(0, 0, 1) // inclusive of the whole day
+	}
+
+	entries := `
+		SELECT invoice_date AS date, 'INVOICE' AS type, id AS document_id, invoice_no AS document_no,
+			total_amount AS debit, 0 AS credit, created_at
+		FROM invoices WHERE customer_id = @customer AND status <> 'CANCELLED'
+		UNION ALL
+		SELECT i.invoice_date, 'PAYMENT', i.id, i.invoice_no, 0, i.paid_amount - COALESCE(r.amount, 0), i.created_at
+		FROM invoices i
+		LEFT JOIN (
+			SELECT invoice_id, SUM(amount) AS amount FROM receipt_allocations GROUP BY invoice_id
+		) r ON r.invoice_id = i.id
+		WHERE i.customer_id = @customer AND i.status <> 'CANCELLED' AND i.paid_amount - COALESCE(r.amount, 0) > 0
+		UNION ALL
+		SELECT receipt_date, 'RECEIPT', id, receipt_no, 0, amount, created_at
+		FROM receipts WHERE customer_id = @customer
+		UNION ALL
+		SELECT issue_date, 'CREDIT_NOTE', id, credit_note_no, 0, amount, created_at
+		FROM credit_notes WHERE customer_id = @customer
+		UNION ALL
+		SELECT a.created_at, 'REFUND', a.id, n.credit_note_no, a.amount, 0, a.created_at
+		FROM credit_note_applications a
+		JOIN credit_notes n ON n.id = a.credit_note_id
+		WHERE n.customer_id = @customer AND a.type = 'REFUND'
+	`
+	args := map[string]interface{}{
+		"customer": customerID,
+		"from":     from,
+		"to":       to,
+	}
+
+	var opening float64
+	if err := db.Raw(`SELECT COALESCE(SUM(debit - credit), 0) FROM (`+entries+`) e WHERE e.date < @from`, args).
+		Scan(&opening).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to build statement",
+		})
+	}
+
+	var lines []StatementLine
+	if err := db.Raw(`SELECT date, type, document_id, document_no, debit, credit FROM (`+entries+`) e
+		WHERE e.date >= @from AND e.date < @to ORDER BY e.date, e.created_at`, args).
+		Scan(&lines).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to build statement",
+		})
+	}
+
+	balance := roundPaise(opening)
+	var debits, credits float64
+	for i := range lines {
+		debits += lines[i].Debit
+		credits += lines[i].Credit
+		balance = roundPaise(balance + lines[i].Debit - lines[i].Credit)
+		lines[i].Balance = balance
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"customer_id":     customerID,
+			"from":            from,
+			"to":              to,
+			"opening_balance": roundPaise(opening),
+			"total_debit":     roundPaise(debits),
+			"total_credit":    roundPaise(credits),
+			"closing_balance": balance,
+			"lines":           lines,
+		},
+	})
+}
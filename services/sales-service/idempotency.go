@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyKeyHeader lets a client retry a request without repeating it
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyClaimTTL is how long a claim may stay in progress. A claim left
+// behind by a process that died mid-request is taken over after this.
+const idempotencyClaimTTL = 2 * time.Minute
+
+// errClaimLost is returned by complete when the claim was taken over
+var errClaimLost = &allocationError{status: http.StatusConflict, msg: "A retry with this " + IdempotencyKeyHeader + " took the request over"}
+
+// IdempotencyKey remembers a request made under a client's key and the
+// response it got. The table is shared with api-golang, which scopes its keys
+// separately.
+type IdempotencyKey struct {
+	Scope       string          `json:"scope" gorm:"primaryKey;size:100"`
+	Key         string          `json:"key" gorm:"primaryKey;size:255"`
+	RequestHash string          `json:"request_hash" gorm:"size:64;not null"`
+	StatusCode  int             `json:"status_code" gorm:"not null;default:0"` // 0 while in progress
+	Response    json.RawMessage `json:"response" gorm:"type:jsonb"`
+	CreatedAt   time.Time       `json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at"`
+}
+
+// beginIdempotent claims the request's Idempotency-Key before it is handled.
+// Without a key it returns nil and the request is handled as usual. A repeat
+// of a completed request is answered with the original response, the same
+// key with a different body is rejected, and a repeat while the first attempt
+// is still running is told to retry; in those cases done is true and the
+// caller must not handle the request.
+//
+// The response should be stored with complete in the same transaction as the
+// work it reports, so a key is never left without its response. A claim that
+// was not completed is released so the client can retry, and one older than
+// idempotencyClaimTTL is taken over by the next request with its key.
+func beginIdempotent(c echo.Context, scope string) (claim *IdempotencyKey, done bool, err error) {
+	key := c.Request().Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		return nil, false, nil
+	}
+	if len(key) > 255 {
+		return nil, true, c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   IdempotencyKeyHeader + " is too long",
+		})
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, true, c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+
+	claim = &IdempotencyKey{Scope: scope, Key: key, RequestHash: hex.EncodeToString(sum[:])}
+	// The claim is told apart from a later takeover by when it was made
+	claim.CreatedAt = time.Now().Truncate(time.Microsecond)
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(claim)
+	if res.Error != nil {
+		return nil, true, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return claim, false, nil
+	}
+
+	// Take over a claim of the same request that never finished. A different
+	// request under the key is never let in; it gets a 422 below.
+	res = db.Model(&IdempotencyKey{}).
+		Where("scope = ? AND key = ? AND request_hash = ? AND status_code = 0 AND created_at < ?", scope, key, claim.RequestHash, claim.CreatedAt.Add(-idempotencyClaimTTL)).
+		Update("created_at", claim.CreatedAt)
+	if res.Error != nil {
+		return nil, true, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return claim, false, nil
+	}
+
+	var existing IdempotencyKey
+	if err := db.First(&existing, "scope = ? AND key = ?", scope, key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Released between our insert and read; let the client retry
+			return nil, true, c.JSON(http.StatusConflict, Response{
+				Success: false,
+				Error:   "A request with this " + IdempotencyKeyHeader + " is being retried, try again",
+			})
+		}
+		return nil, true, err
+	}
+
+	switch {
+	case existing.RequestHash != claim.RequestHash:
+		return nil, true, c.JSON(http.StatusUnprocessableEntity, Response{
+			Success: false,
+			Error:   IdempotencyKeyHeader + " was already used with a different request",
+		})
+	case existing.StatusCode == 0:
+		return nil, true, c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Error:   "A request with this " + IdempotencyKeyHeader + " is still in progress",
+		})
+	}
+
+	c.Response().Header().Set("Idempotent-Replayed", "true")
+	return nil, true, c.JSONBlob(existing.StatusCode, existing.Response)
+}
+
+// complete stores the response to a claimed request so repeats get it back.
+// It fails with errClaimLost if the claim was taken over, so the work it
+// would report rolls back.
+func (k *IdempotencyKey) complete(tx *gorm.DB, status int, response interface{}) error {
+	if k == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	res := tx.Model(&IdempotencyKey{}).
+		Where("scope = ? AND key = ? AND status_code = 0 AND created_at = ?", k.Scope, k.Key, k.CreatedAt).
+		Updates(map[string]interface{}{"status_code": status, "response": string(body), "completed_at": time.Now()})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errClaimLost
+	}
+	return nil
+}
+
+// release frees a claim whose request was not completed; a completed claim,
+// or one taken over by a retry, is left alone
+func (k *IdempotencyKey) release() {
+	if k == nil {
+		return
+	}
+	db.Where("scope = ? AND key = ? AND status_code = 0 AND created_at = ?", k.Scope, k.Key, k.CreatedAt).Delete(&IdempotencyKey{})
+}
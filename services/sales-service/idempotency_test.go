@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Table-driven tests for the Idempotency-Key checks made before a claim
+func TestBeginIdempotentWithoutClaim(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		wantDone   bool
+		wantStatus int
+	}{
+		{name: "no key is handled as usual", key: "", wantDone: false, wantStatus: http.StatusOK},
+		{name: "key too long", key: strings.Repeat("k", 256), wantDone: true, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/invoices", strings.NewReader(`{"items":[]}`))
+			if tt.key != "" {
+				req.Header.Set(IdempotencyKeyHeader, tt.key)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+
+			claim, done, err := beginIdempotent(c, "sales:invoice")
+			require.NoError(t, err)
+			assert.Nil(t, claim)
+			assert.Equal(t, tt.wantDone, done)
+			assert.Equal(t, tt.wantStatus, rec.Code)
+		})
+	}
+}
+
+// A request without a key has no claim to complete or release
+func TestNilClaim(t *testing.T) {
+	var claim *IdempotencyKey
+	assert.NoError(t, claim.complete(nil, http.StatusCreated, Response{Success: true}))
+	assert.NotPanics(t, claim.release)
+}
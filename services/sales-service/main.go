@@ -28,40 +28,68 @@ type Config struct {
 
 // Invoice model
 type Invoice struct {
-	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	InvoiceNo    string    `json:"invoice_no" gorm:"uniqueIndex;not null"`
-	CustomerID   string    `json:"customer_id" gorm:"type:uuid;index"`
-	ShopID       string    `json:"shop_id" gorm:"type:uuid;not null;index"`
-	InvoiceDate  time.Time `json:"invoice_date" gorm:"not null"`
-	SubTotal     float64   `json:"sub_total" gorm:"not null"`
-	TaxAmount    float64   `json:"tax_amount" gorm:"not null;default:0"`
-	DiscountAmt  float64   `json:"discount_amount" gorm:"not null;default:0"`
-	TotalAmount  float64   `json:"total_amount" gorm:"not null"`
-	PaidAmount   float64   `json:"paid_amount" gorm:"not null;default:0"`
-	DueAmount    float64   `json:"due_amount" gorm:"not null;default:0"`
-	PaymentMode  string    `json:"payment_mode"` // CASH, CARD, UPI, CREDIT
-	Status       string    `json:"status" gorm:"not null;default:'DRAFT'"` // DRAFT, PAID, PARTIAL, CANCELLED
-	Notes        string    `json:"notes"`
-	CreatedBy    string    `json:"created_by" gorm:"type:uuid"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	Items        []InvoiceItem `json:"items" gorm:"foreignKey:InvoiceID"`
+	ID                   string           `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	InvoiceNo            string           `json:"invoice_no" gorm:"uniqueIndex;not null"`
+	CustomerID           string           `json:"customer_id" gorm:"type:uuid;index"`
+	ShopID               string           `json:"shop_id" gorm:"type:uuid;not null;index"`
+	InvoiceDate          time.Time        `json:"invoice_date" gorm:"not null"`
+	SubTotal             float64          `json:"sub_total" gorm:"not null"`
+	TaxAmount            float64          `json:"tax_amount" gorm:"not null;default:0"`
+	DiscountAmt          float64          `json:"discount_amount" gorm:"not null;default:0"`
+	TotalAmount          float64          `json:"total_amount" gorm:"not null"`
+	PaidAmount           float64          `json:"paid_amount" gorm:"not null;default:0"`
+	DueAmount            float64          `json:"due_amount" gorm:"not null;default:0"`
+	CreditedAmount       float64          `json:"credited_amount" gorm:"not null;default:0"` // dues settled by credit notes
+	CGSTAmount           float64          `json:"cgst_amount" gorm:"not null;default:0"`
+	SGSTAmount           float64          `json:"sgst_amount" gorm:"not null;default:0"`
+	IGSTAmount           float64          `json:"igst_amount" gorm:"not null;default:0"`
+	RoundOff             float64          `json:"round_off" gorm:"not null;default:0"`
+	PlaceOfSupply        string           `json:"place_of_supply"`
+	SupplyType           string           `json:"supply_type"`  // INTRA_STATE, INTER_STATE
+	PaymentMode          string           `json:"payment_mode"` // CASH, CARD, UPI, CREDIT, SPLIT
+	ChangeDue            float64          `json:"change_due" gorm:"not null;default:0"`
+	Status               string           `json:"status" gorm:"not null;default:'DRAFT'"` // DRAFT, PAID, PARTIAL, CANCELLED
+	Notes                string           `json:"notes"`
+	CreatedBy            string           `json:"created_by" gorm:"type:uuid"`
+	CreatedAt            time.Time        `json:"created_at"`
+	UpdatedAt            time.Time        `json:"updated_at"`
+	Items                []InvoiceItem    `json:"items" gorm:"foreignKey:InvoiceID"`
+	Payments             []InvoicePayment `json:"payments" gorm:"foreignKey:InvoiceID"` // one row per tender
+	CouponCode           string           `json:"coupon_code"`
+	ShiftID              *string          `json:"shift_id" gorm:"type:uuid;index"`       // cashier shift it was billed in
+	ReservationID        *string          `json:"reservation_id" gorm:"type:uuid;index"` // stock reservation the invoice bills, if any
+	SeriesID             string           `json:"series_id,omitempty" gorm:"-"`          // optional; defaults to the shop's active series
+	CreditOverride       *creditOverride  `json:"credit_override,omitempty" gorm:"-"`    // manager approval to bill past credit terms
+	CreditOverrideBy     *string          `json:"credit_override_by" gorm:"type:uuid"`
+	CreditOverrideReason string           `json:"credit_override_reason"`
 }
 
 // InvoiceItem model
 type InvoiceItem struct {
-	ID         string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
-	InvoiceID  string    `json:"invoice_id" gorm:"type:uuid;not null;index"`
-	ProductID  string    `json:"product_id" gorm:"type:uuid;not null"`
-	ProductName string   `json:"product_name" gorm:"not null"`
-	Quantity   float64   `json:"quantity" gorm:"not null"`
-	Price      float64   `json:"price" gorm:"not null"`
-	TaxRate    float64   `json:"tax_rate" gorm:"not null;default:0"`
-	TaxAmount  float64   `json:"tax_amount" gorm:"not null;default:0"`
-	Discount   float64   `json:"discount" gorm:"not null;default:0"`
-	Total      float64   `json:"total" gorm:"not null"`
-	BatchNo    string    `json:"batch_no"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID           string          `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	InvoiceID    string          `json:"invoice_id" gorm:"type:uuid;not null;index"`
+	ProductID    string          `json:"product_id" gorm:"type:uuid;not null"`
+	ProductName  string          `json:"product_name" gorm:"not null"`
+	Quantity     float64         `json:"quantity" gorm:"not null"`
+	Price        float64         `json:"price" gorm:"not null"`
+	TaxInclusive bool            `json:"tax_inclusive" gorm:"not null;default:false"` // price is MRP including GST
+	PriceListID  *string         `json:"price_list_id,omitempty" gorm:"type:uuid"`
+	HSNCode      string          `json:"hsn_code"`
+	TaxableValue float64         `json:"taxable_value" gorm:"not null;default:0"`
+	TaxRate      float64         `json:"tax_rate" gorm:"not null;default:0"`
+	CGSTRate     float64         `json:"cgst_rate" gorm:"not null;default:0"`
+	CGSTAmount   float64         `json:"cgst_amount" gorm:"not null;default:0"`
+	SGSTRate     float64         `json:"sgst_rate" gorm:"not null;default:0"`
+	SGSTAmount   float64         `json:"sgst_amount" gorm:"not null;default:0"`
+	IGSTRate     float64         `json:"igst_rate" gorm:"not null;default:0"`
+	IGSTAmount   float64         `json:"igst_amount" gorm:"not null;default:0"`
+	TaxAmount    float64         `json:"tax_amount" gorm:"not null;default:0"`
+	Discount     float64         `json:"discount" gorm:"not null;default:0"`
+	Schemes      []appliedScheme `json:"schemes" gorm:"serializer:json;type:jsonb"` // why the discount was given
+	Total        float64         `json:"total" gorm:"not null"`
+	BatchNo      string          `json:"batch_no"`
+	BatchID      *string         `json:"batch_id" gorm:"type:uuid"` // batch the line was drawn from
+	CreatedAt    time.Time       `json:"created_at"`
 }
 
 // HeldBill model
@@ -98,7 +126,10 @@ func main() {
 	}
 
 	// Auto-migrate models
-	db.AutoMigrate(&Invoice{}, &InvoiceItem{}, &HeldBill{})
+	db.AutoMigrate(&Invoice{}, &InvoiceItem{}, &HeldBill{}, &InvoiceSequence{},
+		&SalesReturn{}, &SalesReturnItem{}, &CreditNote{}, &CreditNoteApplication{},
+		&Receipt{}, &ReceiptAllocation{}, &Shift{}, &CashMovement{},
+		&InvoicePayment{}, &IdempotencyKey{})
 
 	// Initialize Echo
 	e := echo.New()
@@ -198,9 +229,19 @@ func setupRoutes(e *echo.Echo) {
 	pos.POST("/invoice", createInvoice)
 	pos.POST("/hold", holdBill)
 	pos.GET("/held-bills", listHeldBills)
+	pos.GET("/prices", getPrices)
+	pos.POST("/schemes", previewSchemes)
 	pos.POST("/resume/:id", resumeBill)
 	pos.DELETE("/held-bills/:id", deleteHeldBill)
 
+	// Cashier shifts
+	shifts := pos.Group("/shifts")
+	shifts.GET("", listShifts)
+	shifts.POST("", openShift)
+	shifts.POST("/:id/cash", recordCashMovement)
+	shifts.POST("/:id/close", closeShift)
+	shifts.GET("/:id/z-report", getShiftReport)
+
 	// Sales orders
 	orders := v1.Group("/sales/orders")
 	orders.GET("", listOrders)
@@ -208,6 +249,7 @@ func setupRoutes(e *echo.Echo) {
 	orders.GET("/:id", getOrder)
 	orders.PUT("/:id", updateOrder)
 	orders.DELETE("/:id", cancelOrder)
+	orders.POST("/schemes", previewSchemes)
 
 	// Invoices
 	invoices := v1.Group("/sales/invoices")
@@ -219,10 +261,26 @@ func setupRoutes(e *echo.Echo) {
 	// Returns
 	v1.POST("/sales/returns", createReturn)
 	v1.GET("/sales/returns", listReturns)
+	v1.GET("/sales/returns/:id", getReturn)
+
+	// Credit notes
+	creditNotes := v1.Group("/sales/credit-notes")
+	creditNotes.GET("", listCreditNotes)
+	creditNotes.GET("/:id", getCreditNote)
+	creditNotes.POST("/:id/settle", settleCreditNote)
 
 	// Credit sales / Dues
 	v1.GET("/sales/dues", listDues)
 	v1.POST("/sales/dues/:id/payment", recordPayment)
+	v1.GET("/sales/customers/:id/statement", customerStatement)
+	v1.GET("/sales/customers/:id/credit", getCreditPosition)
+
+	// Receipts
+	receipts := v1.Group("/sales/receipts")
+	receipts.GET("", listReceipts)
+	receipts.POST("", createReceipt)
+	receipts.GET("/:id", getReceipt)
+	receipts.POST("/:id/allocate", allocateAdvance)
 }
 
 // Handlers
@@ -235,6 +293,13 @@ func healthCheck(c echo.Context) error {
 }
 
 func createInvoice(c echo.Context) error {
+	// Counters on flaky networks retry; a repeat returns the original invoice
+	claim, done, err := beginIdempotent(c, "sales-service:pos.invoice")
+	if done {
+		return err
+	}
+	defer claim.release()
+
 	var invoice Invoice
 	if err := c.Bind(&invoice); err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
@@ -243,11 +308,6 @@ func createInvoice(c echo.Context) error {
 		})
 	}
 
-	// Generate invoice number
-	if invoice.InvoiceNo == "" {
-		invoice.InvoiceNo = fmt.Sprintf("INV-%d", time.Now().Unix())
-	}
-
 	// Set defaults
 	if invoice.InvoiceDate.IsZero() {
 		invoice.InvoiceDate = time.Now()
@@ -256,35 +316,120 @@ func createInvoice(c echo.Context) error {
 		invoice.Status = "DRAFT"
 	}
 
-	// Begin transaction
-	tx := db.Begin()
-
-	// Create invoice
-	if err := tx.Create(&invoice).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusInternalServerError, Response{
+	if len(invoice.Items) == 0 {
+		return c.JSON(http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "Failed to create invoice",
+			Error:   "At least one item is required",
 		})
 	}
 
-	// Create invoice items
-	for i := range invoice.Items {
-		invoice.Items[i].InvoiceID = invoice.ID
-		if err := tx.Create(&invoice.Items[i]).Error; err != nil {
-			tx.Rollback()
-			return c.JSON(http.StatusInternalServerError, Response{
-				Success: false,
-				Error:   "Failed to create invoice items",
-			})
-		}
+	// Price each line from the customer's price lists
+	if err := applyPrices(db, &invoice); err != nil {
+		return allocationErrorResponse(c, err, "Failed to price invoice")
 	}
 
-	// Commit transaction
-	tx.Commit()
+	// Apply eligible schemes and the coupon, if any
+	schemes, err := applySchemes(db, &invoice)
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to apply schemes")
+	}
+
+	// Resolve GST rates and place of supply from the masters
+	taxes, err := resolveTaxContext(db, &invoice)
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to compute tax")
+	}
+
+	// Pick batches and create the invoice in one transaction
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// A reservation's held stock is for this invoice to sell
+		reservation, err := claimReservation(tx, &invoice)
+		if err != nil {
+			return err
+		}
+
+		items, err := allocateBatches(tx, invoice.ShopID, invoice.Items, invoice.InvoiceDate, reservation)
+		if err != nil {
+			return err
+		}
+
+		// Price each batch line; client-supplied tax figures are ignored
+		taxes.applyInvoiceTax(&invoice, items)
+
+		// Bill into the cashier's open shift
+		if err := attachShift(tx, &invoice); err != nil {
+			return err
+		}
+
+		// Number the invoice from its series
+		if invoice.InvoiceNo, err = nextInvoiceNo(tx, invoice.ShopID, invoice.SeriesID, invoice.InvoiceDate); err != nil {
+			return err
+		}
+
+		// Take the tenders, redeeming gift cards and points
+		if err := settleTenders(tx, &invoice); err != nil {
+			return err
+		}
+
+		// Anything left unpaid must fit the customer's credit terms
+		overridden, err := enforceCredit(tx, &invoice)
+		if err != nil {
+			return err
+		}
+
+		if err := redeemCoupon(tx, schemes.Coupon); err != nil {
+			return err
+		}
+
+		payments := invoice.Payments
+		invoice.Items, invoice.Payments = nil, nil
+		if err := tx.Create(&invoice).Error; err != nil {
+			return err
+		}
+		if overridden != nil {
+			if err := recordCreditOverride(tx, c, &invoice, overridden); err != nil {
+				return err
+			}
+		}
+
+		// Create invoice items
+		for i := range items {
+			items[i].InvoiceID = invoice.ID
+			if err := tx.Create(&items[i]).Error; err != nil {
+				return err
+			}
+		}
+		invoice.Items = items
+
+		// Release the hold so the sale below takes the reserved units
+		if err := convertReservation(tx, reservation, &invoice); err != nil {
+			return err
+		}
+
+		// Take the sold batches out of the shop's stock
+		if err := postSale(tx, &invoice); err != nil {
+			return err
+		}
+
+		for i := range payments {
+			payments[i].InvoiceID = invoice.ID
+			if err := tx.Create(&payments[i]).Error; err != nil {
+				return err
+			}
+		}
+		invoice.Payments = payments
+
+		return claim.complete(tx, http.StatusCreated, Response{
+			Success: true,
+			Data:    invoice,
+			Message: "Invoice created successfully",
+		})
+	})
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to create invoice")
+	}
 
 	// TODO: Publish event to Kafka (order.created, invoice.issued)
-	// TODO: Update inventory (reduce stock)
 
 	return c.JSON(http.StatusCreated, Response{
 		Success: true,
@@ -410,7 +555,7 @@ func cancelOrder(c echo.Context) error {
 func listInvoices(c echo.Context) error {
 	var invoices []Invoice
 	
-	query := db.Model(&Invoice{}).Preload("Items")
+	query := db.Model(&Invoice{}).Preload("Items").Preload("Payments")
 	
 	// Filters
 	if shopID := c.QueryParam("shop_id"); shopID != "" {
@@ -445,7 +590,7 @@ func getInvoice(c echo.Context) error {
 	id := c.Param("id")
 	var invoice Invoice
 
-	if err := db.Preload("Items").First(&invoice, "id = ?", id).Error; err != nil {
+	if err := db.Preload("Items").Preload("Payments").First(&invoice, "id = ?", id).Error; err != nil {
 		return c.JSON(http.StatusNotFound, Response{
 			Success: false,
 			Error:   "Invoice not found",
@@ -473,40 +618,3 @@ func cancelInvoice(c echo.Context) error {
 		Message: "Cancel invoice endpoint - to be implemented",
 	})
 }
-
-func createReturn(c echo.Context) error {
-	// TODO: Implement sales return
-	return c.JSON(http.StatusOK, Response{
-		Success: true,
-		Message: "Create return endpoint - to be implemented",
-	})
-}
-
-func listReturns(c echo.Context) error {
-	// TODO: Implement list returns
-	return c.JSON(http.StatusOK, Response{
-		Success: true,
-		Message: "List returns endpoint - to be implemented",
-	})
-}
-
-func listDues(c echo.Context) error {
-	var invoices []Invoice
-	
-	db.Where("status IN ? AND due_amount > 0", []string{"PARTIAL", "PAID"}).
-		Order("invoice_date DESC").
-		Find(&invoices)
-
-	return c.JSON(http.StatusOK, Response{
-		Success: true,
-		Data:    invoices,
-	})
-}
-
-func recordPayment(c echo.Context) error {
-	// TODO: Implement payment recording
-	return c.JSON(http.StatusOK, Response{
-		Success: true,
-		Message: "Record payment endpoint - to be implemented",
-	})
-}
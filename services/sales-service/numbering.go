@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yeelo/homeopathy-platform/shared-go/docno"
+	"gorm.io/gorm"
+)
+
+// InvoiceSeries is the api-golang invoice series master. The table is owned
+// by api-golang; sales-service only reads the numbering configuration.
+type InvoiceSeries struct {
+	ID          string `json:"id" gorm:"primaryKey;type:uuid"`
+	Code        string `json:"code"`
+	Prefix      string `json:"prefix"`
+	Suffix      string `json:"suffix"`
+	Pattern     string `json:"pattern"`
+	StartNumber int    `json:"start_number"`
+	EndNumber   int    `json:"end_number"`
+	BranchID    string `json:"branch_id"`
+	IsActive    bool   `json:"is_active"`
+}
+
+// InvoiceSequence is the last number issued by a series in a financial year
+type InvoiceSequence = docno.Sequence
+
+// nextInvoiceNo draws the next number for the shop's active series in the
+// invoice date's financial year. The sequence row stays locked until tx ends,
+// which serialises invoices within a series.
+func nextInvoiceNo(tx *gorm.DB, shopID, seriesID string, at time.Time) (string, error) {
+	query := tx.Where("is_active = ?", true)
+	if seriesID != "" {
+		query = query.Where("id = ?", seriesID)
+	} else {
+		query = query.Where("branch_id = ?", shopID)
+	}
+
+	// The master table only exists once api-golang has migrated
+	var found []InvoiceSeries
+	if tx.Migrator().HasTable(&InvoiceSeries{}) {
+		if err := query.Order("code").Limit(1).Find(&found).Error; err != nil {
+			return "", err
+		}
+	}
+
+	var series InvoiceSeries
+	switch {
+	case len(found) > 0:
+		series = found[0]
+	case seriesID != "":
+		return "", &allocationError{status: http.StatusBadRequest, msg: "Invoice series not found or inactive"}
+	default:
+		// No series configured for the shop; share one default series so
+		// numbers stay unique across shops
+		series = InvoiceSeries{ID: "default", Prefix: "INV", StartNumber: 1}
+	}
+
+	start := series.StartNumber
+	if start <= 0 {
+		start = 1
+	}
+
+	fy := docno.FinancialYear(at)
+	seq, err := docno.NextSequence(tx, series.ID, fy, start)
+	if err != nil {
+		return "", err
+	}
+
+	if series.EndNumber > 0 && seq > series.EndNumber {
+		return "", &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Invoice series %s is exhausted for %s", series.Code, fy)}
+	}
+
+	return docno.Format(series.Pattern, series.Prefix, series.Suffix, fy, seq), nil
+}
+
+// nextDocumentNo draws the next number for a non-invoice document such as a
+// credit note or receipt
+func nextDocumentNo(tx *gorm.DB, key, prefix string, at time.Time) (string, error) {
+	return docno.Next(tx, key, prefix, at)
+}
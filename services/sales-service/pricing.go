@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Where a resolved price came from
+const (
+	PriceFromList    = "PRICE_LIST"
+	PriceFromProduct = "PRODUCT"
+)
+
+// resolvedPrice is what a customer pays for a product at a branch on a date
+type resolvedPrice struct {
+	ProductID    string  `json:"product_id"`
+	Price        float64 `json:"price"`
+	TaxInclusive bool    `json:"tax_inclusive"`
+	PriceListID  string  `json:"price_list_id,omitempty"`
+	Source       string  `json:"source"` // PRICE_LIST, PRODUCT
+}
+
+// resolvePrices picks each product's price from api-golang's price list
+// masters. A list applies when its customer group, price level and branch
+// are either unset or match the sale; the most specific list wins, then the
+// higher priority, then the most recent line. A line for the product's size
+// beats a line for any size. Walk-in sales only see lists open to everyone,
+// such as the MRP list.
+//
+// Products on no list fall back to their selling price, or MRP when there is
+// none, less the customer's group or price level discount.
+func resolvePrices(tx *gorm.DB, customerID, branchID string, at time.Time, productIDs []string) (map[string]resolvedPrice, error) {
+	prices := make(map[string]resolvedPrice, len(productIDs))
+	args := map[string]interface{}{
+		"customer": customerID,
+		"branch":   branchID,
+		"at":       at,
+		"ids":      productIDs,
+	}
+
+	// A customer's group and price level columns only exist once api-golang
+	// has migrated its price lists; until then no customer has either
+	groupID, levelID := "NULL::uuid", "NULL::uuid"
+	if tx.Migrator().HasColumn("customers", "group_id") {
+		groupID = "c.group_id"
+	}
+	if tx.Migrator().HasColumn("customers", "price_level_id") {
+		levelID = "c.price_level_id"
+	}
+
+	if tx.Migrator().HasTable("price_list_items") {
+		var listed []resolvedPrice
+		if err := tx.Raw(fmt.Sprintf(`
+			SELECT DISTINCT ON (pli.product_id)
+				pli.product_id, pli.price, pl.id AS price_list_id,
+				(pl.type = 'MRP' OR pl.prices_include_tax) AS tax_inclusive
+			FROM price_list_items pli
+			JOIN price_lists pl ON pl.id = pli.price_list_id
+			JOIN products p ON p.id = pli.product_id
+			LEFT JOIN customers c ON c.id::text = @customer
+			WHERE pli.product_id IN @ids AND pli.is_active = true AND pl.is_active = true
+				AND pl.type IN ('Sale', 'MRP')
+				AND (pli.size_id IS NULL OR pli.size_id = p.size_id)
+				AND (pl.effective_from IS NULL OR pl.effective_from <= @at)
+				AND (pl.effective_to IS NULL OR pl.effective_to >= @at)
+				AND (pli.effective_from IS NULL OR pli.effective_from <= @at)
+				AND (pli.effective_to IS NULL OR pli.effective_to >= @at)
+				AND (pl.customer_group_id IS NULL OR pl.customer_group_id = %[1]s)
+				AND (pl.price_level_id IS NULL OR pl.price_level_id = %[2]s)
+				AND (pl.branch_id IS NULL OR pl.branch_id::text = @branch)
+			ORDER BY pli.product_id,
+				(pl.customer_group_id IS NOT NULL)::int + (pl.price_level_id IS NOT NULL)::int + (pl.branch_id IS NOT NULL)::int DESC,
+				(pli.size_id IS NOT NULL) DESC,
+				pl.priority DESC,
+				pli.effective_from DESC NULLS LAST
+		`, groupID, levelID), args).Scan(&listed).Error; err != nil {
+			return nil, err
+		}
+
+		for _, p := range listed {
+			p.Source = PriceFromList
+			prices[p.ProductID] = p
+		}
+	}
+
+	var missing []string
+	for _, id := range productIDs {
+		if _, ok := prices[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return prices, nil
+	}
+
+	var fallback []struct {
+		ProductID     string
+		SellingPrice  float64
+		MRP           float64
+		GroupDiscount float64
+		LevelDiscount float64
+	}
+	args["ids"] = missing
+	if err := tx.Raw(fmt.Sprintf(`
+		SELECT p.id AS product_id, COALESCE(p.selling_price, 0) AS selling_price, COALESCE(p.mrp, 0) AS mrp,
+			COALESCE(cg.discount_percent, 0) AS group_discount,
+			COALESCE(lv.discount_percent, 0) AS level_discount
+		FROM products p
+		LEFT JOIN customers c ON c.id::text = @customer
+		LEFT JOIN customer_groups cg ON cg.id = %[1]s AND cg.is_active = true
+		LEFT JOIN price_levels lv ON lv.is_active = true AND lv.id = COALESCE(%[2]s,
+			(SELECT id FROM price_levels WHERE is_default = true AND is_active = true LIMIT 1))
+		WHERE p.id IN @ids
+	`, groupID, levelID), args).Scan(&fallback).Error; err != nil {
+		return nil, err
+	}
+
+	for _, f := range fallback {
+		price := resolvedPrice{ProductID: f.ProductID, Price: f.SellingPrice, Source: PriceFromProduct}
+		if price.Price <= 0 {
+			price.Price = f.MRP
+			price.TaxInclusive = true
+		}
+		// Group and level discounts do not stack; the better one applies
+		discount := math.Max(f.GroupDiscount, f.LevelDiscount)
+		price.Price = roundPaise(price.Price * (100 - discount) / 100)
+		prices[f.ProductID] = price
+	}
+
+	return prices, nil
+}
+
+// applyPrices prices every line of the invoice from the resolver. Prices
+// sent by the client are ignored.
+func applyPrices(tx *gorm.DB, invoice *Invoice) error {
+	productIDs := make([]string, 0, len(invoice.Items))
+	for _, item := range invoice.Items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	prices, err := resolvePrices(tx, invoice.CustomerID, invoice.ShopID, invoice.InvoiceDate, productIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range invoice.Items {
+		item := &invoice.Items[i]
+		price, ok := prices[item.ProductID]
+		if !ok || price.Price <= 0 {
+			return &allocationError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("No price configured for %s", item.ProductName)}
+		}
+		item.Price = price.Price
+		item.TaxInclusive = price.TaxInclusive
+		item.PriceListID = nil
+		if price.PriceListID != "" {
+			listID := price.PriceListID
+			item.PriceListID = &listID
+		}
+	}
+	return nil
+}
+
+// getPrices shows the counter what a customer will pay before billing
+func getPrices(c echo.Context) error {
+	productIDs := strings.Split(c.QueryParam("product_id"), ",")
+	if c.QueryParam("product_id") == "" {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "product_id is required",
+		})
+	}
+
+	at := time.Now()
+	if v := c.QueryParam("date"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "date must be YYYY-MM-DD",
+			})
+		}
+		at = t
+	}
+
+	prices, err := resolvePrices(db, c.QueryParam("customer_id"), c.QueryParam("shop_id"), at, productIDs)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to resolve prices",
+		})
+	}
+
+	result := make([]resolvedPrice, 0, len(prices))
+	for _, id := range productIDs {
+		if p, ok := prices[id]; ok {
+			result = append(result, p)
+		}
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    result,
+	})
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/yeelo/homeopathy-platform/shared-go/creditnote"
+	"github.com/yeelo/homeopathy-platform/shared-go/ledger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Return dispositions decide where returned stock goes
+const (
+	ReturnSellable = ledger.ReturnSellable // back into the batch it was sold from
+	ReturnDamaged  = ledger.ReturnDamaged  // into the damaged bin
+)
+
+// Credit note settlements
+const (
+	SettleStoreCredit = "STORE_CREDIT"
+	SettleRefund      = "REFUND"
+	SettleAdjust      = "ADJUST"
+)
+
+// SalesReturn is goods coming back against an invoice
+type SalesReturn struct {
+	ID          string            `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ReturnNo    string            `json:"return_no" gorm:"uniqueIndex;not null"`
+	InvoiceID   string            `json:"invoice_id" gorm:"type:uuid;not null;index"`
+	CustomerID  string            `json:"customer_id" gorm:"type:uuid;index"`
+	ShopID      string            `json:"shop_id" gorm:"type:uuid;not null;index"`
+	ReturnDate  time.Time         `json:"return_date" gorm:"not null"`
+	ReasonID    string            `json:"reason_id"` // api-golang ReturnReason
+	Reason      string            `json:"reason"`
+	SubTotal    float64           `json:"sub_total" gorm:"not null;default:0"`
+	CGSTAmount  float64           `json:"cgst_amount" gorm:"not null;default:0"`
+	SGSTAmount  float64           `json:"sgst_amount" gorm:"not null;default:0"`
+	IGSTAmount  float64           `json:"igst_amount" gorm:"not null;default:0"`
+	TaxAmount   float64           `json:"tax_amount" gorm:"not null;default:0"`
+	TotalAmount float64           `json:"total_amount" gorm:"not null;default:0"`
+	Notes       string            `json:"notes"`
+	CreatedBy   string            `json:"created_by" gorm:"type:uuid"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Items       []SalesReturnItem `json:"items" gorm:"foreignKey:ReturnID"`
+	CreditNote  *CreditNote       `json:"credit_note,omitempty" gorm:"foreignKey:ReturnID"`
+}
+
+// SalesReturnItem is the part of one invoice line being returned
+type SalesReturnItem struct {
+	ID            string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ReturnID      string    `json:"return_id" gorm:"type:uuid;not null;index"`
+	InvoiceItemID string    `json:"invoice_item_id" gorm:"type:uuid;not null;index"`
+	ProductID     string    `json:"product_id" gorm:"type:uuid;not null"`
+	ProductName   string    `json:"product_name"`
+	BatchNo       string    `json:"batch_no"`
+	BatchID       string    `json:"batch_id" gorm:"type:uuid"` // batch row the stock went back into
+	Quantity      float64   `json:"quantity" gorm:"not null"`
+	Disposition   string    `json:"disposition" gorm:"not null"` // SELLABLE, DAMAGED
+	TaxableValue  float64   `json:"taxable_value" gorm:"not null;default:0"`
+	CGSTAmount    float64   `json:"cgst_amount" gorm:"not null;default:0"`
+	SGSTAmount    float64   `json:"sgst_amount" gorm:"not null;default:0"`
+	IGSTAmount    float64   `json:"igst_amount" gorm:"not null;default:0"`
+	TaxAmount     float64   `json:"tax_amount" gorm:"not null;default:0"`
+	Total         float64   `json:"total" gorm:"not null;default:0"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// CreditNote is what the shop owes the customer for a return
+type CreditNote = creditnote.CreditNote
+
+// CreditNoteApplication is one use of a credit note's balance
+type CreditNoteApplication = creditnote.Application
+
+// returnedSoFar is what has already been returned against one invoice line
+type returnedSoFar struct {
+	InvoiceItemID string
+	Quantity      float64
+	TaxableValue  float64
+	CGSTAmount    float64
+	SGSTAmount    float64
+	IGSTAmount    float64
+	Total         float64
+}
+
+func createReturn(c echo.Context) error {
+	type ReturnLine struct {
+		InvoiceItemID string  `json:"invoice_item_id"`
+		Quantity      float64 `json:"quantity"`
+		ReasonID      string  `json:"reason_id"`
+		Condition     string  `json:"condition"` // SELLABLE, DAMAGED; overrides the reason
+	}
+
+	type ReturnRequest struct {
+		InvoiceID  string       `json:"invoice_id"`
+		ReasonID   string       `json:"reason_id"`
+		Reason     string       `json:"reason"`
+		Notes      string       `json:"notes"`
+		Settlement string       `json:"settlement"` // STORE_CREDIT (default), REFUND, ADJUST
+		RefundMode string       `json:"refund_mode"`
+		CreatedBy  string       `json:"created_by"`
+		Items      []ReturnLine `json:"items"`
+	}
+
+	var req ReturnRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.InvoiceID == "" || len(req.Items) == 0 {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invoice_id and at least one item are required",
+		})
+	}
+	if req.Settlement == "" {
+		req.Settlement = SettleStoreCredit
+	}
+	if req.Settlement != SettleStoreCredit && req.Settlement != SettleRefund && req.Settlement != SettleAdjust {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "settlement must be one of STORE_CREDIT, REFUND, ADJUST",
+		})
+	}
+
+	now := time.Now()
+	var ret SalesReturn
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Lock the invoice so concurrent returns cannot both take the last unit
+		var invoice Invoice
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invoice, "id = ?", req.InvoiceID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &allocationError{status: http.StatusNotFound, msg: "Invoice not found"}
+			}
+			return err
+		}
+		if invoice.Status == "CANCELLED" {
+			return &allocationError{status: http.StatusConflict, msg: "Cannot return against a cancelled invoice"}
+		}
+
+		var invoiceItems []InvoiceItem
+		if err := tx.Where("invoice_id = ?", invoice.ID).Find(&invoiceItems).Error; err != nil {
+			return err
+		}
+		byID := make(map[string]InvoiceItem, len(invoiceItems))
+		for _, item := range invoiceItems {
+			byID[item.ID] = item
+		}
+
+		var prior []returnedSoFar
+		if err := tx.Raw(`
+			SELECT ri.invoice_item_id, SUM(ri.quantity) AS quantity, SUM(ri.taxable_value) AS taxable_value,
+				SUM(ri.cgst_amount) AS cgst_amount, SUM(ri.sgst_amount) AS sgst_amount,
+				SUM(ri.igst_amount) AS igst_amount, SUM(ri.total) AS total
+			FROM sales_return_items ri
+			JOIN sales_returns r ON r.id = ri.return_id
+			WHERE r.invoice_id = ?
+			GROUP BY ri.invoice_item_id
+		`, invoice.ID).Scan(&prior).Error; err != nil {
+			return err
+		}
+		returned := make(map[string]*returnedSoFar, len(prior))
+		for i := range prior {
+			returned[prior[i].InvoiceItemID] = &prior[i]
+		}
+
+		ret = SalesReturn{
+			ReturnNo:   fmt.Sprintf("RET-%d", now.UnixNano()),
+			InvoiceID:  invoice.ID,
+			CustomerID: invoice.CustomerID,
+			ShopID:     invoice.ShopID,
+			ReturnDate: now,
+			ReasonID:   req.ReasonID,
+			Reason:     req.Reason,
+			Notes:      req.Notes,
+			CreatedBy:  req.CreatedBy,
+		}
+
+		// The header goes in first so the stock put back can point at it
+		if err := tx.Create(&ret).Error; err != nil {
+			return err
+		}
+
+		for _, line := range req.Items {
+			item, ok := byID[line.InvoiceItemID]
+			if !ok {
+				return &allocationError{status: http.StatusBadRequest, msg: fmt.Sprintf("Item %s is not on invoice %s", line.InvoiceItemID, invoice.InvoiceNo)}
+			}
+			if line.Quantity <= 0 {
+				return &allocationError{status: http.StatusBadRequest, msg: "Each item needs a positive quantity"}
+			}
+
+			done := returned[item.ID]
+			if done == nil {
+				done = &returnedSoFar{InvoiceItemID: item.ID}
+				returned[item.ID] = done
+			}
+			if left := item.Quantity - done.Quantity; line.Quantity > left {
+				return &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Cannot return %.2f of %s (batch %s): only %.2f left to return", line.Quantity, item.ProductName, item.BatchNo, left)}
+			}
+
+			disposition, reason, err := returnDisposition(tx, line.Condition, line.ReasonID, req.ReasonID)
+			if err != nil {
+				return err
+			}
+			if ret.Reason == "" {
+				ret.Reason = reason
+			}
+
+			batchID, disposition, err := restockReturn(tx, &ret, item, line.Quantity, disposition)
+			if err != nil {
+				return err
+			}
+
+			// Credit the line pro rata; the last unit back takes whatever is
+			// left so the credits add up to exactly what was invoiced
+			last := done.Quantity+line.Quantity >= item.Quantity
+			share := line.Quantity / item.Quantity
+			part := SalesReturnItem{
+				ReturnID:      ret.ID,
+				InvoiceItemID: item.ID,
+				ProductID:     item.ProductID,
+				ProductName:   item.ProductName,
+				BatchNo:       item.BatchNo,
+				BatchID:       batchID,
+				Quantity:      line.Quantity,
+				Disposition:   disposition,
+				TaxableValue:  creditPortion(item.TaxableValue, done.TaxableValue, share, last),
+				CGSTAmount:    creditPortion(item.CGSTAmount, done.CGSTAmount, share, last),
+				SGSTAmount:    creditPortion(item.SGSTAmount, done.SGSTAmount, share, last),
+				IGSTAmount:    creditPortion(item.IGSTAmount, done.IGSTAmount, share, last),
+				Total:         creditPortion(item.Total, done.Total, share, last),
+			}
+			part.TaxAmount = roundPaise(part.CGSTAmount + part.SGSTAmount + part.IGSTAmount)
+
+			done.Quantity += part.Quantity
+			done.TaxableValue += part.TaxableValue
+			done.CGSTAmount += part.CGSTAmount
+			done.SGSTAmount += part.SGSTAmount
+			done.IGSTAmount += part.IGSTAmount
+			done.Total += part.Total
+
+			ret.SubTotal += part.TaxableValue
+			ret.CGSTAmount += part.CGSTAmount
+			ret.SGSTAmount += part.SGSTAmount
+			ret.IGSTAmount += part.IGSTAmount
+			ret.TotalAmount += part.Total
+			ret.Items = append(ret.Items, part)
+		}
+
+		ret.SubTotal = roundPaise(ret.SubTotal)
+		ret.CGSTAmount = roundPaise(ret.CGSTAmount)
+		ret.SGSTAmount = roundPaise(ret.SGSTAmount)
+		ret.IGSTAmount = roundPaise(ret.IGSTAmount)
+		ret.TaxAmount = roundPaise(ret.CGSTAmount + ret.SGSTAmount + ret.IGSTAmount)
+		ret.TotalAmount = roundPaise(ret.TotalAmount)
+
+		if err := tx.Create(&ret.Items).Error; err != nil {
+			return err
+		}
+		if err := tx.Omit(clause.Associations).Save(&ret).Error; err != nil {
+			return err
+		}
+
+		note := CreditNote{
+			ReturnID:   ret.ID,
+			InvoiceID:  invoice.ID,
+			CustomerID: invoice.CustomerID,
+			ShopID:     invoice.ShopID,
+			IssueDate:  now,
+			Amount:     ret.TotalAmount,
+		}
+		err := creditnote.Issue(tx, &note)
+		if err != nil {
+			return err
+		}
+
+		switch req.Settlement {
+		case SettleRefund:
+			err = refundCreditNote(tx, &note, note.Balance, req.RefundMode, ret.ReturnNo, req.CreatedBy)
+		case SettleAdjust:
+			// Whatever the original invoice does not absorb stays as store credit
+			if amount := minAmount(note.Balance, invoice.DueAmount); amount > 0 {
+				err = adjustCreditNote(tx, &note, invoice.ID, amount, req.CreatedBy)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		ret.CreditNote = &note
+		return nil
+	})
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to create return")
+	}
+
+	return c.JSON(http.StatusCreated, Response{
+		Success: true,
+		Data:    ret,
+		Message: "Return recorded and credit note " + ret.CreditNote.CreditNoteNo + " issued",
+	})
+}
+
+// creditPortion is a returned share of an invoiced amount. On the last return
+// of a line it is the remainder rather than a fresh share, which absorbs any
+// rounding left by earlier partial returns.
+func creditPortion(invoiced, creditedSoFar, share float64, last bool) float64 {
+	if last {
+		return roundPaise(invoiced - creditedSoFar)
+	}
+	return roundPaise(invoiced * share)
+}
+
+func minAmount(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// returnDisposition decides whether returned units can be sold again. An
+// explicit condition wins; otherwise the line's reason, then the return's
+// reason, is looked up in api-golang's return reason master.
+func returnDisposition(tx *gorm.DB, condition, lineReasonID, reasonID string) (string, string, error) {
+	if lineReasonID != "" {
+		reasonID = lineReasonID
+	}
+
+	var reason struct {
+		Name        string
+		Disposition string
+	}
+	if reasonID != "" && tx.Migrator().HasTable("return_reasons") {
+		if err := tx.Table("return_reasons").
+			Select("name, COALESCE(disposition, '') AS disposition").
+			Where("id = ? AND is_active = ?", reasonID, true).
+			Take(&reason).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return "", "", &allocationError{status: http.StatusBadRequest, msg: "Return reason not found or inactive"}
+			}
+			return "", "", err
+		}
+	}
+
+	switch {
+	case condition != "":
+		if condition != ReturnSellable && condition != ReturnDamaged {
+			return "", "", &allocationError{status: http.StatusBadRequest, msg: "condition must be SELLABLE or DAMAGED"}
+		}
+		return condition, reason.Name, nil
+	case reason.Disposition == ReturnDamaged:
+		return ReturnDamaged, reason.Name, nil
+	default:
+		return ReturnSellable, reason.Name, nil
+	}
+}
+
+// restockReturn puts returned units back into the shop's stock through the
+// shared ledger, into the batch they were sold from or its damaged bin. It
+// returns the batch row used and the disposition actually applied.
+func restockReturn(tx *gorm.DB, ret *SalesReturn, item InvoiceItem, qty float64, disposition string) (string, string, error) {
+	batchID, disposition, err := ledger.Restock(tx, ledger.Return{
+		ProductID:     item.ProductID,
+		ShopID:        ret.ShopID,
+		BatchID:       item.BatchID,
+		BatchNo:       item.BatchNo,
+		Quantity:      qty,
+		Disposition:   disposition,
+		Reason:        "Sales return " + ret.ReturnNo,
+		ReferenceType: "RETURN",
+		ReferenceID:   ret.ID,
+		CreatedBy:     ret.CreatedBy,
+		At:            ret.ReturnDate,
+	})
+	if errors.Is(err, ledger.ErrBatchNotFound) {
+		return "", "", &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Original batch %q of %s not found", item.BatchNo, item.ProductName)}
+	}
+	return batchID, disposition, err
+}
+
+// refundCreditNote pays amount of the note's balance back to the customer
+func refundCreditNote(tx *gorm.DB, note *CreditNote, amount float64, mode, reference, by string) error {
+	if mode == "" {
+		mode = "CASH"
+	}
+	return applyCreditNote(tx, note, CreditNoteApplication{
+		Type:        SettleRefund,
+		PaymentMode: mode,
+		Reference:   reference,
+		Amount:      amount,
+		CreatedBy:   by,
+	})
+}
+
+// adjustCreditNote sets amount of the note's balance off against the dues on
+// one of the same customer's invoices
+func adjustCreditNote(tx *gorm.DB, note *CreditNote, invoiceID string, amount float64, by string) error {
+	var invoice Invoice
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invoice, "id = ?", invoiceID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &allocationError{status: http.StatusNotFound, msg: "Invoice not found"}
+		}
+		return err
+	}
+	if invoice.CustomerID != note.CustomerID {
+		return &allocationError{status: http.StatusBadRequest, msg: "Credit note and invoice belong to different customers"}
+	}
+	if invoice.Status == "CANCELLED" {
+		return &allocationError{status: http.StatusConflict, msg: "Cannot adjust against a cancelled invoice"}
+	}
+	if amount > invoice.DueAmount {
+		return &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Invoice %s has only %.2f due", invoice.InvoiceNo, invoice.DueAmount)}
+	}
+
+	invoice.CreditedAmount = roundPaise(invoice.CreditedAmount + amount)
+	invoice.DueAmount = roundPaise(invoice.DueAmount - amount)
+	if invoice.DueAmount <= 0 {
+		invoice.DueAmount = 0
+		invoice.Status = "PAID"
+	}
+	if err := tx.Model(&invoice).Updates(map[string]interface{}{
+		"credited_amount": invoice.CreditedAmount,
+		"due_amount":      invoice.DueAmount,
+		"status":          invoice.Status,
+	}).Error; err != nil {
+		return err
+	}
+
+	return applyCreditNote(tx, note, CreditNoteApplication{
+		Type:      SettleAdjust,
+		InvoiceID: &invoice.ID,
+		Reference: invoice.InvoiceNo,
+		Amount:    amount,
+		CreatedBy: by,
+	})
+}
+
+// applyCreditNote records a use of the note and draws down its balance
+func applyCreditNote(tx *gorm.DB, note *CreditNote, app CreditNoteApplication) error {
+	app.Amount = roundPaise(app.Amount)
+	if app.Amount <= 0 {
+		return &allocationError{status: http.StatusBadRequest, msg: "amount must be positive"}
+	}
+	if app.Amount > note.Balance {
+		return &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Credit note %s has only %.2f left", note.CreditNoteNo, note.Balance)}
+	}
+
+	app.CreditNoteID = note.ID
+	if err := tx.Create(&app).Error; err != nil {
+		return err
+	}
+
+	note.Balance = roundPaise(note.Balance - app.Amount)
+	note.Status = creditnote.StatusPartial
+	if note.Balance <= 0 {
+		note.Balance = 0
+		note.Status = creditnote.StatusClosed
+	}
+	note.Applications = append(note.Applications, app)
+	return tx.Model(note).Updates(map[string]interface{}{
+		"balance": note.Balance,
+		"status":  note.Status,
+	}).Error
+}
+
+func listReturns(c echo.Context) error {
+	var returns []SalesReturn
+
+	query := db.Model(&SalesReturn{}).Preload("Items").Preload("CreditNote")
+
+	if shopID := c.QueryParam("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	if invoiceID := c.QueryParam("invoice_id"); invoiceID != "" {
+		query = query.Where("invoice_id = ?", invoiceID)
+	}
+
+	if customerID := c.QueryParam("customer_id"); customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+
+	query.Order("created_at DESC").Find(&returns)
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    returns,
+	})
+}
+
+func getReturn(c echo.Context) error {
+	var ret SalesReturn
+
+	if err := db.Preload("Items").Preload("CreditNote.Applications").First(&ret, "id = ?", c.Param("id")).Error; err != nil {
+		return c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Return not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    ret,
+	})
+}
+
+func listCreditNotes(c echo.Context) error {
+	var notes []CreditNote
+
+	query := db.Model(&CreditNote{})
+
+	if customerID := c.QueryParam("customer_id"); customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+
+	if shopID := c.QueryParam("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	if status := c.QueryParam("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	query.Order("issue_date DESC").Find(&notes)
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    notes,
+	})
+}
+
+func getCreditNote(c echo.Context) error {
+	var note CreditNote
+
+	if err := db.Preload("Applications").First(&note, "id = ?", c.Param("id")).Error; err != nil {
+		return c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Credit note not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    note,
+	})
+}
+
+// settleCreditNote refunds or adjusts part of a credit note's balance. Any
+// balance left over remains available as store credit.
+func settleCreditNote(c echo.Context) error {
+	type SettleRequest struct {
+		Type        string  `json:"type"` // REFUND, ADJUST
+		Amount      float64 `json:"amount"`
+		InvoiceID   string  `json:"invoice_id"`
+		PaymentMode string  `json:"payment_mode"`
+		Reference   string  `json:"reference"`
+		CreatedBy   string  `json:"created_by"`
+	}
+
+	var req SettleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.Type != SettleRefund && req.Type != SettleAdjust {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "type must be REFUND or ADJUST",
+		})
+	}
+	if req.Type == SettleAdjust && req.InvoiceID == "" {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invoice_id is required to adjust against dues",
+		})
+	}
+
+	var note CreditNote
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&note, "id = ?", c.Param("id")).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &allocationError{status: http.StatusNotFound, msg: "Credit note not found"}
+			}
+			return err
+		}
+
+		if req.Type == SettleRefund {
+			return refundCreditNote(tx, &note, req.Amount, req.PaymentMode, req.Reference, req.CreatedBy)
+		}
+		return adjustCreditNote(tx, &note, req.InvoiceID, req.Amount, req.CreatedBy)
+	})
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to settle credit note")
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    note,
+		Message: "Credit note settled",
+	})
+}
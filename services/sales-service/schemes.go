@@ -0,0 +1,432 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Scheme scopes
+const (
+	ScopeBill     = "BILL"
+	ScopeBrand    = "BRAND"
+	ScopeCategory = "CATEGORY"
+	ScopeProduct  = "PRODUCT"
+)
+
+// enteredCodePriority ranks the code entered at the counter above every
+// auto-applied scheme, so an auto scheme that does not stack with it is
+// dropped instead of the customer's coupon
+const enteredCodePriority = math.MaxInt32
+
+// scheme is a discount or coupon from api-golang's Discount and Offer
+// masters, as the engine sees it
+type scheme struct {
+	ID           string
+	Code         string
+	Name         string
+	Type         string // Percentage, Fixed Amount, Buy X Get Y
+	Value        float64
+	MinAmount    float64
+	MaxDiscount  float64
+	Scope        string
+	BrandID      string
+	CategoryID   string
+	ProductID    string
+	BuyQuantity  int
+	FreeQuantity int
+	Priority     int
+	Stackable    bool
+	Coupon       bool // an Offer; counts against its usage limit
+}
+
+// appliedScheme explains one discount taken on a line
+type appliedScheme struct {
+	Code   string  `json:"code"`
+	Name   string  `json:"name"`
+	Scope  string  `json:"scope"`
+	Amount float64 `json:"amount"`
+	Note   string  `json:"note"`
+}
+
+// schemeLine is a cart line after schemes
+type schemeLine struct {
+	ProductID string          `json:"product_id"`
+	Quantity  float64         `json:"quantity"`
+	Price     float64         `json:"price"`
+	Gross     float64         `json:"gross"`
+	Discount  float64         `json:"discount"`
+	Net       float64         `json:"net"`
+	Schemes   []appliedScheme `json:"schemes"`
+}
+
+// schemeResult is what the engine makes of a cart
+type schemeResult struct {
+	Lines        []schemeLine `json:"lines"`
+	LineDiscount float64      `json:"line_discount"`
+	BillDiscount float64      `json:"bill_discount"`
+	Discount     float64      `json:"discount"`
+	Coupon       *scheme      `json:"-"`
+}
+
+type productAttrs struct {
+	ID         string
+	BrandID    string
+	CategoryID string
+}
+
+// loadSchemes reads the schemes in force on a date: every auto-applied
+// discount, plus the discount or offer whose code was entered at the counter.
+// An entered code that matches nothing in force is an error; one that does
+// goes first in priority order.
+func loadSchemes(tx *gorm.DB, code string, at time.Time) ([]scheme, error) {
+	var schemes []scheme
+	args := map[string]interface{}{"code": code, "at": at}
+
+	if tx.Migrator().HasTable("discounts") {
+		if err := tx.Raw(`
+			SELECT id, code, name, type, value,
+				COALESCE(min_amount, 0) AS min_amount, COALESCE(max_discount, 0) AS max_discount,
+				COALESCE(scope, 'BILL') AS scope,
+				COALESCE(brand_id::text, '') AS brand_id,
+				COALESCE(category_id::text, '') AS category_id,
+				COALESCE(product_id::text, '') AS product_id,
+				COALESCE(buy_quantity, 0) AS buy_quantity, COALESCE(free_quantity, 0) AS free_quantity,
+				COALESCE(priority, 0) AS priority, COALESCE(stackable, false) AS stackable
+			FROM discounts
+			WHERE is_active = true AND (auto_apply = true OR code = @code)
+				AND (effective_from IS NULL OR effective_from <= @at)
+				AND (effective_to IS NULL OR effective_to >= @at)
+		`, args).Scan(&schemes).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	// Coupons are bill-level and combine with other stackable schemes
+	if code != "" && tx.Migrator().HasTable("offers") {
+		var coupons []scheme
+		if err := tx.Raw(`
+			SELECT id, code, name, type, value,
+				COALESCE(min_amount, 0) AS min_amount, COALESCE(max_discount, 0) AS max_discount,
+				'BILL' AS scope, true AS stackable, true AS coupon
+			FROM offers
+			WHERE is_active = true AND code = @code
+				AND (valid_from IS NULL OR valid_from <= @at)
+				AND (valid_to IS NULL OR valid_to >= @at)
+				AND (usage_limit = 0 OR used_count < usage_limit)
+		`, args).Scan(&coupons).Error; err != nil {
+			return nil, err
+		}
+		schemes = append(schemes, coupons...)
+	}
+
+	if code != "" {
+		found := false
+		for i := range schemes {
+			if schemes[i].Code == code {
+				schemes[i].Priority = enteredCodePriority
+				found = true
+			}
+		}
+		if !found {
+			return nil, &allocationError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("Coupon %s is not valid", code)}
+		}
+	}
+
+	sort.SliceStable(schemes, func(i, j int) bool {
+		if schemes[i].Priority != schemes[j].Priority {
+			return schemes[i].Priority > schemes[j].Priority
+		}
+		return schemes[i].Code < schemes[j].Code
+	})
+	return schemes, nil
+}
+
+// evaluateSchemes works out the discounts on a priced cart. Line schemes
+// (product, brand, category, buy-X-get-Y) are applied first, then bill schemes
+// and the coupon on what is left; a bill discount is spread over the lines in
+// proportion to their net value so GST is charged on the discounted price.
+//
+// On each line, and then on the bill, eligible schemes are tried in priority
+// order. A scheme that is not stackable only applies on its own: if it comes
+// first it is the only one taken, otherwise it is skipped. Stackable schemes
+// are taken one after another, each on the amount left by the ones before.
+func evaluateSchemes(lines []InvoiceItem, schemes []scheme, attrs map[string]productAttrs, code string) (*schemeResult, error) {
+	result := &schemeResult{Lines: make([]schemeLine, len(lines))}
+
+	var bill []scheme
+	for _, s := range schemes {
+		if normaliseScope(s.Scope) == ScopeBill {
+			bill = append(bill, s)
+		}
+	}
+
+	var net float64
+	for i, item := range lines {
+		line := &result.Lines[i]
+		line.ProductID = item.ProductID
+		line.Quantity = item.Quantity
+		line.Price = item.Price
+		line.Gross = roundPaise(item.Price * item.Quantity)
+
+		var eligible []scheme
+		for _, s := range schemes {
+			if appliesToLine(s, attrs[item.ProductID]) && line.Gross >= s.MinAmount {
+				eligible = append(eligible, s)
+			}
+		}
+		line.Schemes, line.Discount = stackSchemes(eligible, line.Gross, item)
+		line.Net = roundPaise(line.Gross - line.Discount)
+
+		result.LineDiscount += line.Discount
+		net += line.Net
+	}
+	net = roundPaise(net)
+
+	var eligible []scheme
+	for _, s := range bill {
+		if net >= s.MinAmount {
+			eligible = append(eligible, s)
+		} else if s.Code == code {
+			return nil, &allocationError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("Coupon %s needs a bill of at least %.2f", code, s.MinAmount)}
+		}
+	}
+	applied, billDiscount := stackSchemes(eligible, net, InvoiceItem{})
+	spreadBillSchemes(result.Lines, applied, net)
+
+	if code != "" {
+		used := false
+		for _, line := range result.Lines {
+			for _, a := range line.Schemes {
+				used = used || a.Code == code
+			}
+		}
+		if !used {
+			return nil, &allocationError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("Coupon %s cannot be combined with the schemes on this bill", code)}
+		}
+	}
+	for _, s := range schemes {
+		if s.Coupon && s.Code == code {
+			coupon := s
+			result.Coupon = &coupon
+		}
+	}
+
+	result.LineDiscount = roundPaise(result.LineDiscount)
+	result.BillDiscount = billDiscount
+	result.Discount = roundPaise(result.LineDiscount + billDiscount)
+	return result, nil
+}
+
+// stackSchemes applies eligible schemes, already in priority order, to base
+func stackSchemes(eligible []scheme, base float64, item InvoiceItem) ([]appliedScheme, float64) {
+	var applied []appliedScheme
+	var total float64
+
+	for _, s := range eligible {
+		if len(applied) > 0 && !s.Stackable {
+			continue
+		}
+
+		amount, note := schemeAmount(s, base-total, item)
+		if amount <= 0 {
+			continue
+		}
+		applied = append(applied, appliedScheme{Code: s.Code, Name: s.Name, Scope: normaliseScope(s.Scope), Amount: amount, Note: note})
+		total = roundPaise(total + amount)
+
+		if !s.Stackable {
+			break
+		}
+	}
+	return applied, total
+}
+
+// schemeAmount is what one scheme takes off base, capped at its maximum
+// discount and never more than base
+func schemeAmount(s scheme, base float64, item InvoiceItem) (float64, string) {
+	var amount float64
+	var note string
+
+	switch strings.ToUpper(strings.ReplaceAll(s.Type, " ", "")) {
+	case "PERCENTAGE":
+		amount = base * s.Value / 100
+		note = fmt.Sprintf("%g%% off", s.Value)
+	case "FIXED", "FIXEDAMOUNT":
+		amount = s.Value
+		note = fmt.Sprintf("%.2f off", s.Value)
+	case "BUYXGETY":
+		// Buy X get Y free on the same remedy; the free units are in the
+		// quantity billed
+		if s.BuyQuantity <= 0 || s.FreeQuantity <= 0 || item.ProductID == "" {
+			return 0, ""
+		}
+		free := math.Floor(item.Quantity/float64(s.BuyQuantity+s.FreeQuantity)) * float64(s.FreeQuantity)
+		amount = free * item.Price
+		note = fmt.Sprintf("Buy %d get %d free: %g free", s.BuyQuantity, s.FreeQuantity, free)
+	}
+
+	if s.MaxDiscount > 0 && amount > s.MaxDiscount {
+		amount = s.MaxDiscount
+		note += fmt.Sprintf(", capped at %.2f", s.MaxDiscount)
+	}
+	return roundPaise(math.Min(amount, base)), note
+}
+
+// spreadBillSchemes shares each bill-level discount over the lines by net
+// value, leaving any rounding remainder on the last line
+func spreadBillSchemes(lines []schemeLine, applied []appliedScheme, net float64) {
+	if net <= 0 {
+		return
+	}
+
+	for _, a := range applied {
+		var given float64
+		for i := range lines {
+			share := roundPaise(a.Amount * lines[i].Net / net)
+			if i == len(lines)-1 {
+				share = roundPaise(a.Amount - given)
+			}
+			given += share
+			if share == 0 {
+				continue
+			}
+
+			part := a
+			part.Amount = share
+			lines[i].Schemes = append(lines[i].Schemes, part)
+			lines[i].Discount = roundPaise(lines[i].Discount + share)
+		}
+	}
+	for i := range lines {
+		lines[i].Net = roundPaise(lines[i].Gross - lines[i].Discount)
+	}
+}
+
+func appliesToLine(s scheme, p productAttrs) bool {
+	switch normaliseScope(s.Scope) {
+	case ScopeProduct:
+		return s.ProductID != "" && s.ProductID == p.ID
+	case ScopeBrand:
+		return s.BrandID != "" && s.BrandID == p.BrandID
+	case ScopeCategory:
+		return s.CategoryID != "" && s.CategoryID == p.CategoryID
+	}
+	return false
+}
+
+func normaliseScope(scope string) string {
+	if scope == "" {
+		return ScopeBill
+	}
+	return strings.ToUpper(scope)
+}
+
+// applySchemes discounts a priced invoice, replacing any discounts sent by
+// the client, and records the explanation on each line
+func applySchemes(tx *gorm.DB, invoice *Invoice) (*schemeResult, error) {
+	result, err := evaluateCart(tx, invoice.Items, invoice.CouponCode, invoice.InvoiceDate)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range invoice.Items {
+		invoice.Items[i].Discount = result.Lines[i].Discount
+		invoice.Items[i].Schemes = result.Lines[i].Schemes
+	}
+	return result, nil
+}
+
+// evaluateCart loads the schemes and product attributes a cart needs and
+// evaluates it
+func evaluateCart(tx *gorm.DB, lines []InvoiceItem, code string, at time.Time) (*schemeResult, error) {
+	code = strings.TrimSpace(code)
+	schemes, err := loadSchemes(tx, code, at)
+	if err != nil {
+		return nil, err
+	}
+
+	productIDs := make([]string, 0, len(lines))
+	for _, item := range lines {
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	var rows []productAttrs
+	if len(productIDs) > 0 {
+		if err := tx.Raw(`
+			SELECT id, COALESCE(brand_id::text, '') AS brand_id, COALESCE(category_id::text, '') AS category_id
+			FROM products WHERE id IN ?
+		`, productIDs).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+	}
+	attrs := make(map[string]productAttrs, len(rows))
+	for _, row := range rows {
+		attrs[row.ID] = row
+	}
+
+	return evaluateSchemes(lines, schemes, attrs, code)
+}
+
+// redeemCoupon counts a coupon use against its usage limit
+func redeemCoupon(tx *gorm.DB, coupon *scheme) error {
+	if coupon == nil {
+		return nil
+	}
+
+	res := tx.Exec(`
+		UPDATE offers SET used_count = used_count + 1, updated_at = NOW()
+		WHERE id = ? AND (usage_limit = 0 OR used_count < usage_limit)
+	`, coupon.ID)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Coupon %s has been used up", coupon.Code)}
+	}
+	return nil
+}
+
+// previewSchemes prices a cart and shows the discounts it would get, so the
+// counter and order entry quote the same figures billing will charge
+func previewSchemes(c echo.Context) error {
+	var req struct {
+		CustomerID string        `json:"customer_id"`
+		ShopID     string        `json:"shop_id"`
+		CouponCode string        `json:"coupon_code"`
+		Items      []InvoiceItem `json:"items"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if len(req.Items) == 0 {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "At least one item is required",
+		})
+	}
+
+	cart := Invoice{CustomerID: req.CustomerID, ShopID: req.ShopID, InvoiceDate: time.Now(), Items: req.Items}
+	if err := applyPrices(db, &cart); err != nil {
+		return allocationErrorResponse(c, err, "Failed to price cart")
+	}
+
+	result, err := evaluateCart(db, cart.Items, req.CouponCode, cart.InvoiceDate)
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to apply schemes")
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    result,
+	})
+}
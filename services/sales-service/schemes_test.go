@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Table-driven tests for discount schemes and coupons on a cart
+func TestEvaluateSchemes(t *testing.T) {
+	attrs := map[string]productAttrs{
+		"arnica":    {ID: "arnica", BrandID: "sbl", CategoryID: "dilutions"},
+		"calendula": {ID: "calendula", BrandID: "reckeweg", CategoryID: "ointments"},
+	}
+	cart := []InvoiceItem{
+		{ProductID: "arnica", Quantity: 4, Price: 100},
+		{ProductID: "calendula", Quantity: 1, Price: 200},
+	}
+
+	tests := []struct {
+		name      string
+		schemes   []scheme
+		code      string
+		wantLine  float64 // line discount
+		wantBill  float64 // bill discount
+		wantCodes []string
+		wantErr   string
+	}{
+		{
+			name:      "brand percentage on its lines only",
+			schemes:   []scheme{{Code: "SBL10", Type: "Percentage", Value: 10, Scope: ScopeBrand, BrandID: "sbl"}},
+			wantLine:  40,
+			wantCodes: []string{"SBL10"},
+		},
+		{
+			name: "non-stackable scheme after another is skipped",
+			schemes: []scheme{
+				{Code: "SBL10", Type: "Percentage", Value: 10, Scope: ScopeBrand, BrandID: "sbl", Stackable: true},
+				{Code: "ARN50", Type: "Fixed Amount", Value: 50, Scope: ScopeProduct, ProductID: "arnica"},
+			},
+			wantLine:  40,
+			wantCodes: []string{"SBL10"},
+		},
+		{
+			name: "stackable schemes apply on what is left",
+			schemes: []scheme{
+				{Code: "SBL10", Type: "Percentage", Value: 10, Scope: ScopeBrand, BrandID: "sbl", Stackable: true},
+				{Code: "DIL10", Type: "Percentage", Value: 10, Scope: ScopeCategory, CategoryID: "dilutions", Stackable: true},
+			},
+			wantLine:  76, // 40, then 10% of 360
+			wantCodes: []string{"SBL10", "DIL10"},
+		},
+		{
+			name:      "buy three get one free",
+			schemes:   []scheme{{Code: "B3G1", Type: "Buy X Get Y", Scope: ScopeProduct, ProductID: "arnica", BuyQuantity: 3, FreeQuantity: 1}},
+			wantLine:  100,
+			wantCodes: []string{"B3G1"},
+		},
+		{
+			name:      "capped at the maximum discount",
+			schemes:   []scheme{{Code: "BILL20", Type: "Percentage", Value: 20, MaxDiscount: 75}},
+			wantBill:  75,
+			wantCodes: []string{"BILL20"},
+		},
+		{
+			name: "entered coupon outranks a conflicting auto scheme",
+			schemes: []scheme{
+				{Code: "WELCOME", Type: "Fixed Amount", Value: 100, Coupon: true, Priority: enteredCodePriority},
+				{Code: "AUTO5", Type: "Percentage", Value: 5},
+			},
+			code:      "WELCOME",
+			wantBill:  100,
+			wantCodes: []string{"WELCOME"},
+		},
+		{
+			name:    "coupon below its minimum bill",
+			schemes: []scheme{{Code: "BIG", Type: "Fixed Amount", Value: 100, MinAmount: 1000, Coupon: true, Priority: enteredCodePriority}},
+			code:    "BIG",
+			wantErr: "Coupon BIG needs a bill of at least 1000.00",
+		},
+		{
+			name: "coupon that cannot combine with a line scheme",
+			schemes: []scheme{
+				{Code: "ARN50", Type: "Fixed Amount", Value: 50, Scope: ScopeProduct, ProductID: "arnica"},
+				{Code: "CALONLY", Type: "Fixed Amount", Value: 20, Scope: ScopeProduct, ProductID: "arnica", Coupon: true, Priority: enteredCodePriority},
+			},
+			code:    "CALONLY",
+			wantErr: "Coupon CALONLY cannot be combined with the schemes on this bill",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := evaluateSchemes(cart, tt.schemes, attrs, tt.code)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantErr, err.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantLine, result.LineDiscount)
+			assert.Equal(t, tt.wantBill, result.BillDiscount)
+			assert.Equal(t, roundPaise(tt.wantLine+tt.wantBill), result.Discount)
+
+			var given float64
+			codes := map[string]bool{}
+			for _, line := range result.Lines {
+				given += line.Discount
+				assert.Equal(t, roundPaise(line.Gross-line.Discount), line.Net)
+				for _, a := range line.Schemes {
+					codes[a.Code] = true
+				}
+			}
+			// Bill discounts are spread over the lines to the paisa
+			assert.InDelta(t, result.Discount, given, 0.001)
+			assert.Len(t, codes, len(tt.wantCodes))
+			for _, code := range tt.wantCodes {
+				assert.True(t, codes[code], "%s not applied", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Shift statuses
+const (
+	ShiftOpen   = "OPEN"
+	ShiftClosed = "CLOSED"
+)
+
+// Cash drawer movements
+const (
+	CashIn  = "CASH_IN"
+	CashOut = "CASH_OUT"
+)
+
+// Shift is one cashier's session at a counter, from opening float to the
+// drawer count at close. Invoices billed by the cashier while it is open are
+// stamped with it.
+type Shift struct {
+	ID            string         `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ShopID        string         `json:"shop_id" gorm:"type:uuid;not null;index"`
+	CashierID     string         `json:"cashier_id" gorm:"type:uuid;not null;index"`
+	Counter       string         `json:"counter"`
+	Status        string         `json:"status" gorm:"not null;default:'OPEN';index"` // OPEN, CLOSED
+	OpeningFloat  float64        `json:"opening_float" gorm:"not null;default:0"`
+	OpenedAt      time.Time      `json:"opened_at" gorm:"not null"`
+	ClosedAt      *time.Time     `json:"closed_at"`
+	ClosedBy      string         `json:"closed_by" gorm:"type:uuid"`
+	ZReportNo     string         `json:"z_report_no" gorm:"index"`
+	Denominations map[string]int `json:"denominations" gorm:"serializer:json;type:jsonb"` // note or coin value -> count
+	ExpectedCash  float64        `json:"expected_cash" gorm:"not null;default:0"`
+	CountedCash   float64        `json:"counted_cash" gorm:"not null;default:0"`
+	Variance      float64        `json:"variance" gorm:"not null;default:0"` // counted less expected
+	Notes         string         `json:"notes"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	Movements     []CashMovement `json:"movements,omitempty" gorm:"foreignKey:ShiftID"`
+}
+
+// CashMovement is cash put into or taken out of the drawer other than by a
+// sale, such as petty cash or a bank deposit
+type CashMovement struct {
+	ID        string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	ShiftID   string    `json:"shift_id" gorm:"type:uuid;not null;index"`
+	Type      string    `json:"type" gorm:"not null"` // CASH_IN, CASH_OUT
+	Category  string    `json:"category"`             // PETTY_CASH, BANK_DEPOSIT, CHANGE, ...
+	Amount    float64   `json:"amount" gorm:"not null"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by" gorm:"type:uuid"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// modeTotal is money of one payment mode in a shift report
+type modeTotal struct {
+	PaymentMode string  `json:"payment_mode"`
+	Count       int     `json:"count"`
+	Amount      float64 `json:"amount"`
+}
+
+// zReport summarises a shift. Sales are the shift's invoices by payment mode;
+// collected is what was actually taken at the counter, by tender, net of
+// change given and excluding what was left on credit. Refunds and receipts are the cashier's own during the shift.
+type zReport struct {
+	Shift        Shift       `json:"shift"`
+	Sales        []modeTotal `json:"sales"`
+	SalesTotal   float64     `json:"sales_total"`
+	Collected    []modeTotal `json:"collected"`
+	Voids        modeTotal   `json:"voids"`
+	Returns      modeTotal   `json:"returns"`
+	Refunds      []modeTotal `json:"refunds"`
+	Receipts     []modeTotal `json:"receipts"`
+	CashIn       float64     `json:"cash_in"`
+	CashOut      float64     `json:"cash_out"`
+	ExpectedCash float64     `json:"expected_cash"`
+	CountedCash  float64     `json:"counted_cash"`
+	Variance     float64     `json:"variance"`
+}
+
+// attachShift stamps an invoice with the shift it is billed in. A named shift
+// must be open at the invoice's shop; otherwise the cashier's open shift, if
+// any, is used. The shift row is share-locked so it cannot close underneath
+// the invoice.
+func attachShift(tx *gorm.DB, invoice *Invoice) error {
+	var shift Shift
+	query := tx.Clauses(clause.Locking{Strength: "SHARE"})
+
+	switch {
+	case invoice.ShiftID != nil && *invoice.ShiftID != "":
+		err := query.First(&shift, "id = ?", *invoice.ShiftID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &allocationError{status: http.StatusNotFound, msg: "Shift not found"}
+		}
+		if err != nil {
+			return err
+		}
+		if shift.Status != ShiftOpen || shift.ShopID != invoice.ShopID {
+			return &allocationError{status: http.StatusConflict, msg: "Shift is not open at this shop"}
+		}
+	case invoice.CreatedBy != "":
+		var shifts []Shift
+		if err := query.Where("shop_id = ? AND cashier_id = ? AND status = ?", invoice.ShopID, invoice.CreatedBy, ShiftOpen).
+			Limit(1).Find(&shifts).Error; err != nil {
+			return err
+		}
+		if len(shifts) == 0 {
+			invoice.ShiftID = nil
+			return nil
+		}
+		shift = shifts[0]
+	default:
+		invoice.ShiftID = nil
+		return nil
+	}
+
+	invoice.ShiftID = &shift.ID
+	return nil
+}
+
+func openShift(c echo.Context) error {
+	type OpenShiftRequest struct {
+		ShopID       string  `json:"shop_id"`
+		CashierID    string  `json:"cashier_id"`
+		Counter      string  `json:"counter"`
+		OpeningFloat float64 `json:"opening_float"`
+		Notes        string  `json:"notes"`
+	}
+
+	var req OpenShiftRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if req.ShopID == "" || req.CashierID == "" || req.OpeningFloat < 0 {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "shop_id, cashier_id and a non-negative opening_float are required",
+		})
+	}
+
+	shift := Shift{
+		ShopID:       req.ShopID,
+		CashierID:    req.CashierID,
+		Counter:      req.Counter,
+		Status:       ShiftOpen,
+		OpeningFloat: roundPaise(req.OpeningFloat),
+		OpenedAt:     time.Now(),
+		Notes:        req.Notes,
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// A cashier has at most one open shift per shop
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "shifts:"+req.ShopID+":"+req.CashierID).Error; err != nil {
+			return err
+		}
+
+		var open int64
+		if err := tx.Model(&Shift{}).
+			Where("shop_id = ? AND cashier_id = ? AND status = ?", req.ShopID, req.CashierID, ShiftOpen).
+			Count(&open).Error; err != nil {
+			return err
+		}
+		if open > 0 {
+			return &allocationError{status: http.StatusConflict, msg: "Cashier already has an open shift at this shop"}
+		}
+
+		return tx.Create(&shift).Error
+	})
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to open shift")
+	}
+
+	return c.JSON(http.StatusCreated, Response{
+		Success: true,
+		Data:    shift,
+		Message: "Shift opened",
+	})
+}
+
+func recordCashMovement(c echo.Context) error {
+	var movement CashMovement
+	if err := c.Bind(&movement); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	movement.ID = ""
+	movement.ShiftID = c.Param("id")
+	movement.Type = strings.ToUpper(movement.Type)
+	movement.Amount = roundPaise(movement.Amount)
+	if (movement.Type != CashIn && movement.Type != CashOut) || movement.Amount <= 0 {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "type must be CASH_IN or CASH_OUT with a positive amount",
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		shift, err := lockShift(tx, movement.ShiftID)
+		if err != nil {
+			return err
+		}
+
+		// The drawer cannot pay out more cash than it should hold
+		if movement.Type == CashOut {
+			report, err := buildZReport(tx, shift, time.Now())
+			if err != nil {
+				return err
+			}
+			if movement.Amount > report.ExpectedCash {
+				return &allocationError{status: http.StatusConflict, msg: fmt.Sprintf("Drawer should hold only %.2f", report.ExpectedCash)}
+			}
+		}
+
+		return tx.Create(&movement).Error
+	})
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to record cash movement")
+	}
+
+	return c.JSON(http.StatusCreated, Response{
+		Success: true,
+		Data:    movement,
+	})
+}
+
+// closeShift counts the drawer, freezes the Z-report figures on the shift
+// and numbers the report
+func closeShift(c echo.Context) error {
+	type CloseShiftRequest struct {
+		ClosedBy      string         `json:"closed_by"`
+		Denominations map[string]int `json:"denominations"` // e.g. {"500": 4, "10": 12}
+		Notes         string         `json:"notes"`
+	}
+
+	var req CloseShiftRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	counted, err := countDenominations(req.Denominations)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	var report *zReport
+	err = db.Transaction(func(tx *gorm.DB) error {
+		shift, err := lockShift(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if report, err = buildZReport(tx, shift, now); err != nil {
+			return err
+		}
+
+		if shift.ZReportNo, err = nextDocumentNo(tx, "z-report", "Z", now); err != nil {
+			return err
+		}
+		shift.Status = ShiftClosed
+		shift.ClosedAt = &now
+		shift.ClosedBy = req.ClosedBy
+		if shift.ClosedBy == "" {
+			shift.ClosedBy = shift.CashierID
+		}
+		shift.Denominations = req.Denominations
+		shift.ExpectedCash = report.ExpectedCash
+		shift.CountedCash = counted
+		shift.Variance = roundPaise(counted - report.ExpectedCash)
+		if req.Notes != "" {
+			shift.Notes = req.Notes
+		}
+		if err := tx.Omit("Movements").Save(shift).Error; err != nil {
+			return err
+		}
+
+		report.Shift = *shift
+		report.CountedCash = shift.CountedCash
+		report.Variance = shift.Variance
+		return nil
+	})
+	if err != nil {
+		return allocationErrorResponse(c, err, "Failed to close shift")
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    report,
+		Message: "Shift closed with Z-report " + report.Shift.ZReportNo,
+	})
+}
+
+// lockShift loads an open shift for update
+func lockShift(tx *gorm.DB, id string) (*Shift, error) {
+	var shift Shift
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&shift, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &allocationError{status: http.StatusNotFound, msg: "Shift not found"}
+		}
+		return nil, err
+	}
+	if shift.Status != ShiftOpen {
+		return nil, &allocationError{status: http.StatusConflict, msg: "Shift is already closed"}
+	}
+	return &shift, nil
+}
+
+// countDenominations totals a drawer count keyed by note or coin value
+func countDenominations(denominations map[string]int) (float64, error) {
+	if len(denominations) == 0 {
+		return 0, errors.New("denominations are required to close a shift")
+	}
+
+	var total float64
+	for value, count := range denominations {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil || v <= 0 || count < 0 {
+			return 0, fmt.Errorf("invalid denomination %s x %d", value, count)
+		}
+		total += v * float64(count)
+	}
+	return roundPaise(total), nil
+}
+
+// buildZReport works out a shift's figures up to until. Expected cash is the
+// opening float plus cash collected on sales and receipts and cash put in,
+// less cash refunds and cash taken out.
+func buildZReport(tx *gorm.DB, shift *Shift, until time.Time) (*zReport, error) {
+	report := &zReport{Shift: *shift, CountedCash: shift.CountedCash, Variance: shift.Variance}
+	if shift.ClosedAt != nil {
+		until = *shift.ClosedAt
+	}
+	window := map[string]interface{}{
+		"shift":   shift.ID,
+		"shop":    shift.ShopID,
+		"cashier": shift.CashierID,
+		"from":    shift.OpenedAt,
+		"until":   until,
+	}
+
+	if err := tx.Raw(`
+		SELECT COALESCE(NULLIF(payment_mode, ''), 'CASH') AS payment_mode, COUNT(*) AS count,
+			COALESCE(SUM(total_amount), 0) AS amount
+		FROM invoices
+		WHERE shift_id = @shift AND status <> 'CANCELLED'
+		GROUP BY 1 ORDER BY 1
+	`, window).Scan(&report.Sales).Error; err != nil {
+		return nil, err
+	}
+	for i := range report.Sales {
+		report.Sales[i].Amount = roundPaise(report.Sales[i].Amount)
+		report.SalesTotal += report.Sales[i].Amount
+	}
+	report.SalesTotal = roundPaise(report.SalesTotal)
+
+	// Split bills are collected tender by tender; bills without tender rows
+	// by their payment mode
+	if err := tx.Raw(`
+		SELECT payment_mode, COUNT(*) AS count, COALESCE(SUM(amount), 0) AS amount
+		FROM (
+			SELECT p.mode AS payment_mode, p.amount
+			FROM invoice_payments p
+			JOIN invoices i ON i.id = p.invoice_id
+			WHERE i.shift_id = @shift AND i.status <> 'CANCELLED'
+			UNION ALL
+			SELECT COALESCE(NULLIF(i.payment_mode, ''), 'CASH'), i.paid_amount
+			FROM invoices i
+			WHERE i.shift_id = @shift AND i.status <> 'CANCELLED'
+				AND NOT EXISTS (SELECT 1 FROM invoice_payments p WHERE p.invoice_id = i.id)
+		) tenders
+		GROUP BY 1 ORDER BY 1
+	`, window).Scan(&report.Collected).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Raw(`
+		SELECT 'VOID' AS payment_mode, COUNT(*) AS count, COALESCE(SUM(total_amount), 0) AS amount
+		FROM invoices WHERE shift_id = @shift AND status = 'CANCELLED'
+	`, window).Scan(&report.Voids).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Raw(`
+		SELECT 'RETURN' AS payment_mode, COUNT(*) AS count, COALESCE(SUM(total_amount), 0) AS amount
+		FROM sales_returns
+		WHERE shop_id = @shop AND created_by::text = @cashier AND created_at >= @from AND created_at <= @until
+	`, window).Scan(&report.Returns).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Raw(`
+		SELECT COALESCE(NULLIF(a.payment_mode, ''), 'CASH') AS payment_mode, COUNT(*) AS count, COALESCE(SUM(a.amount), 0) AS amount
+		FROM credit_note_applications a
+		JOIN credit_notes cn ON cn.id = a.credit_note_id
+		WHERE a.type = 'REFUND' AND cn.shop_id = @shop AND a.created_by::text = @cashier
+			AND a.created_at >= @from AND a.created_at <= @until
+		GROUP BY 1 ORDER BY 1
+	`, window).Scan(&report.Refunds).Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Raw(`
+		SELECT COALESCE(NULLIF(payment_mode, ''), 'CASH') AS payment_mode, COUNT(*) AS count, COALESCE(SUM(amount), 0) AS amount
+		FROM receipts
+		WHERE shop_id = @shop AND created_by::text = @cashier AND created_at >= @from AND created_at <= @until
+		GROUP BY 1 ORDER BY 1
+	`, window).Scan(&report.Receipts).Error; err != nil {
+		return nil, err
+	}
+
+	var movements []CashMovement
+	if err := tx.Where("shift_id = ?", shift.ID).Order("created_at").Find(&movements).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range movements {
+		if m.Type == CashIn {
+			report.CashIn += m.Amount
+		} else {
+			report.CashOut += m.Amount
+		}
+	}
+	report.CashIn = roundPaise(report.CashIn)
+	report.CashOut = roundPaise(report.CashOut)
+	report.Shift.Movements = movements
+
+	expected := shift.OpeningFloat + cashIn(report.Collected) + cashIn(report.Receipts) + report.CashIn -
+		cashIn(report.Refunds) - report.CashOut
+	report.ExpectedCash = roundPaise(expected)
+	return report, nil
+}
+
+// cashIn picks the cash figure out of a mode breakdown
+func cashIn(totals []modeTotal) float64 {
+	for _, t := range totals {
+		if strings.EqualFold(t.PaymentMode, "CASH") {
+			return t.Amount
+		}
+	}
+	return 0
+}
+
+func listShifts(c echo.Context) error {
+	var shifts []Shift
+
+	query := db.Model(&Shift{})
+
+	if shopID := c.QueryParam("shop_id"); shopID != "" {
+		query = query.Where("shop_id = ?", shopID)
+	}
+
+	if cashierID := c.QueryParam("cashier_id"); cashierID != "" {
+		query = query.Where("cashier_id = ?", cashierID)
+	}
+
+	if status := c.QueryParam("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	query.Order("opened_at DESC").Find(&shifts)
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    shifts,
+	})
+}
+
+// getShiftReport returns the Z-report of a closed shift, or the running
+// figures of an open one
+func getShiftReport(c echo.Context) error {
+	var shift Shift
+
+	if err := db.First(&shift, "id = ?", c.Param("id")).Error; err != nil {
+		return c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "Shift not found",
+		})
+	}
+
+	report, err := buildZReport(db, &shift, time.Now())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, Response{
+			Success: false,
+			Error:   "Failed to build shift report",
+		})
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    report,
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/yeelo/homeopathy-platform/shared-go/gst"
+	"gorm.io/gorm"
+)
+
+// taxContext is what the engine needs to know about an invoice before it
+// can price its lines
+type taxContext struct {
+	SupplyType    string
+	PlaceOfSupply string
+	Rates         map[string]gst.Rate
+}
+
+// resolveTaxContext looks up GST rates for the invoice's products and works
+// out the place of supply through the GST engine shared with api-golang.
+// The masters are read from api-golang's tables.
+func resolveTaxContext(db *gorm.DB, invoice *Invoice) (*taxContext, error) {
+	productIDs := make([]string, 0, len(invoice.Items))
+	for _, item := range invoice.Items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+
+	rates, err := gst.Rates(db, productIDs, invoice.InvoiceDate)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range invoice.Items {
+		if _, ok := rates[item.ProductID]; !ok {
+			return nil, &allocationError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("No GST rate configured for %s", item.ProductName)}
+		}
+	}
+
+	tc := &taxContext{Rates: rates}
+	tc.PlaceOfSupply, tc.SupplyType, err = gst.ResolveSupply(db, invoice.ShopID, invoice.CustomerID, invoice.PlaceOfSupply)
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// applyTax prices one line after its discount
+func (tc *taxContext) applyTax(item *InvoiceItem) {
+	tax := tc.Rates[item.ProductID]
+
+	line := gst.ComputeLine(item.Price*item.Quantity-item.Discount, tax.Rate, item.TaxInclusive, tc.SupplyType)
+	item.HSNCode = tax.HSNCode
+	item.TaxRate = tax.Rate
+	item.TaxableValue = line.TaxableValue
+	item.CGSTRate, item.CGSTAmount = line.CGSTRate, line.CGSTAmount
+	item.SGSTRate, item.SGSTAmount = line.SGSTRate, line.SGSTAmount
+	item.IGSTRate, item.IGSTAmount = line.IGSTRate, line.IGSTAmount
+	item.TaxAmount = line.TaxAmount
+	item.Total = line.Total
+}
+
+// applyInvoiceTax prices every line and rolls the breakup up to the invoice.
+// The payable total is rounded to the nearest rupee and the difference kept
+// as round-off, as GST invoices are settled in whole rupees.
+func (tc *taxContext) applyInvoiceTax(invoice *Invoice, items []InvoiceItem) {
+	invoice.PlaceOfSupply = tc.PlaceOfSupply
+	invoice.SupplyType = tc.SupplyType
+	invoice.SubTotal, invoice.DiscountAmt, invoice.TaxAmount = 0, 0, 0
+	invoice.CGSTAmount, invoice.SGSTAmount, invoice.IGSTAmount = 0, 0, 0
+
+	var total float64
+	for i := range items {
+		tc.applyTax(&items[i])
+		invoice.SubTotal += items[i].TaxableValue
+		invoice.DiscountAmt += items[i].Discount
+		invoice.CGSTAmount += items[i].CGSTAmount
+		invoice.SGSTAmount += items[i].SGSTAmount
+		invoice.IGSTAmount += items[i].IGSTAmount
+		total += items[i].Total
+	}
+
+	invoice.SubTotal = roundPaise(invoice.SubTotal)
+	invoice.DiscountAmt = roundPaise(invoice.DiscountAmt)
+	invoice.CGSTAmount = roundPaise(invoice.CGSTAmount)
+	invoice.SGSTAmount = roundPaise(invoice.SGSTAmount)
+	invoice.IGSTAmount = roundPaise(invoice.IGSTAmount)
+	invoice.TaxAmount = roundPaise(invoice.CGSTAmount + invoice.SGSTAmount + invoice.IGSTAmount)
+
+	invoice.TotalAmount, invoice.RoundOff = gst.RoundOff(total)
+	invoice.DueAmount = roundPaise(invoice.TotalAmount - invoice.PaidAmount)
+	if invoice.DueAmount < 0 {
+		invoice.DueAmount = 0
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yeelo/homeopathy-platform/shared-go/loyalty"
+	"gorm.io/gorm"
+)
+
+// Tender modes
+const (
+	TenderCash          = "CASH"
+	TenderCard          = "CARD"
+	TenderUPI           = "UPI"
+	TenderGiftCard      = "GIFT_CARD"
+	TenderLoyaltyPoints = "LOYALTY_POINTS"
+)
+
+// PaymentSplit marks an invoice paid with more than one tender mode
+const PaymentSplit = "SPLIT"
+
+// InvoicePayment is one tender on a bill. Amount is what the tender paid
+// towards the bill; for cash, Tendered is what was handed over and Change
+// what was given back.
+type InvoicePayment struct {
+	ID           string    `json:"id" gorm:"primaryKey;type:uuid;default:gen_random_uuid()"`
+	InvoiceID    string    `json:"invoice_id" gorm:"type:uuid;not null;index"`
+	Mode         string    `json:"mode" gorm:"not null"` // CASH, CARD, UPI, GIFT_CARD, LOYALTY_POINTS
+	Amount       float64   `json:"amount" gorm:"not null"`
+	Tendered     float64   `json:"tendered" gorm:"not null;default:0"`
+	Change       float64   `json:"change" gorm:"not null;default:0"`
+	Reference    string    `json:"reference"` // card or UPI transaction id
+	GiftCardCode string    `json:"gift_card_code,omitempty"`
+	Points       float64   `json:"points,omitempty" gorm:"not null;default:0"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// settleTenders applies the tenders sent with a bill to its total, redeeming
+// gift cards and loyalty points inside tx. Cash is applied last and is the
+// only tender that can give change; card, UPI, gift card and points cannot
+// pay more than is left on the bill. Whatever the tenders do not cover is
+// left due, and the bill is PAID or PARTIAL accordingly.
+func settleTenders(tx *gorm.DB, invoice *Invoice) error {
+	if len(invoice.Payments) == 0 {
+		return nil
+	}
+
+	var cash []*InvoicePayment
+	var paid float64
+	modes := map[string]bool{}
+
+	for i := range invoice.Payments {
+		p := &invoice.Payments[i]
+		p.ID = ""
+		p.Mode = strings.ToUpper(strings.TrimSpace(p.Mode))
+		p.Change = 0
+		modes[p.Mode] = true
+
+		if p.Mode == TenderCash {
+			if p.Tendered <= 0 {
+				p.Tendered = p.Amount
+			}
+			if p.Tendered <= 0 {
+				return &allocationError{status: http.StatusBadRequest, msg: "Cash tenders need a positive amount"}
+			}
+			p.Tendered = roundPaise(p.Tendered)
+			cash = append(cash, p)
+			continue
+		}
+
+		var err error
+		switch p.Mode {
+		case TenderCard, TenderUPI:
+			if p.Amount <= 0 {
+				return &allocationError{status: http.StatusBadRequest, msg: p.Mode + " tenders need a positive amount"}
+			}
+		case TenderGiftCard:
+			err = redeemGiftCardTender(tx, invoice, p)
+		case TenderLoyaltyPoints:
+			err = redeemPointsTender(tx, invoice, p)
+		default:
+			return &allocationError{status: http.StatusBadRequest, msg: fmt.Sprintf("Unknown tender mode %q", p.Mode)}
+		}
+		if err != nil {
+			return err
+		}
+
+		p.Amount = roundPaise(p.Amount)
+		p.Tendered = p.Amount
+		paid = roundPaise(paid + p.Amount)
+		if paid > invoice.TotalAmount {
+			return &allocationError{status: http.StatusUnprocessableEntity, msg: fmt.Sprintf("Tenders other than cash come to %.2f, more than the bill of %.2f", paid, invoice.TotalAmount)}
+		}
+	}
+
+	// Cash covers what is left; anything over comes back as change
+	for _, p := range cash {
+		left := roundPaise(invoice.TotalAmount - paid)
+		p.Amount = math.Max(0, math.Min(p.Tendered, left))
+		p.Change = roundPaise(p.Tendered - p.Amount)
+		paid = roundPaise(paid + p.Amount)
+		invoice.ChangeDue = roundPaise(invoice.ChangeDue + p.Change)
+	}
+
+	invoice.PaidAmount = paid
+	invoice.DueAmount = roundPaise(invoice.TotalAmount - paid)
+	if invoice.DueAmount <= 0 {
+		invoice.Status = "PAID"
+	} else if paid > 0 {
+		invoice.Status = "PARTIAL"
+	}
+	if len(modes) == 1 {
+		invoice.PaymentMode = invoice.Payments[0].Mode
+	} else {
+		invoice.PaymentMode = PaymentSplit
+	}
+	return nil
+}
+
+// redeemGiftCardTender takes a gift card tender off the card's balance
+// through loyalty.RedeemGiftCard, the redemption api-golang's gift card
+// endpoint uses, so it commits or rolls back with the bill.
+func redeemGiftCardTender(tx *gorm.DB, invoice *Invoice, p *InvoicePayment) error {
+	if p.GiftCardCode == "" || p.Amount <= 0 {
+		return &allocationError{status: http.StatusBadRequest, msg: "Gift card tenders need a gift_card_code and a positive amount"}
+	}
+
+	_, err := loyalty.RedeemGiftCard(tx, p.GiftCardCode, p.Amount, "POS bill "+invoice.InvoiceNo, invoice.InvoiceDate)
+	switch {
+	case errors.Is(err, loyalty.ErrGiftCardNotFound):
+		return &allocationError{status: http.StatusNotFound, msg: "Gift card not found or expired"}
+	case errors.Is(err, loyalty.ErrGiftCardExpired), errors.Is(err, loyalty.ErrInsufficientBalance):
+		return &allocationError{status: http.StatusUnprocessableEntity, msg: capitalize(err.Error())}
+	}
+	return err
+}
+
+// redeemPointsTender pays part of the bill with the customer's loyalty
+// points, valued at the active loyalty programme's point value, through
+// loyalty.RedeemPoints like api-golang's points endpoint.
+func redeemPointsTender(tx *gorm.DB, invoice *Invoice, p *InvoicePayment) error {
+	if invoice.CustomerID == "" {
+		return &allocationError{status: http.StatusBadRequest, msg: "A customer is required to pay with loyalty points"}
+	}
+
+	pointValue := 1.0
+	if tx.Migrator().HasColumn("loyalty_programs", "point_value") {
+		var values []float64
+		if err := tx.Raw(`
+			SELECT point_value FROM loyalty_programs
+			WHERE is_active = true AND point_value > 0
+			ORDER BY created_at LIMIT 1
+		`).Scan(&values).Error; err != nil {
+			return err
+		}
+		if len(values) > 0 {
+			pointValue = values[0]
+		}
+	}
+
+	// Either the points or the rupee amount may be given
+	if p.Points <= 0 {
+		p.Points = math.Ceil(p.Amount / pointValue)
+	}
+	if p.Points <= 0 {
+		return &allocationError{status: http.StatusBadRequest, msg: "Loyalty point tenders need points or a positive amount"}
+	}
+	p.Amount = roundPaise(p.Points * pointValue)
+
+	_, _, err := loyalty.RedeemPoints(tx, loyalty.PointsRedemption{
+		CustomerID:  invoice.CustomerID,
+		Points:      p.Points,
+		Description: "POS bill " + invoice.InvoiceNo,
+	})
+	if errors.Is(err, loyalty.ErrInsufficientPoints) {
+		return &allocationError{status: http.StatusUnprocessableEntity, msg: capitalize(err.Error())}
+	}
+	return err
+}
+
+// capitalize turns a shared package's error into a response message
+func capitalize(msg string) string {
+	if msg == "" {
+		return msg
+	}
+	return strings.ToUpper(msg[:1]) + msg[1:]
+}
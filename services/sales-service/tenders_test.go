@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Table-driven tests for settling a bill's cash, card and UPI tenders
+func TestSettleTenders(t *testing.T) {
+	tests := []struct {
+		name       string
+		total      float64
+		payments   []InvoicePayment
+		wantPaid   float64
+		wantDue    float64
+		wantChange float64
+		wantMode   string
+		wantStatus string
+		wantErr    string
+	}{
+		{
+			name:       "exact cash",
+			total:      500,
+			payments:   []InvoicePayment{{Mode: "cash", Amount: 500}},
+			wantPaid:   500,
+			wantMode:   TenderCash,
+			wantStatus: "PAID",
+		},
+		{
+			name:       "cash over the bill gives change",
+			total:      460,
+			payments:   []InvoicePayment{{Mode: TenderCash, Tendered: 500}},
+			wantPaid:   460,
+			wantChange: 40,
+			wantMode:   TenderCash,
+			wantStatus: "PAID",
+		},
+		{
+			name:       "card then cash is a split",
+			total:      1000,
+			payments:   []InvoicePayment{{Mode: TenderCash, Tendered: 500}, {Mode: TenderCard, Amount: 700, Reference: "TXN1"}},
+			wantPaid:   1000,
+			wantChange: 200,
+			wantMode:   PaymentSplit,
+			wantStatus: "PAID",
+		},
+		{
+			name:       "part paid leaves the rest due",
+			total:      1000,
+			payments:   []InvoicePayment{{Mode: TenderUPI, Amount: 400}},
+			wantPaid:   400,
+			wantDue:    600,
+			wantMode:   TenderUPI,
+			wantStatus: "PARTIAL",
+		},
+		{
+			name:     "card cannot pay more than the bill",
+			total:    300,
+			payments: []InvoicePayment{{Mode: TenderCard, Amount: 350}},
+			wantErr:  "Tenders other than cash come to 350.00, more than the bill of 300.00",
+		},
+		{
+			name:     "unknown mode",
+			total:    300,
+			payments: []InvoicePayment{{Mode: "CHEQUE", Amount: 300}},
+			wantErr:  `Unknown tender mode "CHEQUE"`,
+		},
+		{
+			name:     "cash needs an amount",
+			total:    300,
+			payments: []InvoicePayment{{Mode: TenderCash}},
+			wantErr:  "Cash tenders need a positive amount",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invoice := &Invoice{TotalAmount: tt.total, Status: "DRAFT", Payments: tt.payments}
+
+			// Cash, card and UPI tenders never touch the database
+			err := settleTenders(nil, invoice)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.wantErr, err.Error())
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantPaid, invoice.PaidAmount)
+			assert.Equal(t, tt.wantDue, invoice.DueAmount)
+			assert.Equal(t, tt.wantChange, invoice.ChangeDue)
+			assert.Equal(t, tt.wantMode, invoice.PaymentMode)
+			assert.Equal(t, tt.wantStatus, invoice.Status)
+		})
+	}
+}